@@ -0,0 +1,202 @@
+package bench
+
+import (
+	"errors"
+	"math/rand"
+	"pushan/RedTopK/topk"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// 操作类型, 与 topk 的 op 标签一致
+const (
+	OpAdd    = topk.OpAdd
+	OpDelete = topk.OpDelete
+	OpTopK   = topk.OpTopK
+)
+
+var ops = []string{OpAdd, OpDelete, OpTopK}
+
+// Mix add/delete/topk 的权重, 例如 {70, 10, 20}
+type Mix struct {
+	Add    int
+	Delete int
+	TopK   int
+}
+
+func (m Mix) pick(r *rand.Rand) string {
+	total := m.Add + m.Delete + m.TopK
+	if total <= 0 {
+		return OpAdd
+	}
+	n := r.Intn(total)
+	switch {
+	case n < m.Add:
+		return OpAdd
+	case n < m.Add+m.Delete:
+		return OpDelete
+	}
+	return OpTopK
+}
+
+type Config struct {
+	// Name 结果中的provider名称, 为空时使用provider的类型名
+	Name    string
+	Key     string
+	Clients int
+	// OpsPerClient 和 Duration 任一达到即停止, 为0表示不限制
+	OpsPerClient int
+	Duration     time.Duration
+	// Workload 为空时使用 Mix 和 K 生成均匀分布的操作
+	Workload Workload
+	Mix      Mix
+	// K topk操作读取的元素个数
+	K    int
+	Seed int64
+}
+
+// OpResult 单个操作类型的统计
+type OpResult struct {
+	Count  int64         `json:"count"`
+	Errors int64         `json:"errors"`
+	Mean   time.Duration `json:"mean_ns"`
+	P50    time.Duration `json:"p50_ns"`
+	P99    time.Duration `json:"p99_ns"`
+	P999   time.Duration `json:"p999_ns"`
+	Max    time.Duration `json:"max_ns"`
+}
+
+type Result struct {
+	Provider   string              `json:"provider"`
+	Clients    int                 `json:"clients"`
+	Ops        int64               `json:"ops"`
+	Errors     int64               `json:"errors"`
+	Elapsed    time.Duration       `json:"elapsed_ns"`
+	Throughput float64             `json:"throughput"`
+	PerOp      map[string]OpResult `json:"per_op"`
+	All        OpResult            `json:"all"`
+}
+
+type clientStats struct {
+	hists  map[string]*Histogram
+	errors map[string]int64
+}
+
+// Run 使用 cfg.Clients 个goroutine并发请求tp, 每个goroutine模拟一个client
+func Run(tp topk.TopKProvider, cfg Config) *Result {
+	if cfg.Clients <= 0 {
+		cfg.Clients = 1
+	}
+	if cfg.Workload == nil {
+		if cfg.OpsPerClient <= 0 && cfg.Duration <= 0 {
+			cfg.OpsPerClient = 1000
+		}
+		if cfg.K <= 0 {
+			cfg.K = 100
+		}
+		cfg.Workload = Synthetic{Mix: cfg.Mix, K: cfg.K}
+	}
+	if cfg.Name == "" {
+		cfg.Name = reflect.TypeOf(tp).String()
+	}
+	stats := make([]clientStats, cfg.Clients)
+	wg := sync.WaitGroup{}
+	start := make(chan struct{})
+	for i := 0; i < cfg.Clients; i++ {
+		wg.Add(1)
+		stream := cfg.Workload.NewStream(i, cfg.Seed+int64(i))
+		go func(cs *clientStats) {
+			defer wg.Done()
+			<-start
+			runClient(tp, cfg, cs, stream)
+		}(&stats[i])
+	}
+	st := time.Now()
+	close(start)
+	wg.Wait()
+	elapsed := time.Since(st)
+
+	res := &Result{
+		Provider: cfg.Name,
+		Clients:  cfg.Clients,
+		Elapsed:  elapsed,
+		PerOp:    make(map[string]OpResult),
+	}
+	all := NewHistogram()
+	var allErrors int64
+	for _, op := range ops {
+		h := NewHistogram()
+		var errs int64
+		for i := range stats {
+			h.Merge(stats[i].hists[op])
+			errs += stats[i].errors[op]
+		}
+		if h.Count() == 0 {
+			continue
+		}
+		res.PerOp[op] = summarize(h, errs)
+		all.Merge(h)
+		allErrors += errs
+	}
+	res.All = summarize(all, allErrors)
+	res.Ops = all.Count()
+	res.Errors = allErrors
+	if elapsed > 0 {
+		res.Throughput = float64(res.Ops) / elapsed.Seconds()
+	}
+	return res
+}
+
+func summarize(h *Histogram, errs int64) OpResult {
+	return OpResult{
+		Count:  h.Count(),
+		Errors: errs,
+		Mean:   h.Mean(),
+		P50:    h.Percentile(50),
+		P99:    h.Percentile(99),
+		P999:   h.Percentile(99.9),
+		Max:    h.Max(),
+	}
+}
+
+func runClient(tp topk.TopKProvider, cfg Config, cs *clientStats, stream Stream) {
+	cs.hists = make(map[string]*Histogram, len(ops))
+	cs.errors = make(map[string]int64, len(ops))
+	for _, op := range ops {
+		cs.hists[op] = NewHistogram()
+	}
+	var deadline time.Time
+	if cfg.Duration > 0 {
+		deadline = time.Now().Add(cfg.Duration)
+	}
+	for i := 0; cfg.OpsPerClient <= 0 || i < cfg.OpsPerClient; i++ {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return
+		}
+		op, ok := stream.Next()
+		if !ok {
+			return
+		}
+		var err error
+		st := time.Now()
+		switch op.Kind {
+		case OpAdd:
+			err = tp.AddElement(cfg.Key, op.Id, op.Score)
+		case OpDelete:
+			err = tp.DeleteElement(cfg.Key, op.Id)
+			// 热点id可能已被其他client删除, 不算作错误
+			if errors.Is(err, topk.ErrNotFound) {
+				err = nil
+			}
+		case OpTopK:
+			err, _ = tp.GetTopKS(cfg.Key, op.K)
+		default:
+			continue
+		}
+		cs.hists[op.Kind].Record(time.Since(st))
+		if err != nil {
+			cs.errors[op.Kind]++
+		}
+	}
+}
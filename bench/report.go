@@ -0,0 +1,77 @@
+package bench
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// opRows 返回结果中出现的操作及其统计, 最后一行为所有操作的汇总
+func opRows(res *Result) ([]string, []OpResult) {
+	names := make([]string, 0, len(ops)+1)
+	rows := make([]OpResult, 0, len(ops)+1)
+	for _, op := range ops {
+		if r, ok := res.PerOp[op]; ok {
+			names = append(names, op)
+			rows = append(rows, r)
+		}
+	}
+	return append(names, "all"), append(rows, res.All)
+}
+
+// WriteJSON 每个结果输出为一个json对象, 延迟单位为纳秒
+func WriteJSON(w io.Writer, results []*Result) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
+
+var csvHeader = []string{"provider", "clients", "op", "count", "errors", "throughput",
+	"mean_us", "p50_us", "p99_us", "p999_us", "max_us"}
+
+// WriteCSV 每个结果的每种操作输出一行, op 为 all 的行是所有操作的汇总
+func WriteCSV(w io.Writer, results []*Result) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	us := func(d time.Duration) string {
+		return strconv.FormatInt(d.Microseconds(), 10)
+	}
+	for _, res := range results {
+		names, rows := opRows(res)
+		for i, r := range rows {
+			op := names[i]
+			throughput := float64(r.Count) / res.Elapsed.Seconds()
+			err := cw.Write([]string{res.Provider, strconv.Itoa(res.Clients), op,
+				strconv.FormatInt(r.Count, 10), strconv.FormatInt(r.Errors, 10),
+				strconv.FormatFloat(throughput, 'f', 1, 64),
+				us(r.Mean), us(r.P50), us(r.P99), us(r.P999), us(r.Max)})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteText 输出便于阅读的表格
+func WriteText(w io.Writer, results []*Result) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROVIDER\tCLIENTS\tOP\tCOUNT\tERRORS\tOPS/S\tMEAN\tP50\tP99\tP999\tMAX")
+	for _, res := range results {
+		names, rows := opRows(res)
+		for i, r := range rows {
+			op := names[i]
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t%s\n",
+				res.Provider, res.Clients, op, r.Count, r.Errors, float64(r.Count)/res.Elapsed.Seconds(),
+				r.Mean, r.P50, r.P99, r.P999, r.Max)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,130 @@
+package bench
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+trace文件为csv格式, 每行一个操作:
+
+	add,<id>,<score>
+	delete,<id>
+	topk,<k>
+*/
+
+// ReadTrace 读取trace文件中的所有操作
+func ReadTrace(r io.Reader) ([]Op, error) {
+	cr := csv.NewReader(bufio.NewReader(r))
+	cr.FieldsPerRecord = -1
+	ops := make([]Op, 0, 1024)
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return ops, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		op, err := parseTraceRecord(record)
+		if err != nil {
+			return nil, fmt.Errorf("trace line %d: %w", line, err)
+		}
+		ops = append(ops, op)
+	}
+}
+
+func parseTraceRecord(record []string) (Op, error) {
+	switch {
+	case record[0] == OpAdd && len(record) == 3:
+		score, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return Op{}, fmt.Errorf("bad score %q", record[2])
+		}
+		return Op{Kind: OpAdd, Id: record[1], Score: score}, nil
+	case record[0] == OpDelete && len(record) == 2:
+		return Op{Kind: OpDelete, Id: record[1]}, nil
+	case record[0] == OpTopK && len(record) == 2:
+		k, err := strconv.Atoi(record[1])
+		if err != nil {
+			return Op{}, fmt.Errorf("bad k %q", record[1])
+		}
+		return Op{Kind: OpTopK, K: k}, nil
+	}
+	return Op{}, fmt.Errorf("bad record %q", record)
+}
+
+func traceRecord(op Op) []string {
+	switch op.Kind {
+	case OpAdd:
+		return []string{OpAdd, op.Id, strconv.FormatFloat(op.Score, 'g', -1, 64)}
+	case OpDelete:
+		return []string{OpDelete, op.Id}
+	}
+	return []string{OpTopK, strconv.Itoa(op.K)}
+}
+
+// Replay 所有client按顺序共同消费trace中的操作, 每个操作只执行一次
+type Replay struct {
+	ops    []Op
+	cursor int64
+}
+
+func NewReplay(ops []Op) *Replay {
+	return &Replay{ops: ops}
+}
+
+func (rp *Replay) NewStream(client int, seed int64) Stream {
+	return rp
+}
+
+func (rp *Replay) Next() (Op, bool) {
+	i := atomic.AddInt64(&rp.cursor, 1) - 1
+	if i >= int64(len(rp.ops)) {
+		return Op{}, false
+	}
+	return rp.ops[i], true
+}
+
+// Recorder 把 Workload 生成的操作写入trace文件, 可以用 Replay 重放
+type Recorder struct {
+	w  Workload
+	mu sync.Mutex
+	cw *csv.Writer
+}
+
+func NewRecorder(w Workload, out io.Writer) *Recorder {
+	return &Recorder{w: w, cw: csv.NewWriter(out)}
+}
+
+func (rec *Recorder) NewStream(client int, seed int64) Stream {
+	return recordedStream{s: rec.w.NewStream(client, seed), rec: rec}
+}
+
+// Flush 写出缓冲中的操作, 在 Run 结束后调用
+func (rec *Recorder) Flush() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.cw.Flush()
+	return rec.cw.Error()
+}
+
+type recordedStream struct {
+	s   Stream
+	rec *Recorder
+}
+
+func (rs recordedStream) Next() (Op, bool) {
+	op, ok := rs.s.Next()
+	if ok {
+		rs.rec.mu.Lock()
+		_ = rs.rec.cw.Write(traceRecord(op))
+		rs.rec.mu.Unlock()
+	}
+	return op, ok
+}
@@ -0,0 +1,285 @@
+package bench
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Op 一次操作, Kind 为 OpAdd, OpDelete 或 OpTopK
+type Op struct {
+	Kind  string
+	Id    string
+	Score float64
+	K     int
+}
+
+// Stream 单个client的操作序列, 只会被一个goroutine使用
+type Stream interface {
+	// Next 返回下一个操作, 没有更多操作时返回false
+	Next() (Op, bool)
+}
+
+// Workload 为每个client创建独立的操作序列, NewStream 需要并发安全
+type Workload interface {
+	NewStream(client int, seed int64) Stream
+}
+
+// IdGen 为每个client创建独立的id生成函数
+type IdGen func(r *rand.Rand) func() string
+
+// ScoreGen 为每个client创建独立的score生成函数
+type ScoreGen func(r *rand.Rand) func() float64
+
+// UniformIds 均匀分布的随机id, 几乎不会重复
+func UniformIds() IdGen {
+	return func(r *rand.Rand) func() string {
+		return func() string {
+			return strconv.FormatInt(r.Int63(), 10)
+		}
+	}
+}
+
+// ZipfIds 从n个member中按zipf分布选取, s > 1, 越大热点越集中
+func ZipfIds(n uint64, s float64) IdGen {
+	return func(r *rand.Rand) func() string {
+		z := rand.NewZipf(r, s, 1, n-1)
+		return func() string {
+			return strconv.FormatUint(z.Uint64(), 10)
+		}
+	}
+}
+
+// UniformScores [min, max) 之间均匀分布
+func UniformScores(min, max float64) ScoreGen {
+	return func(r *rand.Rand) func() float64 {
+		return func() float64 {
+			return min + r.Float64()*(max-min)
+		}
+	}
+}
+
+// NormalScores 正态分布
+func NormalScores(mean, stddev float64) ScoreGen {
+	return func(r *rand.Rand) func() float64 {
+		return func() float64 {
+			return r.NormFloat64()*stddev + mean
+		}
+	}
+}
+
+// ParetoScores 帕累托分布, 重尾, alpha 越小尾部越重
+func ParetoScores(scale, alpha float64) ScoreGen {
+	return func(r *rand.Rand) func() float64 {
+		return func() float64 {
+			return scale / math.Pow(1-r.Float64(), 1/alpha)
+		}
+	}
+}
+
+// DiscreteScores [0, n) 之间的整数, n较小时会产生大量相等的score
+func DiscreteScores(n int) ScoreGen {
+	return func(r *rand.Rand) func() float64 {
+		return func() float64 {
+			return float64(r.Intn(n))
+		}
+	}
+}
+
+// MonotonicScores 所有client共享的递增score, 从start开始每次增加step
+func MonotonicScores(start, step float64) ScoreGen {
+	var seq int64
+	return func(r *rand.Rand) func() float64 {
+		return func() float64 {
+			return start + float64(atomic.AddInt64(&seq, 1)-1)*step
+		}
+	}
+}
+
+// Synthetic 按 Mix 随机生成操作的 Workload
+type Synthetic struct {
+	Mix    Mix
+	K      int
+	Ids    IdGen
+	Scores ScoreGen
+}
+
+func (s Synthetic) NewStream(client int, seed int64) Stream {
+	r := rand.New(rand.NewSource(seed))
+	ids, scores := s.Ids, s.Scores
+	if ids == nil {
+		ids = UniformIds()
+	}
+	if scores == nil {
+		scores = UniformScores(0, math.MaxInt32)
+	}
+	return &syntheticStream{
+		Synthetic: s,
+		r:         r,
+		nextId:    ids(r),
+		nextScore: scores(r),
+		index:     make(map[string]int),
+	}
+}
+
+type syntheticStream struct {
+	Synthetic
+	r         *rand.Rand
+	nextId    func() string
+	nextScore func() float64
+	// 当前client添加过的id, 用于删除
+	added []string
+	index map[string]int
+}
+
+func (s *syntheticStream) Next() (Op, bool) {
+	kind := s.Mix.pick(s.r)
+	if kind == OpDelete && len(s.added) == 0 {
+		kind = OpAdd
+	}
+	switch kind {
+	case OpAdd:
+		id := s.nextId()
+		if _, ok := s.index[id]; !ok {
+			s.index[id] = len(s.added)
+			s.added = append(s.added, id)
+		}
+		return Op{Kind: OpAdd, Id: id, Score: s.nextScore()}, true
+	case OpDelete:
+		i := s.r.Intn(len(s.added))
+		id := s.added[i]
+		last := s.added[len(s.added)-1]
+		s.added[i] = last
+		s.index[last] = i
+		s.added = s.added[:len(s.added)-1]
+		delete(s.index, id)
+		return Op{Kind: OpDelete, Id: id}, true
+	}
+	return Op{Kind: OpTopK, K: s.K}, true
+}
+
+// params 解析 name:k=v,k=v 形式的描述
+func params(spec string) (string, map[string]string, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	kvs := make(map[string]string)
+	if len(parts) == 2 && parts[1] != "" {
+		for _, kv := range strings.Split(parts[1], ",") {
+			p := strings.SplitN(kv, "=", 2)
+			if len(p) != 2 {
+				return "", nil, fmt.Errorf("bad parameter %q in %q", kv, spec)
+			}
+			kvs[p[0]] = p[1]
+		}
+	}
+	return parts[0], kvs, nil
+}
+
+func floatParam(kvs map[string]string, name string, def float64) (float64, error) {
+	v, ok := kvs[name]
+	if !ok {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %q for %s", v, name)
+	}
+	return f, nil
+}
+
+/*
+ParseIdGen 解析id分布:
+
+	uniform
+	zipf:n=100000,s=1.1
+*/
+func ParseIdGen(spec string) (IdGen, error) {
+	name, kvs, err := params(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "uniform":
+		return UniformIds(), nil
+	case "zipf":
+		n, err := floatParam(kvs, "n", 100000)
+		if err != nil {
+			return nil, err
+		}
+		s, err := floatParam(kvs, "s", 1.1)
+		if err != nil {
+			return nil, err
+		}
+		if n < 2 || s <= 1 {
+			return nil, fmt.Errorf("zipf requires n >= 2 and s > 1")
+		}
+		return ZipfIds(uint64(n), s), nil
+	}
+	return nil, fmt.Errorf("unknown id distribution %q", name)
+}
+
+/*
+ParseScoreGen 解析score分布:
+
+	uniform:min=0,max=2147483647
+	normal:mean=10000,stddev=1000
+	pareto:scale=1,alpha=1.5
+	discrete:n=16
+	monotonic:start=0,step=1
+*/
+func ParseScoreGen(spec string) (ScoreGen, error) {
+	name, kvs, err := params(spec)
+	if err != nil {
+		return nil, err
+	}
+	get := func(names []string, defs []float64) ([]float64, error) {
+		vals := make([]float64, len(names))
+		for i := range names {
+			if vals[i], err = floatParam(kvs, names[i], defs[i]); err != nil {
+				return nil, err
+			}
+		}
+		return vals, nil
+	}
+	switch name {
+	case "uniform":
+		v, err := get([]string{"min", "max"}, []float64{0, math.MaxInt32})
+		if err != nil {
+			return nil, err
+		}
+		return UniformScores(v[0], v[1]), nil
+	case "normal":
+		v, err := get([]string{"mean", "stddev"}, []float64{10000, 1000})
+		if err != nil {
+			return nil, err
+		}
+		return NormalScores(v[0], v[1]), nil
+	case "pareto":
+		v, err := get([]string{"scale", "alpha"}, []float64{1, 1.5})
+		if err != nil {
+			return nil, err
+		}
+		if v[0] <= 0 || v[1] <= 0 {
+			return nil, fmt.Errorf("pareto requires scale > 0 and alpha > 0")
+		}
+		return ParetoScores(v[0], v[1]), nil
+	case "discrete":
+		v, err := get([]string{"n"}, []float64{16})
+		if err != nil {
+			return nil, err
+		}
+		if v[0] < 1 {
+			return nil, fmt.Errorf("discrete requires n >= 1")
+		}
+		return DiscreteScores(int(v[0])), nil
+	case "monotonic":
+		v, err := get([]string{"start", "step"}, []float64{0, 1})
+		if err != nil {
+			return nil, err
+		}
+		return MonotonicScores(v[0], v[1]), nil
+	}
+	return nil, fmt.Errorf("unknown score distribution %q", name)
+}
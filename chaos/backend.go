@@ -0,0 +1,412 @@
+package chaos
+
+import (
+	"pushan/RedTopK/topk"
+	"time"
+)
+
+// backend 按 Injector 的规则在 topk.Backend 的每条命令上注入故障
+type backend struct {
+	in *Injector
+	b  topk.Backend
+}
+
+func firstKey(keys []string) string {
+	if len(keys) == 0 {
+		return ""
+	}
+	return keys[0]
+}
+
+// do 按触发的规则执行fn: ActionError 不执行, ActionDelay 延迟后执行, ActionDrop 执行后返回错误
+func (c *backend) do(name, key string, fn func() error) error {
+	rule := c.in.decide(name, key)
+	if rule == nil {
+		return fn()
+	}
+	switch rule.Action {
+	case ActionDelay:
+		time.Sleep(rule.Delay)
+		return fn()
+	case ActionDrop:
+		_ = fn()
+	}
+	return injected(rule.Action, name)
+}
+
+func (c *backend) ZRem(key string, members ...string) (n int64, err error) {
+	err = c.do("zrem", key, func() error {
+		n, err = c.b.ZRem(key, members...)
+		return err
+	})
+	return n, err
+}
+
+func (c *backend) ZCard(key string) (n int64, err error) {
+	err = c.do("zcard", key, func() error {
+		n, err = c.b.ZCard(key)
+		return err
+	})
+	return n, err
+}
+
+func (c *backend) ZCount(key, min, max string) (n int64, err error) {
+	err = c.do("zcount", key, func() error {
+		n, err = c.b.ZCount(key, min, max)
+		return err
+	})
+	return n, err
+}
+
+func (c *backend) ZScore(key, member string) (score float64, ok bool, err error) {
+	err = c.do("zscore", key, func() error {
+		score, ok, err = c.b.ZScore(key, member)
+		return err
+	})
+	return score, ok, err
+}
+
+func (c *backend) ZUnionStore(dst string, keys []string, weights []float64, aggregate string) (n int64, err error) {
+	err = c.do("zunionstore", dst, func() error {
+		n, err = c.b.ZUnionStore(dst, keys, weights, aggregate)
+		return err
+	})
+	return n, err
+}
+
+func (c *backend) ZRank(key, member string) (rank int64, ok bool, err error) {
+	err = c.do("zrank", key, func() error {
+		rank, ok, err = c.b.ZRank(key, member)
+		return err
+	})
+	return rank, ok, err
+}
+
+func (c *backend) ZRangeWithScores(key string, start, stop int64) (res []topk.Element, err error) {
+	err = c.do("zrange", key, func() error {
+		res, err = c.b.ZRangeWithScores(key, start, stop)
+		return err
+	})
+	return res, err
+}
+
+func (c *backend) ZPopMin(key string, count int64) (res []topk.Element, err error) {
+	err = c.do("zpopmin", key, func() error {
+		res, err = c.b.ZPopMin(key, count)
+		return err
+	})
+	return res, err
+}
+
+func (c *backend) ZPopMax(key string, count int64) (res []topk.Element, err error) {
+	err = c.do("zpopmax", key, func() error {
+		res, err = c.b.ZPopMax(key, count)
+		return err
+	})
+	return res, err
+}
+
+func (c *backend) ZRangeByScore(key string, by topk.RangeBy) (res []string, err error) {
+	err = c.do("zrangebyscore", key, func() error {
+		res, err = c.b.ZRangeByScore(key, by)
+		return err
+	})
+	return res, err
+}
+
+func (c *backend) ZRangeByScoreWithScores(key string, by topk.RangeBy) (res []topk.Element, err error) {
+	err = c.do("zrangebyscore", key, func() error {
+		res, err = c.b.ZRangeByScoreWithScores(key, by)
+		return err
+	})
+	return res, err
+}
+
+func (c *backend) ZRevRangeByScore(key string, by topk.RangeBy) (res []string, err error) {
+	err = c.do("zrevrangebyscore", key, func() error {
+		res, err = c.b.ZRevRangeByScore(key, by)
+		return err
+	})
+	return res, err
+}
+
+func (c *backend) ZRevRangeByScoreWithScores(key string, by topk.RangeBy) (res []topk.Element, err error) {
+	err = c.do("zrevrangebyscore", key, func() error {
+		res, err = c.b.ZRevRangeByScoreWithScores(key, by)
+		return err
+	})
+	return res, err
+}
+
+func (c *backend) HGet(key, field string) (value string, ok bool, err error) {
+	err = c.do("hget", key, func() error {
+		value, ok, err = c.b.HGet(key, field)
+		return err
+	})
+	return value, ok, err
+}
+
+func (c *backend) Get(key string) (value string, ok bool, err error) {
+	err = c.do("get", key, func() error {
+		value, ok, err = c.b.Get(key)
+		return err
+	})
+	return value, ok, err
+}
+
+func (c *backend) Incr(key string) (n int64, err error) {
+	err = c.do("incr", key, func() error {
+		n, err = c.b.Incr(key)
+		return err
+	})
+	return n, err
+}
+
+func (c *backend) PTTL(key string) (ttl time.Duration, err error) {
+	err = c.do("pttl", key, func() error {
+		ttl, err = c.b.PTTL(key)
+		return err
+	})
+	return ttl, err
+}
+
+func (c *backend) SetNX(key, value string, ttl time.Duration) (ok bool, err error) {
+	err = c.do("setnx", key, func() error {
+		ok, err = c.b.SetNX(key, value, ttl)
+		return err
+	})
+	return ok, err
+}
+
+func (c *backend) BLPop(timeout time.Duration, keys ...string) (res []string, err error) {
+	err = c.do("blpop", firstKey(keys), func() error {
+		res, err = c.b.BLPop(timeout, keys...)
+		return err
+	})
+	return res, err
+}
+
+func (c *backend) Eval(script *topk.Script, keys []string, args ...interface{}) (res interface{}, err error) {
+	err = c.do("evalsha", firstKey(keys), func() error {
+		res, err = c.b.Eval(script, keys, args...)
+		return err
+	})
+	return res, err
+}
+
+func (c *backend) Pipeline() topk.Pipeline {
+	return &pipeline{in: c.in, newPipeline: c.b.Pipeline}
+}
+
+func (c *backend) TxPipeline() topk.Pipeline {
+	return &pipeline{in: c.in, newPipeline: c.b.TxPipeline}
+}
+
+func (c *backend) WithHook(hook topk.Hook) topk.Backend {
+	return &backend{in: c.in, b: c.b.WithHook(hook)}
+}
+
+// op 管道中排队的命令, Exec 时才加入底层的管道
+type op struct {
+	name, key string
+	// queue 把命令加入pl, 返回在pl执行之后复制结果的函数
+	queue func(pl topk.Pipeline) func()
+	err   *error
+}
+
+// pipeline 在 Exec 时按顺序检查每条命令, 第一条触发 ActionError 或 ActionDrop 的命令决定整个管道的结果
+type pipeline struct {
+	in          *Injector
+	newPipeline func() topk.Pipeline
+	ops         []op
+}
+
+func (p *pipeline) add(name, key string, err *error, queue func(pl topk.Pipeline) func()) {
+	p.ops = append(p.ops, op{name: name, key: key, queue: queue, err: err})
+}
+
+func (p *pipeline) Exec() error {
+	run := p.ops
+	var fault error
+	for i, o := range p.ops {
+		rule := p.in.decide(o.name, o.key)
+		if rule == nil {
+			continue
+		}
+		if rule.Action == ActionDelay {
+			time.Sleep(rule.Delay)
+			continue
+		}
+		if rule.Action == ActionError {
+			run = nil
+			if rule.Partial {
+				// 之前的命令仍然执行
+				run = p.ops[:i]
+			}
+		}
+		fault = injected(rule.Action, o.name)
+		break
+	}
+	var err error
+	if len(run) > 0 {
+		pl := p.newPipeline()
+		fills := make([]func(), len(run))
+		for i := range run {
+			fills[i] = run[i].queue(pl)
+		}
+		err = pl.Exec()
+		for _, fill := range fills {
+			fill()
+		}
+	}
+	if fault == nil {
+		return err
+	}
+	// 调用方看到的是整个管道失败, 没有执行或者回复丢失的命令都带上注入的错误
+	for _, o := range p.ops {
+		*o.err = fault
+	}
+	return fault
+}
+
+func (p *pipeline) intReply(name, key string, queue func(pl topk.Pipeline) *topk.IntReply) *topk.IntReply {
+	r := &topk.IntReply{}
+	p.add(name, key, &r.Err, func(pl topk.Pipeline) func() {
+		res := queue(pl)
+		return func() { *r = *res }
+	})
+	return r
+}
+
+func (p *pipeline) statusReply(name, key string, queue func(pl topk.Pipeline) *topk.StatusReply) *topk.StatusReply {
+	r := &topk.StatusReply{}
+	p.add(name, key, &r.Err, func(pl topk.Pipeline) func() {
+		res := queue(pl)
+		return func() { *r = *res }
+	})
+	return r
+}
+
+func (p *pipeline) elementsReply(name, key string, queue func(pl topk.Pipeline) *topk.ElementsReply) *topk.ElementsReply {
+	r := &topk.ElementsReply{}
+	p.add(name, key, &r.Err, func(pl topk.Pipeline) func() {
+		res := queue(pl)
+		return func() { *r = *res }
+	})
+	return r
+}
+
+func (p *pipeline) ZAdd(key string, members ...topk.Element) *topk.IntReply {
+	return p.intReply("zadd", key, func(pl topk.Pipeline) *topk.IntReply { return pl.ZAdd(key, members...) })
+}
+
+func (p *pipeline) ZIncrBy(key string, delta float64, member string) *topk.FloatReply {
+	r := &topk.FloatReply{}
+	p.add("zincrby", key, &r.Err, func(pl topk.Pipeline) func() {
+		res := pl.ZIncrBy(key, delta, member)
+		return func() { *r = *res }
+	})
+	return r
+}
+
+func (p *pipeline) ZRem(key string, members ...string) *topk.IntReply {
+	return p.intReply("zrem", key, func(pl topk.Pipeline) *topk.IntReply { return pl.ZRem(key, members...) })
+}
+
+func (p *pipeline) ZRemRangeByScore(key, min, max string) *topk.IntReply {
+	return p.intReply("zremrangebyscore", key, func(pl topk.Pipeline) *topk.IntReply { return pl.ZRemRangeByScore(key, min, max) })
+}
+
+func (p *pipeline) ZRemRangeByRank(key string, start, stop int64) *topk.IntReply {
+	return p.intReply("zremrangebyrank", key, func(pl topk.Pipeline) *topk.IntReply { return pl.ZRemRangeByRank(key, start, stop) })
+}
+
+func (p *pipeline) ZCard(key string) *topk.IntReply {
+	return p.intReply("zcard", key, func(pl topk.Pipeline) *topk.IntReply { return pl.ZCard(key) })
+}
+
+func (p *pipeline) ZCount(key, min, max string) *topk.IntReply {
+	return p.intReply("zcount", key, func(pl topk.Pipeline) *topk.IntReply { return pl.ZCount(key, min, max) })
+}
+
+func (p *pipeline) ZRangeWithScores(key string, start, stop int64) *topk.ElementsReply {
+	return p.elementsReply("zrange", key, func(pl topk.Pipeline) *topk.ElementsReply { return pl.ZRangeWithScores(key, start, stop) })
+}
+
+func (p *pipeline) ZRevRangeWithScores(key string, start, stop int64) *topk.ElementsReply {
+	return p.elementsReply("zrevrange", key, func(pl topk.Pipeline) *topk.ElementsReply { return pl.ZRevRangeWithScores(key, start, stop) })
+}
+
+func (p *pipeline) HSet(key, field, value string) *topk.IntReply {
+	return p.intReply("hset", key, func(pl topk.Pipeline) *topk.IntReply { return pl.HSet(key, field, value) })
+}
+
+func (p *pipeline) HMSet(key string, fields map[string]string) *topk.StatusReply {
+	return p.statusReply("hmset", key, func(pl topk.Pipeline) *topk.StatusReply { return pl.HMSet(key, fields) })
+}
+
+func (p *pipeline) HDel(key string, fields ...string) *topk.IntReply {
+	return p.intReply("hdel", key, func(pl topk.Pipeline) *topk.IntReply { return pl.HDel(key, fields...) })
+}
+
+func (p *pipeline) HLen(key string) *topk.IntReply {
+	return p.intReply("hlen", key, func(pl topk.Pipeline) *topk.IntReply { return pl.HLen(key) })
+}
+
+func (p *pipeline) HGetAll(key string) *topk.MapReply {
+	r := &topk.MapReply{}
+	p.add("hgetall", key, &r.Err, func(pl topk.Pipeline) func() {
+		res := pl.HGetAll(key)
+		return func() { *r = *res }
+	})
+	return r
+}
+
+func (p *pipeline) Get(key string) *topk.StringReply {
+	r := &topk.StringReply{}
+	p.add("get", key, &r.Err, func(pl topk.Pipeline) func() {
+		res := pl.Get(key)
+		return func() { *r = *res }
+	})
+	return r
+}
+
+func (p *pipeline) Set(key, value string) *topk.StatusReply {
+	return p.statusReply("set", key, func(pl topk.Pipeline) *topk.StatusReply { return pl.Set(key, value) })
+}
+
+func (p *pipeline) Del(keys ...string) *topk.IntReply {
+	return p.intReply("del", firstKey(keys), func(pl topk.Pipeline) *topk.IntReply { return pl.Del(keys...) })
+}
+
+func (p *pipeline) Unlink(keys ...string) *topk.IntReply {
+	return p.intReply("unlink", firstKey(keys), func(pl topk.Pipeline) *topk.IntReply { return pl.Unlink(keys...) })
+}
+
+func (p *pipeline) LPush(key string, values ...string) *topk.IntReply {
+	return p.intReply("lpush", key, func(pl topk.Pipeline) *topk.IntReply { return pl.LPush(key, values...) })
+}
+
+func (p *pipeline) RPush(key string, values ...string) *topk.IntReply {
+	return p.intReply("rpush", key, func(pl topk.Pipeline) *topk.IntReply { return pl.RPush(key, values...) })
+}
+
+func (p *pipeline) LRem(key string, count int64, value string) *topk.IntReply {
+	return p.intReply("lrem", key, func(pl topk.Pipeline) *topk.IntReply { return pl.LRem(key, count, value) })
+}
+
+func (p *pipeline) PExpire(key string, ttl time.Duration) *topk.IntReply {
+	return p.intReply("pexpire", key, func(pl topk.Pipeline) *topk.IntReply { return pl.PExpire(key, ttl) })
+}
+
+func (p *pipeline) PExpireAt(key string, at time.Time) *topk.IntReply {
+	return p.intReply("pexpireat", key, func(pl topk.Pipeline) *topk.IntReply { return pl.PExpireAt(key, at) })
+}
+
+func (p *pipeline) Exists(keys ...string) *topk.IntReply {
+	return p.intReply("exists", firstKey(keys), func(pl topk.Pipeline) *topk.IntReply { return pl.Exists(keys...) })
+}
+
+func (p *pipeline) MemoryUsage(key string) *topk.IntReply {
+	return p.intReply("memory", key, func(pl topk.Pipeline) *topk.IntReply { return pl.MemoryUsage(key) })
+}
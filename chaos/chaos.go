@@ -0,0 +1,141 @@
+/*
+Package chaos 在provider和 topk.Backend 之间注入故障: 按命令名和key匹配, 以一定概率
+让命令失败, 延迟执行, 或者执行后丢失回复, 用于测试provider在部分失败时的行为.
+
+	inj := chaos.New(seed, chaos.Rule{Command: "zremrangebyscore", Action: chaos.ActionDelay, Delay: time.Second})
+	b := inj.Wrap(topk.NewRedisBackend(cli))
+	tp := topk.NewLockTopKProviderWithBackend(b, topk.WithLockTimeout(100*time.Millisecond))
+*/
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"path"
+	"pushan/RedTopK/topk"
+	"sync"
+	"time"
+)
+
+// Action 故障类型
+type Action int
+
+const (
+	// ActionError 命令不执行, 返回错误
+	ActionError Action = iota
+	// ActionDelay 延迟 Delay 后正常执行
+	ActionDelay
+	// ActionDrop 命令正常执行, 但回复丢失, 返回错误. 调用方无法知道命令是否生效
+	ActionDrop
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionError:
+		return "error"
+	case ActionDelay:
+		return "delay"
+	case ActionDrop:
+		return "drop"
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// ErrInjected 注入的错误
+var ErrInjected = errors.New("chaos: injected fault")
+
+// IsInjected 判断err是否为注入的故障
+func IsInjected(err error) bool {
+	return errors.Is(err, ErrInjected)
+}
+
+func injected(a Action, name string) error {
+	return fmt.Errorf("%w: %s %s", ErrInjected, a, name)
+}
+
+type Rule struct {
+	// Command 小写redis命令名的匹配模式, 使用 path.Match 语法, 例如 "zadd", "z*", "*". 脚本的命令名为 "evalsha"
+	Command string
+	// Key 不为空时还要求命令的第一个key匹配, 例如 "*:m_to_z:*"
+	Key    string
+	Action Action
+	// Probability 命中后触发的概率, 为0时总是触发
+	Probability float64
+	Delay       time.Duration
+	// Skip 跳过前 Skip 次命中, Limit 最多触发 Limit 次, 为0时不限制
+	Skip  int
+	Limit int
+	// Partial 管道中的命令触发 ActionError 时, 之前的命令仍然执行, 模拟管道执行到一半失败
+	Partial bool
+}
+
+func (r *Rule) match(name, key string) bool {
+	if ok, _ := path.Match(r.Command, name); !ok {
+		return false
+	}
+	if r.Key == "" {
+		return true
+	}
+	ok, _ := path.Match(r.Key, key)
+	return ok
+}
+
+// Injector 按规则注入故障, 并发安全
+type Injector struct {
+	mu    sync.Mutex
+	r     *rand.Rand
+	rules []Rule
+	hits  []int
+	fired []int
+}
+
+func New(seed int64, rules ...Rule) *Injector {
+	in := &Injector{r: rand.New(rand.NewSource(seed))}
+	in.SetRules(rules...)
+	return in
+}
+
+// SetRules 替换所有规则并清零计数, 不传参数时关闭故障注入
+func (in *Injector) SetRules(rules ...Rule) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.rules = append([]Rule(nil), rules...)
+	in.hits = make([]int, len(rules))
+	in.fired = make([]int, len(rules))
+}
+
+// Fired 返回每条规则触发的次数
+func (in *Injector) Fired() []int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return append([]int(nil), in.fired...)
+}
+
+// decide 返回命令触发的规则, 没有触发时返回nil
+func (in *Injector) decide(name, key string) *Rule {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for i := range in.rules {
+		r := &in.rules[i]
+		if !r.match(name, key) {
+			continue
+		}
+		in.hits[i]++
+		if in.hits[i] <= r.Skip || (r.Limit > 0 && in.fired[i] >= r.Limit) {
+			continue
+		}
+		if r.Probability > 0 && in.r.Float64() >= r.Probability {
+			continue
+		}
+		in.fired[i]++
+		rule := *r
+		return &rule
+	}
+	return nil
+}
+
+// Wrap 返回经过故障注入的 Backend, b本身不受影响
+func (in *Injector) Wrap(b topk.Backend) topk.Backend {
+	return &backend{in: in, b: b}
+}
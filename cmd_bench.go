@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"pushan/RedTopK/bench"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseMix 解析 add=70,delete=10,topk=20
+func parseMix(s string) (bench.Mix, error) {
+	mix := bench.Mix{}
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return mix, fmt.Errorf("bad mix %q, expect op=weight", part)
+		}
+		w, err := strconv.Atoi(kv[1])
+		if err != nil || w < 0 {
+			return mix, fmt.Errorf("bad weight %q for %s", kv[1], kv[0])
+		}
+		switch kv[0] {
+		case bench.OpAdd:
+			mix.Add = w
+		case bench.OpDelete:
+			mix.Delete = w
+		case bench.OpTopK:
+			mix.TopK = w
+		default:
+			return mix, fmt.Errorf("unknown op %q in mix", kv[0])
+		}
+	}
+	return mix, nil
+}
+
+func runBench(e *env, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	clients := fs.Int("clients", 8, "number of concurrent clients")
+	opsPerClient := fs.Int("ops", 1000, "operations per client, 0 for no limit (requires -duration or -trace)")
+	duration := fs.Duration("duration", 0, "stop after this long, 0 for no limit (requires -ops or -trace)")
+	mixStr := fs.String("mix", "add=70,delete=10,topk=20", "operation weights")
+	k := fs.Int("k", 100, "k for topk operations")
+	idSpec := fs.String("ids", "uniform", "member distribution: uniform or zipf[:n=100000,s=1.1]")
+	scoreSpec := fs.String("scores", "uniform", "score distribution: uniform[:min=,max=], normal[:mean=,stddev=], "+
+		"pareto[:scale=,alpha=], discrete[:n=16] or monotonic[:start=,step=]")
+	tracePath := fs.String("trace", "", "replay operations from a trace file instead of generating them")
+	recordPath := fs.String("record", "", "record generated operations to a trace file")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "random seed")
+	format := fs.String("format", "text", "output format: text, json or csv")
+	output := fs.String("o", "-", "output file, - for stdout")
+	fs.Parse(args)
+
+	// 生成的操作没有尽头, 需要至少一个停止条件; 重放trace时执行完即停止
+	if *tracePath == "" && *opsPerClient <= 0 && *duration <= 0 {
+		return fmt.Errorf("-ops and -duration cannot both be 0 without -trace, the benchmark would never stop")
+	}
+	mix, err := parseMix(*mixStr)
+	if err != nil {
+		return err
+	}
+	ids, err := bench.ParseIdGen(*idSpec)
+	if err != nil {
+		return err
+	}
+	if _, err := bench.ParseScoreGen(*scoreSpec); err != nil {
+		return err
+	}
+	var trace []bench.Op
+	if *tracePath != "" {
+		f, err := os.Open(*tracePath)
+		if err != nil {
+			return err
+		}
+		trace, err = bench.ReadTrace(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		// 重放时执行完trace中的所有操作
+		*opsPerClient = 0
+	}
+	var record io.Writer
+	if *recordPath != "" {
+		f, err := os.Create(*recordPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		record = f
+	}
+
+	results := make([]*bench.Result, 0, len(e.providers))
+	for _, name := range e.providers {
+		tp, err := e.newProvider(name)
+		if err != nil {
+			return err
+		}
+		if e.flush {
+			if err := e.reset(); err != nil {
+				return err
+			}
+		}
+		var workload bench.Workload
+		var rec *bench.Recorder
+		if trace != nil {
+			workload = bench.NewReplay(trace)
+			log.Printf("bench %s: clients=%d, duration=%s, trace=%s (%d ops)", name, *clients, *duration, *tracePath, len(trace))
+		} else {
+			// monotonic 的序号在生成器内共享, 每个provider重新创建
+			scores, _ := bench.ParseScoreGen(*scoreSpec)
+			workload = bench.Synthetic{Mix: mix, K: *k, Ids: ids, Scores: scores}
+			if record != nil {
+				rec = bench.NewRecorder(workload, record)
+				workload = rec
+			}
+			log.Printf("bench %s: clients=%d, ops=%d, duration=%s, mix=%s, ids=%s, scores=%s",
+				name, *clients, *opsPerClient, *duration, *mixStr, *idSpec, *scoreSpec)
+		}
+		results = append(results, bench.Run(tp, bench.Config{
+			Name:         name,
+			Key:          e.key("bench_" + name),
+			Clients:      *clients,
+			OpsPerClient: *opsPerClient,
+			Duration:     *duration,
+			Workload:     workload,
+			Seed:         *seed,
+		}))
+		if rec != nil {
+			if err := rec.Flush(); err != nil {
+				return err
+			}
+			// 只记录第一个provider的操作
+			record = nil
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	switch *format {
+	case "json":
+		return bench.WriteJSON(w, results)
+	case "csv":
+		return bench.WriteCSV(w, results)
+	case "text":
+		return bench.WriteText(w, results)
+	}
+	return fmt.Errorf("unknown format %q", *format)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"pushan/RedTopK/bench"
+	"pushan/RedTopK/chaos"
+	"pushan/RedTopK/topk"
+	"pushan/RedTopK/topktest"
+	"strings"
+	"time"
+)
+
+// chaosRules 每种故障场景对应的注入规则
+func chaosRules(profile string, p float64, lockTimeout time.Duration) ([]chaos.Rule, error) {
+	switch profile {
+	case "error":
+		// 任意命令失败, 管道执行到一半
+		return []chaos.Rule{{Command: "*", Action: chaos.ActionError, Probability: p, Partial: true}}, nil
+	case "drop":
+		// 命令生效但回复丢失
+		return []chaos.Rule{{Command: "*", Action: chaos.ActionDrop, Probability: p}}, nil
+	case "delay":
+		// 持有锁时的命令延迟超过锁的超时时间, 锁在操作中途过期
+		return []chaos.Rule{{Command: "z*", Action: chaos.ActionDelay, Delay: 2 * lockTimeout, Probability: p}}, nil
+	case "script":
+		// 脚本失败, 包括解锁脚本
+		return []chaos.Rule{{Command: "eval*", Action: chaos.ActionError, Probability: 10 * p}}, nil
+	}
+	return nil, fmt.Errorf("unknown chaos profile %q, expect error, drop, delay or script", profile)
+}
+
+func runChaos(e *env, args []string) error {
+	fs := flag.NewFlagSet("chaos", flag.ExitOnError)
+	profiles := fs.String("profile", "error,drop,delay,script", "comma separated fault profiles")
+	prob := fs.Float64("p", 0.01, "fault probability per matching command")
+	clients := fs.Int("clients", 4, "number of concurrent clients")
+	ops := fs.Int("n", 1000, "operations per client")
+	ids := fs.Int("ids", 20000, "number of distinct members")
+	scores := fs.Int("scores", 100, "number of distinct scores")
+	lockTimeout := fs.Duration("lock-timeout", 200*time.Millisecond, "lock timeout of the lock provider")
+	shardLimit := fs.Int("shard-limit", 50, "shard limit of the lock provider, small limits split more often")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "random seed")
+	fs.Parse(args)
+
+	log.Printf("seed: %d", *seed)
+	for _, name := range e.providers {
+		for _, profile := range strings.Split(*profiles, ",") {
+			rules, err := chaosRules(profile, *prob, *lockTimeout)
+			if err != nil {
+				return err
+			}
+			opts := []topk.Option{topk.WithLockTimeout(*lockTimeout), topk.WithShardLimit(*shardLimit)}
+			if err := chaosTest(e, name, profile, rules, opts, *clients, *ops, *ids, *scores, *seed); err != nil {
+				return fmt.Errorf("%s/%s: %w", name, profile, err)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+chaosTest 在故障注入下并发执行随机操作, 然后关闭故障, 检查布局.
+有问题时使用 Repairer 修复, 修复后布局必须一致, 并且能继续通过差分测试.
+*/
+func chaosTest(e *env, name, profile string, rules []chaos.Rule, opts []topk.Option,
+	clients, ops, ids, scores int, seed int64) error {
+	ctor := providerCtors[name]
+	inj := chaos.New(seed, rules...)
+	b := topk.NewRedisBackend(e.cli)
+	faulty := ctor(inj.Wrap(b), opts...)
+	tp := ctor(b, opts...)
+	if e.flush {
+		if err := e.reset(); err != nil {
+			return err
+		}
+	}
+	key := e.key(fmt.Sprintf("chaos_%s_%s_%d", name, profile, seed))
+	res := bench.Run(faulty, bench.Config{
+		Name:         name,
+		Key:          key,
+		Clients:      clients,
+		OpsPerClient: ops,
+		Workload: bench.Synthetic{
+			Mix:    bench.Mix{Add: 70, Delete: 20, TopK: 10},
+			K:      10,
+			Ids:    bench.ZipfIds(uint64(ids), 1.01),
+			Scores: bench.DiscreteScores(scores),
+		},
+		Seed: seed,
+	})
+	log.Printf("%s/%s: %d ops, %d errors, faults fired %v", name, profile, res.Ops, res.Errors, inj.Fired())
+	inj.SetRules()
+
+	checker, ok := tp.(topk.Checker)
+	if !ok {
+		log.Printf("%s/%s: provider has no layout, skip check", name, profile)
+		return nil
+	}
+	err, report := checker.Check(key)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s/%s: %d shards, %d members, %d problems", name, profile, report.Shards, report.Members, len(report.Problems))
+	for i, p := range report.Problems {
+		if i == 10 {
+			log.Printf("  ... %d more", len(report.Problems)-i)
+			break
+		}
+		log.Printf("  %s", p)
+	}
+	if !report.OK() {
+		repairer, ok := tp.(topk.Repairer)
+		if !ok {
+			return fmt.Errorf("layout is inconsistent and provider cannot repair it")
+		}
+		if err, _ := repairer.Repair(key); err != nil {
+			return err
+		}
+		if err, report = checker.Check(key); err != nil {
+			return err
+		}
+		if !report.OK() {
+			return fmt.Errorf("layout still inconsistent after repair: %v", report.Problems)
+		}
+		log.Printf("%s/%s: repaired, %d shards, %d members", name, profile, report.Shards, report.Members)
+	}
+
+	// 修复后的布局必须能继续正常使用
+	err, elements := tp.GetTopKS(key, int(report.Members))
+	if err != nil {
+		return err
+	}
+	seq := topktest.Generate(rand.New(rand.NewSource(seed)), 500, topktest.Config{Ids: 64, Scores: scores})
+	if f := topktest.CheckFrom(tp, key, elements, seq); f != nil {
+		return f
+	}
+	log.Printf("%s/%s: passed", name, profile)
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"pushan/RedTopK/topk"
+	"strconv"
+)
+
+type exportedElement struct {
+	Id    string  `json:"id"`
+	Score float64 `json:"score"`
+}
+
+func runExport(e *env, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "jsonl", "output format: jsonl or csv")
+	output := fs.String("o", "-", "output file, - for stdout")
+	batch := fs.Int("batch", 1000, "members read per RangeByScore call")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: export [-format jsonl|csv] [-o file] [-batch n] <key>")
+	}
+	if *batch <= 0 {
+		return fmt.Errorf("batch must be positive")
+	}
+	tp, err := e.singleProvider()
+	if err != nil {
+		return err
+	}
+	rq, ok := tp.(topk.RangeQuerier)
+	if !ok {
+		return fmt.Errorf("provider %s does not support export", e.providers[0])
+	}
+	key := e.key(fs.Arg(0))
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	var write func(ele topk.Element) error
+	switch *format {
+	case "jsonl":
+		enc := json.NewEncoder(bw)
+		write = func(ele topk.Element) error {
+			return enc.Encode(exportedElement{Id: ele.Id, Score: ele.Score})
+		}
+	case "csv":
+		cw := csv.NewWriter(bw)
+		write = func(ele topk.Element) error {
+			if err := cw.Write([]string{ele.Id, strconv.FormatFloat(ele.Score, 'g', -1, 64)}); err != nil {
+				return err
+			}
+			// 每条记录都写入bw, 最后只需要flush bw
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	// 按批读取, 避免一次读取整个排行榜. 导出期间的写入可能导致重复或遗漏
+	cnt := 0
+	for offset := 0; ; offset += *batch {
+		err, elements := rq.RangeByScore(key, "-inf", "+inf", offset, *batch)
+		if err != nil {
+			return err
+		}
+		for _, ele := range elements {
+			if err := write(ele); err != nil {
+				return err
+			}
+		}
+		cnt += len(elements)
+		if len(elements) < *batch {
+			break
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	log.Printf("exported %d elements from %s", cnt, key)
+	return nil
+}
+
+func runImport(e *env, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "jsonl", "input format: jsonl or csv")
+	input := fs.String("i", "-", "input file, - for stdin")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: import [-format jsonl|csv] [-i file] <key>")
+	}
+	tp, err := e.singleProvider()
+	if err != nil {
+		return err
+	}
+	key := e.key(fs.Arg(0))
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	cnt := 0
+	add := func(ele exportedElement) error {
+		if err := tp.AddElement(key, ele.Id, ele.Score); err != nil {
+			return fmt.Errorf("add (%s, %g) failed, err=%w", ele.Id, ele.Score, err)
+		}
+		cnt++
+		return nil
+	}
+	switch *format {
+	case "jsonl":
+		dec := json.NewDecoder(bufio.NewReader(r))
+		for {
+			var ele exportedElement
+			err := dec.Decode(&ele)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if err := add(ele); err != nil {
+				return err
+			}
+		}
+	case "csv":
+		cr := csv.NewReader(bufio.NewReader(r))
+		cr.FieldsPerRecord = 2
+		for {
+			record, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			score, err := strconv.ParseFloat(record[1], 64)
+			if err != nil {
+				return fmt.Errorf("bad score %q for %s", record[1], record[0])
+			}
+			if err := add(exportedElement{Id: record[0], Score: score}); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	log.Printf("imported %d elements into %s", cnt, key)
+	return nil
+}
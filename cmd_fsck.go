@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"pushan/RedTopK/topk"
+)
+
+func runFsck(e *env, args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	format := fs.String("format", "text", "output format: text or json")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: fsck [-format text|json] <key>")
+	}
+	tp, err := e.singleProvider()
+	if err != nil {
+		return err
+	}
+	checker, ok := tp.(topk.Checker)
+	if !ok {
+		return fmt.Errorf("provider %s does not support fsck", e.providers[0])
+	}
+	err, report := checker.Check(e.key(fs.Arg(0)))
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("key: %s, shards: %d, members: %d, problems: %d\n",
+			report.Key, report.Shards, report.Members, len(report.Problems))
+		for _, p := range report.Problems {
+			fmt.Println("  " + p.String())
+		}
+	}
+	if !report.OK() {
+		log.Printf("%d problems found in %s", len(report.Problems), report.Key)
+		os.Exit(1)
+	}
+	return nil
+}
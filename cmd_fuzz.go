@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"pushan/RedTopK/topk"
+	"pushan/RedTopK/topktest"
+	"time"
+)
+
+func runFuzz(e *env, args []string) error {
+	fs := flag.NewFlagSet("fuzz", flag.ExitOnError)
+	runs := fs.Int("runs", 20, "number of random sequences")
+	ops := fs.Int("n", 200, "operations per sequence")
+	ids := fs.Int("ids", 32, "number of distinct members")
+	scores := fs.Int("scores", 8, "number of distinct scores")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "random seed")
+	ref := fs.String("ref", "zset", "reference implementation: zset or model")
+	ranges := fs.Bool("ranges", false, "also compare RangeByScore, CountByScore and GetAround")
+	pops := fs.Bool("pops", false, "also compare PopTop and PopBottom")
+	capacity := fs.Int("capacity", 0, "cap every leaderboard at this many members, 0 means unlimited")
+	fs.Parse(args)
+
+	cfg := topktest.Config{
+		Key:      e.key("fuzz"),
+		Seed:     *seed,
+		Runs:     *runs,
+		Ops:      *ops,
+		Ids:      *ids,
+		Scores:   *scores,
+		Ranges:   *ranges,
+		Pops:     *pops,
+		Capacity: *capacity,
+	}
+	switch *ref {
+	case "zset":
+		cfg.NewReference = func() topk.TopKProvider { return topk.NewZSetProvider(e.cli, topk.WithCapacity(*capacity)) }
+	case "model":
+	default:
+		return fmt.Errorf("unknown reference %q", *ref)
+	}
+	if e.flush {
+		cfg.Reset = e.reset
+	}
+	log.Printf("seed: %d", *seed)
+	for _, name := range e.providers {
+		tp, err := e.newProvider(name, topk.WithCapacity(*capacity))
+		if err != nil {
+			return err
+		}
+		if f := topktest.Check(tp, cfg); f != nil {
+			return fmt.Errorf("%s: %w", name, f)
+		}
+		log.Printf("fuzz passed, provider: %s, sequences: %d, operations: %d", name, *runs, *ops)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"pushan/RedTopK/topk"
+	"text/tabwriter"
+)
+
+func runInspect(e *env, args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	format := fs.String("format", "table", "output format: table or json")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: inspect [-format table|json] <key>")
+	}
+	tp, err := e.singleProvider()
+	if err != nil {
+		return err
+	}
+	ins, ok := tp.(topk.Inspector)
+	if !ok {
+		return fmt.Errorf("provider %s does not support inspect", e.providers[0])
+	}
+	return inspect(ins, e.key(fs.Arg(0)), *format)
+}
+
+// inspect 打印leaderboard的布局, format 为 table 或 json
+func inspect(ins topk.Inspector, key string, format string) error {
+	err, stats := ins.Stats(key)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+	fmt.Printf("key: %s\nmeta key: %s\nshards: %d\nmembers: %d\nmemory: %d bytes\n\n",
+		stats.Key, stats.MetaKey, stats.ShardCount, stats.TotalMembers, stats.MemoryBytes)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SHARD\tMEMBERS\tMIN\tMAX\tMETA\tMEMORY")
+	for _, s := range stats.Shards {
+		fmt.Fprintf(w, "%s\t%d\t%g\t%g\t%g\t%d\n", s.Key, s.Members, s.MinScore, s.MaxScore, s.MetaScore, s.MemoryBytes)
+	}
+	w.Flush()
+	fmt.Println("\nFILL FACTOR")
+	for i, cnt := range stats.FillFactor {
+		if i == len(stats.FillFactor)-1 {
+			fmt.Printf("  >100%%\t%d\n", cnt)
+		} else {
+			fmt.Printf("  %d-%d%%\t%d\n", i*10, (i+1)*10, cnt)
+		}
+	}
+	if len(stats.HashBuckets) > 0 {
+		var minBucket, maxBucket, total int64 = stats.HashBuckets[0], stats.HashBuckets[0], 0
+		for _, b := range stats.HashBuckets {
+			total += b
+			if b < minBucket {
+				minBucket = b
+			}
+			if b > maxBucket {
+				maxBucket = b
+			}
+		}
+		fmt.Printf("\nHASH BUCKETS\n  buckets: %d, min: %d, max: %d, avg: %.1f\n",
+			len(stats.HashBuckets), minBucket, maxBucket, float64(total)/float64(len(stats.HashBuckets)))
+	}
+	return nil
+}
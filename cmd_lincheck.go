@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"pushan/RedTopK/topktest"
+	"time"
+)
+
+func runLincheck(e *env, args []string) error {
+	fs := flag.NewFlagSet("lincheck", flag.ExitOnError)
+	runs := fs.Int("runs", 10, "number of concurrent histories per provider")
+	clients := fs.Int("clients", 4, "number of concurrent clients")
+	ops := fs.Int("n", topktest.DefaultConcurrentOps, "operations per client")
+	ids := fs.Int("ids", 4, "number of distinct members")
+	scores := fs.Int("scores", 4, "number of distinct scores")
+	steps := fs.Int("steps", 1000000, "maximum search steps of the checker")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "random seed")
+	output := fs.String("history", "", "write the failing history as json to this file")
+	pops := fs.Bool("pops", false, "also run PopTop and PopBottom")
+	fs.Parse(args)
+
+	log.Printf("seed: %d", *seed)
+	for _, name := range e.providers {
+		tp, err := e.newProvider(name)
+		if err != nil {
+			return err
+		}
+		exhausted := 0
+		for i := 0; i < *runs; i++ {
+			cfg := topktest.Config{
+				Key:      e.key("lincheck"),
+				Seed:     *seed + int64(i**clients),
+				Ops:      *ops,
+				Ids:      *ids,
+				Scores:   *scores,
+				Clients:  *clients,
+				MaxSteps: *steps,
+				Pops:     *pops,
+			}
+			h, lin := topktest.CheckConcurrent(tp, cfg)
+			if lin.Exhausted {
+				exhausted++
+				continue
+			}
+			if lin.Ok {
+				continue
+			}
+			if err := topktest.WriteTimeline(os.Stdout, h, lin); err != nil {
+				return err
+			}
+			if *output != "" {
+				if err := writeHistory(*output, h); err != nil {
+					return err
+				}
+			}
+			return fmt.Errorf("%s: history %d (seed %d) is not linearizable", name, i, cfg.Seed)
+		}
+		log.Printf("lincheck passed, provider: %s, histories: %d, exhausted: %d", name, *runs, exhausted)
+	}
+	return nil
+}
+
+func writeHistory(path string, h topktest.History) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(h)
+}
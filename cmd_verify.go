@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"pushan/RedTopK/topk"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func runVerify(e *env, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	addTime := fs.Int("n", 10000, "number of random adds")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "random seed")
+	fs.Parse(args)
+
+	tps := make([]topk.TopKProvider, 0, len(e.providers))
+	for _, name := range e.providers {
+		tp, err := e.newProvider(name)
+		if err != nil {
+			return err
+		}
+		tps = append(tps, tp)
+	}
+	if !validationTest(e.key("abcd"), tps...) {
+		return errors.New("validation test failed")
+	}
+	log.Printf("seed: %d", *seed)
+	rand.Seed(*seed)
+	for _, tp := range tps {
+		if err := testAddAndTopK(e, *addTime, tp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func testAddAndTopK(e *env, addTime int, tp topk.TopKProvider) error {
+	if err := e.reset(); err != nil {
+		return err
+	}
+	tpZSet := topk.NewZSetProvider(e.cli)
+	key := e.key("abcd")
+	st := time.Now()
+	for i := 0; i < addTime; i++ {
+		id := strconv.FormatInt(rand.Int63(), 10)
+		score := rand.Int31n(65535)
+		err := tp.AddElement(key, id, float64(score))
+		if err != nil {
+			log.Printf("sharding: add (%s, %d) failed, err=%s", id, score, err)
+		}
+		err = tpZSet.AddElement(key, id, float64(score))
+		if err != nil {
+			log.Printf("zset: add (%s, %d) failed, err=%s", id, score, err)
+		}
+	}
+	log.Printf("add time:%d\n", time.Since(st).Milliseconds())
+	st = time.Now()
+	tk := addTime
+	if tk >= 10000 {
+		tk = 10000
+	}
+	err, eleShard := tp.GetTopKS(key, tk)
+	if err != nil {
+		return fmt.Errorf("sharding: top %d failed, err=%w", tk, err)
+	}
+	err, eleZset := tpZSet.GetTopKS(key, tk)
+	if err != nil {
+		return fmt.Errorf("zset: top %d failed, err=%w", tk, err)
+	}
+	if !reflect.DeepEqual(eleShard, eleZset) {
+		return fmt.Errorf("not equal:k=%d, alg: %v", tk, reflect.TypeOf(tp))
+	}
+	log.Printf("verify time:%d\n", time.Since(st).Milliseconds())
+	log.Printf("all test passed, alg: %v", reflect.TypeOf(tp))
+	return nil
+}
+
+// validationTest 校验所有provider对非法输入的处理一致
+func validationTest(key string, tps ...topk.TopKProvider) bool {
+	cases := []struct {
+		id     string
+		score  float64
+		expect error
+	}{
+		{"", 1, topk.ErrInvalidId},
+		{strings.Repeat("a", topk.DefaultMaxIdLen+1), 1, topk.ErrInvalidId},
+		{"a,b", 1, topk.ErrInvalidId},
+		{string([]byte{0xff, 0xfe}), 1, topk.ErrInvalidId},
+		{"a", math.NaN(), topk.ErrInvalidScore},
+		{"a", math.Inf(1), topk.ErrInvalidScore},
+		{"a", math.Inf(-1), topk.ErrInvalidScore},
+	}
+	passed := true
+	for _, tp := range tps {
+		for _, c := range cases {
+			err := tp.AddElement(key, c.id, c.score)
+			if !errors.Is(err, c.expect) {
+				log.Printf("add (%q, %f): expect %s, got %v, alg: %v", c.id, c.score, c.expect, err, reflect.TypeOf(tp))
+				passed = false
+			}
+			if c.expect != topk.ErrInvalidId {
+				continue
+			}
+			err = tp.DeleteElement(key, c.id)
+			if !errors.Is(err, c.expect) {
+				log.Printf("del (%q): expect %s, got %v, alg: %v", c.id, c.expect, err, reflect.TypeOf(tp))
+				passed = false
+			}
+		}
+	}
+	if passed {
+		log.Println("validation test passed.")
+	}
+	return passed
+}
@@ -1,208 +1,138 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"os"
 	"pushan/RedTopK/topk"
-	"reflect"
-	"strconv"
-	"sync"
-	"time"
+	"sort"
+	"strings"
 
 	"github.com/go-redis/redis"
 )
 
-func testAddAndTopK(addTime int, tp topk.TopKProvider) {
-	cli2 := redis.NewClient(&redis.Options{
-		Addr: "127.0.0.1:6379",
-		DB:   0,
-	})
-	defer cli2.Close()
-	// rand.Seed(1)
-	cli2.FlushAll()
-	tpZSet := topk.NewZSetProvider(cli2)
-	key := "abcd"
-	st := time.Now()
-	for i := 0; i < addTime; i++ {
-		id := strconv.FormatInt(rand.Int63(), 10)
-		// id = strconv.FormatInt(int64(i+1), 10)
-		score := rand.Int31n(65535)
-		// fmt.Println(id, score)
-		err := tp.AddElement(key, id, float64(score))
-		if err != nil {
-			log.Printf("sharding: add (%s, %d) failed, err=%s", id, score, err)
-		}
-		err = tpZSet.AddElement(key, id, float64(score))
-		if err != nil {
-			log.Printf("zset: add (%s, %d) failed, err=%s", id, score, err)
-		}
-	}
-	log.Printf("add time:%d\n", time.Since(st).Milliseconds())
-	st = time.Now()
-	tk := addTime
-	if tk >= 10000 {
-		tk = 10000
-	}
-	for i := tk; i <= tk; i++ {
-		err, eleShard := tp.GetTopKS(key, i)
-		if err != nil {
-			log.Printf("sharding: top %d failed, err=%s", i, err)
-		}
-		err, eleZset := tpZSet.GetTopKS(key, i)
-		if err != nil {
-			log.Printf("zset: top %d failed, err=%s", i, err)
-		}
-		if !reflect.DeepEqual(eleShard, eleZset) {
-			// log.Printf("not equal:%v,%v", eleShard, eleZset)
-			log.Printf("not equal:k=%d\n", i)
-			// return
-		}
-	}
-	log.Printf("verify time:%d\n", time.Since(st).Milliseconds())
-	log.Println("all test passed.")
+// command 子命令, run 的参数为子命令自己的参数
+type command struct {
+	usage string
+	run   func(env *env, args []string) error
 }
 
-func randomTest(testTime int, tp topk.TopKProvider) {
-	cli2 := redis.NewClient(&redis.Options{
-		Addr: "127.0.0.1:6379",
-		DB:   0,
-	})
-	defer cli2.Close()
-	// rand.Seed(1)
-	cli2.FlushAll()
-	tpZSet := topk.NewZSetProvider(cli2)
-	key := "abcd"
-	members := make(map[string]float64)
-	cnt := 0
-	for i := 0; i < testTime; i++ {
-		rnd := rand.Int31n(7)
-		switch rnd {
-		case 0, 1, 2, 3:
-			// add
-			id := fmt.Sprintf("%d", rand.Int63())
-			score := rand.Int31n(4096)
-			err := tp.AddElement(key, id, float64(score))
-			err2 := tpZSet.AddElement(key, id, float64(score))
-			if err != nil || err2 != nil {
-				log.Printf("add failed:err1:%s, err2:%s\n", err, err2)
-			} else {
-				members[id] = float64(score)
-				cnt++
-			}
-		case 4, 5, 6:
-			// del
-			keys := make([]string, 0, len(members))
-			for k := range members {
-				keys = append(keys, k)
-			}
-			if len(keys) > 0 {
-				member := keys[rand.Int63n(int64(len(keys)))]
-				err1 := tp.DeleteElement(key, member)
-				err2 := tpZSet.DeleteElement(key, member)
-				if err1 != nil || err2 != nil {
-					log.Printf("del failed:err1:%s, err2:%s\n", err1, err2)
-				} else {
-					delete(members, member)
-					cnt--
-				}
-			}
-		}
+var commands = map[string]command{
+	"chaos":    {"run random operations with injected redis faults and check the layout recovers", runChaos},
+	"bench":    {"run concurrent add/delete/topk benchmarks against providers", runBench},
+	"verify":   {"compare providers with a plain zset after random adds", runVerify},
+	"fuzz":     {"run random add/delete sequences against providers", runFuzz},
+	"lincheck": {"check concurrent histories of providers for linearizability", runLincheck},
+	"inspect":  {"print the shard layout of a leaderboard", runInspect},
+	"export":   {"dump a leaderboard as jsonl or csv", runExport},
+	"import":   {"load a leaderboard from jsonl or csv", runImport},
+	"fsck":     {"check the shard layout of a leaderboard for inconsistencies", runFsck},
+}
 
-		k := cnt
-		if cnt >= 10000 {
-			k = 10000
-		}
-		err1, tk1 := tp.GetTopKS(key, k)
-		err2, tk2 := tpZSet.GetTopKS(key, k)
-		if err1 != nil || err2 != nil {
-			log.Printf("add failed:err1:%s, err2:%s\n", err1, err2)
-		} else {
-			if !reflect.DeepEqual(tk1, tk2) {
-				log.Printf("not equal:k=%d\n", i)
-			} else {
-				if rand.Int31n(1000) == 0 {
-					log.Printf("pass for k:%d\n, %v", k, reflect.TypeOf(tp))
-				}
-			}
-		}
+// env 全局参数, 所有子命令共享
+type env struct {
+	addr      string
+	db        int
+	password  string
+	prefix    string
+	providers []string
+	flush     bool
+
+	cli *redis.Client
+}
+
+func (e *env) key(name string) string {
+	return e.prefix + name
+}
+
+var providerCtors = map[string]func(b topk.Backend, opts ...topk.Option) topk.TopKProvider{
+	"lua":  topk.NewTopKProviderWithBackend,
+	"lock": topk.NewLockTopKProviderWithBackend,
+	"zset": topk.NewZSetProviderWithBackend,
+	// memory 不使用redis, 每次创建都是空的
+	"memory": func(b topk.Backend, opts ...topk.Option) topk.TopKProvider {
+		return topk.NewMemoryProvider(opts...)
+	},
+}
+
+func (e *env) newProvider(name string, opts ...topk.Option) (topk.TopKProvider, error) {
+	ctor, ok := providerCtors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q, expect lua, lock, zset or memory", name)
 	}
+	return ctor(topk.NewRedisBackend(e.cli), opts...), nil
 }
 
-func BenchMarkAddAndTopK(tp topk.TopKProvider, testTime int, addTimes int, resetFunc func()) {
-	totalTime := 0
-	key := "abcde"
-	for i := 0; i < testTime; i++ {
-		resetFunc()
-		st := time.Now()
-		for j := 0; j < addTimes; j++ {
-			id := strconv.FormatInt(rand.Int63(), 10)
-			score := rand.Int31()
-			err := tp.AddElement(key, id, float64(score))
-			if err != nil {
-				log.Fatalf("add failed for (%s, %d), err=%s\n", id, score, err)
-			}
-		}
-		totalTime += int(time.Since(st).Milliseconds())
+// singleProvider 用于只能作用在一个provider上的子命令
+func (e *env) singleProvider() (topk.TopKProvider, error) {
+	if len(e.providers) != 1 {
+		return nil, fmt.Errorf("exactly one provider expected, got %q", strings.Join(e.providers, ","))
 	}
-	log.Printf("sync::all test passed, alg: %v, testTime:%d, addTimes:%d, time elapsed:%d", reflect.TypeOf(tp), testTime, addTimes, totalTime/testTime)
+	return e.newProvider(e.providers[0])
 }
-func BenchMarkAddAndTopKASync(tp topk.TopKProvider, clientNum int, addTimesPerClient int, resetFunc func()) {
-	resetFunc()
-	key := "abcde"
-	testFunc := func(totalTime *int, wg *sync.WaitGroup) {
-		*totalTime = 0
-		st := time.Now()
-		for j := 0; j < addTimesPerClient; j++ {
-			id := strconv.FormatInt(rand.Int63(), 10)
-			score := rand.Int31()
-			err := tp.AddElement(key, id, float64(score))
-			if err != nil {
-				log.Fatalf("add failed for (%s, %d), err=%s\n", id, score, err)
-			}
-		}
-		*totalTime += int(time.Since(st).Milliseconds())
-		wg.Done()
+
+// reset 清空当前db, 必须显式指定 -flush
+func (e *env) reset() error {
+	if !e.flush {
+		return fmt.Errorf("refusing to flush db %d on %s, pass -flush to allow it", e.db, e.addr)
 	}
-	wg := &sync.WaitGroup{}
-	totalTimes := make([]int, clientNum)
-	for i := 0; i < clientNum; i++ {
-		wg.Add(1)
-		testFunc(&totalTimes[i], wg)
+	return e.cli.FlushDB().Err()
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: %s [flags] <command> [command flags]\n\ncommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
 	}
-	wg.Wait()
-	totalTime := 0
-	for i := 0; i < clientNum; i++ {
-		totalTime += totalTimes[i]
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-8s %s\n", name, commands[name].usage)
 	}
-	totalTime /= clientNum
-	log.Printf("async:all test passed, alg: %v, testTime:%d, addTimes:%d, time elapsed:%d", reflect.TypeOf(tp), clientNum, addTimesPerClient, totalTime)
+	fmt.Fprintf(out, "\nflags:\n")
+	flag.PrintDefaults()
 }
 
 func main() {
-	cli2 := redis.NewClient(&redis.Options{
-		Addr: "127.0.0.1:6379",
-		DB:   0,
-	})
-	reset := func() {
-		cli2.FlushAll()
+	e := &env{}
+	var providers string
+	flag.StringVar(&e.addr, "addr", "127.0.0.1:6379", "redis address")
+	flag.IntVar(&e.db, "db", 0, "redis db")
+	flag.StringVar(&e.password, "password", "", "redis password")
+	flag.StringVar(&e.prefix, "prefix", "", "prefix added to every leaderboard key")
+	flag.StringVar(&providers, "provider", "lua", "comma separated providers: lua, lock, zset, memory")
+	flag.BoolVar(&e.flush, "flush", false, "allow commands to FLUSHDB the selected db before running")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	e.providers = strings.Split(providers, ",")
+	for _, name := range e.providers {
+		if _, ok := providerCtors[name]; !ok {
+			log.Fatalf("unknown provider %q, expect lua, lock, zset or memory", name)
+		}
 	}
-	testTime := int64(50)
-	testTime, _ = strconv.ParseInt(os.Args[1], 10, 64)
-	addTime, _ := strconv.ParseInt(os.Args[2], 10, 64)
 
-	tp := topk.NewLockTopKProvider(cli2)
-	// testAddAndTopK(int(testTime), tp)
-	// randomTest(int(testTime), tp)
-	BenchMarkAddAndTopK(tp, int(testTime), int(addTime), reset)
-	BenchMarkAddAndTopKASync(tp, int(testTime), int(addTime), reset)
-	tp2 := topk.NewTopKProvider(cli2)
-	// testAddAndTopK(int(testTime), tp2)
-	// randomTest(int(testTime), tp2)
-	BenchMarkAddAndTopK(tp2, int(testTime), int(addTime), reset)
-	BenchMarkAddAndTopKASync(tp2, int(testTime), int(addTime), reset)
-	tp3 := topk.NewZSetProvider(cli2)
-	BenchMarkAddAndTopK(tp3, int(testTime), int(addTime), reset)
-	BenchMarkAddAndTopKASync(tp3, int(testTime), int(addTime), reset)
+	e.cli = redis.NewClient(&redis.Options{
+		Addr:     e.addr,
+		DB:       e.db,
+		Password: e.password,
+	})
+	defer e.cli.Close()
+	if err := e.cli.Ping().Err(); err != nil {
+		log.Fatalf("connect to %s failed, err=%s", e.addr, err)
+	}
+	if err := cmd.run(e, flag.Args()[1:]); err != nil {
+		log.Fatalf("%s failed, err=%s", flag.Arg(0), err)
+	}
 }
@@ -0,0 +1,304 @@
+/*
+Package periodic 按时间周期(日, 周, 月, 总榜)维护并行的排行榜.
+每次写入根据时间戳和时区算出每个周期所在的桶, 写入所有配置的桶. 桶的key为 "{key}:{周期}:{桶名}", 例如
+"rank:daily:20261019", "rank:weekly:2026W42", "rank:monthly:202610", 总榜为 "rank:all".
+周为ISO周, 从周一开始. 桶在周期结束后保留 Retention 的时间, 过期时间通过 topk.Expirer 设置.
+
+	l := periodic.New(topk.NewTopKProvider(cli), periodic.WithLocation(loc))
+	_ = l.AddElement("rank", "user-1", 100, time.Now())
+	_, top := l.GetTopKS("rank", periodic.Weekly, time.Now(), 10)
+*/
+package periodic
+
+import (
+	"errors"
+	"fmt"
+	"pushan/RedTopK/topk"
+	"pushan/RedTopK/util"
+	"sync"
+	"time"
+)
+
+// Period 排行榜的周期
+type Period int
+
+const (
+	Daily Period = iota
+	Weekly
+	Monthly
+	// AllTime 总榜只有一个桶, 不会过期
+	AllTime
+)
+
+func (p Period) String() string {
+	switch p {
+	case Daily:
+		return "daily"
+	case Weekly:
+		return "weekly"
+	case Monthly:
+		return "monthly"
+	case AllTime:
+		return "all"
+	}
+	return fmt.Sprintf("period(%d)", int(p))
+}
+
+const (
+	DefaultDailyRetention   = 7 * 24 * time.Hour
+	DefaultWeeklyRetention  = 28 * 24 * time.Hour
+	DefaultMonthlyRetention = 92 * 24 * time.Hour
+	// DefaultRefreshInterval 同一个桶重复设置过期时间的最小间隔
+	DefaultRefreshInterval = time.Minute
+)
+
+// Option periodic的可选配置
+type Option func(*options)
+
+type options struct {
+	periods   []Period
+	loc       *time.Location
+	retention map[Period]time.Duration
+	refresh   time.Duration
+	logger    util.Logger
+	now       func() time.Time
+}
+
+// WithPeriods 写入的周期, 默认为全部四个周期
+func WithPeriods(periods ...Period) Option {
+	return func(o *options) {
+		if len(periods) > 0 {
+			o.periods = periods
+		}
+	}
+}
+
+// WithLocation 计算桶的时区, 默认为UTC
+func WithLocation(loc *time.Location) Option {
+	return func(o *options) {
+		if loc != nil {
+			o.loc = loc
+		}
+	}
+}
+
+// WithRetention 周期p的桶在周期结束后保留的时间, 对 AllTime 无效
+func WithRetention(p Period, d time.Duration) Option {
+	return func(o *options) {
+		if d >= 0 && p != AllTime {
+			o.retention[p] = d
+		}
+	}
+}
+
+// WithRefreshInterval 同一个桶重复设置过期时间的最小间隔, 默认为 DefaultRefreshInterval
+func WithRefreshInterval(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.refresh = d
+		}
+	}
+}
+
+// WithClock 指定获取当前时间的函数, 用于判断桶是否已经过期, 默认为 time.Now
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		if now != nil {
+			o.now = now
+		}
+	}
+}
+
+// WithLogger 设置过期时间失败时使用的 Logger, 默认不输出日志
+func WithLogger(l util.Logger) Option {
+	return func(o *options) {
+		if l != nil {
+			o.logger = l
+		}
+	}
+}
+
+type Leaderboard struct {
+	tp   topk.TopKProvider
+	ex   topk.Expirer
+	opts options
+
+	mu sync.Mutex
+	// refreshed 每个桶最后一次设置过期时间的时间, 桶过期后删除
+	refreshed map[string]refreshState
+	pruned    time.Time
+}
+
+type refreshState struct {
+	at       time.Time
+	deadline time.Time
+}
+
+/*
+New 返回写入tp的 Leaderboard. 配置了 AllTime 以外的周期时tp需要实现 topk.Expirer.
+*/
+func New(tp topk.TopKProvider, opts ...Option) *Leaderboard {
+	if tp == nil {
+		panic("invalid param: tp")
+	}
+	o := options{
+		periods: []Period{Daily, Weekly, Monthly, AllTime},
+		loc:     time.UTC,
+		retention: map[Period]time.Duration{
+			Daily:   DefaultDailyRetention,
+			Weekly:  DefaultWeeklyRetention,
+			Monthly: DefaultMonthlyRetention,
+		},
+		refresh: DefaultRefreshInterval,
+		logger:  util.NopLogger,
+		now:     time.Now,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	ex, ok := tp.(topk.Expirer)
+	for _, p := range o.periods {
+		if p < Daily || p > AllTime {
+			panic(fmt.Sprintf("invalid param: period %d", int(p)))
+		}
+		if p != AllTime && !ok {
+			panic("invalid param: tp does not implement topk.Expirer")
+		}
+	}
+	return &Leaderboard{
+		tp:        tp,
+		ex:        ex,
+		opts:      o,
+		refreshed: make(map[string]refreshState),
+	}
+}
+
+// Key 返回at所在的周期p的桶的key
+func (l *Leaderboard) Key(key string, p Period, at time.Time) string {
+	t := at.In(l.opts.loc)
+	switch p {
+	case Daily:
+		return key + ":daily:" + t.Format("20060102")
+	case Weekly:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%s:weekly:%04dW%02d", key, year, week)
+	case Monthly:
+		return key + ":monthly:" + t.Format("200601")
+	}
+	return key + ":all"
+}
+
+// End 返回at所在的周期p的结束时间, AllTime 返回零值
+func (l *Leaderboard) End(p Period, at time.Time) time.Time {
+	t := at.In(l.opts.loc)
+	y, m, d := t.Date()
+	switch p {
+	case Daily:
+		return time.Date(y, m, d+1, 0, 0, 0, 0, l.opts.loc)
+	case Weekly:
+		// 周一为0
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(y, m, d-offset+7, 0, 0, 0, 0, l.opts.loc)
+	case Monthly:
+		return time.Date(y, m+1, 1, 0, 0, 0, 0, l.opts.loc)
+	}
+	return time.Time{}
+}
+
+// deadline 返回桶的过期时间, AllTime 返回零值
+func (l *Leaderboard) deadline(p Period, at time.Time) time.Time {
+	if p == AllTime {
+		return time.Time{}
+	}
+	return l.End(p, at).Add(l.opts.retention[p])
+}
+
+/*
+AddElement 把id的score写入at所在的每个周期的桶, 已经过期的桶会被跳过.
+依次写入每个桶, 中途失败时之前的桶已经写入. 设置了容量的桶拒绝写入时继续写入其他桶, 最后返回 topk.ErrRejected.
+*/
+func (l *Leaderboard) AddElement(key string, id string, score float64, at time.Time) error {
+	now := l.opts.now()
+	var rejected error
+	for _, p := range l.opts.periods {
+		deadline := l.deadline(p, at)
+		if !deadline.IsZero() && !deadline.After(now) {
+			continue
+		}
+		bucket := l.Key(key, p, at)
+		err := l.tp.AddElement(bucket, id, score)
+		if errors.Is(err, topk.ErrRejected) {
+			rejected = err
+		} else if err != nil {
+			return err
+		}
+		if !deadline.IsZero() {
+			l.expire(bucket, deadline, now)
+		}
+	}
+	return rejected
+}
+
+// DeleteElement 从at所在的每个周期的桶中删除id, 与 topk.TopKProvider 相同, id不存在时不是错误
+func (l *Leaderboard) DeleteElement(key string, id string, at time.Time) error {
+	for _, p := range l.opts.periods {
+		if err := l.tp.DeleteElement(l.Key(key, p, at), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetTopK 返回at所在的周期p的桶的前k个member
+func (l *Leaderboard) GetTopK(key string, p Period, at time.Time, k int) (error, []string) {
+	err, members := l.tp.GetTopK(l.Key(key, p, at), k)
+	if err != nil {
+		return err, nil
+	}
+	ids := make([]string, len(members))
+	for i := range members {
+		ids[i] = members[i].Id
+	}
+	return nil, ids
+}
+
+// GetTopKS 与 GetTopK 相同, 同时返回score
+func (l *Leaderboard) GetTopKS(key string, p Period, at time.Time, k int) (error, []topk.Element) {
+	return l.tp.GetTopKS(l.Key(key, p, at), k)
+}
+
+/*
+expire 设置桶的过期时间. 分裂出的新shard会继承过期时间, 但桶被清空后再次写入时重新创建的key没有过期时间,
+因此每个桶每隔 RefreshInterval 重新设置一次.
+失败时只记录日志, 下一次写入时重试.
+*/
+func (l *Leaderboard) expire(bucket string, deadline time.Time, now time.Time) {
+	l.mu.Lock()
+	if st, ok := l.refreshed[bucket]; ok && now.Sub(st.at) < l.opts.refresh {
+		l.mu.Unlock()
+		return
+	}
+	l.refreshed[bucket] = refreshState{at: now, deadline: deadline}
+	l.prune(now)
+	l.mu.Unlock()
+
+	if err := l.ex.ExpireAt(bucket, deadline); err != nil {
+		l.opts.logger.Log(util.LevelError, "expire bucket failed", "key", bucket, "err", err)
+		l.mu.Lock()
+		delete(l.refreshed, bucket)
+		l.mu.Unlock()
+	}
+}
+
+// prune 删除已经过期的桶的记录, 每个 RefreshInterval 最多执行一次, 在持有锁的情况下执行
+func (l *Leaderboard) prune(now time.Time) {
+	if now.Sub(l.pruned) < l.opts.refresh {
+		return
+	}
+	l.pruned = now
+	for bucket, st := range l.refreshed {
+		if !st.deadline.After(now) {
+			delete(l.refreshed, bucket)
+		}
+	}
+}
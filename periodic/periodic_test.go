@@ -0,0 +1,222 @@
+package periodic_test
+
+import (
+	"fmt"
+	"pushan/RedTopK/periodic"
+	"pushan/RedTopK/topk"
+	"sync"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// clock 测试中手动推进的时间
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// expireRecorder 记录 ExpireAt 的调用, 不真正删除桶
+type expireRecorder struct {
+	*topk.MemoryTopKProvider
+	mu      sync.Mutex
+	expires map[string][]time.Time
+}
+
+func newExpireRecorder() *expireRecorder {
+	return &expireRecorder{MemoryTopKProvider: topk.NewMemoryProvider(), expires: make(map[string][]time.Time)}
+}
+
+func (r *expireRecorder) ExpireAt(key string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expires[key] = append(r.expires[key], at)
+	return nil
+}
+
+func (r *expireRecorder) calls(key string) []time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.expires[key]
+}
+
+func location(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestKey(t *testing.T) {
+	shanghai := location(t, "Asia/Shanghai")
+	la := location(t, "America/Los_Angeles")
+	cases := []struct {
+		loc                    *time.Location
+		at                     string
+		daily, weekly, monthly string
+	}{
+		{time.UTC, "2026-10-18T23:30:00Z", "rank:daily:20261018", "rank:weekly:2026W42", "rank:monthly:202610"},
+		// 同一时刻在东八区已经是周一
+		{shanghai, "2026-10-18T23:30:00Z", "rank:daily:20261019", "rank:weekly:2026W43", "rank:monthly:202610"},
+		{shanghai, "2026-10-31T16:00:00Z", "rank:daily:20261101", "rank:weekly:2026W44", "rank:monthly:202611"},
+		{shanghai, "2026-10-31T15:59:59Z", "rank:daily:20261031", "rank:weekly:2026W44", "rank:monthly:202610"},
+		// ISO周属于周四所在的年
+		{time.UTC, "2027-01-01T12:00:00Z", "rank:daily:20270101", "rank:weekly:2026W53", "rank:monthly:202701"},
+		{time.UTC, "2025-12-29T12:00:00Z", "rank:daily:20251229", "rank:weekly:2026W01", "rank:monthly:202512"},
+		{la, "2026-01-01T05:00:00Z", "rank:daily:20251231", "rank:weekly:2026W01", "rank:monthly:202512"},
+	}
+	for _, c := range cases {
+		l := periodic.New(topk.NewMemoryProvider(), periodic.WithLocation(c.loc))
+		at, err := time.Parse(time.RFC3339, c.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{l.Key("rank", periodic.Daily, at), l.Key("rank", periodic.Weekly, at), l.Key("rank", periodic.Monthly, at)}
+		if fmt.Sprint(got) != fmt.Sprint([]string{c.daily, c.weekly, c.monthly}) {
+			t.Errorf("%s in %s: %q", c.at, c.loc, got)
+		}
+		if got := l.Key("rank", periodic.AllTime, at); got != "rank:all" {
+			t.Errorf("all time key %q", got)
+		}
+	}
+}
+
+// TestEndDST 周期的结束时间按当地日历计算, 夏令时切换的那一天为23或25小时
+func TestEndDST(t *testing.T) {
+	ny := location(t, "America/New_York")
+	l := periodic.New(topk.NewMemoryProvider(), periodic.WithLocation(ny))
+	cases := []struct {
+		p      periodic.Period
+		at     time.Time
+		start  time.Time
+		end    time.Time
+		length time.Duration
+	}{
+		{periodic.Daily, time.Date(2026, 3, 8, 12, 0, 0, 0, ny), time.Date(2026, 3, 8, 0, 0, 0, 0, ny), time.Date(2026, 3, 9, 0, 0, 0, 0, ny), 23 * time.Hour},
+		{periodic.Daily, time.Date(2026, 11, 1, 12, 0, 0, 0, ny), time.Date(2026, 11, 1, 0, 0, 0, 0, ny), time.Date(2026, 11, 2, 0, 0, 0, 0, ny), 25 * time.Hour},
+		// 周日是一周的最后一天
+		{periodic.Weekly, time.Date(2026, 3, 8, 23, 59, 0, 0, ny), time.Date(2026, 3, 2, 0, 0, 0, 0, ny), time.Date(2026, 3, 9, 0, 0, 0, 0, ny), 7*24*time.Hour - time.Hour},
+		{periodic.Weekly, time.Date(2026, 10, 26, 0, 0, 0, 0, ny), time.Date(2026, 10, 26, 0, 0, 0, 0, ny), time.Date(2026, 11, 2, 0, 0, 0, 0, ny), 7*24*time.Hour + time.Hour},
+		{periodic.Monthly, time.Date(2026, 3, 31, 23, 0, 0, 0, ny), time.Date(2026, 3, 1, 0, 0, 0, 0, ny), time.Date(2026, 4, 1, 0, 0, 0, 0, ny), 31*24*time.Hour - time.Hour},
+	}
+	for _, c := range cases {
+		end := l.End(c.p, c.at)
+		if !end.Equal(c.end) {
+			t.Errorf("%s end of %v: %v, want %v", c.p, c.at, end, c.end)
+		}
+		if d := end.Sub(c.start); d != c.length {
+			t.Errorf("%s of %v lasts %v, want %v", c.p, c.at, d, c.length)
+		}
+		// 上一个周期在 start 结束
+		if prev := l.End(c.p, c.start.Add(-time.Nanosecond)); !prev.Equal(c.start) {
+			t.Errorf("%s before %v ends at %v", c.p, c.start, prev)
+		}
+	}
+	if end := l.End(periodic.AllTime, time.Now()); !end.IsZero() {
+		t.Errorf("all time end %v", end)
+	}
+}
+
+// TestExpiredBuckets 已经过期的桶不再写入, 其他桶的过期时间为周期结束加上保留时间
+func TestExpiredBuckets(t *testing.T) {
+	c := &clock{now: time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)}
+	tp := newExpireRecorder()
+	l := periodic.New(tp, periodic.WithClock(c.Now),
+		periodic.WithRetention(periodic.Daily, 0),
+		periodic.WithRetention(periodic.Weekly, 24*time.Hour),
+		periodic.WithRetention(periodic.Monthly, 0))
+	// 上周日, 日榜已经过期, 周榜还在保留期内
+	at := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	if err := l.AddElement("rank", "a", 1, at); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []periodic.Period{periodic.Daily, periodic.Weekly, periodic.Monthly, periodic.AllTime} {
+		err, top := l.GetTopKS("rank", p, at, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := p != periodic.Daily; (len(top) == 1) != want {
+			t.Errorf("%s bucket: %v", p, top)
+		}
+	}
+	expect := map[string][]time.Time{
+		"rank:daily:20261018": nil,
+		"rank:weekly:2026W42": {time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)},
+		"rank:monthly:202610": {time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+		"rank:all":            nil,
+	}
+	for key, want := range expect {
+		if got := tp.calls(key); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("expire %s: %v, want %v", key, got, want)
+		}
+	}
+
+	// 周榜在保留期结束后也不再写入
+	c.advance(14 * time.Hour)
+	if err := l.AddElement("rank", "b", 2, at); err != nil {
+		t.Fatal(err)
+	}
+	if err, top := l.GetTopKS("rank", periodic.Weekly, at, 10); err != nil || len(top) != 1 {
+		t.Fatalf("expired weekly bucket written: %v %v", err, top)
+	}
+	if err, top := l.GetTopKS("rank", periodic.AllTime, at, 10); err != nil || len(top) != 2 {
+		t.Fatalf("all time bucket: %v %v", err, top)
+	}
+}
+
+// TestRefreshInterval 同一个桶每个 RefreshInterval 最多设置一次过期时间
+func TestRefreshInterval(t *testing.T) {
+	c := &clock{now: time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)}
+	tp := newExpireRecorder()
+	l := periodic.New(tp, periodic.WithClock(c.Now), periodic.WithPeriods(periodic.Daily), periodic.WithRefreshInterval(time.Minute))
+	add := func(id string) {
+		t.Helper()
+		if err := l.AddElement("rank", id, 1, c.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("a")
+	c.advance(30 * time.Second)
+	add("b")
+	if n := len(tp.calls("rank:daily:20261019")); n != 1 {
+		t.Fatalf("expire called %d times within the refresh interval", n)
+	}
+	c.advance(30 * time.Second)
+	add("c")
+	if n := len(tp.calls("rank:daily:20261019")); n != 2 {
+		t.Fatalf("expire called %d times after the refresh interval", n)
+	}
+}
+
+// TestDeleteElement 从所有周期的桶中删除, 不存在时不是错误
+func TestDeleteElement(t *testing.T) {
+	c := &clock{now: time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)}
+	l := periodic.New(newExpireRecorder(), periodic.WithClock(c.Now))
+	if err := l.AddElement("rank", "a", 1, c.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := l.DeleteElement("rank", "a", c.Now()); err != nil {
+			t.Fatalf("delete #%d: %v", i, err)
+		}
+	}
+	for _, p := range []periodic.Period{periodic.Daily, periodic.Weekly, periodic.Monthly, periodic.AllTime} {
+		if err, top := l.GetTopK("rank", p, c.Now(), 10); err != nil || len(top) != 0 {
+			t.Errorf("%s after delete: %v %v", p, err, top)
+		}
+	}
+}
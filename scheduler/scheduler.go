@@ -0,0 +1,354 @@
+/*
+Package scheduler 基于分片 TopKProvider 的延迟任务调度, score为任务的到期时间(毫秒时间戳).
+pending 保存等待到期的任务, 使用分片provider避免单个大zset成为热点;
+processing 保存已经被领取的任务, score为可见性超时的截止时间.
+领取通过 topk.Mover 把到期的任务原子地移动到 processing, 多个poller不会领取到同一个任务.
+超时没有确认的任务会被移回 pending 重试, 因此任务至少执行一次, handler需要是幂等的.
+确认通过 topk.ConditionalDeleter 只删除截止时间相同的领取记录, 超时后被重新领取的任务不会被之前的领取者确认.
+attempts 记录每个任务被领取的次数, 设置 WithMaxAttempts 后超过次数的任务在领取时移入 dead, 不再重试.
+
+	s := scheduler.New(topk.NewTopKProvider(cli), "jobs", scheduler.WithVisibilityTimeout(time.Minute))
+	_ = s.Schedule("job-1", time.Now().Add(time.Hour))
+	_ = s.Run(ctx, func(ctx context.Context, job scheduler.Job) error { ... })
+*/
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"pushan/RedTopK/topk"
+	"pushan/RedTopK/util"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultVisibilityTimeout = 30 * time.Second
+	DefaultBatch             = 100
+	DefaultPollInterval      = time.Second
+)
+
+// Job 一个被领取的任务, Due 为任务的到期时间, 重试的任务为重新入队的时间
+type Job struct {
+	Id  string
+	Due time.Time
+	// Deadline 领取记录的可见性截止时间, Ack 和 Nack 只处理截止时间相同的记录, Requeue 返回的任务为零值
+	Deadline time.Time
+	// Attempt 第几次被领取, 从1开始, 只有 Claim 返回的任务有值
+	Attempt int
+}
+
+// Handler 处理任务, 返回错误时任务在 RetryDelay 之后重试
+type Handler func(ctx context.Context, job Job) error
+
+// Option scheduler的可选配置
+type Option func(*options)
+
+type options struct {
+	visibility  time.Duration
+	retryDelay  time.Duration
+	batch       int
+	interval    time.Duration
+	maxAttempts int
+	logger      util.Logger
+	now         func() time.Time
+}
+
+// WithVisibilityTimeout 领取后超过该时间没有确认的任务会重试, 默认为 DefaultVisibilityTimeout
+func WithVisibilityTimeout(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.visibility = d
+		}
+	}
+}
+
+// WithRetryDelay handler失败或者超时的任务重新入队时的延迟, 默认立即重试
+func WithRetryDelay(d time.Duration) Option {
+	return func(o *options) {
+		if d >= 0 {
+			o.retryDelay = d
+		}
+	}
+}
+
+// WithBatch Run 每次 Requeue 的最大任务数, 默认为 DefaultBatch. Run 每次只领取一个任务, 每个任务都有完整的可见性超时
+func WithBatch(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.batch = n
+		}
+	}
+}
+
+// WithPollInterval 没有到期任务时 Run 的轮询间隔, 默认为 DefaultPollInterval
+func WithPollInterval(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.interval = d
+		}
+	}
+}
+
+// WithMaxAttempts 任务最多被领取n次, 第n+1次领取时移入死信, 可以用 Dead 查看. 默认为0, 不限制次数
+func WithMaxAttempts(n int) Option {
+	return func(o *options) {
+		if n >= 0 {
+			o.maxAttempts = n
+		}
+	}
+}
+
+// WithClock 指定获取当前时间的函数, 默认为 time.Now, 用于测试
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		if now != nil {
+			o.now = now
+		}
+	}
+}
+
+// WithLogger 指定 Run 使用的 Logger, 默认不输出日志
+func WithLogger(l util.Logger) Option {
+	return func(o *options) {
+		if l != nil {
+			o.logger = l
+		}
+	}
+}
+
+type Scheduler struct {
+	tp         topk.TopKProvider
+	mv         topk.Mover
+	cd         topk.ConditionalDeleter
+	inc        topk.Incrementer
+	pending    string
+	processing string
+	attempts   string
+	dead       string
+	opts       options
+}
+
+/*
+New 返回名为name的调度器, tp需要实现 topk.Mover, topk.ConditionalDeleter 和 topk.Incrementer.
+pending, processing, attempts 和 dead 的key为 "{name}:pending" 等, 在集群模式下位于同一个slot.
+attempts 的score为领取次数, dead 的score为移入死信的时间.
+*/
+func New(tp topk.TopKProvider, name string, opts ...Option) *Scheduler {
+	if tp == nil {
+		panic("invalid param: tp")
+	}
+	mv, ok := tp.(topk.Mover)
+	if !ok {
+		panic("invalid param: tp does not implement topk.Mover")
+	}
+	cd, ok := tp.(topk.ConditionalDeleter)
+	if !ok {
+		panic("invalid param: tp does not implement topk.ConditionalDeleter")
+	}
+	inc, ok := tp.(topk.Incrementer)
+	if !ok {
+		panic("invalid param: tp does not implement topk.Incrementer")
+	}
+	o := options{
+		visibility: DefaultVisibilityTimeout,
+		batch:      DefaultBatch,
+		interval:   DefaultPollInterval,
+		logger:     util.NopLogger,
+		now:        time.Now,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Scheduler{
+		tp:         tp,
+		mv:         mv,
+		cd:         cd,
+		inc:        inc,
+		pending:    "{" + name + "}:pending",
+		processing: "{" + name + "}:processing",
+		attempts:   "{" + name + "}:attempts",
+		dead:       "{" + name + "}:dead",
+		opts:       o,
+	}
+}
+
+func toScore(t time.Time) float64 {
+	return float64(t.UnixNano() / int64(time.Millisecond))
+}
+
+func fromScore(score float64) time.Time {
+	ms := int64(score)
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func toJobs(members []topk.Element, deadline time.Time) []Job {
+	jobs := make([]Job, len(members))
+	for i := range members {
+		jobs[i] = Job{Id: members[i].Id, Due: fromScore(members[i].Score), Deadline: deadline}
+	}
+	return jobs
+}
+
+// Schedule 在at到期时执行job, job已经存在时更新到期时间, 已经在死信中时重新调度
+func (s *Scheduler) Schedule(job string, at time.Time) error {
+	if err := s.tp.AddElement(s.pending, job, toScore(at)); err != nil {
+		return err
+	}
+	if s.opts.maxAttempts > 0 {
+		return s.tp.DeleteElement(s.dead, job)
+	}
+	return nil
+}
+
+/*
+Cancel 取消等待中, 已经被领取或者在死信中的job, 并清除领取次数, job不存在时不是错误.
+按 pending, processing, pending 的顺序删除, 避免与 Requeue 的移动错过.
+*/
+func (s *Scheduler) Cancel(job string) error {
+	for _, key := range []string{s.pending, s.processing, s.pending, s.dead, s.attempts} {
+		if err := s.tp.DeleteElement(key, job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Claim 领取最多n个到期的任务, 同一批任务的截止时间相同, 需要在截止时间之前全部 Ack, 否则会被 Requeue 移回 pending.
+处理时间较长时应该减小n. 超过 MaxAttempts 的任务移入死信, 不会返回, 因此返回的任务可能少于n个.
+记录领取次数失败时返回错误, 已经移入 processing 的任务在可见性超时后重试.
+*/
+func (s *Scheduler) Claim(n int) (error, []Job) {
+	now := s.opts.now()
+	deadline := fromScore(toScore(now.Add(s.opts.visibility)))
+	err, members := s.mv.MoveTopUntil(s.pending, s.processing, formatMs(now), n, toScore(deadline))
+	if err != nil {
+		return err, nil
+	}
+	jobs := make([]Job, 0, len(members))
+	for _, job := range toJobs(members, deadline) {
+		err, attempt := s.inc.IncrElement(s.attempts, job.Id, 1)
+		if err != nil {
+			return err, nil
+		}
+		job.Attempt = int(attempt)
+		if s.opts.maxAttempts > 0 && job.Attempt > s.opts.maxAttempts {
+			if err := s.bury(job, now); err != nil {
+				return err, nil
+			}
+			s.opts.logger.Log(util.LevelWarn, "job exceeded max attempts, moved to dead letter", "key", s.dead, "job", job.Id, "attempts", job.Attempt-1)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return nil, jobs
+}
+
+// bury 把领取的job移入死信. 先加入死信再删除领取记录, 中途失败时job在可见性超时后重新领取, 再次移入死信
+func (s *Scheduler) bury(job Job, now time.Time) error {
+	if err := s.tp.AddElement(s.dead, job.Id, toScore(now)); err != nil {
+		return err
+	}
+	err := s.cd.DeleteElementIf(s.processing, job.Id, toScore(job.Deadline))
+	if err != nil && !errors.Is(err, topk.ErrNotFound) {
+		return err
+	}
+	return s.tp.DeleteElement(s.attempts, job.Id)
+}
+
+// Dead 返回最早移入死信的最多n个任务, Due 为移入死信的时间. Schedule 或 Cancel 会把任务移出死信
+func (s *Scheduler) Dead(n int) (error, []Job) {
+	err, members := s.tp.GetTopKS(s.dead, n)
+	if err != nil {
+		return err, nil
+	}
+	return nil, toJobs(members, time.Time{})
+}
+
+/*
+Ack 确认job已经完成并清除领取次数.
+job超时后已经被移回 pending 或者被重新领取时返回 topk.ErrNotFound, 不影响新的领取记录.
+*/
+func (s *Scheduler) Ack(job Job) error {
+	if err := s.cd.DeleteElementIf(s.processing, job.Id, toScore(job.Deadline)); err != nil {
+		return err
+	}
+	return s.tp.DeleteElement(s.attempts, job.Id)
+}
+
+/*
+Nack 把领取的job在 RetryDelay 之后重新放回 pending. 先入队再删除, 中途失败时job可能执行两次.
+job超时后被重新领取时, 新的领取记录仍然保留.
+*/
+func (s *Scheduler) Nack(job Job) error {
+	if err := s.tp.AddElement(s.pending, job.Id, toScore(s.opts.now().Add(s.opts.retryDelay))); err != nil {
+		return err
+	}
+	err := s.cd.DeleteElementIf(s.processing, job.Id, toScore(job.Deadline))
+	if err != nil && !errors.Is(err, topk.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// Requeue 把最多n个可见性超时的任务移回 pending, 返回这些任务和超时的时间
+func (s *Scheduler) Requeue(n int) (error, []Job) {
+	now := s.opts.now()
+	err, members := s.mv.MoveTopUntil(s.processing, s.pending, formatMs(now), n, toScore(now.Add(s.opts.retryDelay)))
+	if err != nil {
+		return err, nil
+	}
+	return nil, toJobs(members, time.Time{})
+}
+
+func formatMs(t time.Time) string {
+	return strconv.FormatFloat(toScore(t), 'f', -1, 64)
+}
+
+/*
+Run 循环执行 Requeue 和 Claim, 调用h处理领取的任务, 成功时 Ack, 失败时 Nack, 直到ctx结束.
+每次只领取一个任务, 前面的任务处理较慢时, 后面的任务不会在等待期间超时被重新领取.
+没有到期任务时等待 PollInterval. 多个进程或goroutine可以同时 Run.
+redis错误只记录日志并在下一个周期重试, 返回值为ctx的错误.
+*/
+func (s *Scheduler) Run(ctx context.Context, h Handler) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err, _ := s.Requeue(s.opts.batch); err != nil {
+			s.opts.logger.Log(util.LevelError, "requeue failed", "key", s.processing, "err", err)
+		}
+		err, jobs := s.Claim(1)
+		if err != nil {
+			s.opts.logger.Log(util.LevelError, "claim failed", "key", s.pending, "err", err)
+		}
+		if len(jobs) > 0 {
+			s.handle(ctx, h, jobs[0])
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.opts.interval):
+		}
+	}
+}
+
+func (s *Scheduler) handle(ctx context.Context, h Handler, job Job) {
+	if err := h(ctx, job); err != nil {
+		s.opts.logger.Log(util.LevelWarn, "job failed, retry later", "key", s.pending, "job", job.Id, "err", err)
+		if err := s.Nack(job); err != nil {
+			s.opts.logger.Log(util.LevelError, "nack failed", "key", s.pending, "job", job.Id, "err", err)
+		}
+		return
+	}
+	if err := s.Ack(job); err != nil {
+		if errors.Is(err, topk.ErrNotFound) {
+			s.opts.logger.Log(util.LevelWarn, "job timed out before ack", "key", s.processing, "job", job.Id)
+			return
+		}
+		s.opts.logger.Log(util.LevelError, "ack failed", "key", s.processing, "job", job.Id, "err", err)
+	}
+}
@@ -0,0 +1,282 @@
+package scheduler_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pushan/RedTopK/scheduler"
+	"pushan/RedTopK/topk"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clock 测试中手动推进的时间
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func newScheduler(opts ...scheduler.Option) (*scheduler.Scheduler, *clock) {
+	c := &clock{now: time.Unix(1700000000, 0)}
+	opts = append([]scheduler.Option{scheduler.WithClock(c.Now)}, opts...)
+	return scheduler.New(topk.NewMemoryProvider(), "jobs", opts...), c
+}
+
+func claim(t *testing.T, s *scheduler.Scheduler, n int) []scheduler.Job {
+	t.Helper()
+	err, jobs := s.Claim(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+func ids(jobs []scheduler.Job) string {
+	ans := make([]string, len(jobs))
+	for i := range jobs {
+		ans[i] = fmt.Sprintf("%s#%d", jobs[i].Id, jobs[i].Attempt)
+	}
+	return fmt.Sprint(ans)
+}
+
+func TestClaimAck(t *testing.T) {
+	s, c := newScheduler(scheduler.WithVisibilityTimeout(10 * time.Second))
+	if err := s.Schedule("a", c.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Schedule("b", c.Now().Add(2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if jobs := claim(t, s, 10); len(jobs) != 0 {
+		t.Fatalf("claimed jobs before due: %s", ids(jobs))
+	}
+	c.advance(time.Second)
+	jobs := claim(t, s, 10)
+	if ids(jobs) != "[a#1]" {
+		t.Fatalf("claim: %s", ids(jobs))
+	}
+	if want := c.Now().Add(10 * time.Second); !jobs[0].Deadline.Equal(want) {
+		t.Fatalf("deadline %v, want %v", jobs[0].Deadline, want)
+	}
+	if !jobs[0].Due.Equal(c.Now()) {
+		t.Fatalf("due %v, want %v", jobs[0].Due, c.Now())
+	}
+	if err := s.Ack(jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ack(jobs[0]); !errors.Is(err, topk.ErrNotFound) {
+		t.Fatalf("second ack: %v", err)
+	}
+	c.advance(time.Second)
+	if jobs := claim(t, s, 10); ids(jobs) != "[b#1]" {
+		t.Fatalf("claim: %s", ids(jobs))
+	}
+}
+
+// TestScheduleAgain 重新调度更新到期时间, 确认之后领取次数重新计算
+func TestScheduleAgain(t *testing.T) {
+	s, c := newScheduler()
+	if err := s.Schedule("a", c.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Schedule("a", c.Now()); err != nil {
+		t.Fatal(err)
+	}
+	jobs := claim(t, s, 10)
+	if ids(jobs) != "[a#1]" {
+		t.Fatalf("claim: %s", ids(jobs))
+	}
+	if err := s.Ack(jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Schedule("a", c.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if jobs := claim(t, s, 10); ids(jobs) != "[a#1]" {
+		t.Fatalf("claim after ack: %s", ids(jobs))
+	}
+}
+
+func TestNack(t *testing.T) {
+	s, c := newScheduler(scheduler.WithRetryDelay(5 * time.Second))
+	if err := s.Schedule("a", c.Now()); err != nil {
+		t.Fatal(err)
+	}
+	jobs := claim(t, s, 10)
+	if err := s.Nack(jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ack(jobs[0]); !errors.Is(err, topk.ErrNotFound) {
+		t.Fatalf("ack after nack: %v", err)
+	}
+	c.advance(4 * time.Second)
+	if jobs := claim(t, s, 10); len(jobs) != 0 {
+		t.Fatalf("claimed before retry delay: %s", ids(jobs))
+	}
+	c.advance(time.Second)
+	if jobs := claim(t, s, 10); ids(jobs) != "[a#2]" {
+		t.Fatalf("claim after retry delay: %s", ids(jobs))
+	}
+}
+
+// TestRequeueAfterDeadline 超时的任务移回 pending, 之前的领取者不能再确认
+func TestRequeueAfterDeadline(t *testing.T) {
+	s, c := newScheduler(scheduler.WithVisibilityTimeout(10 * time.Second))
+	for _, id := range []string{"a", "b"} {
+		if err := s.Schedule(id, c.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := claim(t, s, 10)
+	if ids(old) != "[a#1 b#1]" {
+		t.Fatalf("claim: %s", ids(old))
+	}
+	if err := s.Ack(old[1]); err != nil {
+		t.Fatal(err)
+	}
+	c.advance(9 * time.Second)
+	if err, jobs := s.Requeue(10); err != nil || len(jobs) != 0 {
+		t.Fatalf("requeue before deadline: %v %s", err, ids(jobs))
+	}
+	c.advance(time.Second)
+	err, jobs := s.Requeue(10)
+	if err != nil || len(jobs) != 1 || jobs[0].Id != "a" {
+		t.Fatalf("requeue after deadline: %v %s", err, ids(jobs))
+	}
+	if err := s.Ack(old[0]); !errors.Is(err, topk.ErrNotFound) {
+		t.Fatalf("ack after requeue: %v", err)
+	}
+	jobs = claim(t, s, 10)
+	if ids(jobs) != "[a#2]" {
+		t.Fatalf("claim after requeue: %s", ids(jobs))
+	}
+	if err := s.Ack(jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMaxAttempts 超过次数的任务在领取时移入死信, 重新调度后移出死信
+func TestMaxAttempts(t *testing.T) {
+	s, c := newScheduler(scheduler.WithMaxAttempts(2), scheduler.WithVisibilityTimeout(10*time.Second))
+	if err := s.Schedule("a", c.Now()); err != nil {
+		t.Fatal(err)
+	}
+	jobs := claim(t, s, 10)
+	if err := s.Nack(jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	// 第二次超时而不是失败, 同样计入次数
+	if jobs := claim(t, s, 10); ids(jobs) != "[a#2]" {
+		t.Fatalf("second claim: %s", ids(jobs))
+	}
+	c.advance(10 * time.Second)
+	if err, _ := s.Requeue(10); err != nil {
+		t.Fatal(err)
+	}
+	if jobs := claim(t, s, 10); len(jobs) != 0 {
+		t.Fatalf("claimed a job over max attempts: %s", ids(jobs))
+	}
+	err, dead := s.Dead(10)
+	if err != nil || len(dead) != 1 || dead[0].Id != "a" || !dead[0].Due.Equal(c.Now()) {
+		t.Fatalf("dead: %v %v", err, dead)
+	}
+	if err, _ := s.Requeue(10); err != nil {
+		t.Fatal(err)
+	}
+	c.advance(time.Minute)
+	if jobs := claim(t, s, 10); len(jobs) != 0 {
+		t.Fatalf("dead job claimed again: %s", ids(jobs))
+	}
+
+	if err := s.Schedule("a", c.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err, dead := s.Dead(10); err != nil || len(dead) != 0 {
+		t.Fatalf("dead after schedule: %v %v", err, dead)
+	}
+	if jobs := claim(t, s, 10); ids(jobs) != "[a#1]" {
+		t.Fatalf("claim after schedule: %s", ids(jobs))
+	}
+}
+
+func TestCancel(t *testing.T) {
+	s, c := newScheduler()
+	for _, id := range []string{"a", "b"} {
+		if err := s.Schedule(id, c.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jobs := claim(t, s, 1)
+	if ids(jobs) != "[a#1]" {
+		t.Fatalf("claim: %s", ids(jobs))
+	}
+	for _, id := range []string{"a", "b", "b", "missing"} {
+		if err := s.Cancel(id); err != nil {
+			t.Fatalf("cancel %s: %v", id, err)
+		}
+	}
+	if err := s.Ack(jobs[0]); !errors.Is(err, topk.ErrNotFound) {
+		t.Fatalf("ack after cancel: %v", err)
+	}
+	if jobs := claim(t, s, 10); len(jobs) != 0 {
+		t.Fatalf("claimed canceled jobs: %s", ids(jobs))
+	}
+}
+
+// TestRun 成功的任务被确认, 一直失败的任务在 MaxAttempts 次之后进入死信
+func TestRun(t *testing.T) {
+	s, c := newScheduler(scheduler.WithMaxAttempts(3), scheduler.WithPollInterval(time.Millisecond))
+	for _, id := range []string{"a", "b", "c"} {
+		if err := s.Schedule(id, c.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		for ctx.Err() == nil {
+			mu.Lock()
+			handled := calls["a"] > 0 && calls["c"] > 0
+			mu.Unlock()
+			if err, dead := s.Dead(10); err == nil && len(dead) > 0 && handled {
+				cancel()
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	err := s.Run(ctx, func(ctx context.Context, job scheduler.Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[job.Id]++
+		if job.Id == "b" {
+			return errors.New("poison")
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("run: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(calls) != "map[a:1 b:3 c:1]" {
+		t.Fatalf("calls: %v", calls)
+	}
+	if err, dead := s.Dead(10); err != nil || len(dead) != 1 || dead[0].Id != "b" {
+		t.Fatalf("dead: %v %v", err, dead)
+	}
+}
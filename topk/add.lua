@@ -32,6 +32,19 @@ local function getNewTargetKey(metaZSetCounterKey)
     return metaKey .. ":data_shard:" .. cnt
 end
 
+-- 新建的key继承meta的剩余过期时间, 使 ExpireAt 之后分裂出的shard和新的 m_to_z 也会过期
+local function inheritTTL(metaKey, ...)
+  local ttl = redis.call("pttl", metaKey)
+  if ttl <= 0 then
+    return
+  end
+  for _, key in ipairs({...}) do
+    if redis.call("pttl", key) == -1 then
+      redis.call("pexpire", key, ttl)
+    end
+  end
+end
+
 local function getMaximiumScore(zSetKey)
   local maxMember = redis.call("zrevrangebyscore", zSetKey, "inf", "-inf", "withscores", "limit", 0, 1)
   return maxMember[2]
@@ -51,11 +64,14 @@ local function splitShard(metaKey, targetKey, shardLimit)
         local maxScore = getMaximiumScore(targetKey)
         local maxMemberScores = redis.call("zrangebyscore", targetKey, maxScore, maxScore, "withscores")
         local splitKey = ""
+        -- 2: 分裂出新的shard, 3: 并入下一个shard
+        local splitRes = 2
         local nextZsets = redis.call("zrangebyscore", metaKey, "("..maxScore, "inf", "limit", 0, 1)
         if #nextZsets > 0 then
           local nextShardCounter = redis.call("zcard", nextZsets[1])
           if nextShardCounter + #maxMemberScores / 2 <= shardLimit then
             splitKey = nextZsets[1]
+            splitRes = 3
           else
             splitKey = getNewTargetKey(metaZSetCounterKey)
           end
@@ -76,6 +92,7 @@ local function splitShard(metaKey, targetKey, shardLimit)
           local memberZSetKey = metaKey .. ":m_to_z:" .. (hashCodeOfMember % hashShardTotal)
           redis.call("hset", memberZSetKey, member, splitKey)
         end
+        inheritTTL(metaKey, splitKey)
         
         
         if shardCounter <= 0 then
@@ -84,6 +101,7 @@ local function splitShard(metaKey, targetKey, shardLimit)
           maxScore = getMaximiumScore(targetKey)
           metaAddRes = redis.call("zadd", metaKey, maxScore, targetKey)
         end
+        return splitRes
 end
 
 local function DelMember(metaKey, member, memberZsetKey)
@@ -101,7 +119,7 @@ end
 
 local function RemoveIfExists(metaKey, member)
   if member == "" then
-    return
+    return 0
   end
   
   local hashCodeOfMember = JSHash(member)
@@ -110,14 +128,19 @@ local function RemoveIfExists(metaKey, member)
   if targetZsetKey ~= false then
     DelMember(metaKey, member, targetZsetKey)
     local delMemberRes = redis.call("hdel", memberToZsetKey, member)
+    return 1
   end
+  -- 不存在返回0, 而不是nil
+  return 0
 end
 
 
 local function AddMember(metaKey, score, member,  shardLimit)
     if member == "" then
-      return
+      return redis.error_reply("ERR empty member")
     end
+    -- 已存在的member先删除, 否则会在另一个shard中留下旧的score
+    RemoveIfExists(metaKey, member)
     local hashCodeOfMember = JSHash(member)
     local memberToZsetKey = metaKey .. ":m_to_z:" .. (hashCodeOfMember % hashShardTotal)
     local metaZSetCounterKey = metaKey .. ":shard_cnt"
@@ -138,9 +161,10 @@ local function AddMember(metaKey, score, member,  shardLimit)
     local addRes = redis.call("zadd", targetKey, score, member)
     -- 添加到hash
     redis.call("hset", memberToZsetKey, member, targetKey)
+    inheritTTL(metaKey, targetKey, memberToZsetKey)
     local shardCounter = redis.call("zcard", targetKey)
     if shardCounter > shardLimit then
-      splitShard(metaKey, targetKey, shardLimit)
+      return splitShard(metaKey, targetKey, shardLimit)
         -- TODO. 移除一部分非最大值数据到新的set
     else
       local maxScore = getMaximiumScore(targetKey)
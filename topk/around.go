@@ -0,0 +1,250 @@
+package topk
+
+import (
+	"fmt"
+	"pushan/RedTopK/util"
+	"strconv"
+	"strings"
+)
+
+// RankedElement 带排名的元素, Rank 从0开始, 与 ZRANK 相同
+type RankedElement struct {
+	Id    string
+	Score float64
+	Rank  int64
+}
+
+// AroundQuerier 可以查询某个member附近元素的provider
+type AroundQuerier interface {
+	// GetAround 按排名升序返回id之前的before个, id自身, 以及之后的after个元素, id不存在时返回 ErrNotFound
+	// 排名靠前或靠后时实际返回的个数会少于窗口大小
+	GetAround(key string, id string, before, after int) (error, []RankedElement)
+}
+
+func ranked(first int64, members []Element) []RankedElement {
+	ans := make([]RankedElement, len(members))
+	for i := range members {
+		ans[i] = RankedElement{Id: members[i].Id, Score: members[i].Score, Rank: first + int64(i)}
+	}
+	return ans
+}
+
+// window before 和 after 小于0时按0处理
+func window(before, after int) (int, int) {
+	if before < 0 {
+		before = 0
+	}
+	if after < 0 {
+		after = 0
+	}
+	return before, after
+}
+
+/*
+layoutAround 读取shard中id前后的member, 窗口跨过shard边界时继续读取meta中相邻的shard.
+id的排名为之前所有shard的member数加上id在shard中的排名. lua 和 lock provider 的布局相同.
+*/
+func layoutAround(b Backend, metaKey, shard, id string, before, after int) ([]RankedElement, error) {
+	shards, err := b.ZRangeByScore(metaKey, RangeBy{Min: "-inf", Max: "+inf"})
+	if err != nil {
+		return nil, err
+	}
+	pos := -1
+	for i := range shards {
+		if shards[i] == shard {
+			pos = i
+			break
+		}
+	}
+	r, ok, err := b.ZRank(shard, id)
+	if err != nil {
+		return nil, err
+	}
+	if pos < 0 || !ok {
+		return nil, fmt.Errorf("%w: member %s points to %s", ErrCorruptLayout, id, shard)
+	}
+	pl := b.Pipeline()
+	cards := make([]*IntReply, pos)
+	for i := 0; i < pos; i++ {
+		cards[i] = pl.ZCard(shards[i])
+	}
+	if pos > 0 {
+		if err := pl.Exec(); err != nil {
+			return nil, err
+		}
+	}
+	base := int64(0)
+	for i := range cards {
+		base += cards[i].Val
+	}
+
+	var head []Element
+	need := int64(before)
+	for i := pos; i >= 0 && need > 0; i-- {
+		var members []Element
+		if i == pos {
+			if r > 0 {
+				start := r - need
+				if start < 0 {
+					start = 0
+				}
+				members, err = b.ZRangeWithScores(shard, start, r-1)
+			}
+		} else {
+			members, err = b.ZRangeWithScores(shards[i], -need, -1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		need -= int64(len(members))
+		head = append(members, head...)
+	}
+	self, err := b.ZRangeWithScores(shard, r, r)
+	if err != nil {
+		return nil, err
+	}
+	ans := append(head, self...)
+	need = int64(after)
+	for i := pos; i < len(shards) && need > 0; i++ {
+		var members []Element
+		if i == pos {
+			members, err = b.ZRangeWithScores(shard, r+1, r+need)
+		} else {
+			members, err = b.ZRangeWithScores(shards[i], 0, need-1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		need -= int64(len(members))
+		ans = append(ans, members...)
+	}
+	return ranked(base+r-int64(len(head)), ans), nil
+}
+
+func (z ZSetTopKProvider) GetAround(key string, id string, before, after int) (err error, ans []RankedElement) {
+	_, end := z.opts.begin(ProviderZSet, OpAround, "key", key, "member", id)
+	defer end(&err)
+	if err := z.opts.validateId(key, id); err != nil {
+		return err, nil
+	}
+	before, after = window(before, after)
+	r, ok, err := z.b.ZRank(key, id)
+	if err != nil {
+		z.opts.logError("get around failed", err, key, id, key)
+		return util.Wrap(err), nil
+	}
+	if !ok {
+		return util.Wrap(fmt.Errorf("%w: (%s, %s)", ErrNotFound, key, id)), nil
+	}
+	start := r - int64(before)
+	if start < 0 {
+		start = 0
+	}
+	members, err := z.b.ZRangeWithScores(key, start, r+int64(after))
+	if err != nil {
+		z.opts.logError("get around failed", err, key, id, key)
+		return util.Wrap(err), nil
+	}
+	return nil, ranked(start, members)
+}
+
+func (z zSetLockTopKProvider) GetAround(key string, id string, before, after int) (err error, ans []RankedElement) {
+	span, end := z.opts.begin(ProviderLock, OpAround, "key", key, "member", id)
+	defer end(&err)
+	z = z.withTrace(span)
+	if err := z.opts.validateId(key, id); err != nil {
+		return err, nil
+	}
+	before, after = window(before, after)
+	lock, err := z.acquire(key)
+	if err != nil {
+		return err, nil
+	}
+	defer lock.UnLock()
+	metaKey, err := z.currentMeta(key)
+	if err != nil {
+		return err, nil
+	}
+	shard, err := z.lookupMember(z.getExistsKey(metaKey, id), id)
+	if err != nil {
+		z.opts.logError("get around failed", err, metaKey, id, "")
+		return util.Wrap(err), nil
+	}
+	if shard == "" {
+		return util.Wrap(fmt.Errorf("%w: (%s, %s)", ErrNotFound, key, id)), nil
+	}
+	ans, err = layoutAround(z.b, metaKey, shard, id, before, after)
+	if err != nil {
+		z.opts.logError("get around failed", err, metaKey, id, shard)
+		return util.Wrap(err), nil
+	}
+	return nil, ans
+}
+
+// GetAround 在脚本中执行, 与 layoutAround 的逻辑相同
+func (z zSetShardTopKProvider) GetAround(key string, id string, before, after int) (err error, ans []RankedElement) {
+	_, end := z.opts.begin(ProviderLua, OpAround, "key", key, "member", id)
+	defer end(&err)
+	if err := z.opts.validateId(key, id); err != nil {
+		return err, nil
+	}
+	before, after = window(before, after)
+	res, err := z.b.Eval(script, []string{z.makeMetaKey(key)}, "around", id, before, after)
+	if err != nil {
+		z.opts.logError("get around failed", err, key, id, "")
+		return util.Wrap(err), nil
+	}
+	if res == nil {
+		return util.Wrap(fmt.Errorf("%w: (%s, %s)", ErrNotFound, key, id)), nil
+	}
+	resStr, ok := res.(string)
+	if !ok {
+		return util.Wrap(fmt.Errorf("%w: unexpected script reply %v", ErrCorruptLayout, res)), nil
+	}
+	// 第一个字段为第一个元素的排名
+	i := strings.IndexByte(resStr, ',')
+	if i < 0 {
+		return util.Wrap(fmt.Errorf("%w: unexpected script reply %v", ErrCorruptLayout, res)), nil
+	}
+	first, err := strconv.ParseInt(resStr[:i], 10, 64)
+	if err != nil {
+		return util.Wrap(fmt.Errorf("%w: bad rank: %s", ErrCorruptLayout, err)), nil
+	}
+	members, err := parseScoredReply(resStr[i+1:])
+	if err != nil {
+		return util.Wrap(err), nil
+	}
+	return nil, ranked(first, members)
+}
+
+func (m *MemoryTopKProvider) GetAround(key string, id string, before, after int) (err error, ans []RankedElement) {
+	_, end := m.opts.begin(ProviderMemory, OpAround, "key", key, "member", id)
+	defer end(&err)
+	if err := m.opts.validateId(key, id); err != nil {
+		return err, nil
+	}
+	before, after = window(before, after)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	zs, ok := m.keys[key]
+	if !ok {
+		return util.Wrap(fmt.Errorf("%w: (%s, %s)", ErrNotFound, key, id)), nil
+	}
+	score, ok := zs.dict[id]
+	if !ok {
+		return util.Wrap(fmt.Errorf("%w: (%s, %s)", ErrNotFound, key, id)), nil
+	}
+	rank, x := zs.zsl.rank(score, id)
+	n := after + 1
+	for i := 0; i < before && x.prev() != nil; i++ {
+		x = x.prev()
+		rank--
+		n++
+	}
+	ans = make([]RankedElement, 0, n)
+	for ; x != nil && len(ans) < n; x = x.next() {
+		// skipList 的排名从1开始
+		ans = append(ans, RankedElement{Id: x.member, Score: x.score, Rank: int64(rank - 1 + len(ans))})
+	}
+	return nil, ans
+}
@@ -0,0 +1,146 @@
+package topk
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"time"
+)
+
+/*
+Backend provider使用的存储命令, 分片逻辑只依赖这个接口, 不直接依赖redis客户端.
+默认实现为 go-redis 的适配器 NewRedisBackend, 替换客户端或者在测试中注入fake时实现该接口即可.
+member和score统一使用 Element 表示, key或field不存在不算错误.
+*/
+type Backend interface {
+	ZRem(key string, members ...string) (int64, error)
+	ZCard(key string) (int64, error)
+	ZCount(key, min, max string) (int64, error)
+	// ZScore member不存在时ok为false
+	ZScore(key, member string) (score float64, ok bool, err error)
+	// ZUnionStore aggregate为 "SUM", "MIN" 或 "MAX", 返回dst中的member数
+	ZUnionStore(dst string, keys []string, weights []float64, aggregate string) (int64, error)
+	// ZRank member不存在时ok为false
+	ZRank(key, member string) (rank int64, ok bool, err error)
+	ZRangeWithScores(key string, start, stop int64) ([]Element, error)
+	// ZPopMin 和 ZPopMax 与redis相同, ZPopMax 按score降序返回
+	ZPopMin(key string, count int64) ([]Element, error)
+	ZPopMax(key string, count int64) ([]Element, error)
+	ZRangeByScore(key string, by RangeBy) ([]string, error)
+	ZRangeByScoreWithScores(key string, by RangeBy) ([]Element, error)
+	ZRevRangeByScore(key string, by RangeBy) ([]string, error)
+	ZRevRangeByScoreWithScores(key string, by RangeBy) ([]Element, error)
+	// HGet field不存在时ok为false
+	HGet(key, field string) (value string, ok bool, err error)
+	// Get key不存在时ok为false
+	Get(key string) (value string, ok bool, err error)
+	Incr(key string) (int64, error)
+	// PTTL key不存在或没有过期时间时返回值小于等于0
+	PTTL(key string) (time.Duration, error)
+	// SetNX ttl为0表示不过期
+	SetNX(key, value string, ttl time.Duration) (bool, error)
+	// BLPop 与redis相同, 返回 [key, value], 超时返回nil; timeout按秒向上取整, 最少1秒
+	BLPop(timeout time.Duration, keys ...string) ([]string, error)
+	// Eval 执行脚本, 返回值按RESP类型转换为 int64, string, []interface{} 或 nil
+	Eval(script *Script, keys []string, args ...interface{}) (interface{}, error)
+	// Pipeline 返回批量发送的命令队列
+	Pipeline() Pipeline
+	// TxPipeline 返回在 MULTI/EXEC 事务中执行的命令队列
+	TxPipeline() Pipeline
+	// WithHook 返回每条命令(pipeline整体算一条)执行时都会调用hook的副本, 不支持时可以返回自身
+	WithHook(hook Hook) Backend
+}
+
+/*
+Pipeline 命令在 Exec 之后才会执行, 返回的Reply在 Exec 之后才能读取.
+Exec 返回第一个失败命令的错误, 每条命令的错误也会记录在各自的Reply中.
+*/
+type Pipeline interface {
+	ZAdd(key string, members ...Element) *IntReply
+	ZIncrBy(key string, delta float64, member string) *FloatReply
+	ZRem(key string, members ...string) *IntReply
+	ZRemRangeByScore(key, min, max string) *IntReply
+	ZRemRangeByRank(key string, start, stop int64) *IntReply
+	ZCard(key string) *IntReply
+	ZCount(key, min, max string) *IntReply
+	ZRangeWithScores(key string, start, stop int64) *ElementsReply
+	ZRevRangeWithScores(key string, start, stop int64) *ElementsReply
+	HSet(key, field, value string) *IntReply
+	HMSet(key string, fields map[string]string) *StatusReply
+	HDel(key string, fields ...string) *IntReply
+	HLen(key string) *IntReply
+	HGetAll(key string) *MapReply
+	Get(key string) *StringReply
+	Set(key, value string) *StatusReply
+	Del(keys ...string) *IntReply
+	// Unlink 与 Del 相同, 在后台释放内存
+	Unlink(keys ...string) *IntReply
+	LPush(key string, values ...string) *IntReply
+	RPush(key string, values ...string) *IntReply
+	LRem(key string, count int64, value string) *IntReply
+	PExpire(key string, ttl time.Duration) *IntReply
+	PExpireAt(key string, at time.Time) *IntReply
+	Exists(keys ...string) *IntReply
+	// MemoryUsage 不支持 MEMORY USAGE 时Reply带错误, key不存在时为0
+	MemoryUsage(key string) *IntReply
+	Exec() error
+}
+
+// Hook 命令开始执行时调用, 返回的函数在命令结束时调用, attrs 为交替出现的 key 和 value
+type Hook func(name string, attrs ...interface{}) func(err *error)
+
+// RangeBy score区间, Min 和 Max 与 ZRANGEBYSCORE 的写法相同, 例如 "-inf", "(1.5"; Count为0表示不限制
+type RangeBy struct {
+	Min, Max      string
+	Offset, Count int64
+}
+
+// StatusReply 只关心是否成功的命令
+type StatusReply struct {
+	Err error
+}
+
+type IntReply struct {
+	Val int64
+	Err error
+}
+
+type FloatReply struct {
+	Val float64
+	Err error
+}
+
+// StringReply key不存在时 Ok 为false
+type StringReply struct {
+	Val string
+	Ok  bool
+	Err error
+}
+
+type ElementsReply struct {
+	Val []Element
+	Err error
+}
+
+type MapReply struct {
+	Val map[string]string
+	Err error
+}
+
+// Script lua脚本, 创建时计算sha1, Backend 可以先用 EVALSHA 执行
+type Script struct {
+	src  string
+	hash string
+}
+
+func NewScript(src string) *Script {
+	h := sha1.Sum([]byte(src))
+	return &Script{src: src, hash: hex.EncodeToString(h[:])}
+}
+
+func (s *Script) Src() string {
+	return s.src
+}
+
+func (s *Script) Hash() string {
+	return s.hash
+}
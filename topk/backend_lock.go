@@ -0,0 +1,42 @@
+package topk
+
+import (
+	"fmt"
+	"pushan/RedTopK/util"
+	"time"
+)
+
+var unlockScript = NewScript(util.UnlockScript)
+
+// BackendLockFactory 返回基于 Backend 的 util.RedisLock, 是provider默认使用的锁
+func BackendLockFactory(b Backend) util.LockerFactory {
+	return util.LockFactory(BackendLockClient(b))
+}
+
+// BackendLockClient 把 Backend 适配为 util.LockClient, 也可以用于 util.MultiLockFactory
+func BackendLockClient(b Backend) util.LockClient {
+	if b == nil {
+		return nil
+	}
+	return backendLockClient{b}
+}
+
+type backendLockClient struct {
+	b Backend
+}
+
+func (c backendLockClient) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	return c.b.SetNX(key, value, ttl)
+}
+
+func (c backendLockClient) DelIfEqual(key, value string) (bool, error) {
+	res, err := c.b.Eval(unlockScript, []string{key}, value)
+	if err != nil {
+		return false, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected unlock reply %T(%v)", res, res)
+	}
+	return n == 1, nil
+}
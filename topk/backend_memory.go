@@ -0,0 +1,1080 @@
+package topk
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errWrongType  = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errNotInteger = errors.New("ERR value is not an integer or out of range")
+	errNaNScore   = errors.New("ERR resulting score is not a number (NaN)")
+)
+
+// memScript Go实现的脚本, 在持有 MemoryBackend 的锁时执行
+type memScript func(m *MemoryBackend, keys []string, args []string) (interface{}, error)
+
+// memScripts MemoryBackend 支持的脚本, 只有lock provider用到的几个, lua provider的脚本不支持
+var memScripts = map[string]memScript{
+	unlockScript.Hash():     memUnlock,
+	inheritTTLScript.Hash(): memInheritTTL,
+	wakeScript.Hash():       memWake,
+	lockScoresScript.Hash(): memLockScores,
+}
+
+// memList 内存中的list
+type memList struct {
+	items []string
+}
+
+/*
+MemoryBackend 纯内存的 Backend, 用于在没有redis的测试中运行 lock 和 zset provider, 也可以在外面包一层故障注入.
+命令的语义与redis相同, 过期的key在访问时删除. Pipeline 和 TxPipeline 都在一次加锁中执行所有命令.
+Eval 只支持lock provider使用的脚本, 其余脚本返回错误, 因此不能用于 lua provider. 并发安全.
+*/
+type MemoryBackend struct {
+	mu sync.Mutex
+	// values 的值为 *memZSet, map[string]string, string 或 *memList
+	values  map[string]interface{}
+	expires map[string]time.Time
+	// pushed 每次向list写入之后关闭并替换, 唤醒 BLPop
+	pushed chan struct{}
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		values:  make(map[string]interface{}),
+		expires: make(map[string]time.Time),
+		pushed:  make(chan struct{}),
+	}
+}
+
+// lookup 返回key的值, 已经过期时删除key
+func (m *MemoryBackend) lookup(key string) interface{} {
+	if at, ok := m.expires[key]; ok && !time.Now().Before(at) {
+		m.del(key)
+	}
+	return m.values[key]
+}
+
+func (m *MemoryBackend) del(key string) bool {
+	_, ok := m.values[key]
+	delete(m.values, key)
+	delete(m.expires, key)
+	return ok
+}
+
+// cleanup 与redis相同, 删除变为空的zset, hash和list
+func (m *MemoryBackend) cleanup(key string) {
+	switch v := m.values[key].(type) {
+	case *memZSet:
+		if len(v.dict) == 0 {
+			m.del(key)
+		}
+	case map[string]string:
+		if len(v) == 0 {
+			m.del(key)
+		}
+	case *memList:
+		if len(v.items) == 0 {
+			m.del(key)
+		}
+	}
+}
+
+// zset 返回key的zset, 不存在且create为false时返回nil
+func (m *MemoryBackend) zset(key string, create bool) (*memZSet, error) {
+	switch v := m.lookup(key).(type) {
+	case nil:
+		if !create {
+			return nil, nil
+		}
+		zs := &memZSet{dict: make(map[string]float64), zsl: newSkipList()}
+		m.values[key] = zs
+		return zs, nil
+	case *memZSet:
+		return v, nil
+	}
+	return nil, errWrongType
+}
+
+func (m *MemoryBackend) hash(key string, create bool) (map[string]string, error) {
+	switch v := m.lookup(key).(type) {
+	case nil:
+		if !create {
+			return nil, nil
+		}
+		h := make(map[string]string)
+		m.values[key] = h
+		return h, nil
+	case map[string]string:
+		return v, nil
+	}
+	return nil, errWrongType
+}
+
+func (m *MemoryBackend) list(key string, create bool) (*memList, error) {
+	switch v := m.lookup(key).(type) {
+	case nil:
+		if !create {
+			return nil, nil
+		}
+		l := &memList{}
+		m.values[key] = l
+		return l, nil
+	case *memList:
+		return v, nil
+	}
+	return nil, errWrongType
+}
+
+func (m *MemoryBackend) str(key string) (string, bool, error) {
+	switch v := m.lookup(key).(type) {
+	case nil:
+		return "", false, nil
+	case string:
+		return v, true, nil
+	}
+	return "", false, errWrongType
+}
+
+// pttl 与 PTTL 命令相同, key不存在返回-2, 没有过期时间返回-1
+func (m *MemoryBackend) pttl(key string) int64 {
+	if m.lookup(key) == nil {
+		return -2
+	}
+	at, ok := m.expires[key]
+	if !ok {
+		return -1
+	}
+	return time.Until(at).Milliseconds()
+}
+
+func (m *MemoryBackend) expireAt(key string, at time.Time) int64 {
+	if m.lookup(key) == nil {
+		return 0
+	}
+	if !time.Now().Before(at) {
+		m.del(key)
+	} else {
+		m.expires[key] = at
+	}
+	return 1
+}
+
+func (m *MemoryBackend) push(key string, values []string, left bool) (int64, error) {
+	l, err := m.list(key, true)
+	if err != nil {
+		return 0, err
+	}
+	for _, v := range values {
+		if left {
+			l.items = append([]string{v}, l.items...)
+		} else {
+			l.items = append(l.items, v)
+		}
+	}
+	close(m.pushed)
+	m.pushed = make(chan struct{})
+	return int64(len(l.items)), nil
+}
+
+func (m *MemoryBackend) lpop(key string) (string, bool, error) {
+	l, err := m.list(key, false)
+	if err != nil || l == nil {
+		return "", false, err
+	}
+	v := l.items[0]
+	l.items = l.items[1:]
+	m.cleanup(key)
+	return v, true, nil
+}
+
+// set 添加或更新member, 返回是否新增
+func (zs *memZSet) set(member string, score float64) bool {
+	old, ok := zs.dict[member]
+	if ok {
+		if old == score {
+			return false
+		}
+		zs.zsl.delete(old, member)
+	}
+	zs.zsl.insert(score, member)
+	zs.dict[member] = score
+	return !ok
+}
+
+func (zs *memZSet) rem(member string) bool {
+	score, ok := zs.dict[member]
+	if !ok {
+		return false
+	}
+	zs.zsl.delete(score, member)
+	delete(zs.dict, member)
+	return true
+}
+
+// rankRange 把redis风格的下标(可以为负)转换为 [start, stop], 为空时ok为false
+func rankRange(n, start, stop int64) (int64, int64, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	return start, stop, start <= stop
+}
+
+// byRank 返回升序排名在 [start, stop] 的元素, rev为true时按降序排名
+func (zs *memZSet) byRank(start, stop int64, rev bool) []Element {
+	ans := make([]Element, 0)
+	if zs == nil {
+		return ans
+	}
+	start, stop, ok := rankRange(int64(zs.zsl.length), start, stop)
+	if !ok {
+		return ans
+	}
+	if rev {
+		n := int64(zs.zsl.length)
+		for x := zs.zsl.byRank(int(n - start)); x != nil && int64(len(ans)) <= stop-start; x = x.prev() {
+			ans = append(ans, Element{Id: x.member, Score: x.score})
+		}
+		return ans
+	}
+	for x := zs.zsl.byRank(int(start + 1)); x != nil && int64(len(ans)) <= stop-start; x = x.next() {
+		ans = append(ans, Element{Id: x.member, Score: x.score})
+	}
+	return ans
+}
+
+func parseBounds(min, max string) (lo, hi scoreBound, err error) {
+	if lo, err = parseBound(min); err != nil {
+		return lo, hi, errors.New("ERR min or max is not a float")
+	}
+	if hi, err = parseBound(max); err != nil {
+		return lo, hi, errors.New("ERR min or max is not a float")
+	}
+	return lo, hi, nil
+}
+
+// byScore 与 ZRANGEBYSCORE 相同, rev为true时与 ZREVRANGEBYSCORE 相同
+func (zs *memZSet) byScore(by RangeBy, rev bool) ([]Element, error) {
+	lo, hi, err := parseBounds(by.Min, by.Max)
+	if err != nil {
+		return nil, err
+	}
+	ans := make([]Element, 0)
+	if zs == nil {
+		return ans, nil
+	}
+	// 与 go-redis 相同, Offset 和 Count 都为0时不限制, Count小于0时返回offset之后的所有元素
+	offset, count := by.Offset, by.Count
+	if offset == 0 && count == 0 {
+		count = -1
+	}
+	var x *skipNode
+	if rev {
+		x = zs.zsl.byRank(zs.zsl.countWhile(func(score float64) bool { return !hi.above(score) }))
+	} else {
+		x = zs.zsl.byRank(zs.zsl.countWhile(lo.below) + 1)
+	}
+	for ; x != nil && count != 0; offset-- {
+		if (rev && lo.below(x.score)) || (!rev && hi.above(x.score)) {
+			break
+		}
+		if offset <= 0 {
+			ans = append(ans, Element{Id: x.member, Score: x.score})
+			count--
+		}
+		if rev {
+			x = x.prev()
+		} else {
+			x = x.next()
+		}
+	}
+	return ans, nil
+}
+
+func (zs *memZSet) count(min, max string) (int64, error) {
+	lo, hi, err := parseBounds(min, max)
+	if err != nil || zs == nil {
+		return 0, err
+	}
+	below := zs.zsl.countWhile(lo.below)
+	upTo := zs.zsl.countWhile(func(score float64) bool { return !hi.above(score) })
+	if upTo < below {
+		return 0, nil
+	}
+	return int64(upTo - below), nil
+}
+
+func (m *MemoryBackend) pop(key string, count int64, max bool) ([]Element, error) {
+	zs, err := m.zset(key, false)
+	if err != nil {
+		return nil, err
+	}
+	var ans []Element
+	if max {
+		ans = zs.byRank(0, count-1, true)
+	} else {
+		ans = zs.byRank(0, count-1, false)
+	}
+	for i := range ans {
+		zs.rem(ans[i].Id)
+	}
+	m.cleanup(key)
+	return ans, nil
+}
+
+func (m *MemoryBackend) ZRem(key string, members ...string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.zrem(key, members)
+}
+
+func (m *MemoryBackend) zrem(key string, members []string) (int64, error) {
+	zs, err := m.zset(key, false)
+	if err != nil || zs == nil {
+		return 0, err
+	}
+	var n int64
+	for _, member := range members {
+		if zs.rem(member) {
+			n++
+		}
+	}
+	m.cleanup(key)
+	return n, nil
+}
+
+func (m *MemoryBackend) ZCard(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.zcard(key)
+}
+
+func (m *MemoryBackend) zcard(key string) (int64, error) {
+	zs, err := m.zset(key, false)
+	if err != nil || zs == nil {
+		return 0, err
+	}
+	return int64(len(zs.dict)), nil
+}
+
+func (m *MemoryBackend) ZCount(key, min, max string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	zs, err := m.zset(key, false)
+	if err != nil {
+		return 0, err
+	}
+	return zs.count(min, max)
+}
+
+func (m *MemoryBackend) ZScore(key, member string) (float64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	zs, err := m.zset(key, false)
+	if err != nil || zs == nil {
+		return 0, false, err
+	}
+	score, ok := zs.dict[member]
+	return score, ok, nil
+}
+
+func (m *MemoryBackend) ZUnionStore(dst string, keys []string, weights []float64, aggregate string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	union := make(map[string]float64)
+	for i, key := range keys {
+		zs, err := m.zset(key, false)
+		if err != nil {
+			return 0, err
+		}
+		if zs == nil {
+			continue
+		}
+		w := 1.0
+		if i < len(weights) {
+			w = weights[i]
+		}
+		for member, score := range zs.dict {
+			v := score * w
+			if math.IsNaN(v) {
+				v = 0
+			}
+			old, ok := union[member]
+			if !ok {
+				union[member] = v
+				continue
+			}
+			switch strings.ToUpper(aggregate) {
+			case "MIN":
+				v = math.Min(old, v)
+			case "MAX":
+				v = math.Max(old, v)
+			default:
+				if v += old; math.IsNaN(v) {
+					v = 0
+				}
+			}
+			union[member] = v
+		}
+	}
+	m.del(dst)
+	if len(union) == 0 {
+		return 0, nil
+	}
+	zs, _ := m.zset(dst, true)
+	for member, score := range union {
+		zs.set(member, score)
+	}
+	return int64(len(union)), nil
+}
+
+func (m *MemoryBackend) ZRank(key, member string) (int64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	zs, err := m.zset(key, false)
+	if err != nil || zs == nil {
+		return 0, false, err
+	}
+	score, ok := zs.dict[member]
+	if !ok {
+		return 0, false, nil
+	}
+	rank, _ := zs.zsl.rank(score, member)
+	return int64(rank - 1), true, nil
+}
+
+func (m *MemoryBackend) ZRangeWithScores(key string, start, stop int64) ([]Element, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	zs, err := m.zset(key, false)
+	if err != nil {
+		return nil, err
+	}
+	return zs.byRank(start, stop, false), nil
+}
+
+func (m *MemoryBackend) ZPopMin(key string, count int64) ([]Element, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pop(key, count, false)
+}
+
+func (m *MemoryBackend) ZPopMax(key string, count int64) ([]Element, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pop(key, count, true)
+}
+
+func (m *MemoryBackend) rangeByScore(key string, by RangeBy, rev bool) ([]Element, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	zs, err := m.zset(key, false)
+	if err != nil {
+		return nil, err
+	}
+	return zs.byScore(by, rev)
+}
+
+func members(elements []Element, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	ans := make([]string, len(elements))
+	for i := range elements {
+		ans[i] = elements[i].Id
+	}
+	return ans, nil
+}
+
+func (m *MemoryBackend) ZRangeByScore(key string, by RangeBy) ([]string, error) {
+	return members(m.rangeByScore(key, by, false))
+}
+
+func (m *MemoryBackend) ZRangeByScoreWithScores(key string, by RangeBy) ([]Element, error) {
+	return m.rangeByScore(key, by, false)
+}
+
+func (m *MemoryBackend) ZRevRangeByScore(key string, by RangeBy) ([]string, error) {
+	return members(m.rangeByScore(key, by, true))
+}
+
+func (m *MemoryBackend) ZRevRangeByScoreWithScores(key string, by RangeBy) ([]Element, error) {
+	return m.rangeByScore(key, by, true)
+}
+
+func (m *MemoryBackend) HGet(key, field string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hget(key, field)
+}
+
+func (m *MemoryBackend) hget(key, field string) (string, bool, error) {
+	h, err := m.hash(key, false)
+	if err != nil {
+		return "", false, err
+	}
+	v, ok := h[field]
+	return v, ok, nil
+}
+
+func (m *MemoryBackend) Get(key string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.str(key)
+}
+
+func (m *MemoryBackend) Incr(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, _, err := m.str(key)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if v != "" {
+		if n, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return 0, errNotInteger
+		}
+	}
+	n++
+	// INCR 保留过期时间
+	m.values[key] = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+func (m *MemoryBackend) PTTL(key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// 与 go-redis 相同, -1 和 -2 不乘以毫秒
+	ttl := m.pttl(key)
+	if ttl <= 0 {
+		return time.Duration(ttl), nil
+	}
+	return time.Duration(ttl) * time.Millisecond, nil
+}
+
+func (m *MemoryBackend) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lookup(key) != nil {
+		return false, nil
+	}
+	m.values[key] = value
+	if ttl > 0 {
+		m.expires[key] = time.Now().Add(ttl)
+	}
+	return true, nil
+}
+
+func (m *MemoryBackend) BLPop(timeout time.Duration, keys ...string) ([]string, error) {
+	// 与 RedisBackend 相同的取整
+	if rem := timeout % time.Second; rem != 0 {
+		timeout += time.Second - rem
+	}
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		m.mu.Lock()
+		for _, key := range keys {
+			v, ok, err := m.lpop(key)
+			if err != nil || ok {
+				m.mu.Unlock()
+				if err != nil {
+					return nil, err
+				}
+				return []string{key, v}, nil
+			}
+		}
+		pushed := m.pushed
+		m.mu.Unlock()
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, nil
+		}
+		timer := time.NewTimer(left)
+		select {
+		case <-pushed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// argString 与 go-redis 相同的参数格式
+func argString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(arg)
+}
+
+func (m *MemoryBackend) Eval(script *Script, keys []string, args ...interface{}) (interface{}, error) {
+	fn, ok := memScripts[script.Hash()]
+	if !ok {
+		return nil, fmt.Errorf("ERR memory backend does not support script %s", script.Hash())
+	}
+	strs := make([]string, len(args))
+	for i := range args {
+		strs[i] = argString(args[i])
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return fn(m, keys, strs)
+}
+
+func memUnlock(m *MemoryBackend, keys []string, args []string) (interface{}, error) {
+	v, ok, err := m.str(keys[0])
+	if err != nil {
+		return nil, err
+	}
+	if ok && v == args[0] {
+		m.del(keys[0])
+		return int64(1), nil
+	}
+	return int64(0), nil
+}
+
+func memInheritTTL(m *MemoryBackend, keys []string, args []string) (interface{}, error) {
+	ttl := m.pttl(keys[0])
+	if ttl <= 0 {
+		return int64(0), nil
+	}
+	for _, key := range keys[1:] {
+		if m.pttl(key) == -1 {
+			m.expires[key] = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+	}
+	return int64(1), nil
+}
+
+func memWake(m *MemoryBackend, keys []string, args []string) (interface{}, error) {
+	queueKey := keys[0]
+	ttl, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return nil, errNotInteger
+	}
+	for {
+		id, ok, err := m.lpop(queueKey)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return int64(0), nil
+		}
+		wakeKey := queueKey + ":" + id
+		if m.lookup(wakeKey+":alive") != nil {
+			if _, err := m.push(wakeKey, []string{"1"}, false); err != nil {
+				return nil, err
+			}
+			m.expireAt(wakeKey, time.Now().Add(time.Duration(ttl)*time.Millisecond))
+			return int64(1), nil
+		}
+	}
+}
+
+func memLockScores(m *MemoryBackend, keys []string, args []string) (interface{}, error) {
+	var b strings.Builder
+	for i, id := range args {
+		shard, ok, err := m.hget(keys[i], id)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		zs, err := m.zset(shard, false)
+		if err != nil {
+			return nil, err
+		}
+		if zs == nil {
+			continue
+		}
+		if score, ok := zs.dict[id]; ok {
+			b.WriteString(id + "," + formatScore(score) + ",")
+		}
+	}
+	return b.String(), nil
+}
+
+func (m *MemoryBackend) Pipeline() Pipeline {
+	return &memPipeline{m: m}
+}
+
+func (m *MemoryBackend) TxPipeline() Pipeline {
+	return &memPipeline{m: m}
+}
+
+// WithHook 不支持hook, 返回自身
+func (m *MemoryBackend) WithHook(hook Hook) Backend {
+	return m
+}
+
+// memPipeline 排队的命令在 Exec 时一次加锁执行, 与事务一样不会和其他命令交错
+type memPipeline struct {
+	m   *MemoryBackend
+	ops []func() error
+}
+
+func (p *memPipeline) Exec() error {
+	p.m.mu.Lock()
+	defer p.m.mu.Unlock()
+	var first error
+	for _, op := range p.ops {
+		if err := op(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (p *memPipeline) intReply(fn func() (int64, error)) *IntReply {
+	r := &IntReply{}
+	p.ops = append(p.ops, func() error {
+		r.Val, r.Err = fn()
+		return r.Err
+	})
+	return r
+}
+
+func (p *memPipeline) statusReply(fn func() error) *StatusReply {
+	r := &StatusReply{}
+	p.ops = append(p.ops, func() error {
+		r.Err = fn()
+		return r.Err
+	})
+	return r
+}
+
+func (p *memPipeline) elementsReply(fn func() ([]Element, error)) *ElementsReply {
+	r := &ElementsReply{}
+	p.ops = append(p.ops, func() error {
+		r.Val, r.Err = fn()
+		return r.Err
+	})
+	return r
+}
+
+func (p *memPipeline) ZAdd(key string, members ...Element) *IntReply {
+	return p.intReply(func() (int64, error) {
+		zs, err := p.m.zset(key, true)
+		if err != nil {
+			return 0, err
+		}
+		var n int64
+		for i := range members {
+			if zs.set(members[i].Id, members[i].Score) {
+				n++
+			}
+		}
+		p.m.cleanup(key)
+		return n, nil
+	})
+}
+
+func (p *memPipeline) ZIncrBy(key string, delta float64, member string) *FloatReply {
+	r := &FloatReply{}
+	p.ops = append(p.ops, func() error {
+		zs, err := p.m.zset(key, true)
+		if err != nil {
+			r.Err = err
+			return err
+		}
+		score := zs.dict[member] + delta
+		if math.IsNaN(score) {
+			r.Err = errNaNScore
+			p.m.cleanup(key)
+			return r.Err
+		}
+		zs.set(member, score)
+		r.Val = score
+		return nil
+	})
+	return r
+}
+
+func (p *memPipeline) ZRem(key string, members ...string) *IntReply {
+	return p.intReply(func() (int64, error) { return p.m.zrem(key, members) })
+}
+
+func (p *memPipeline) ZRemRangeByScore(key, min, max string) *IntReply {
+	return p.intReply(func() (int64, error) {
+		zs, err := p.m.zset(key, false)
+		if err != nil {
+			return 0, err
+		}
+		removed, err := zs.byScore(RangeBy{Min: min, Max: max}, false)
+		if err != nil || zs == nil {
+			return 0, err
+		}
+		return p.m.zrem(key, elementIds(removed))
+	})
+}
+
+func (p *memPipeline) ZRemRangeByRank(key string, start, stop int64) *IntReply {
+	return p.intReply(func() (int64, error) {
+		zs, err := p.m.zset(key, false)
+		if err != nil || zs == nil {
+			return 0, err
+		}
+		return p.m.zrem(key, elementIds(zs.byRank(start, stop, false)))
+	})
+}
+
+func elementIds(elements []Element) []string {
+	ids, _ := members(elements, nil)
+	return ids
+}
+
+func (p *memPipeline) ZCard(key string) *IntReply {
+	return p.intReply(func() (int64, error) { return p.m.zcard(key) })
+}
+
+func (p *memPipeline) ZCount(key, min, max string) *IntReply {
+	return p.intReply(func() (int64, error) {
+		zs, err := p.m.zset(key, false)
+		if err != nil {
+			return 0, err
+		}
+		return zs.count(min, max)
+	})
+}
+
+func (p *memPipeline) ZRangeWithScores(key string, start, stop int64) *ElementsReply {
+	return p.elementsReply(func() ([]Element, error) {
+		zs, err := p.m.zset(key, false)
+		if err != nil {
+			return nil, err
+		}
+		return zs.byRank(start, stop, false), nil
+	})
+}
+
+func (p *memPipeline) ZRevRangeWithScores(key string, start, stop int64) *ElementsReply {
+	return p.elementsReply(func() ([]Element, error) {
+		zs, err := p.m.zset(key, false)
+		if err != nil {
+			return nil, err
+		}
+		return zs.byRank(start, stop, true), nil
+	})
+}
+
+func (p *memPipeline) HSet(key, field, value string) *IntReply {
+	return p.intReply(func() (int64, error) {
+		h, err := p.m.hash(key, true)
+		if err != nil {
+			return 0, err
+		}
+		_, ok := h[field]
+		h[field] = value
+		if ok {
+			return 0, nil
+		}
+		return 1, nil
+	})
+}
+
+func (p *memPipeline) HMSet(key string, fields map[string]string) *StatusReply {
+	return p.statusReply(func() error {
+		h, err := p.m.hash(key, true)
+		if err != nil {
+			return err
+		}
+		for field, value := range fields {
+			h[field] = value
+		}
+		p.m.cleanup(key)
+		return nil
+	})
+}
+
+func (p *memPipeline) HDel(key string, fields ...string) *IntReply {
+	return p.intReply(func() (int64, error) {
+		h, err := p.m.hash(key, false)
+		if err != nil {
+			return 0, err
+		}
+		var n int64
+		for _, field := range fields {
+			if _, ok := h[field]; ok {
+				delete(h, field)
+				n++
+			}
+		}
+		p.m.cleanup(key)
+		return n, nil
+	})
+}
+
+func (p *memPipeline) HLen(key string) *IntReply {
+	return p.intReply(func() (int64, error) {
+		h, err := p.m.hash(key, false)
+		return int64(len(h)), err
+	})
+}
+
+func (p *memPipeline) HGetAll(key string) *MapReply {
+	r := &MapReply{}
+	p.ops = append(p.ops, func() error {
+		h, err := p.m.hash(key, false)
+		if err != nil {
+			r.Err = err
+			return err
+		}
+		r.Val = make(map[string]string, len(h))
+		for field, value := range h {
+			r.Val[field] = value
+		}
+		return nil
+	})
+	return r
+}
+
+func (p *memPipeline) Get(key string) *StringReply {
+	r := &StringReply{}
+	p.ops = append(p.ops, func() error {
+		r.Val, r.Ok, r.Err = p.m.str(key)
+		return r.Err
+	})
+	return r
+}
+
+func (p *memPipeline) Set(key, value string) *StatusReply {
+	return p.statusReply(func() error {
+		// SET 清除过期时间
+		p.m.del(key)
+		p.m.values[key] = value
+		return nil
+	})
+}
+
+func (p *memPipeline) Del(keys ...string) *IntReply {
+	return p.intReply(func() (int64, error) {
+		var n int64
+		for _, key := range keys {
+			if p.m.lookup(key) != nil && p.m.del(key) {
+				n++
+			}
+		}
+		return n, nil
+	})
+}
+
+func (p *memPipeline) Unlink(keys ...string) *IntReply {
+	return p.Del(keys...)
+}
+
+func (p *memPipeline) LPush(key string, values ...string) *IntReply {
+	return p.intReply(func() (int64, error) { return p.m.push(key, values, true) })
+}
+
+func (p *memPipeline) RPush(key string, values ...string) *IntReply {
+	return p.intReply(func() (int64, error) { return p.m.push(key, values, false) })
+}
+
+func (p *memPipeline) LRem(key string, count int64, value string) *IntReply {
+	return p.intReply(func() (int64, error) {
+		l, err := p.m.list(key, false)
+		if err != nil || l == nil {
+			return 0, err
+		}
+		// count小于0时从尾部开始删除
+		items, rev := l.items, count < 0
+		if rev {
+			items = reversed(items)
+			count = -count
+		}
+		kept := make([]string, 0, len(items))
+		var n int64
+		for _, v := range items {
+			if v == value && (count == 0 || n < count) {
+				n++
+				continue
+			}
+			kept = append(kept, v)
+		}
+		if rev {
+			kept = reversed(kept)
+		}
+		l.items = kept
+		p.m.cleanup(key)
+		return n, nil
+	})
+}
+
+func reversed(items []string) []string {
+	ans := make([]string, len(items))
+	for i := range items {
+		ans[len(items)-1-i] = items[i]
+	}
+	return ans
+}
+
+func (p *memPipeline) PExpire(key string, ttl time.Duration) *IntReply {
+	return p.intReply(func() (int64, error) { return p.m.expireAt(key, time.Now().Add(ttl)), nil })
+}
+
+func (p *memPipeline) PExpireAt(key string, at time.Time) *IntReply {
+	return p.intReply(func() (int64, error) { return p.m.expireAt(key, at), nil })
+}
+
+func (p *memPipeline) Exists(keys ...string) *IntReply {
+	return p.intReply(func() (int64, error) {
+		var n int64
+		for _, key := range keys {
+			if p.m.lookup(key) != nil {
+				n++
+			}
+		}
+		return n, nil
+	})
+}
+
+// MemoryUsage 按key和值的长度估算, 不包括数据结构本身的开销
+func (p *memPipeline) MemoryUsage(key string) *IntReply {
+	return p.intReply(func() (int64, error) {
+		n := len(key)
+		switch v := p.m.lookup(key).(type) {
+		case nil:
+			return 0, nil
+		case *memZSet:
+			for member := range v.dict {
+				n += len(member) + 8
+			}
+		case map[string]string:
+			for field, value := range v {
+				n += len(field) + len(value)
+			}
+		case string:
+			n += len(v)
+		case *memList:
+			for _, item := range v.items {
+				n += len(item)
+			}
+		}
+		return int64(n), nil
+	})
+}
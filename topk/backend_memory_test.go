@@ -0,0 +1,88 @@
+package topk_test
+
+import (
+	"context"
+	"pushan/RedTopK/topk"
+	"pushan/RedTopK/topktest"
+	"testing"
+	"time"
+)
+
+// TestMemoryBackendLockProvider lock provider 只用到 MemoryBackend 支持的脚本, 不需要redis
+func TestMemoryBackendLockProvider(t *testing.T) {
+	m := newShardEvents()
+	tp := topk.NewLockTopKProviderWithBackend(topk.NewMemoryBackend(), topk.WithShardLimit(4), topk.WithMetrics(m))
+	topktest.Test(t, tp, topktest.Config{Seed: 1, Runs: 10, Ops: 400, Ranges: true, Pops: true})
+	m.expect(t, topk.ShardSplit, topk.ShardRebalance)
+}
+
+func TestMemoryBackendZSetProvider(t *testing.T) {
+	tp := topk.NewZSetProviderWithBackend(topk.NewMemoryBackend())
+	topktest.Test(t, tp, topktest.Config{Seed: 1, Ranges: true, Pops: true})
+}
+
+func TestMemoryBackendConcurrent(t *testing.T) {
+	tp := topk.NewLockTopKProviderWithBackend(topk.NewMemoryBackend(), topk.WithShardLimit(4))
+	topktest.TestConcurrent(t, tp, topktest.Config{Seed: 1})
+}
+
+// TestMemoryBackendRepairAfterChaos 与 TestRepairAfterChaos 相同, 故障注入在 MemoryBackend 外面, 每个子测试使用独立的backend
+func TestMemoryBackendRepairAfterChaos(t *testing.T) {
+	for _, p := range repairProfiles {
+		p := p
+		t.Run(p.name, func(t *testing.T) {
+			t.Parallel()
+			tp := runChaos(t, topk.NewMemoryBackend(), "chaos", p.rules)
+			repairAndCheck(t, tp, "chaos")
+		})
+	}
+}
+
+// TestMemoryBackendBlockingPop 等待者通过 BLPOP 和唤醒脚本收到 AddElement 的通知
+func TestMemoryBackendBlockingPop(t *testing.T) {
+	tp := topk.NewLockTopKProviderWithBackend(topk.NewMemoryBackend())
+	type result struct {
+		err error
+		ans []topk.Element
+	}
+	done := make(chan result, 1)
+	go func() {
+		err, ans := tp.(topk.BlockingPopper).BlockingPopTop(context.Background(), "queue", 1, 5*time.Second)
+		done <- result{err, ans}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := tp.AddElement("queue", "a", 1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-done:
+		if r.err != nil || len(r.ans) != 1 || r.ans[0].Id != "a" {
+			t.Fatalf("blocking pop: %v %v", r.err, r.ans)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiter not woken")
+	}
+}
+
+// TestMemoryBackendExpire 过期时间由 MemoryBackend 在访问时检查, 新建的shard继承meta的过期时间
+func TestMemoryBackendExpire(t *testing.T) {
+	tp := topk.NewLockTopKProviderWithBackend(topk.NewMemoryBackend(), topk.WithShardLimit(2))
+	if err := tp.AddElement("key", "a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tp.(topk.Expirer).ExpireAt("key", time.Now().Add(100*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []string{"b", "c", "d"} {
+		if err := tp.AddElement("key", id, float64(i+2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err, ans := tp.GetTopKS("key", 10); err != nil || len(ans) != 4 {
+		t.Fatalf("before expiry: %v %v", err, ans)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if err, ans := tp.GetTopKS("key", 10); err != nil || len(ans) != 0 {
+		t.Fatalf("after expiry: %v %v", err, ans)
+	}
+}
@@ -0,0 +1,438 @@
+package topk
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisBackend go-redis v6 的 Backend 适配器
+type RedisBackend struct {
+	cli *redis.Client
+}
+
+func NewRedisBackend(cli *redis.Client) *RedisBackend {
+	if cli == nil {
+		panic("invalid param: cli")
+	}
+	return &RedisBackend{cli: cli}
+}
+
+// Client 返回适配的 go-redis client
+func (b *RedisBackend) Client() *redis.Client {
+	return b.cli
+}
+
+func toZ(members []Element) []redis.Z {
+	zs := make([]redis.Z, len(members))
+	for i := range members {
+		zs[i] = redis.Z{Score: members[i].Score, Member: members[i].Id}
+	}
+	return zs
+}
+
+func fromZ(zs []redis.Z) []Element {
+	members := make([]Element, len(zs))
+	for i := range zs {
+		members[i] = Element{Id: zs[i].Member.(string), Score: zs[i].Score}
+	}
+	return members
+}
+
+func toZRangeBy(by RangeBy) redis.ZRangeBy {
+	return redis.ZRangeBy{Min: by.Min, Max: by.Max, Offset: by.Offset, Count: by.Count}
+}
+
+func (b *RedisBackend) ZRem(key string, members ...string) (int64, error) {
+	args := make([]interface{}, len(members))
+	for i := range members {
+		args[i] = members[i]
+	}
+	return b.cli.ZRem(key, args...).Result()
+}
+
+func (b *RedisBackend) ZCard(key string) (int64, error) {
+	return b.cli.ZCard(key).Result()
+}
+
+func (b *RedisBackend) ZCount(key, min, max string) (int64, error) {
+	return b.cli.ZCount(key, min, max).Result()
+}
+
+func (b *RedisBackend) ZScore(key, member string) (float64, bool, error) {
+	score, err := b.cli.ZScore(key, member).Result()
+	if err == redis.Nil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return score, true, nil
+}
+
+func (b *RedisBackend) ZUnionStore(dst string, keys []string, weights []float64, aggregate string) (int64, error) {
+	return b.cli.ZUnionStore(dst, redis.ZStore{Weights: weights, Aggregate: aggregate}, keys...).Result()
+}
+
+func (b *RedisBackend) ZRank(key, member string) (int64, bool, error) {
+	rank, err := b.cli.ZRank(key, member).Result()
+	if err == redis.Nil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return rank, true, nil
+}
+
+func (b *RedisBackend) ZRangeWithScores(key string, start, stop int64) ([]Element, error) {
+	zs, err := b.cli.ZRangeWithScores(key, start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	return fromZ(zs), nil
+}
+
+func (b *RedisBackend) ZPopMin(key string, count int64) ([]Element, error) {
+	zs, err := b.cli.ZPopMin(key, count).Result()
+	if err != nil {
+		return nil, err
+	}
+	return fromZ(zs), nil
+}
+
+func (b *RedisBackend) ZPopMax(key string, count int64) ([]Element, error) {
+	zs, err := b.cli.ZPopMax(key, count).Result()
+	if err != nil {
+		return nil, err
+	}
+	return fromZ(zs), nil
+}
+
+func (b *RedisBackend) ZRangeByScore(key string, by RangeBy) ([]string, error) {
+	return b.cli.ZRangeByScore(key, toZRangeBy(by)).Result()
+}
+
+func (b *RedisBackend) ZRangeByScoreWithScores(key string, by RangeBy) ([]Element, error) {
+	zs, err := b.cli.ZRangeByScoreWithScores(key, toZRangeBy(by)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return fromZ(zs), nil
+}
+
+func (b *RedisBackend) ZRevRangeByScore(key string, by RangeBy) ([]string, error) {
+	return b.cli.ZRevRangeByScore(key, toZRangeBy(by)).Result()
+}
+
+func (b *RedisBackend) ZRevRangeByScoreWithScores(key string, by RangeBy) ([]Element, error) {
+	zs, err := b.cli.ZRevRangeByScoreWithScores(key, toZRangeBy(by)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return fromZ(zs), nil
+}
+
+func (b *RedisBackend) HGet(key, field string) (string, bool, error) {
+	return stringResult(b.cli.HGet(key, field))
+}
+
+func (b *RedisBackend) Get(key string) (string, bool, error) {
+	return stringResult(b.cli.Get(key))
+}
+
+func (b *RedisBackend) PTTL(key string) (time.Duration, error) {
+	return b.cli.PTTL(key).Result()
+}
+
+func stringResult(cmd *redis.StringCmd) (string, bool, error) {
+	val, err := cmd.Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return val, true, nil
+}
+
+func (b *RedisBackend) Incr(key string) (int64, error) {
+	return b.cli.Incr(key).Result()
+}
+
+func (b *RedisBackend) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	return b.cli.SetNX(key, value, ttl).Result()
+}
+
+func (b *RedisBackend) BLPop(timeout time.Duration, keys ...string) ([]string, error) {
+	// go-redis 按秒截断timeout, 0表示永久阻塞
+	if rem := timeout % time.Second; rem != 0 {
+		timeout += time.Second - rem
+	}
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+	res, err := b.cli.BLPop(timeout, keys...).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return res, err
+}
+
+// Eval 先用 EVALSHA 执行, 脚本未加载时退回 EVAL, 与 redis.Script.Run 相同
+func (b *RedisBackend) Eval(script *Script, keys []string, args ...interface{}) (interface{}, error) {
+	res, err := b.cli.EvalSha(script.Hash(), keys, args...).Result()
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT ") {
+		res, err = b.cli.Eval(script.Src(), keys, args...).Result()
+	}
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return res, err
+}
+
+func (b *RedisBackend) Pipeline() Pipeline {
+	return &redisPipeline{pl: b.cli.Pipeline()}
+}
+
+func (b *RedisBackend) TxPipeline() Pipeline {
+	return &redisPipeline{pl: b.cli.TxPipeline()}
+}
+
+// WithHook 复制client, 复制出的client每条命令都会调用hook, 原client不受影响
+func (b *RedisBackend) WithHook(hook Hook) Backend {
+	cli := b.cli.WithContext(b.cli.Context())
+	cli.WrapProcess(func(old func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			end := hook("redis." + cmd.Name())
+			err := old(cmd)
+			hookErr := err
+			if err == redis.Nil {
+				hookErr = nil
+			}
+			end(&hookErr)
+			return err
+		}
+	})
+	cli.WrapProcessPipeline(func(old func(cmds []redis.Cmder) error) func(cmds []redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			end := hook("redis.pipeline", "cmds", len(cmds))
+			err := old(cmds)
+			end(&err)
+			return err
+		}
+	})
+	return &RedisBackend{cli: cli}
+}
+
+// redisPipeline Exec 之后把 go-redis 的结果复制到Reply中
+type redisPipeline struct {
+	pl    redis.Pipeliner
+	fills []func()
+}
+
+func nilAsNone(err error) error {
+	if err == redis.Nil {
+		return nil
+	}
+	return err
+}
+
+func (p *redisPipeline) intReply(cmd *redis.IntCmd) *IntReply {
+	r := &IntReply{}
+	p.fills = append(p.fills, func() {
+		r.Val, r.Err = cmd.Val(), nilAsNone(cmd.Err())
+	})
+	return r
+}
+
+func (p *redisPipeline) floatReply(cmd *redis.FloatCmd) *FloatReply {
+	r := &FloatReply{}
+	p.fills = append(p.fills, func() {
+		r.Val, r.Err = cmd.Val(), cmd.Err()
+	})
+	return r
+}
+
+func (p *redisPipeline) statusReply(cmd *redis.StatusCmd) *StatusReply {
+	r := &StatusReply{}
+	p.fills = append(p.fills, func() {
+		r.Err = cmd.Err()
+	})
+	return r
+}
+
+func (p *redisPipeline) elementsReply(cmd *redis.ZSliceCmd) *ElementsReply {
+	r := &ElementsReply{}
+	p.fills = append(p.fills, func() {
+		if r.Err = cmd.Err(); r.Err == nil {
+			r.Val = fromZ(cmd.Val())
+		}
+	})
+	return r
+}
+
+func (p *redisPipeline) ZAdd(key string, members ...Element) *IntReply {
+	return p.intReply(p.pl.ZAdd(key, toZ(members)...))
+}
+
+func (p *redisPipeline) ZIncrBy(key string, delta float64, member string) *FloatReply {
+	return p.floatReply(p.pl.ZIncrBy(key, delta, member))
+}
+
+func (p *redisPipeline) ZRem(key string, members ...string) *IntReply {
+	args := make([]interface{}, len(members))
+	for i := range members {
+		args[i] = members[i]
+	}
+	return p.intReply(p.pl.ZRem(key, args...))
+}
+
+func (p *redisPipeline) ZRemRangeByScore(key, min, max string) *IntReply {
+	return p.intReply(p.pl.ZRemRangeByScore(key, min, max))
+}
+
+func (p *redisPipeline) ZRemRangeByRank(key string, start, stop int64) *IntReply {
+	return p.intReply(p.pl.ZRemRangeByRank(key, start, stop))
+}
+
+func (p *redisPipeline) ZCard(key string) *IntReply {
+	return p.intReply(p.pl.ZCard(key))
+}
+
+func (p *redisPipeline) ZCount(key, min, max string) *IntReply {
+	return p.intReply(p.pl.ZCount(key, min, max))
+}
+
+func (p *redisPipeline) ZRangeWithScores(key string, start, stop int64) *ElementsReply {
+	return p.elementsReply(p.pl.ZRangeWithScores(key, start, stop))
+}
+
+func (p *redisPipeline) ZRevRangeWithScores(key string, start, stop int64) *ElementsReply {
+	return p.elementsReply(p.pl.ZRevRangeWithScores(key, start, stop))
+}
+
+func (p *redisPipeline) HSet(key, field, value string) *IntReply {
+	cmd := p.pl.HSet(key, field, value)
+	r := &IntReply{}
+	p.fills = append(p.fills, func() {
+		if cmd.Val() {
+			r.Val = 1
+		}
+		r.Err = cmd.Err()
+	})
+	return r
+}
+
+func (p *redisPipeline) HMSet(key string, fields map[string]string) *StatusReply {
+	values := make(map[string]interface{}, len(fields))
+	for field, value := range fields {
+		values[field] = value
+	}
+	return p.statusReply(p.pl.HMSet(key, values))
+}
+
+func (p *redisPipeline) HDel(key string, fields ...string) *IntReply {
+	return p.intReply(p.pl.HDel(key, fields...))
+}
+
+func (p *redisPipeline) HLen(key string) *IntReply {
+	return p.intReply(p.pl.HLen(key))
+}
+
+func (p *redisPipeline) HGetAll(key string) *MapReply {
+	cmd := p.pl.HGetAll(key)
+	r := &MapReply{}
+	p.fills = append(p.fills, func() {
+		r.Val, r.Err = cmd.Val(), cmd.Err()
+	})
+	return r
+}
+
+func (p *redisPipeline) Get(key string) *StringReply {
+	cmd := p.pl.Get(key)
+	r := &StringReply{}
+	p.fills = append(p.fills, func() {
+		r.Val, r.Ok, r.Err = stringResult(cmd)
+	})
+	return r
+}
+
+func (p *redisPipeline) Set(key, value string) *StatusReply {
+	return p.statusReply(p.pl.Set(key, value, 0))
+}
+
+func (p *redisPipeline) Del(keys ...string) *IntReply {
+	return p.intReply(p.pl.Del(keys...))
+}
+
+func (p *redisPipeline) Unlink(keys ...string) *IntReply {
+	return p.intReply(p.pl.Unlink(keys...))
+}
+
+func strArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i := range values {
+		args[i] = values[i]
+	}
+	return args
+}
+
+func (p *redisPipeline) LPush(key string, values ...string) *IntReply {
+	return p.intReply(p.pl.LPush(key, strArgs(values)...))
+}
+
+func (p *redisPipeline) RPush(key string, values ...string) *IntReply {
+	return p.intReply(p.pl.RPush(key, strArgs(values)...))
+}
+
+func (p *redisPipeline) LRem(key string, count int64, value string) *IntReply {
+	return p.intReply(p.pl.LRem(key, count, value))
+}
+
+func (p *redisPipeline) PExpire(key string, ttl time.Duration) *IntReply {
+	cmd := p.pl.PExpire(key, ttl)
+	r := &IntReply{}
+	p.fills = append(p.fills, func() {
+		if cmd.Val() {
+			r.Val = 1
+		}
+		r.Err = cmd.Err()
+	})
+	return r
+}
+
+func (p *redisPipeline) PExpireAt(key string, at time.Time) *IntReply {
+	cmd := p.pl.PExpireAt(key, at)
+	r := &IntReply{}
+	p.fills = append(p.fills, func() {
+		if cmd.Val() {
+			r.Val = 1
+		}
+		r.Err = cmd.Err()
+	})
+	return r
+}
+
+func (p *redisPipeline) Exists(keys ...string) *IntReply {
+	return p.intReply(p.pl.Exists(keys...))
+}
+
+func (p *redisPipeline) MemoryUsage(key string) *IntReply {
+	return p.intReply(p.pl.MemoryUsage(key))
+}
+
+// Exec key不存在导致的 redis.Nil 不算错误
+func (p *redisPipeline) Exec() error {
+	cmds, err := p.pl.Exec()
+	for _, fill := range p.fills {
+		fill()
+	}
+	for _, cmd := range cmds {
+		if err := nilAsNone(cmd.Err()); err != nil {
+			return err
+		}
+	}
+	return nilAsNone(err)
+}
@@ -0,0 +1,304 @@
+package topk
+
+import (
+	"context"
+	"fmt"
+	"pushan/RedTopK/util"
+	"time"
+
+	"github.com/go-basic/uuid"
+)
+
+const (
+	// blockSlice 单次 BLPOP 的最长等待时间, 每次等待之后检查ctx并重试弹出
+	blockSlice = time.Second
+	// waiterTTL 等待者存活标记的过期时间, 异常退出的等待者过期后不再被唤醒
+	waiterTTL = 5 * time.Second
+)
+
+/*
+BlockingPopper 可以等待新元素的 Popper.
+BlockingPopTop 先尝试 PopTop, 没有元素时等待 AddElement 的通知, 收到通知后再次弹出,
+直到弹出至少一个元素, 超过timeout或者ctx结束. timeout为0表示只受ctx限制.
+超时返回空的结果, ctx结束返回ctx的错误.
+等待者按开始等待的顺序排队, 每次 AddElement 唤醒队首的一个.
+*/
+type BlockingPopper interface {
+	Popper
+	BlockingPopTop(ctx context.Context, key string, n int, timeout time.Duration) (error, []Element)
+}
+
+// wakeScript 唤醒队列中第一个存活的等待者, 与 lua provider 脚本中的 notify 相同
+var wakeScript = NewScript(`
+	local queueKey = KEYS[1]
+	while true do
+		local id = redis.call("lpop", queueKey)
+		if not id then
+			return 0
+		end
+		local wakeKey = queueKey .. ":" .. id
+		if redis.call("exists", wakeKey .. ":alive") == 1 then
+			redis.call("rpush", wakeKey, "1")
+			redis.call("pexpire", wakeKey, ARGV[1])
+			return 1
+		end
+	end
+`)
+
+// waitQueueKey 等待者id的队列, 每个等待者在 queueKey:id 上 BLPOP
+func waitQueueKey(key string) string {
+	return key + "::waiters"
+}
+
+// wakeWaiter 在 AddElement 之后调用, 失败只记录日志, 等待者在下一次重试弹出时仍然可以取到元素
+func wakeWaiter(b Backend, o options, queueKey string) {
+	if _, err := b.Eval(wakeScript, []string{queueKey}, waiterTTL.Milliseconds()); err != nil {
+		o.logError("wake waiter failed", err, queueKey, "", "")
+	}
+}
+
+/*
+wakeIfWaiting waiting 是与写入在同一个pipeline中(或者在持有锁时)查询的队列是否存在, 没有等待者时不执行脚本.
+查询之后才加入队列的等待者在写入之后弹出, 不需要唤醒.
+*/
+func wakeIfWaiting(b Backend, o options, queueKey string, waiting *IntReply) {
+	if waiting.Val > 0 {
+		wakeWaiter(b, o, queueKey)
+	}
+}
+
+// parseWaitingReply 解析 {等待队列是否存在, 元素} 形式的脚本回复, 队列在写入的脚本中查询
+func parseWaitingReply(res interface{}) ([]Element, *IntReply, error) {
+	l, ok := res.([]interface{})
+	if !ok || len(l) != 2 {
+		return nil, nil, fmt.Errorf("%w: unexpected script reply %v", ErrCorruptLayout, res)
+	}
+	waiting, ok := l[0].(int64)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: unexpected script reply %v", ErrCorruptLayout, res)
+	}
+	elements, err := parseScoredReply(l[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return elements, &IntReply{Val: waiting}, nil
+}
+
+// waiter redis中的一个等待者
+type waiter struct {
+	b        Backend
+	queueKey string
+	id       string
+	queued   bool
+}
+
+func (w *waiter) wakeKey() string {
+	return w.queueKey + ":" + w.id
+}
+
+// join 不在队列中时加入队列, front为true时排在队首; 同时刷新存活标记
+func (w *waiter) join(front bool) error {
+	pl := w.b.TxPipeline()
+	if !w.queued {
+		if front {
+			pl.LPush(w.queueKey, w.id)
+		} else {
+			pl.RPush(w.queueKey, w.id)
+		}
+	}
+	alive := w.wakeKey() + ":alive"
+	pl.Set(alive, "1")
+	pl.PExpire(alive, waiterTTL)
+	if err := pl.Exec(); err != nil {
+		return err
+	}
+	w.queued = true
+	return nil
+}
+
+// leave 离开队列, 已经被唤醒但还没有处理的通知交给下一个等待者
+func (w *waiter) leave(o options) {
+	pl := w.b.TxPipeline()
+	pl.Del(w.wakeKey() + ":alive")
+	pl.LRem(w.queueKey, 1, w.id)
+	pending := pl.Del(w.wakeKey())
+	if err := pl.Exec(); err != nil {
+		o.logError("leave wait queue failed", err, w.queueKey, "", "")
+		return
+	}
+	if pending.Val > 0 {
+		wakeWaiter(w.b, o, w.queueKey)
+	}
+}
+
+// deadline timeout为0时返回零值
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+/*
+blockingPop redis provider共用的等待逻辑. 先加入队列再弹出, 弹出和等待之间的 AddElement 不会丢失.
+被唤醒后没有弹出元素(被其他客户端取走)时重新排在队首, 不会失去位置.
+redis 6 之前 BLPOP 的精度为秒, 实际等待时间最多比timeout多1秒.
+*/
+func blockingPop(ctx context.Context, b Backend, o options, queueKey string, n int, timeout time.Duration,
+	pop func() (error, []Element)) (error, []Element) {
+	if n <= 0 {
+		return nil, make([]Element, 0)
+	}
+	until := deadline(timeout)
+	w := &waiter{b: b, queueKey: queueKey, id: uuid.New()}
+	defer w.leave(o)
+	woken := false
+	for {
+		if err := w.join(woken); err != nil {
+			o.logError("join wait queue failed", err, queueKey, "", "")
+			return util.Wrap(err), nil
+		}
+		err, ans := pop()
+		if err != nil {
+			return err, nil
+		}
+		if len(ans) > 0 {
+			return nil, ans
+		}
+		if err := ctx.Err(); err != nil {
+			return util.Wrap(err), nil
+		}
+		wait := blockSlice
+		if !until.IsZero() {
+			left := time.Until(until)
+			if left <= 0 {
+				return nil, ans
+			}
+			if left < wait {
+				wait = left
+			}
+		}
+		res, err := b.BLPop(wait, w.wakeKey())
+		if err != nil {
+			o.logError("wait notification failed", err, queueKey, "", "")
+			return util.Wrap(err), nil
+		}
+		// 唤醒者已经把id从队列中取出
+		woken = res != nil
+		if woken {
+			w.queued = false
+		}
+	}
+}
+
+func (z ZSetTopKProvider) BlockingPopTop(ctx context.Context, key string, n int, timeout time.Duration) (err error, ans []Element) {
+	_, end := z.opts.begin(ProviderZSet, OpBlockingPopTop, "key", key, "n", n)
+	defer end(&err)
+	return blockingPop(ctx, z.b, z.opts, waitQueueKey(key), n, timeout, func() (error, []Element) {
+		ans, err := z.b.ZPopMin(key, int64(n))
+		if err != nil {
+			z.opts.logError("pop failed", err, key, "", key)
+			return util.Wrap(err), nil
+		}
+		return nil, ans
+	})
+}
+
+// BlockingPopTop 弹出时循环抢锁, 与 AddElement 的锁竞争不会导致失败
+func (z zSetLockTopKProvider) BlockingPopTop(ctx context.Context, key string, n int, timeout time.Duration) (err error, ans []Element) {
+	span, end := z.opts.begin(ProviderLock, OpBlockingPopTop, "key", key, "n", n)
+	defer end(&err)
+	z = z.withTrace(span)
+	return blockingPop(ctx, z.b, z.opts, waitQueueKey(z.makeMetaKey(key)), n, timeout, func() (error, []Element) {
+		return z.pop(key, n, true)
+	})
+}
+
+// BlockingPopTop 等待者由脚本中的 add 唤醒
+func (z zSetShardTopKProvider) BlockingPopTop(ctx context.Context, key string, n int, timeout time.Duration) (err error, ans []Element) {
+	_, end := z.opts.begin(ProviderLua, OpBlockingPopTop, "key", key, "n", n)
+	defer end(&err)
+	return blockingPop(ctx, z.b, z.opts, waitQueueKey(z.makeMetaKey(key)), n, timeout, func() (error, []Element) {
+		return z.pop(key, n, "poptop")
+	})
+}
+
+// BlockingPopTop 等待者在进程内排队, AddElement 唤醒队首的等待者
+func (m *MemoryTopKProvider) BlockingPopTop(ctx context.Context, key string, n int, timeout time.Duration) (err error, ans []Element) {
+	_, end := m.opts.begin(ProviderMemory, OpBlockingPopTop, "key", key, "n", n)
+	defer end(&err)
+	if n <= 0 {
+		return nil, make([]Element, 0)
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	woken := false
+	for {
+		m.mu.Lock()
+		ans = m.popLocked(key, n, true)
+		if len(ans) > 0 {
+			m.mu.Unlock()
+			return nil, ans
+		}
+		ch := make(chan struct{}, 1)
+		if woken {
+			m.waiters[key] = append([]chan struct{}{ch}, m.waiters[key]...)
+		} else {
+			m.waiters[key] = append(m.waiters[key], ch)
+		}
+		m.mu.Unlock()
+		select {
+		case <-ch:
+			woken = true
+			continue
+		case <-expired:
+		case <-ctx.Done():
+			err = util.Wrap(ctx.Err())
+		}
+		m.mu.Lock()
+		if !m.removeWaiter(key, ch) {
+			// 已经被唤醒, 把通知交给下一个等待者
+			m.wakeOne(key)
+		}
+		m.mu.Unlock()
+		if err != nil {
+			return err, nil
+		}
+		return nil, ans
+	}
+}
+
+// wakeOne 唤醒key的第一个等待者, 在持有锁的情况下执行
+func (m *MemoryTopKProvider) wakeOne(key string) {
+	q := m.waiters[key]
+	if len(q) == 0 {
+		return
+	}
+	q[0] <- struct{}{}
+	if len(q) == 1 {
+		delete(m.waiters, key)
+	} else {
+		m.waiters[key] = q[1:]
+	}
+}
+
+// removeWaiter 从队列中删除ch, ch已经被唤醒时返回false, 在持有锁的情况下执行
+func (m *MemoryTopKProvider) removeWaiter(key string, ch chan struct{}) bool {
+	q := m.waiters[key]
+	for i := range q {
+		if q[i] == ch {
+			q = append(q[:i], q[i+1:]...)
+			if len(q) == 0 {
+				delete(m.waiters, key)
+			} else {
+				m.waiters[key] = q
+			}
+			return true
+		}
+	}
+	return false
+}
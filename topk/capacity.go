@@ -0,0 +1,221 @@
+package topk
+
+import (
+	"fmt"
+	"pushan/RedTopK/util"
+	"strconv"
+	"strings"
+)
+
+/*
+CappedAdder 设置了 WithCapacity 时可以取得被淘汰元素的provider.
+AddElementEvict 与 AddElement 相同, 额外返回超出容量被淘汰的元素, 按score降序.
+key已满且id排在最后一名之后时id不会被加入, id本身出现在结果中, 此时 AddElement 返回 ErrRejected.
+已经存在的member更新score时不会被拒绝. 淘汰从最后一个shard开始, 整个shard被淘汰时直接删除.
+没有设置容量时结果总是为空. MoveTopUntil 不检查容量.
+*/
+type CappedAdder interface {
+	AddElementEvict(key string, id string, score float64) (error, []Element)
+}
+
+// rejectedErr id在被淘汰的元素中时返回 ErrRejected
+func rejectedErr(key string, id string, evicted []Element) error {
+	for i := range evicted {
+		if evicted[i].Id == id {
+			return util.WrapSkip(fmt.Errorf("%w: (%s, %s)", ErrRejected, key, id), 1)
+		}
+	}
+	return nil
+}
+
+func evictedOrEmpty(evicted []Element) []Element {
+	if evicted == nil {
+		return make([]Element, 0)
+	}
+	return evicted
+}
+
+// zsetCapAddScript KEYS[2]为key的等待队列, 返回 {队列是否存在, 淘汰的元素}, 直接拒绝时淘汰的是member本身
+var zsetCapAddScript = NewScript(`
+	local key, member, score, cap = KEYS[1], ARGV[1], ARGV[2], tonumber(ARGV[3])
+	local total = redis.call("zcard", key)
+	if not redis.call("zscore", key, member) then
+		if total >= cap and total > 0 then
+			local worst = redis.call("zrange", key, -1, -1, "withscores")
+			if tonumber(score) > tonumber(worst[2]) then
+				return {0, member .. "," .. score .. ","}
+			end
+		end
+		total = total + 1
+	end
+	redis.call("zadd", key, score, member)
+	local waiting = redis.call("exists", KEYS[2])
+	if total <= cap then
+		return {waiting, ""}
+	end
+	local l = redis.call("zrevrange", key, 0, total - cap - 1, "withscores")
+	redis.call("zremrangebyrank", key, cap - total, -1)
+	return {waiting, table.concat(l, ",") .. ","}
+`)
+
+func (z ZSetTopKProvider) AddElementEvict(key string, id string, score float64) (err error, evicted []Element) {
+	_, end := z.opts.begin(ProviderZSet, OpAdd, "key", key, "member", id)
+	defer end(&err)
+	if err := z.opts.validate(key, id, score); err != nil {
+		return err, nil
+	}
+	evicted, err = z.add(key, id, score)
+	if err != nil {
+		return err, nil
+	}
+	return nil, evictedOrEmpty(evicted)
+}
+
+// addCapped 普通zset使用脚本保证原子性
+func (z ZSetTopKProvider) addCapped(key string, id string, score float64, limit int) ([]Element, error) {
+	res, err := z.b.Eval(zsetCapAddScript, []string{key, waitQueueKey(key)}, id, formatScore(score), limit)
+	if err != nil {
+		z.opts.logError("add element failed", err, key, id, key)
+		return nil, util.Wrap(err)
+	}
+	evicted, waiting, err := parseWaitingReply(res)
+	if err != nil {
+		return nil, util.Wrap(err)
+	}
+	// 拒绝时脚本不查询等待队列, waiting为0
+	wakeIfWaiting(z.b, z.opts, waitQueueKey(key), waiting)
+	return evicted, nil
+}
+
+func (z zSetLockTopKProvider) AddElementEvict(key string, id string, score float64) (err error, evicted []Element) {
+	span, end := z.opts.begin(ProviderLock, OpAdd, "key", key, "member", id)
+	defer end(&err)
+	z = z.withTrace(span)
+	if err := z.opts.validate(key, id, score); err != nil {
+		return err, nil
+	}
+	lock, err := z.acquire(key)
+	if err != nil {
+		return err, nil
+	}
+	defer lock.UnLock()
+	metaKey, waiting, err := z.writeMeta(key)
+	if err != nil {
+		return err, nil
+	}
+	evicted, err = z.add(metaKey, key, id, score, waiting)
+	if err != nil {
+		return err, nil
+	}
+	return nil, evictedOrEmpty(evicted)
+}
+
+// addCapped 新member排在最后一名之后时直接拒绝, 否则先添加再从后弹出超出容量的member, 在持有锁的情况下执行
+func (z zSetLockTopKProvider) addCapped(metaKey string, id string, score float64, limit int) ([]Element, error) {
+	total, err := layoutCount(z.b, metaKey, "-inf", "+inf")
+	if err != nil {
+		z.opts.logError("add element failed", err, metaKey, id, "")
+		return nil, util.Wrap(err)
+	}
+	shard, err := z.lookupMember(z.getExistsKey(metaKey, id), id)
+	if err != nil {
+		z.opts.logError("add element failed", err, metaKey, id, "")
+		return nil, util.Wrap(err)
+	}
+	if shard == "" {
+		if total >= int64(limit) {
+			worst, err := z.b.ZRevRangeByScoreWithScores(metaKey, RangeBy{Min: "-inf", Max: "+inf", Count: 1})
+			if err != nil {
+				z.opts.logError("add element failed", err, metaKey, id, "")
+				return nil, util.Wrap(err)
+			}
+			// meta中的score为shard的最大score, 即最后一名的score
+			if len(worst) > 0 && score > worst[0].Score {
+				return []Element{{Id: id, Score: score}}, nil
+			}
+		}
+		total++
+	}
+	if err := z.addMember(metaKey, id, score); err != nil {
+		return nil, err
+	}
+	if total <= int64(limit) {
+		return nil, nil
+	}
+	return z.popMembers(metaKey, int(total)-limit, false)
+}
+
+func (z zSetShardTopKProvider) AddElementEvict(key string, id string, score float64) (err error, evicted []Element) {
+	_, end := z.opts.begin(ProviderLua, OpAdd, "key", key, "member", id)
+	defer end(&err)
+	if err := z.opts.validate(key, id, score); err != nil {
+		return err, nil
+	}
+	evicted, err = z.add(key, id, score)
+	if err != nil {
+		return err, nil
+	}
+	return nil, evictedOrEmpty(evicted)
+}
+
+// addCapped 脚本返回 "结果,淘汰的id,score,...", 结果与 add 相同, 为0表示直接拒绝
+func (z zSetShardTopKProvider) addCapped(key string, id string, score float64, limit int) ([]Element, error) {
+	res, err := z.b.Eval(script, []string{z.makeMetaKey(key)}, "addcap", score, id, limit)
+	if err != nil {
+		z.opts.logError("add element failed", err, key, id, "")
+		return nil, util.Wrap(err)
+	}
+	resStr, ok := res.(string)
+	i := strings.IndexByte(resStr, ',')
+	if !ok || i < 0 {
+		return nil, util.Wrap(fmt.Errorf("%w: unexpected script reply %v", ErrCorruptLayout, res))
+	}
+	code, err := strconv.ParseInt(resStr[:i], 10, 64)
+	if err != nil {
+		return nil, util.Wrap(fmt.Errorf("%w: bad add result: %s", ErrCorruptLayout, err))
+	}
+	z.shardEvent(code)
+	evicted, err := parseScoredReply(resStr[i+1:])
+	if err != nil {
+		return nil, util.Wrap(err)
+	}
+	return evicted, nil
+}
+
+func (m *MemoryTopKProvider) AddElementEvict(key string, id string, score float64) (err error, evicted []Element) {
+	_, end := m.opts.begin(ProviderMemory, OpAdd, "key", key, "member", id)
+	defer end(&err)
+	if err := m.opts.validate(key, id, score); err != nil {
+		return err, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return nil, evictedOrEmpty(m.add(key, id, score))
+}
+
+// addCapped 在持有锁的情况下执行
+func (m *MemoryTopKProvider) addCapped(key string, id string, score float64, limit int) []Element {
+	total := 0
+	exists := false
+	if zs, ok := m.keys[key]; ok {
+		total = len(zs.dict)
+		_, exists = zs.dict[id]
+		if !exists && total >= limit && score > zs.zsl.tail.score {
+			return []Element{{Id: id, Score: score}}
+		}
+	}
+	if !exists {
+		total++
+	}
+	added := m.addLocked(key, id, score)
+	var evicted []Element
+	for ; total > limit; total-- {
+		x := m.keys[key].zsl.tail
+		evicted = append(evicted, Element{Id: x.member, Score: x.score})
+		m.deleteLocked(key, x.member)
+	}
+	if added && rejectedErr(key, id, evicted) == nil {
+		m.wakeOne(key)
+	}
+	return evicted
+}
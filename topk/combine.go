@@ -0,0 +1,303 @@
+package topk
+
+import (
+	"fmt"
+	"math"
+	"pushan/RedTopK/util"
+	"sort"
+	"time"
+)
+
+// Aggregate 合并同一个member在多个key中的加权score的方式, 与 ZUNIONSTORE 的 AGGREGATE 相同
+type Aggregate int
+
+const (
+	AggregateSum Aggregate = iota
+	AggregateMin
+	AggregateMax
+)
+
+const (
+	// DefaultCombineBatch 每一轮从每个key按顺序读取的member数
+	DefaultCombineBatch = 100
+)
+
+// CombineOption TopKUnion 和 TopKInter 的可选配置
+type CombineOption func(*combineOptions)
+
+type combineOptions struct {
+	batch int
+	store string
+}
+
+// WithCombineBatch 每一轮从每个key按顺序读取的member数, 默认为 DefaultCombineBatch
+func WithCombineBatch(n int) CombineOption {
+	return func(o *combineOptions) {
+		if n > 0 {
+			o.batch = n
+		}
+	}
+}
+
+/*
+WithStore 把结果保存为新的排行榜dst, 替换dst原有的内容, 与 UnionStore 相同不检查容量.
+内置的provider先写入新版本再原子地切换, 读取dst不会看到一部分结果.
+其他provider需要实现 Expirer, 先删除dst再逐个写入, 写入期间读取dst可能看到一部分结果.
+*/
+func WithStore(dst string) CombineOption {
+	return func(o *combineOptions) {
+		o.store = dst
+	}
+}
+
+/*
+Combiner 在多个key上计算加权合并之后的前k个member, 不需要读取所有key的全部member.
+使用threshold algorithm: 每一轮从每个key按score升序读取一批member, 对新出现的member查询它在所有key中的score,
+当第k个结果小于所有未出现的member可能达到的最小score时结束.
+*/
+type Combiner struct {
+	tp TopKProvider
+	rq RangeQuerier
+	sq ScoreQuerier
+}
+
+// replacer 可以用一组member原子地替换key的provider, 内置的provider都实现了该接口
+type replacer interface {
+	replace(dst string, members []Element) error
+}
+
+// NewCombiner tp需要实现 RangeQuerier 和 ScoreQuerier, 使用 WithStore 时见 WithStore 的说明
+func NewCombiner(tp TopKProvider) *Combiner {
+	if tp == nil {
+		panic("invalid param: tp")
+	}
+	rq, ok := tp.(RangeQuerier)
+	if !ok {
+		panic("invalid param: tp does not implement topk.RangeQuerier")
+	}
+	sq, ok := tp.(ScoreQuerier)
+	if !ok {
+		panic("invalid param: tp does not implement topk.ScoreQuerier")
+	}
+	return &Combiner{tp: tp, rq: rq, sq: sq}
+}
+
+/*
+TopKUnion 返回所有key的并集中加权合并之后score最小的k个member, 按score升序.
+weights 为nil时所有权重为1, 否则个数需要与keys相同, 且不能为负数.
+member不在某个key中时不参与该key的合并, 与 ZUNIONSTORE 相同.
+*/
+func (c *Combiner) TopKUnion(keys []string, weights []float64, agg Aggregate, k int, opts ...CombineOption) (error, []Element) {
+	return c.combine(keys, weights, agg, k, false, opts)
+}
+
+// TopKInter 与 TopKUnion 相同, 只返回在所有key中都存在的member, 与 ZINTERSTORE 相同
+func (c *Combiner) TopKInter(keys []string, weights []float64, agg Aggregate, k int, opts ...CombineOption) (error, []Element) {
+	return c.combine(keys, weights, agg, k, true, opts)
+}
+
+// walk 按score升序遍历一个key
+type walk struct {
+	key    string
+	weight float64
+	offset int
+	// last 最后读到的加权score, 还没有读到的member的加权score不小于它
+	last float64
+	done bool
+}
+
+func checkWeights(keys []string, weights []float64) ([]float64, error) {
+	if weights == nil {
+		weights = make([]float64, len(keys))
+		for i := range weights {
+			weights[i] = 1
+		}
+		return weights, nil
+	}
+	if len(weights) != len(keys) {
+		return nil, fmt.Errorf("%w: %d weights for %d keys", ErrInvalidWeight, len(weights), len(keys))
+	}
+	for _, w := range weights {
+		// 负数权重会反转顺序, 无法按score升序遍历
+		if math.IsNaN(w) || math.IsInf(w, 0) || w < 0 {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidWeight, w)
+		}
+	}
+	return weights, nil
+}
+
+func (c *Combiner) combine(keys []string, weights []float64, agg Aggregate, k int, inter bool, opts []CombineOption) (error, []Element) {
+	o := combineOptions{batch: DefaultCombineBatch}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	weights, err := checkWeights(keys, weights)
+	if err != nil {
+		return util.Wrap(err), nil
+	}
+	ans := make([]Element, 0)
+	if k > 0 && len(keys) > 0 {
+		ans, err = c.threshold(keys, weights, agg, k, inter, o.batch)
+		if err != nil {
+			return err, nil
+		}
+	}
+	if o.store != "" {
+		if err := c.store(o.store, ans); err != nil {
+			return err, nil
+		}
+	}
+	return nil, ans
+}
+
+func (c *Combiner) threshold(keys []string, weights []float64, agg Aggregate, k int, inter bool, batch int) ([]Element, error) {
+	walks := make([]*walk, len(keys))
+	for i := range keys {
+		walks[i] = &walk{key: keys[i], weight: weights[i]}
+	}
+	seen := make(map[string]bool)
+	found := make([]Element, 0)
+	for {
+		var fresh []string
+		for _, w := range walks {
+			if w.done {
+				continue
+			}
+			err, page := c.rq.RangeByScore(w.key, "-inf", "+inf", w.offset, batch)
+			if err != nil {
+				return nil, err
+			}
+			w.offset += len(page)
+			w.done = len(page) < batch
+			if len(page) > 0 {
+				w.last = w.weight * page[len(page)-1].Score
+			}
+			for _, e := range page {
+				if !seen[e.Id] {
+					seen[e.Id] = true
+					fresh = append(fresh, e.Id)
+				}
+			}
+		}
+		if len(fresh) > 0 {
+			scores := make([]map[string]float64, len(walks))
+			for i, w := range walks {
+				var err error
+				if err, scores[i] = c.sq.GetScores(w.key, fresh); err != nil {
+					return nil, err
+				}
+			}
+			for _, id := range fresh {
+				if score, ok := aggregate(id, walks, scores, agg, inter); ok {
+					found = append(found, Element{Id: id, Score: score})
+				}
+			}
+			sortElements(found)
+			if len(found) > k {
+				found = found[:k]
+			}
+		}
+		bound, more := lowerBound(walks, agg, inter)
+		if !more || (len(found) >= k && found[k-1].Score < bound) {
+			return found, nil
+		}
+	}
+}
+
+// aggregate 合并id在每个key中的加权score, 并集时至少在一个key中存在, 交集时需要在所有key中存在
+func aggregate(id string, walks []*walk, scores []map[string]float64, agg Aggregate, inter bool) (float64, bool) {
+	var ans float64
+	n := 0
+	for i, w := range walks {
+		s, ok := scores[i][id]
+		if !ok {
+			if inter {
+				return 0, false
+			}
+			continue
+		}
+		v := w.weight * s
+		// 与redis相同, 相等时保留先出现的值
+		switch {
+		case n == 0:
+			ans = v
+		case agg == AggregateMin:
+			if v < ans {
+				ans = v
+			}
+		case agg == AggregateMax:
+			if v > ans {
+				ans = v
+			}
+		default:
+			ans += v
+		}
+		n++
+	}
+	return ans, n > 0
+}
+
+/*
+lowerBound 返回还没有读到的member合并之后可能达到的最小score, 没有这样的member时more为false.
+没有读到的member只可能出现在没有遍历完的key中, 且在每个key中的加权score不小于该key的last.
+*/
+func lowerBound(walks []*walk, agg Aggregate, inter bool) (bound float64, more bool) {
+	sum, neg, min, max := 0.0, 0.0, math.Inf(1), math.Inf(-1)
+	hasNeg := false
+	for _, w := range walks {
+		if w.done {
+			if inter {
+				return 0, false
+			}
+			continue
+		}
+		more = true
+		sum += w.last
+		if w.last < 0 {
+			neg += w.last
+			hasNeg = true
+		}
+		min = math.Min(min, w.last)
+		max = math.Max(max, w.last)
+	}
+	switch {
+	case inter && agg == AggregateSum:
+		return sum, more
+	case inter && agg == AggregateMax:
+		return max, more
+	case !inter && agg == AggregateSum && hasNeg:
+		// 并集的和只包含member所在的key, 只出现在last为负数的key中时最小
+		return neg, more
+	}
+	return min, more
+}
+
+// sortElements 按score升序, score相同时按id升序, 与redis zset相同
+func sortElements(members []Element) {
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Score != members[j].Score {
+			return members[i].Score < members[j].Score
+		}
+		return members[i].Id < members[j].Id
+	})
+}
+
+// store 用members替换dst, 见 WithStore
+func (c *Combiner) store(dst string, members []Element) error {
+	if r, ok := c.tp.(replacer); ok {
+		return r.replace(dst, members)
+	}
+	ex, ok := c.tp.(Expirer)
+	if !ok {
+		return util.Wrap(fmt.Errorf("store %s: %T does not implement topk.Expirer", dst, c.tp))
+	}
+	if err := ex.ExpireAt(dst, time.Unix(0, 0)); err != nil {
+		return err
+	}
+	for _, e := range members {
+		if err := c.tp.AddElement(dst, e.Id, e.Score); err != nil {
+			return err
+		}
+	}
+	return nil
+}
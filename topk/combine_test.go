@@ -0,0 +1,218 @@
+package topk_test
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"pushan/RedTopK/topk"
+	"sort"
+	"testing"
+)
+
+var aggregates = []struct {
+	name string
+	agg  topk.Aggregate
+}{
+	{"sum", topk.AggregateSum},
+	{"min", topk.AggregateMin},
+	{"max", topk.AggregateMax},
+}
+
+// fill 把data写入tp, data[i]为第i个key的全部member
+func fill(t *testing.T, tp topk.TopKProvider, keys []string, data []map[string]float64) {
+	t.Helper()
+	for i, key := range keys {
+		for id, score := range data[i] {
+			if err := tp.AddElement(key, id, score); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// bruteCombine 读取全部member计算合并结果, 与 ZUNIONSTORE/ZINTERSTORE 相同
+func bruteCombine(data []map[string]float64, weights []float64, agg topk.Aggregate, k int, inter bool) []topk.Element {
+	ids := make(map[string]bool)
+	for _, m := range data {
+		for id := range m {
+			ids[id] = true
+		}
+	}
+	ans := make([]topk.Element, 0)
+	for id := range ids {
+		var score float64
+		n := 0
+		for i, m := range data {
+			s, ok := m[id]
+			if !ok {
+				continue
+			}
+			w := 1.0
+			if weights != nil {
+				w = weights[i]
+			}
+			v := w * s
+			switch {
+			case n == 0:
+				score = v
+			case agg == topk.AggregateMin && v < score, agg == topk.AggregateMax && v > score:
+				score = v
+			case agg == topk.AggregateSum:
+				score += v
+			}
+			n++
+		}
+		if inter && n < len(data) {
+			continue
+		}
+		ans = append(ans, topk.Element{Id: id, Score: score})
+	}
+	sort.Slice(ans, func(i, j int) bool {
+		if ans[i].Score != ans[j].Score {
+			return ans[i].Score < ans[j].Score
+		}
+		return ans[i].Id < ans[j].Id
+	})
+	if len(ans) > k {
+		ans = ans[:k]
+	}
+	return ans
+}
+
+func combine(c *topk.Combiner, inter bool, keys []string, weights []float64, agg topk.Aggregate, k int, opts ...topk.CombineOption) (error, []topk.Element) {
+	if inter {
+		return c.TopKInter(keys, weights, agg, k, opts...)
+	}
+	return c.TopKUnion(keys, weights, agg, k, opts...)
+}
+
+// TestCombinerBruteForce 随机数据上与读取全部member的结果比较, 每一轮只读取少量member
+func TestCombinerBruteForce(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	keys := []string{"c1", "c2", "c3"}
+	for run := 0; run < 20; run++ {
+		tp := topk.NewMemoryProvider()
+		data := make([]map[string]float64, len(keys))
+		for i := range data {
+			data[i] = make(map[string]float64)
+			for j := r.Intn(30); j >= 0; j-- {
+				data[i][fmt.Sprintf("m%02d", r.Intn(40))] = float64(r.Intn(41) - 20)
+			}
+		}
+		fill(t, tp, keys, data)
+		c := topk.NewCombiner(tp)
+		for _, weights := range [][]float64{nil, {1, 2, 0.5}, {1, 0, 3}} {
+			for _, a := range aggregates {
+				for _, inter := range []bool{false, true} {
+					for _, k := range []int{1, 3, 10, 100} {
+						err, got := combine(c, inter, keys, weights, a.agg, k, topk.WithCombineBatch(2))
+						if err != nil {
+							t.Fatal(err)
+						}
+						want := bruteCombine(data, weights, a.agg, k, inter)
+						if fmt.Sprint(got) != fmt.Sprint(want) {
+							t.Fatalf("run %d inter=%v %s weights=%v k=%d:\n got %v\nwant %v", run, inter, a.name, weights, k, got, want)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestCombinerNegativeSum 并集求和时只出现在last为负数的key中的member可能更小, 不能在读到它之前结束
+func TestCombinerNegativeSum(t *testing.T) {
+	tp := topk.NewMemoryProvider()
+	keys := []string{"n1", "n2"}
+	data := []map[string]float64{
+		{"a": -1, "b": -1, "c": -1, "z": -1},
+		{"w": -1, "x": -1, "y": -1, "z": -1},
+	}
+	fill(t, tp, keys, data)
+	err, got := topk.NewCombiner(tp).TopKUnion(keys, nil, topk.AggregateSum, 1, topk.WithCombineBatch(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[{z -2}]" {
+		t.Fatalf("union sum: %v", got)
+	}
+}
+
+// TestCombinerInterDone 交集时一个key读完之后不会再出现新的member
+func TestCombinerInterDone(t *testing.T) {
+	tp := topk.NewMemoryProvider()
+	keys := []string{"i1", "i2"}
+	data := []map[string]float64{{"a": 1, "b": 2}, {}}
+	for i := 0; i < 20; i++ {
+		data[1][fmt.Sprintf("m%02d", i)] = float64(i)
+	}
+	data[1]["a"] = 50
+	data[1]["b"] = 60
+	fill(t, tp, keys, data)
+	c := topk.NewCombiner(tp)
+	for _, a := range aggregates {
+		err, got := c.TopKInter(keys, nil, a.agg, 10, topk.WithCombineBatch(3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := bruteCombine(data, nil, a.agg, 10, true); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("inter %s: %v, want %v", a.name, got, want)
+		}
+	}
+}
+
+func TestCombinerInvalidWeights(t *testing.T) {
+	c := topk.NewCombiner(topk.NewMemoryProvider())
+	for _, weights := range [][]float64{{1}, {1, -1}} {
+		if err, _ := c.TopKUnion([]string{"a", "b"}, weights, topk.AggregateSum, 1); !errors.Is(err, topk.ErrInvalidWeight) {
+			t.Fatalf("weights %v: %v", weights, err)
+		}
+	}
+}
+
+// plainProvider 只暴露 Combiner 用到的接口, WithStore 先删除dst再逐个写入
+type plainProvider struct {
+	topk.TopKProvider
+	topk.RangeQuerier
+	topk.ScoreQuerier
+	topk.Expirer
+}
+
+func TestCombinerStore(t *testing.T) {
+	m := topk.NewMemoryProvider()
+	plain := plainProvider{m, m, m, m}
+	for _, p := range []struct {
+		name string
+		tp   topk.TopKProvider
+	}{{"replace", m}, {"expirer", plain}} {
+		dst := "dst:" + p.name
+		keys := []string{"s1", "s2"}
+		data := []map[string]float64{{"a": 1, "b": 2, "c": 3}, {"a": 1, "d": 0}}
+		fill(t, p.tp, keys, data)
+		// dst原有的member被替换
+		if err := p.tp.AddElement(dst, "old", -100); err != nil {
+			t.Fatal(err)
+		}
+		err, got := topk.NewCombiner(p.tp).TopKUnion(keys, nil, topk.AggregateSum, 3, topk.WithStore(dst), topk.WithCombineBatch(1))
+		if err != nil {
+			t.Fatalf("%s: %v", p.name, err)
+		}
+		if fmt.Sprint(got) != "[{d 0} {a 2} {b 2}]" {
+			t.Fatalf("%s: %v", p.name, got)
+		}
+		if err, stored := p.tp.GetTopKS(dst, 10); err != nil || fmt.Sprint(stored) != fmt.Sprint(got) {
+			t.Fatalf("%s stored: %v %v", p.name, err, stored)
+		}
+	}
+
+	// 不实现 Expirer 时不能保存
+	type noExpirer struct {
+		topk.TopKProvider
+		topk.RangeQuerier
+		topk.ScoreQuerier
+	}
+	err, _ := topk.NewCombiner(noExpirer{m, m, m}).TopKUnion([]string{"s1"}, nil, topk.AggregateSum, 1, topk.WithStore("dst"))
+	if err == nil {
+		t.Fatal("store without Expirer succeeded")
+	}
+}
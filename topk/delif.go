@@ -0,0 +1,118 @@
+package topk
+
+import (
+	"fmt"
+	"pushan/RedTopK/util"
+)
+
+/*
+ConditionalDeleter 可以按score条件删除member的provider, member的score等于score时才删除.
+member不存在或者score不同时返回 ErrNotFound, 用于只删除自己写入的记录, 例如 scheduler 的领取记录.
+*/
+type ConditionalDeleter interface {
+	DeleteElementIf(key string, id string, score float64) error
+}
+
+// zsetDelIfScript score相同时删除, 返回删除的个数
+var zsetDelIfScript = NewScript(`
+	local score = redis.call("zscore", KEYS[1], ARGV[1])
+	if score and tonumber(score) == tonumber(ARGV[2]) then
+		return redis.call("zrem", KEYS[1], ARGV[1])
+	end
+	return 0
+`)
+
+func (z ZSetTopKProvider) DeleteElementIf(key string, id string, score float64) (err error) {
+	_, end := z.opts.begin(ProviderZSet, OpDelete, "key", key, "member", id)
+	defer end(&err)
+	if err := z.opts.validate(key, id, score); err != nil {
+		return err
+	}
+	res, err := z.b.Eval(zsetDelIfScript, []string{key}, id, formatScore(score))
+	if err != nil {
+		z.opts.logError("delete element failed", err, key, id, key)
+		return util.Wrap(err)
+	}
+	if n, _ := res.(int64); n == 0 {
+		return util.Wrap(fmt.Errorf("%w: (%s, %s, %v)", ErrNotFound, key, id, score))
+	}
+	return nil
+}
+
+func (z zSetLockTopKProvider) DeleteElementIf(key string, id string, score float64) (err error) {
+	span, end := z.opts.begin(ProviderLock, OpDelete, "key", key, "member", id)
+	defer end(&err)
+	z = z.withTrace(span)
+	if err := z.opts.validate(key, id, score); err != nil {
+		return err
+	}
+	lock, err := z.acquire(key)
+	if err != nil {
+		return err
+	}
+	defer lock.UnLock()
+	metaKey, err := z.currentMeta(key)
+	if err != nil {
+		return err
+	}
+	shard, err := z.lookupMember(z.getExistsKey(metaKey, id), id)
+	if err != nil {
+		z.opts.logError("delete element failed", err, metaKey, id, "")
+		return util.Wrap(err)
+	}
+	if shard == "" {
+		return util.Wrap(fmt.Errorf("%w: (%s, %s, %v)", ErrNotFound, key, id, score))
+	}
+	old, ok, err := z.b.ZScore(shard, id)
+	if err != nil {
+		z.opts.logError("delete element failed", err, metaKey, id, shard)
+		return util.Wrap(err)
+	}
+	if !ok {
+		return util.Wrap(fmt.Errorf("%w: member %s points to %s", ErrCorruptLayout, id, shard))
+	}
+	if old != score {
+		return util.Wrap(fmt.Errorf("%w: (%s, %s, %v)", ErrNotFound, key, id, score))
+	}
+	if _, err := z.deleteMember(metaKey, id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteElementIf 脚本中的 "delif" 比较score并删除
+func (z zSetShardTopKProvider) DeleteElementIf(key string, id string, score float64) (err error) {
+	_, end := z.opts.begin(ProviderLua, OpDelete, "key", key, "member", id)
+	defer end(&err)
+	if err := z.opts.validate(key, id, score); err != nil {
+		return err
+	}
+	res, err := evalInt(z.b, []string{z.makeMetaKey(key)}, "delif", id, formatScore(score))
+	if err != nil {
+		z.opts.logError("delete element failed", err, key, id, "")
+		return util.Wrap(err)
+	}
+	if res == 0 {
+		return util.Wrap(fmt.Errorf("%w: (%s, %s, %v)", ErrNotFound, key, id, score))
+	}
+	return nil
+}
+
+func (m *MemoryTopKProvider) DeleteElementIf(key string, id string, score float64) (err error) {
+	_, end := m.opts.begin(ProviderMemory, OpDelete, "key", key, "member", id)
+	defer end(&err)
+	if err := m.opts.validate(key, id, score); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	zs, ok := m.keys[key]
+	if !ok {
+		return util.Wrap(fmt.Errorf("%w: (%s, %s, %v)", ErrNotFound, key, id, score))
+	}
+	if old, ok := zs.dict[id]; !ok || old != score {
+		return util.Wrap(fmt.Errorf("%w: (%s, %s, %v)", ErrNotFound, key, id, score))
+	}
+	m.deleteLocked(key, id)
+	return nil
+}
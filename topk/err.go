@@ -0,0 +1,21 @@
+package topk
+
+import "errors"
+
+// 可以用 errors.Is 判断的错误类型, 返回时都会经过 util.Wrap 包装
+var (
+	// ErrLockNotAcquired 创建分布式锁失败, 或者在锁的超时时间内没有获取到锁
+	ErrLockNotAcquired = errors.New("topk: lock not acquired")
+	// ErrNotFound 查询或者按条件删除的元素不存在. DeleteElement 删除不存在的元素不是错误
+	ErrNotFound = errors.New("topk: element not found")
+	// ErrInvalidScore score不合法, 例如NaN
+	ErrInvalidScore = errors.New("topk: invalid score")
+	// ErrInvalidId id不合法, 例如空字符串或超过长度限制
+	ErrInvalidId = errors.New("topk: invalid id")
+	// ErrCorruptLayout meta zset, data shard 和 m_to_z 之间的数据不一致
+	ErrCorruptLayout = errors.New("topk: corrupt shard layout")
+	// ErrRejected 设置了容量的key已满, 新元素排在最后一名之后
+	ErrRejected = errors.New("topk: rejected by capacity")
+	// ErrInvalidWeight TopKUnion 和 TopKInter 的权重不合法, 例如负数或个数与key不一致
+	ErrInvalidWeight = errors.New("topk: invalid weight")
+)
@@ -0,0 +1,135 @@
+package topk
+
+import (
+	"fmt"
+	"pushan/RedTopK/util"
+	"time"
+)
+
+/*
+Expirer 可以给整个key设置过期时间的provider, 与 PEXPIREAT 相同, at 早于当前时间时立即删除.
+分片provider的一个key由meta, shard, shard_cnt 和 m_to_z 组成, 过期时间设置在所有这些key上,
+之后新建的shard和 m_to_z 继承meta的剩余过期时间. Repair 重建布局后需要重新设置.
+*/
+type Expirer interface {
+	ExpireAt(key string, at time.Time) error
+}
+
+// inheritTTLScript KEYS[1]为meta, 其余没有过期时间的key继承meta的剩余过期时间, 与脚本中的 inheritTTL 相同
+var inheritTTLScript = NewScript(`
+	local ttl = redis.call("pttl", KEYS[1])
+	if ttl <= 0 then
+		return 0
+	end
+	for i = 2, #KEYS do
+		if redis.call("pttl", KEYS[i]) == -1 then
+			redis.call("pexpire", KEYS[i], ttl)
+		end
+	end
+	return 1
+`)
+
+func inheritTTL(b Backend, metaKey string, keys ...string) error {
+	_, err := b.Eval(inheritTTLScript, append([]string{metaKey}, keys...))
+	return err
+}
+
+// layoutExpireAt 给meta和它引用的所有key以及extra设置过期时间, lua 和 lock provider 的布局相同
+func layoutExpireAt(b Backend, metaKey string, at time.Time, extra ...string) error {
+	shards, err := b.ZRangeByScore(metaKey, RangeBy{Min: "-inf", Max: "+inf"})
+	if err != nil {
+		return err
+	}
+	pl := b.Pipeline()
+	for _, key := range append(layoutKeys(metaKey, shards), extra...) {
+		pl.PExpireAt(key, at)
+	}
+	return pl.Exec()
+}
+
+// layoutKeys meta和它引用的所有key, shards 为meta中的shard
+func layoutKeys(metaKey string, shards []string) []string {
+	keys := append([]string{metaKey, metaKey + ":shard_cnt"}, shards...)
+	for i := 0; i < HashShardCnt; i++ {
+		keys = append(keys, fmt.Sprintf("%s:m_to_z:%d", metaKey, i))
+	}
+	return keys
+}
+
+func (z ZSetTopKProvider) ExpireAt(key string, at time.Time) (err error) {
+	_, end := z.opts.begin(ProviderZSet, OpExpire, "key", key)
+	defer end(&err)
+	pl := z.b.Pipeline()
+	pl.PExpireAt(key, at)
+	if err := pl.Exec(); err != nil {
+		z.opts.logError("expire failed", err, key, "", key)
+		return util.Wrap(err)
+	}
+	return nil
+}
+
+func (z zSetLockTopKProvider) ExpireAt(key string, at time.Time) (err error) {
+	span, end := z.opts.begin(ProviderLock, OpExpire, "key", key)
+	defer end(&err)
+	z = z.withTrace(span)
+	lock, err := z.acquire(key)
+	if err != nil {
+		return err
+	}
+	defer lock.UnLock()
+	metaKey, err := z.currentMeta(key)
+	if err != nil {
+		return err
+	}
+	if err := layoutExpireAt(z.b, metaKey, at, pointerKeys(z.makeMetaKey(key))...); err != nil {
+		z.opts.logError("expire failed", err, metaKey, "", "")
+		return util.Wrap(err)
+	}
+	return nil
+}
+
+// ExpireAt 脚本中的 "expire" 读取shard并设置过期时间, 与分裂和 UnionStore 的切换是原子的
+func (z zSetShardTopKProvider) ExpireAt(key string, at time.Time) (err error) {
+	_, end := z.opts.begin(ProviderLua, OpExpire, "key", key)
+	defer end(&err)
+	ms := at.UnixNano() / int64(time.Millisecond)
+	if _, err := evalInt(z.b, []string{z.makeMetaKey(key)}, "expire", ms); err != nil {
+		z.opts.logError("expire failed", err, key, "", "")
+		return util.Wrap(err)
+	}
+	return nil
+}
+
+// pointerKeys UnionStore 使用的版本指针和计数器, 与当前版本一起过期
+func pointerKeys(base string) []string {
+	return []string{base + currentSuffix, base + genSuffix}
+}
+
+// ExpireAt 用定时器删除key, 再次调用时替换之前的定时器. at 早于当前时间时立即删除
+func (m *MemoryTopKProvider) ExpireAt(key string, at time.Time) (err error) {
+	_, end := m.opts.begin(ProviderMemory, OpExpire, "key", key)
+	defer end(&err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.expires[key]; ok {
+		t.Stop()
+		delete(m.expires, key)
+	}
+	if !at.After(time.Now()) {
+		delete(m.keys, key)
+		return nil
+	}
+	var t *time.Timer
+	t = time.AfterFunc(time.Until(at), func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		// 已经被新的定时器替换
+		if m.expires[key] != t {
+			return
+		}
+		delete(m.expires, key)
+		delete(m.keys, key)
+	})
+	m.expires[key] = t
+	return nil
+}
@@ -0,0 +1,184 @@
+package topk
+
+import (
+	"fmt"
+	"pushan/RedTopK/util"
+	"strconv"
+)
+
+// Checker 可以检查分片布局一致性的provider
+type Checker interface {
+	Check(key string) (error, *CheckReport)
+}
+
+// 布局问题类型
+const (
+	// ProblemEmptyShard meta zset 中存在空的shard
+	ProblemEmptyShard = "empty_shard"
+	// ProblemMetaScore meta zset 中记录的score与shard实际的最大score不一致
+	ProblemMetaScore = "meta_score"
+	// ProblemOverlap 相邻shard的score区间重叠, topk结果的顺序会出错
+	ProblemOverlap = "overlap"
+	// ProblemDuplicate 同一个member出现在多个shard中
+	ProblemDuplicate = "duplicate"
+	// ProblemMissingIndex shard中的member在 m_to_z 中没有记录
+	ProblemMissingIndex = "missing_index"
+	// ProblemStaleIndex m_to_z 指向的shard中不存在该member
+	ProblemStaleIndex = "stale_index"
+	// ProblemOrphanShard 存在data shard, 但不在 meta zset 中
+	ProblemOrphanShard = "orphan_shard"
+)
+
+// Problem 一致性检查发现的问题
+type Problem struct {
+	Kind   string `json:"kind"`
+	Shard  string `json:"shard,omitempty"`
+	Member string `json:"member,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: shard=%s member=%s %s", p.Kind, p.Shard, p.Member, p.Detail)
+}
+
+type CheckReport struct {
+	Key      string    `json:"key"`
+	MetaKey  string    `json:"meta_key"`
+	Shards   int       `json:"shards"`
+	Members  int64     `json:"members"`
+	Problems []Problem `json:"problems"`
+}
+
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *CheckReport) add(kind, shard, member, detail string) {
+	r.Problems = append(r.Problems, Problem{Kind: kind, Shard: shard, Member: member, Detail: detail})
+}
+
+// checkLayout 读取整个布局并检查一致性, lua 和 lock provider 的布局相同
+func checkLayout(b Backend, key, metaKey string) (*CheckReport, error) {
+	metaZSets, err := b.ZRangeWithScores(metaKey, 0, -1)
+	if err != nil {
+		return nil, util.Wrap(err)
+	}
+	report := &CheckReport{Key: key, MetaKey: metaKey, Shards: len(metaZSets)}
+
+	pl := b.Pipeline()
+	shardReplies := make([]*ElementsReply, len(metaZSets))
+	for i := range metaZSets {
+		shardReplies[i] = pl.ZRangeWithScores(metaZSets[i].Id, 0, -1)
+	}
+	hashReplies := make([]*MapReply, HashShardCnt)
+	for i := range hashReplies {
+		hashReplies[i] = pl.HGetAll(fmt.Sprintf("%s:m_to_z:%d", metaKey, i))
+	}
+	shardCntReply := pl.Get(metaKey + ":shard_cnt")
+	if err := pl.Exec(); err != nil {
+		return nil, util.Wrap(err)
+	}
+
+	// member -> shard
+	located := make(map[string]string)
+	inMeta := make(map[string]bool, len(metaZSets))
+	var prevShard string
+	var prevMax Element
+	for i := range metaZSets {
+		shard := metaZSets[i].Id
+		inMeta[shard] = true
+		members := shardReplies[i].Val
+		report.Members += int64(len(members))
+		if len(members) == 0 {
+			report.add(ProblemEmptyShard, shard, "", "")
+			continue
+		}
+		first, last := members[0], members[len(members)-1]
+		if last.Score != metaZSets[i].Score {
+			report.add(ProblemMetaScore, shard, "", fmt.Sprintf("meta=%g max=%g", metaZSets[i].Score, last.Score))
+		}
+		if prevShard != "" && (prevMax.Score > first.Score ||
+			prevMax.Score == first.Score && prevMax.Id > first.Id) {
+			report.add(ProblemOverlap, shard, "", fmt.Sprintf("previous shard %s ends at %g, starts at %g", prevShard, prevMax.Score, first.Score))
+		}
+		prevShard, prevMax = shard, last
+		for j := range members {
+			member := members[j].Id
+			if other, ok := located[member]; ok {
+				report.add(ProblemDuplicate, shard, member, "also in "+other)
+				continue
+			}
+			located[member] = shard
+		}
+	}
+
+	indexed := make(map[string]bool, len(located))
+	for i := range hashReplies {
+		for member, shard := range hashReplies[i].Val {
+			indexed[member] = true
+			actual, ok := located[member]
+			if !ok {
+				report.add(ProblemStaleIndex, shard, member, "not in any shard")
+			} else if actual != shard {
+				report.add(ProblemStaleIndex, shard, member, "actually in "+actual)
+			}
+		}
+	}
+	for member, shard := range located {
+		if !indexed[member] {
+			report.add(ProblemMissingIndex, shard, member, "")
+		}
+	}
+
+	shardCnt, _ := strconv.ParseInt(shardCntReply.Val, 10, 64)
+	pl = b.Pipeline()
+	existsReplies := make(map[string]*IntReply)
+	for i := int64(1); i <= shardCnt; i++ {
+		shard := fmt.Sprintf("%s:data_shard:%d", metaKey, i)
+		if !inMeta[shard] {
+			existsReplies[shard] = pl.Exists(shard)
+		}
+	}
+	if len(existsReplies) > 0 {
+		if err := pl.Exec(); err != nil {
+			return nil, util.Wrap(err)
+		}
+	}
+	for shard, reply := range existsReplies {
+		if reply.Val > 0 {
+			report.add(ProblemOrphanShard, shard, "", "")
+		}
+	}
+	return report, nil
+}
+
+func (z zSetShardTopKProvider) Check(key string) (error, *CheckReport) {
+	metaKey, err := z.currentMeta(key)
+	if err != nil {
+		return err, nil
+	}
+	report, err := checkLayout(z.b, key, metaKey)
+	if err != nil {
+		z.opts.logError("check layout failed", err, key, "", "")
+		return err, nil
+	}
+	return nil, report
+}
+
+func (z zSetLockTopKProvider) Check(key string) (error, *CheckReport) {
+	lock, err := z.acquire(key)
+	if err != nil {
+		return err, nil
+	}
+	defer lock.UnLock()
+	metaKey, err := z.currentMeta(key)
+	if err != nil {
+		return err, nil
+	}
+	report, err := checkLayout(z.b, key, metaKey)
+	if err != nil {
+		z.opts.logError("check layout failed", err, metaKey, "", "")
+		return err, nil
+	}
+	return nil, report
+}
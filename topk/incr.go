@@ -0,0 +1,136 @@
+package topk
+
+import (
+	"fmt"
+	"pushan/RedTopK/util"
+	"strconv"
+	"strings"
+)
+
+/*
+Incrementer 可以原子地增加member的score的provider, 与 ZINCRBY 相同, member不存在时从0开始, 返回新的score.
+与 MoveTopUntil 相同, IncrElement 不检查容量.
+*/
+type Incrementer interface {
+	IncrElement(key string, id string, delta float64) (error, float64)
+}
+
+func (z ZSetTopKProvider) IncrElement(key string, id string, delta float64) (err error, score float64) {
+	_, end := z.opts.begin(ProviderZSet, OpIncr, "key", key, "member", id)
+	defer end(&err)
+	if err := z.opts.validate(key, id, delta); err != nil {
+		return err, 0
+	}
+	pl := z.b.Pipeline()
+	incr := pl.ZIncrBy(key, delta, id)
+	waiting := pl.Exists(waitQueueKey(key))
+	if err := pl.Exec(); err != nil {
+		z.opts.logError("incr element failed", err, key, id, key)
+		return util.Wrap(err), 0
+	}
+	wakeIfWaiting(z.b, z.opts, waitQueueKey(key), waiting)
+	return nil, incr.Val
+}
+
+func (z zSetLockTopKProvider) IncrElement(key string, id string, delta float64) (err error, score float64) {
+	span, end := z.opts.begin(ProviderLock, OpIncr, "key", key, "member", id)
+	defer end(&err)
+	z = z.withTrace(span)
+	if err := z.opts.validate(key, id, delta); err != nil {
+		return err, 0
+	}
+	lock, err := z.acquire(key)
+	if err != nil {
+		return err, 0
+	}
+	defer lock.UnLock()
+	metaKey, waiting, err := z.writeMeta(key)
+	if err != nil {
+		return err, 0
+	}
+	shard, err := z.lookupMember(z.getExistsKey(metaKey, id), id)
+	if err != nil {
+		z.opts.logError("incr element failed", err, metaKey, id, "")
+		return util.Wrap(err), 0
+	}
+	if shard != "" {
+		old, ok, err := z.b.ZScore(shard, id)
+		if err != nil {
+			z.opts.logError("incr element failed", err, metaKey, id, shard)
+			return util.Wrap(err), 0
+		}
+		if !ok {
+			return util.Wrap(fmt.Errorf("%w: member %s points to %s", ErrCorruptLayout, id, shard)), 0
+		}
+		score = old
+	}
+	score += delta
+	// Inf 加 -Inf 得到 NaN
+	if err := z.opts.validateScore(key, id, score); err != nil {
+		return err, 0
+	}
+	if err := z.addMember(metaKey, id, score); err != nil {
+		return err, 0
+	}
+	wakeIfWaiting(z.b, z.opts, waitQueueKey(z.makeMetaKey(key)), waiting)
+	return nil, score
+}
+
+// IncrElement 脚本返回 "结果,新的score", 结果与 add 相同, 新的score不合法时结果为 "invalid"
+func (z zSetShardTopKProvider) IncrElement(key string, id string, delta float64) (err error, score float64) {
+	_, end := z.opts.begin(ProviderLua, OpIncr, "key", key, "member", id)
+	defer end(&err)
+	if err := z.opts.validate(key, id, delta); err != nil {
+		return err, 0
+	}
+	allowInf := "0"
+	if z.opts.infPolicy == InfAllow {
+		allowInf = "1"
+	}
+	res, err := z.b.Eval(script, []string{z.makeMetaKey(key)}, "incr", formatScore(delta), id, allowInf)
+	if err != nil {
+		z.opts.logError("incr element failed", err, key, id, "")
+		return util.Wrap(err), 0
+	}
+	resStr, ok := res.(string)
+	i := strings.IndexByte(resStr, ',')
+	if !ok || i < 0 {
+		return util.Wrap(fmt.Errorf("%w: unexpected script reply %v", ErrCorruptLayout, res)), 0
+	}
+	if resStr[:i] == "invalid" {
+		// Inf 加 -Inf 得到 NaN, 与 lock provider 相同
+		return util.Wrap(fmt.Errorf("%w: %s is not allowed (key = %s, id = %s)", ErrInvalidScore, resStr[i+1:], key, id)), 0
+	}
+	code, err := strconv.ParseInt(resStr[:i], 10, 64)
+	if err != nil {
+		return util.Wrap(fmt.Errorf("%w: bad add result: %s", ErrCorruptLayout, err)), 0
+	}
+	z.shardEvent(code)
+	score, err = strconv.ParseFloat(resStr[i+1:], 64)
+	if err != nil {
+		return util.Wrap(fmt.Errorf("%w: bad score of %s: %s", ErrCorruptLayout, id, err)), 0
+	}
+	return nil, score
+}
+
+func (m *MemoryTopKProvider) IncrElement(key string, id string, delta float64) (err error, score float64) {
+	_, end := m.opts.begin(ProviderMemory, OpIncr, "key", key, "member", id)
+	defer end(&err)
+	if err := m.opts.validate(key, id, delta); err != nil {
+		return err, 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if zs, ok := m.keys[key]; ok {
+		score = zs.dict[id]
+	}
+	score += delta
+	// Inf 加 -Inf 得到 NaN
+	if err := m.opts.validateScore(key, id, score); err != nil {
+		return err, 0
+	}
+	if m.addLocked(key, id, score) {
+		m.wakeOne(key)
+	}
+	return nil, score
+}
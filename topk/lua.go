@@ -1,17 +1,19 @@
 package topk
 
-import "github.com/go-redis/redis"
-
-var script = redis.NewScript(`
+var script = NewScript(`
 
 -- local metaKey = "{test_meta}"
 -- local testKey = "{test_split}"
 -- local score = 10.
 -- local member = 10024
-local metaKey = KEYS[1]
+-- UnionStore 之后 KEYS[1]:current 指向当前版本的meta, 不存在时就是 KEYS[1]
+local baseKey = KEYS[1]
+local metaKey = redis.call("get", baseKey .. ":current") or baseKey
 local cmd = ARGV[1]
 local hashShardTotal = 499
 local shardLimit = 4000
+-- 与 waiterTTL 相同, 毫秒
+local waiterTTL = 5000
 
 local lshift = bit.lshift
 local rshift = bit.rshift
@@ -35,7 +37,21 @@ end
 
 local function getNewTargetKey(metaZSetCounterKey)
     local cnt = redis.call("incr", metaZSetCounterKey)
-    return metaKey .. ":data_shard:" .. cnt
+    -- 去掉 ":shard_cnt" 得到所属的meta key, move 时不一定是 KEYS[1]
+    return sub(metaZSetCounterKey, 1, -11) .. ":data_shard:" .. cnt
+end
+
+-- 新建的key继承meta的剩余过期时间, 使 ExpireAt 之后分裂出的shard和新的 m_to_z 也会过期
+local function inheritTTL(metaKey, ...)
+  local ttl = redis.call("pttl", metaKey)
+  if ttl <= 0 then
+    return
+  end
+  for _, key in ipairs({...}) do
+    if redis.call("pttl", key) == -1 then
+      redis.call("pexpire", key, ttl)
+    end
+  end
 end
 
 local function getMaximiumScore(zSetKey)
@@ -57,11 +73,14 @@ local function splitShard(metaKey, targetKey, shardLimit)
         local maxScore = getMaximiumScore(targetKey)
         local maxMemberScores = redis.call("zrangebyscore", targetKey, maxScore, maxScore, "withscores")
         local splitKey = ""
+        -- 2: 分裂出新的shard, 3: 移入下一个已有的shard
+        local splitRes = 2
         local nextZsets = redis.call("zrangebyscore", metaKey, "("..maxScore, "inf", "limit", 0, 1)
         if #nextZsets > 0 then
           local nextShardCounter = redis.call("zcard", nextZsets[1])
           if nextShardCounter + #maxMemberScores / 2 <= shardLimit then
             splitKey = nextZsets[1]
+            splitRes = 3
           else
             splitKey = getNewTargetKey(metaZSetCounterKey)
           end
@@ -80,6 +99,7 @@ local function splitShard(metaKey, targetKey, shardLimit)
           local memberZSetKey = metaKey .. ":m_to_z:" .. (hashCodeOfMember % hashShardTotal)
           redis.call("hset", memberZSetKey, member, splitKey)
         end
+        inheritTTL(metaKey, splitKey)
         
         if shardCounter <= 0 then
           local metaRemRes = redis.call("zrem", metaKey, targetKey)
@@ -87,6 +107,7 @@ local function splitShard(metaKey, targetKey, shardLimit)
           maxScore = getMaximiumScore(targetKey)
           metaAddRes = redis.call("zadd", metaKey, maxScore, targetKey)
         end
+        return splitRes
 end
 
 local function DelMember(metaKey, member, memberZsetKey)
@@ -104,7 +125,7 @@ end
 
 local function RemoveIfExists(metaKey, member)
   if member == "" then
-    return
+    return 0
   end
   
   local hashCodeOfMember = JSHash(member)
@@ -113,14 +134,35 @@ local function RemoveIfExists(metaKey, member)
   if targetZsetKey ~= false then
     DelMember(metaKey, member, targetZsetKey)
     local delMemberRes = redis.call("hdel", memberToZsetKey, member)
+    return 1
   end
+  -- 不存在返回0, 而不是nil
+  return 0
+end
+
+-- member的score等于score时删除, 返回1, 否则返回0
+local function RemoveIfScore(metaKey, member, score)
+  local memberToZsetKey = metaKey .. ":m_to_z:" .. (JSHash(member) % hashShardTotal)
+  local targetZsetKey = redis.call("hget", memberToZsetKey, member)
+  if targetZsetKey == false then
+    return 0
+  end
+  local old = redis.call("zscore", targetZsetKey, member)
+  if not old or tonumber(old) ~= tonumber(score) then
+    return 0
+  end
+  DelMember(metaKey, member, targetZsetKey)
+  redis.call("hdel", memberToZsetKey, member)
+  return 1
 end
 
 
 local function AddMember(metaKey, score, member,  shardLimit)
     if member == "" then
-      return
+      return redis.error_reply("ERR empty member")
     end
+    -- 已存在的member先删除, 否则会在另一个shard中留下旧的score
+    RemoveIfExists(metaKey, member)
     local hashCodeOfMember = JSHash(member)
     local memberToZsetKey = metaKey .. ":m_to_z:" .. (hashCodeOfMember % hashShardTotal)
     local metaZSetCounterKey = metaKey .. ":shard_cnt"
@@ -141,9 +183,10 @@ local function AddMember(metaKey, score, member,  shardLimit)
     local addRes = redis.call("zadd", targetKey, score, member)
     -- 添加到hash
     redis.call("hset", memberToZsetKey, member, targetKey)
+    inheritTTL(metaKey, targetKey, memberToZsetKey)
     local shardCounter = redis.call("zcard", targetKey)
     if shardCounter > shardLimit then
-      splitShard(metaKey, targetKey, shardLimit)
+      return splitShard(metaKey, targetKey, shardLimit)
         -- split. TODO 合并
         -- TODO. 极端情况，一个shard全是score相等的member
         --[[
@@ -215,6 +258,301 @@ local function getTopKWithScore(metaKey, k)
   end
   return ans
 end
+-- 最大score在[min, max]中的shard, 以及之后的第一个shard, 其他shard中不会有区间内的member
+local function getShardsInRange(metaKey, min, max)
+  local shards = redis.call("zrangebyscore", metaKey, min, max)
+  local after = "(" .. max
+  if string.sub(max, 1, 1) == "(" then
+    after = string.sub(max, 2)
+  end
+  local nextZset = redis.call("zrangebyscore", metaKey, after, "+inf", "limit", 0, 1)
+  if #nextZset > 0 then
+    shards[#shards + 1] = nextZset[1]
+  end
+  return shards
+end
+
+local function getRangeWithScore(metaKey, min, max, offset, count)
+  local ans = ""
+  local shards = getShardsInRange(metaKey, min, max)
+  for i = 1, #shards do
+    if count == 0 then
+      return ans
+    end
+    local n = redis.call("zcount", shards[i], min, max)
+    if offset >= n then
+      offset = offset - n
+    else
+      local l = redis.call("zrangebyscore", shards[i], min, max, "withscores", "limit", offset, count)
+      offset = 0
+      if #l > 0 then
+        if count > 0 then
+          count = count - #l / 2
+        end
+        ans = ans .. table.concat(l, ",") .. ","
+      end
+    end
+  end
+  return ans
+end
+
+local function countRange(metaKey, min, max)
+  local cnt = 0
+  local shards = getShardsInRange(metaKey, min, max)
+  for i = 1, #shards do
+    cnt = cnt + redis.call("zcount", shards[i], min, max)
+  end
+  return cnt
+end
+
+-- 返回 "第一个元素的排名,id,score,id,score,", 排名从0开始, member不存在时返回nil
+local function getAround(metaKey, member, before, after)
+  local memberToZsetKey = metaKey .. ":m_to_z:" .. (JSHash(member) % hashShardTotal)
+  local shard = redis.call("hget", memberToZsetKey, member)
+  if shard == false then
+    return false
+  end
+  local shards = redis.call("zrangebyscore", metaKey, "-inf", "inf")
+  local pos = 0
+  local base = 0
+  for i = 1, #shards do
+    if shards[i] == shard then
+      pos = i
+      break
+    end
+    base = base + redis.call("zcard", shards[i])
+  end
+  local r = redis.call("zrank", shard, member)
+  if pos == 0 or r == false then
+    return redis.error_reply("ERR corrupt layout: " .. member .. " points to " .. shard)
+  end
+
+  local chunks = {}
+  -- 向前, 跨过shard边界时读取前一个shard的最后几个member
+  local need = before
+  local idx = pos
+  while need > 0 and idx >= 1 do
+    local l = {}
+    if idx == pos then
+      if r > 0 then
+        l = redis.call("zrange", shard, math.max(0, r - need), r - 1, "withscores")
+      end
+    else
+      l = redis.call("zrange", shards[idx], -need, -1, "withscores")
+    end
+    need = need - #l / 2
+    table.insert(chunks, 1, l)
+    idx = idx - 1
+  end
+  local first = base + r - (before - need)
+  table.insert(chunks, redis.call("zrange", shard, r, r, "withscores"))
+  -- 向后
+  need = after
+  idx = pos
+  while need > 0 and idx <= #shards do
+    local l
+    if idx == pos then
+      l = redis.call("zrange", shard, r + 1, r + need, "withscores")
+    else
+      l = redis.call("zrange", shards[idx], 0, need - 1, "withscores")
+    end
+    need = need - #l / 2
+    table.insert(chunks, l)
+    idx = idx + 1
+  end
+
+  local ans = string.format("%d", first) .. ","
+  for i = 1, #chunks do
+    if #chunks[i] > 0 then
+      ans = ans .. table.concat(chunks[i], ",") .. ","
+    end
+  end
+  return ans
+end
+
+-- 从第一个(fromTop)或最后一个shard开始弹出n个member, 清空的shard从meta中删除
+-- max不为nil时只从前弹出score不超过max的member
+local function popMembers(metaKey, n, fromTop, max)
+  local ans = ""
+  while n > 0 do
+    local shards
+    if fromTop then
+      shards = redis.call("zrangebyscore", metaKey, "-inf", "inf", "limit", 0, 1)
+    else
+      shards = redis.call("zrevrangebyscore", metaKey, "inf", "-inf", "limit", 0, 1)
+    end
+    if #shards == 0 then
+      return ans
+    end
+    local shard = shards[1]
+    local l
+    if max then
+      l = redis.call("zrangebyscore", shard, "-inf", max, "withscores", "limit", 0, n)
+      if #l == 0 then
+        return ans
+      end
+      redis.call("zremrangebyrank", shard, 0, #l / 2 - 1)
+    elseif fromTop then
+      l = redis.call("zrange", shard, 0, n - 1, "withscores")
+      redis.call("zremrangebyrank", shard, 0, n - 1)
+    else
+      l = redis.call("zrevrange", shard, 0, n - 1, "withscores")
+      redis.call("zremrangebyrank", shard, -n, -1)
+    end
+    for i = 1, #l, 2 do
+      redis.call("hdel", metaKey .. ":m_to_z:" .. (JSHash(l[i]) % hashShardTotal), l[i])
+    end
+    if redis.call("zcard", shard) == 0 then
+      redis.call("zrem", metaKey, shard)
+    elseif not fromTop then
+      redis.call("zadd", metaKey, getMaximiumScore(shard), shard)
+    end
+    n = n - #l / 2
+    if #l > 0 then
+      ans = ans .. table.concat(l, ",") .. ","
+    end
+  end
+  return ans
+end
+
+-- 容量为cap时添加member, 之后淘汰超出容量的最后几名, 返回 "结果,淘汰的id,score,..."
+-- 新member排在最后一名之后时不修改, 直接作为淘汰的member返回, 结果为0
+local function AddMemberCapped(metaKey, score, member, cap)
+  if member == "" then
+    return redis.error_reply("ERR empty member")
+  end
+  local total = 0
+  local shards = redis.call("zrange", metaKey, 0, -1)
+  for i = 1, #shards do
+    total = total + redis.call("zcard", shards[i])
+  end
+  local memberToZsetKey = metaKey .. ":m_to_z:" .. (JSHash(member) % hashShardTotal)
+  if redis.call("hexists", memberToZsetKey, member) == 0 then
+    if total >= cap and #shards > 0 then
+      local worst = redis.call("zrevrange", shards[#shards], 0, 0, "withscores")
+      if tonumber(score) > tonumber(worst[2]) then
+        return "0," .. member .. "," .. score .. ","
+      end
+    end
+    total = total + 1
+  end
+  local res = AddMember(metaKey, score, member, shardLimit)
+  local evicted = ""
+  if total > cap then
+    evicted = popMembers(metaKey, total - cap, false)
+  end
+  return res .. "," .. evicted
+end
+
+-- tonumber 依赖 strtod, 不是所有的lua实现都能转换redis返回的 "inf" 和 "-inf"
+local function toScore(s)
+  local n = tonumber(s)
+  if n then
+    return n
+  end
+  s = string.lower(s)
+  if s == "inf" or s == "+inf" then
+    return 1/0
+  elseif s == "-inf" then
+    return -1/0
+  end
+  return nil
+end
+
+-- 与 ZINCRBY 相同, member不存在时从0开始, 返回 "结果,新的score", 结果与 add 相同
+-- 新的score为NaN, 或者为±Inf且allowInf不为"1"时不修改, 结果为 "invalid"
+local function IncrMember(metaKey, delta, member, allowInf)
+  local old = 0
+  local shard = redis.call("hget", metaKey .. ":m_to_z:" .. (JSHash(member) % hashShardTotal), member)
+  if shard then
+    old = toScore(redis.call("zscore", shard, member))
+  end
+  local value = old + toScore(delta)
+  if value ~= value then
+    return "invalid,nan"
+  end
+  if (value == 1/0 or value == -1/0) and allowInf ~= "1" then
+    return "invalid," .. string.format("%.17g", value)
+  end
+  -- %.17g 保证score可以精确还原
+  local score = string.format("%.17g", value)
+  local res = AddMember(metaKey, score, member, shardLimit)
+  if type(res) ~= "number" then
+    return res
+  end
+  return res .. "," .. score
+end
+
+-- 返回 ARGV[first] 之后的member中存在的member的score, 格式与 popMembers 相同
+local function getScores(metaKey, first)
+  local l = {}
+  for i = first, #ARGV do
+    local member = ARGV[i]
+    local shard = redis.call("hget", metaKey .. ":m_to_z:" .. (JSHash(member) % hashShardTotal), member)
+    if shard then
+      local score = redis.call("zscore", shard, member)
+      if score then
+        l[#l + 1] = member
+        l[#l + 1] = score
+      end
+    end
+  end
+  if #l == 0 then
+    return ""
+  end
+  return table.concat(l, ",") .. ","
+end
+
+-- 给meta和它引用的所有key以及版本指针设置过期时间, 与 layoutExpireAt 相同, at为毫秒时间戳
+-- expireLayout cmd 为 "pexpireat" 或 "pexpire"
+local function expireLayout(metaKey, cmd, at)
+  local shards = redis.call("zrange", metaKey, 0, -1)
+  redis.call(cmd, metaKey, at)
+  redis.call(cmd, metaKey .. ":shard_cnt", at)
+  for i = 1, #shards do
+    redis.call(cmd, shards[i], at)
+  end
+  for i = 0, hashShardTotal - 1 do
+    redis.call(cmd, metaKey .. ":m_to_z:" .. i, at)
+  end
+  redis.call(cmd, baseKey .. ":current", at)
+  redis.call(cmd, baseKey .. ":gen", at)
+  return 1
+end
+
+-- 弹出src中score不超过max的n个member, 以score加入dst
+local function moveMembers(srcKey, dstKey, max, n, score)
+  local ans = popMembers(srcKey, n, true, max)
+  if ans == "" then
+    return ans
+  end
+  local i = 0
+  for member in string.gmatch(ans, "([^,]*),") do
+    if i % 2 == 0 then
+      AddMember(dstKey, score, member, shardLimit)
+    end
+    i = i + 1
+  end
+  return ans
+end
+
+-- 唤醒等待队列中第一个存活的等待者, 与 wakeScript 相同
+local function notify(metaKey)
+  local queueKey = metaKey .. "::waiters"
+  while true do
+    local id = redis.call("lpop", queueKey)
+    if not id then
+      return
+    end
+    local wakeKey = queueKey .. ":" .. id
+    if redis.call("exists", wakeKey .. ":alive") == 1 then
+      redis.call("rpush", wakeKey, "1")
+      redis.call("pexpire", wakeKey, waiterTTL)
+      return
+    end
+  end
+end
+
 --[[
 local ans = ""
 for i = 0, 10000, 1 do
@@ -231,13 +569,67 @@ return ans
 if cmd == "add" then 
   local score = ARGV[2]
   local member = ARGV[3]
-  return AddMember(metaKey, score, member, shardLimit)
+  local res = AddMember(metaKey, score, member, shardLimit)
+  if type(res) == "number" then
+    notify(baseKey)
+  end
+  return res
 elseif cmd == "del" then
   local member = ARGV[2]
   return RemoveIfExists(metaKey, member)
+elseif cmd == "delif" then
+  return RemoveIfScore(metaKey, ARGV[2], ARGV[3])
 elseif cmd == "topks" then
   local k = tonumber(ARGV[2])
   return getTopKWithScore(metaKey, k)
+elseif cmd == "range" then
+  return getRangeWithScore(metaKey, ARGV[2], ARGV[3], tonumber(ARGV[4]), tonumber(ARGV[5]))
+elseif cmd == "count" then
+  return countRange(metaKey, ARGV[2], ARGV[3])
+elseif cmd == "poptop" then
+  return popMembers(metaKey, tonumber(ARGV[2]), true)
+elseif cmd == "popbottom" then
+  return popMembers(metaKey, tonumber(ARGV[2]), false)
+elseif cmd == "addcap" then
+  local res = AddMemberCapped(metaKey, ARGV[2], ARGV[3], tonumber(ARGV[4]))
+  if type(res) == "string" and sub(res, 1, 2) ~= "0," then
+    notify(baseKey)
+  end
+  return res
+elseif cmd == "incr" then
+  local res = IncrMember(metaKey, ARGV[2], ARGV[3], ARGV[4])
+  if type(res) == "string" and sub(res, 1, 8) ~= "invalid," then
+    notify(baseKey)
+  end
+  return res
+elseif cmd == "move" then
+  local dstKey = redis.call("get", KEYS[2] .. ":current") or KEYS[2]
+  local ans = moveMembers(metaKey, dstKey, ARGV[2], tonumber(ARGV[3]), ARGV[4])
+  if ans ~= "" then
+    notify(KEYS[2])
+  end
+  return ans
+elseif cmd == "addmany" then
+  -- UnionStore 写入还没有切换的新版本, 不需要通知
+  for i = 2, #ARGV, 2 do
+    AddMember(metaKey, ARGV[i], ARGV[i + 1], shardLimit)
+  end
+  return (#ARGV - 1) / 2
+elseif cmd == "swap" then
+  -- 只切换版本, 旧版本由调用方在脚本之外删除. 新版本继承旧版本的剩余过期时间
+  local ttl = redis.call("pttl", metaKey)
+  redis.call("set", baseKey .. ":current", ARGV[2])
+  if ttl > 0 then
+    expireLayout(ARGV[2], "pexpire", ttl)
+  end
+  notify(baseKey)
+  return metaKey
+elseif cmd == "expire" then
+  return expireLayout(metaKey, "pexpireat", ARGV[2])
+elseif cmd == "scores" then
+  return getScores(metaKey, 2)
+elseif cmd == "around" then
+  return getAround(metaKey, ARGV[2], tonumber(ARGV[3]), tonumber(ARGV[4]))
 else
   local k = tonumber(ARGV[2])
   return getTopKNoScore(metaKey, k)
@@ -0,0 +1,138 @@
+package topk
+
+import (
+	"sync"
+	"time"
+)
+
+// memZSet 内存中的zset, dict 用于按member查找score
+type memZSet struct {
+	dict map[string]float64
+	zsl  *skipList
+}
+
+/*
+MemoryTopKProvider 纯内存的 TopKProvider, 排序规则与redis zset相同.
+可以在单元测试中代替redis provider, 也可以作为本地缓存. 并发安全.
+*/
+type MemoryTopKProvider struct {
+	mu   sync.RWMutex
+	keys map[string]*memZSet
+	// waiters 每个key上 BlockingPopTop 的等待者, 按开始等待的顺序排列
+	waiters map[string][]chan struct{}
+	// expires ExpireAt 设置的删除定时器
+	expires map[string]*time.Timer
+	opts    options
+}
+
+func NewMemoryProvider(opts ...Option) *MemoryTopKProvider {
+	return &MemoryTopKProvider{
+		keys:    make(map[string]*memZSet),
+		waiters: make(map[string][]chan struct{}),
+		expires: make(map[string]*time.Timer),
+		opts:    newOptions(nil, opts),
+	}
+}
+
+func (m *MemoryTopKProvider) AddElement(key string, id string, score float64) (err error) {
+	_, end := m.opts.begin(ProviderMemory, OpAdd, "key", key, "member", id)
+	defer end(&err)
+	if err := m.opts.validate(key, id, score); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return rejectedErr(key, id, m.add(key, id, score))
+}
+
+// add 设置了容量时返回被淘汰的元素, 在持有锁的情况下执行
+func (m *MemoryTopKProvider) add(key string, id string, score float64) []Element {
+	if limit := m.opts.capacityOf(key); limit > 0 {
+		return m.addCapped(key, id, score, limit)
+	}
+	if m.addLocked(key, id, score) {
+		m.wakeOne(key)
+	}
+	return nil
+}
+
+// addLocked 添加或更新id的score, score没有变化时返回false, 在持有锁的情况下执行
+func (m *MemoryTopKProvider) addLocked(key string, id string, score float64) bool {
+	zs, ok := m.keys[key]
+	if !ok {
+		zs = &memZSet{dict: make(map[string]float64), zsl: newSkipList()}
+		m.keys[key] = zs
+	}
+	if old, ok := zs.dict[id]; ok {
+		if old == score {
+			return false
+		}
+		zs.zsl.delete(old, id)
+	}
+	zs.zsl.insert(score, id)
+	zs.dict[id] = score
+	return true
+}
+
+func (m *MemoryTopKProvider) DeleteElement(key string, id string) (err error) {
+	_, end := m.opts.begin(ProviderMemory, OpDelete, "key", key, "member", id)
+	defer end(&err)
+	if err := m.opts.validateId(key, id); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteLocked(key, id)
+	return nil
+}
+
+// deleteLocked 删除id, 返回id是否存在, 在持有锁的情况下执行
+func (m *MemoryTopKProvider) deleteLocked(key string, id string) bool {
+	zs, ok := m.keys[key]
+	if !ok {
+		return false
+	}
+	score, ok := zs.dict[id]
+	if !ok {
+		return false
+	}
+	zs.zsl.delete(score, id)
+	delete(zs.dict, id)
+	if len(zs.dict) == 0 {
+		delete(m.keys, key)
+	}
+	return true
+}
+
+func (m *MemoryTopKProvider) GetTopK(key string, k int) (err error, ans []Element) {
+	_, end := m.opts.begin(ProviderMemory, OpTopK, "key", key, "k", k)
+	defer end(&err)
+	ans = m.topK(key, k)
+	for i := range ans {
+		ans[i].Score = 0
+	}
+	return nil, ans
+}
+
+func (m *MemoryTopKProvider) GetTopKS(key string, k int) (err error, ans []Element) {
+	_, end := m.opts.begin(ProviderMemory, OpTopKS, "key", key, "k", k)
+	defer end(&err)
+	return nil, m.topK(key, k)
+}
+
+func (m *MemoryTopKProvider) topK(key string, k int) []Element {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	zs, ok := m.keys[key]
+	if !ok || k <= 0 {
+		return make([]Element, 0)
+	}
+	if k > zs.zsl.length {
+		k = zs.zsl.length
+	}
+	ans := make([]Element, 0, k)
+	for x := zs.zsl.first(); x != nil && len(ans) < k; x = x.next() {
+		ans = append(ans, Element{Id: x.member, Score: x.score})
+	}
+	return ans
+}
@@ -0,0 +1,21 @@
+package topk_test
+
+import (
+	"pushan/RedTopK/topk"
+	"pushan/RedTopK/topktest"
+	"testing"
+)
+
+func TestMemoryProvider(t *testing.T) {
+	topktest.Test(t, topk.NewMemoryProvider(), topktest.Config{Seed: 1, Ranges: true, Pops: true})
+}
+
+// TestMemoryProviderCapacity 参考实现为 NewCappedModel, 超过容量时淘汰score最大的元素
+func TestMemoryProviderCapacity(t *testing.T) {
+	tp := topk.NewMemoryProvider(topk.WithCapacity(5))
+	topktest.Test(t, tp, topktest.Config{Seed: 1, Capacity: 5, Ranges: true, Pops: true})
+}
+
+func TestMemoryProviderConcurrent(t *testing.T) {
+	topktest.TestConcurrent(t, topk.NewMemoryProvider(), topktest.Config{Seed: 1})
+}
@@ -0,0 +1,64 @@
+package topk
+
+import "time"
+
+// provider 类型, 作为指标的 provider 标签
+const (
+	ProviderZSet   = "zset"
+	ProviderLua    = "lua"
+	ProviderLock   = "lock"
+	ProviderMemory = "memory"
+)
+
+// 操作类型, 作为指标的 op 标签
+const (
+	OpAdd    = "add"
+	OpDelete = "delete"
+	OpTopK   = "topk"
+	OpTopKS  = "topks"
+	OpRange  = "range"
+	OpCount  = "count"
+	OpAround = "around"
+	// OpPopTop 和 OpPopBottom 分别弹出score最小和最大的元素
+	OpPopTop    = "poptop"
+	OpPopBottom = "popbottom"
+	// OpBlockingPopTop 包括等待通知的时间
+	OpBlockingPopTop = "bpoptop"
+	// OpMove 在两个key之间移动元素
+	OpMove = "move"
+	// OpIncr 增加member的score
+	OpIncr = "incr"
+	// OpScores 批量查询member的score
+	OpScores = "scores"
+	// OpExpire 设置整个key的过期时间
+	OpExpire = "expire"
+	// OpUnionStore 把多个key的并集保存为新的key
+	OpUnionStore = "unionstore"
+)
+
+// shard 事件
+const (
+	// ShardSplit shard超过 ShardLimit 后分裂出新的shard
+	ShardSplit = "split"
+	// ShardRebalance shard超过 ShardLimit 后最大score的member移入了相邻的已有shard, 没有分配新的shard
+	ShardRebalance = "rebalance"
+)
+
+// Metrics provider 的指标回调, 实现需要保证并发安全
+type Metrics interface {
+	// ObserveOp 记录一次操作的耗时和结果
+	ObserveOp(provider, op string, d time.Duration, err error)
+	// IncShardEvent 记录一次shard分裂或者再平衡
+	IncShardEvent(provider, event string)
+	// ObserveLockWait 记录获取锁的等待时间, 无论是否获取成功
+	ObserveLockWait(provider string, d time.Duration)
+	// IncLockFailure 每次获取锁时至少失败过一次(需要等待或者最终超时)时记录一次, 与重试次数无关
+	IncLockFailure(provider string)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveOp(string, string, time.Duration, error) {}
+func (nopMetrics) IncShardEvent(string, string)                   {}
+func (nopMetrics) ObserveLockWait(string, time.Duration)          {}
+func (nopMetrics) IncLockFailure(string)                          {}
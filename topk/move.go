@@ -0,0 +1,175 @@
+package topk
+
+import (
+	"pushan/RedTopK/util"
+	"sort"
+)
+
+/*
+Mover 可以在两个key之间原子地移动元素的provider, 用于延迟队列等需要"领取"元素的场景.
+MoveTopUntil 从src中弹出score不超过max的最小n个元素, 以score加入dst, 返回弹出的元素和原来的score.
+max 的写法与 RangeByScore 相同. dst中已经存在的member会更新score.
+lua provider 在集群模式下要求src和dst在同一个slot, 例如 "{jobs}:pending" 和 "{jobs}:processing".
+*/
+type Mover interface {
+	MoveTopUntil(src, dst string, max string, n int, score float64) (error, []Element)
+}
+
+// zsetMoveScript KEYS[3]为dst的等待队列, 返回 {队列是否存在, 移动的元素}
+var zsetMoveScript = NewScript(`
+	local l = redis.call("zrangebyscore", KEYS[1], "-inf", ARGV[1], "withscores", "limit", 0, ARGV[2])
+	for i = 1, #l, 2 do
+		redis.call("zrem", KEYS[1], l[i])
+		redis.call("zadd", KEYS[2], ARGV[3], l[i])
+	end
+	local waiting = redis.call("exists", KEYS[3])
+	if #l == 0 then
+		return {waiting, ""}
+	end
+	return {waiting, table.concat(l, ",") .. ","}
+`)
+
+// MoveTopUntil 普通zset使用脚本保证原子性
+func (z ZSetTopKProvider) MoveTopUntil(src, dst string, max string, n int, score float64) (err error, ans []Element) {
+	_, end := z.opts.begin(ProviderZSet, OpMove, "key", src, "dst", dst, "n", n)
+	defer end(&err)
+	if _, _, err := z.opts.validateRange(src, "-inf", max); err != nil {
+		return err, nil
+	}
+	if err := z.opts.validateScore(dst, "", score); err != nil {
+		return err, nil
+	}
+	if n <= 0 {
+		return nil, make([]Element, 0)
+	}
+	res, err := z.b.Eval(zsetMoveScript, []string{src, dst, waitQueueKey(dst)}, max, n, formatScore(score))
+	if err != nil {
+		z.opts.logError("move failed", err, src, "", src)
+		return util.Wrap(err), nil
+	}
+	ans, waiting, err := parseWaitingReply(res)
+	if err != nil {
+		return util.Wrap(err), nil
+	}
+	if len(ans) > 0 {
+		wakeIfWaiting(z.b, z.opts, waitQueueKey(dst), waiting)
+	}
+	return nil, ans
+}
+
+/*
+MoveTopUntil 按key的顺序获取src和dst的锁, 避免两个方向相反的移动互相等待.
+先加入dst再从src删除, 中途失败时元素可能同时存在于两个key中, 但不会丢失.
+*/
+func (z zSetLockTopKProvider) MoveTopUntil(src, dst string, max string, n int, score float64) (err error, ans []Element) {
+	span, end := z.opts.begin(ProviderLock, OpMove, "key", src, "dst", dst, "n", n)
+	defer end(&err)
+	z = z.withTrace(span)
+	if _, _, err := z.opts.validateRange(src, "-inf", max); err != nil {
+		return err, nil
+	}
+	if err := z.opts.validateScore(dst, "", score); err != nil {
+		return err, nil
+	}
+	if n <= 0 {
+		return nil, make([]Element, 0)
+	}
+	keys := []string{src}
+	if dst != src {
+		keys = append(keys, dst)
+		sort.Strings(keys)
+	}
+	for _, key := range keys {
+		lock, err := z.acquire(key)
+		if err != nil {
+			return err, nil
+		}
+		defer lock.UnLock()
+	}
+	srcMeta, err := z.currentMeta(src)
+	if err != nil {
+		return err, nil
+	}
+	dstMeta, waiting, err := z.writeMeta(dst)
+	if err != nil {
+		return err, nil
+	}
+	ans, err = layoutRange(z.b, srcMeta, "-inf", max, 0, n)
+	if err != nil {
+		z.opts.logError("move failed", err, srcMeta, "", "")
+		return util.Wrap(err), nil
+	}
+	for _, e := range ans {
+		if err := z.addMember(dstMeta, e.Id, score); err != nil {
+			return err, nil
+		}
+	}
+	if dst != src {
+		for _, e := range ans {
+			if _, err := z.deleteMember(srcMeta, e.Id); err != nil {
+				return err, nil
+			}
+		}
+	}
+	if len(ans) > 0 {
+		wakeIfWaiting(z.b, z.opts, waitQueueKey(z.makeMetaKey(dst)), waiting)
+	}
+	return nil, ans
+}
+
+// MoveTopUntil 在脚本中执行, 脚本使用src和dst两个meta key
+func (z zSetShardTopKProvider) MoveTopUntil(src, dst string, max string, n int, score float64) (err error, ans []Element) {
+	_, end := z.opts.begin(ProviderLua, OpMove, "key", src, "dst", dst, "n", n)
+	defer end(&err)
+	if _, _, err := z.opts.validateRange(src, "-inf", max); err != nil {
+		return err, nil
+	}
+	if err := z.opts.validateScore(dst, "", score); err != nil {
+		return err, nil
+	}
+	if n <= 0 {
+		return nil, make([]Element, 0)
+	}
+	res, err := z.b.Eval(script, []string{z.makeMetaKey(src), z.makeMetaKey(dst)}, "move", max, n, formatScore(score))
+	if err != nil {
+		z.opts.logError("move failed", err, src, "", "")
+		return util.Wrap(err), nil
+	}
+	ans, err = parseScoredReply(res)
+	if err != nil {
+		return util.Wrap(err), nil
+	}
+	return nil, ans
+}
+
+func (m *MemoryTopKProvider) MoveTopUntil(src, dst string, max string, n int, score float64) (err error, ans []Element) {
+	_, end := m.opts.begin(ProviderMemory, OpMove, "key", src, "dst", dst, "n", n)
+	defer end(&err)
+	_, hi, err := m.opts.validateRange(src, "-inf", max)
+	if err != nil {
+		return err, nil
+	}
+	if err := m.opts.validateScore(dst, "", score); err != nil {
+		return err, nil
+	}
+	ans = make([]Element, 0)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	zs, ok := m.keys[src]
+	if !ok {
+		return nil, ans
+	}
+	for x := zs.zsl.first(); x != nil && !hi.above(x.score) && len(ans) < n; x = x.next() {
+		ans = append(ans, Element{Id: x.member, Score: x.score})
+	}
+	for _, e := range ans {
+		m.deleteLocked(src, e.Id)
+	}
+	for _, e := range ans {
+		m.addLocked(dst, e.Id, score)
+	}
+	if len(ans) > 0 {
+		m.wakeOne(dst)
+	}
+	return nil, ans
+}
@@ -0,0 +1,133 @@
+package topk
+
+import (
+	"pushan/RedTopK/util"
+	"time"
+)
+
+// Option provider的可选配置
+type Option func(*options)
+
+type options struct {
+	newLocker  util.LockerFactory
+	lockTimeMs uint
+	shardLimit int
+	maxIdLen   int
+	infPolicy  InfPolicy
+	logger     util.Logger
+	metrics    Metrics
+	tracer     Tracer
+	capacity   func(key string) int
+}
+
+func newOptions(b Backend, opts []Option) options {
+	o := options{
+		newLocker:  BackendLockFactory(b),
+		lockTimeMs: LockTimeMs,
+		shardLimit: ShardLimit,
+		maxIdLen:   DefaultMaxIdLen,
+		infPolicy:  InfReject,
+		logger:     util.NopLogger,
+		metrics:    nopMetrics{},
+		tracer:     nopTracer{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithLocker 指定 zSetLockTopKProvider 使用的锁, 默认为 BackendLockFactory 创建的单实例锁
+func WithLocker(f util.LockerFactory) Option {
+	return func(o *options) {
+		if f != nil {
+			o.newLocker = f
+		}
+	}
+}
+
+// WithLockTimeout 指定锁的超时时间, 也是获取锁的最长等待时间, 默认为 LockTimeMs 毫秒
+func WithLockTimeout(d time.Duration) Option {
+	return func(o *options) {
+		if ms := d.Milliseconds(); ms > 0 {
+			o.lockTimeMs = uint(ms)
+		}
+	}
+}
+
+// WithShardLimit 指定 zSetLockTopKProvider 每个shard的最大member数, 默认为 ShardLimit
+// lua provider 的上限写在脚本中, 不受影响
+func WithShardLimit(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.shardLimit = n
+		}
+	}
+}
+
+// WithMaxIdLen 指定id的最大字节数, 默认为 DefaultMaxIdLen
+func WithMaxIdLen(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.maxIdLen = n
+		}
+	}
+}
+
+// WithInfPolicy 指定±Inf score的处理策略, 默认为 InfReject
+func WithInfPolicy(p InfPolicy) Option {
+	return func(o *options) {
+		o.infPolicy = p
+	}
+}
+
+// WithLogger 指定provider使用的 Logger, 默认不输出日志
+// 支持 util.LoggerSetter 的锁也会使用该 Logger
+func WithLogger(l util.Logger) Option {
+	return func(o *options) {
+		if l != nil {
+			o.logger = l
+		}
+	}
+}
+
+// WithMetrics 指定指标回调, 默认不记录, 可以使用内置的 PromMetrics
+func WithMetrics(m Metrics) Option {
+	return func(o *options) {
+		if m != nil {
+			o.metrics = m
+		}
+	}
+}
+
+// WithTracer 指定 Tracer, 默认不记录, 测试中可以使用 SpanRecorder
+func WithTracer(t Tracer) Option {
+	return func(o *options) {
+		if t != nil {
+			o.tracer = t
+		}
+	}
+}
+
+// WithCapacity 每个key最多保留score最小的n个元素, 默认不限制
+func WithCapacity(n int) Option {
+	return WithKeyCapacity(func(string) int { return n })
+}
+
+// WithKeyCapacity 按key指定容量, f返回0表示该key不限制
+func WithKeyCapacity(f func(key string) int) Option {
+	return func(o *options) {
+		o.capacity = f
+	}
+}
+
+func (o options) capacityOf(key string) int {
+	if o.capacity == nil {
+		return 0
+	}
+	return o.capacity(key)
+}
+
+func (o options) logError(msg string, err error, key, member, shard string) {
+	o.logger.Log(util.LevelError, msg, "key", key, "member", member, "shard", shard, "err", err)
+}
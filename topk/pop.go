@@ -0,0 +1,212 @@
+package topk
+
+import "pushan/RedTopK/util"
+
+/*
+Popper 可以原子地删除并返回元素的provider, 用作优先队列.
+PopTop 按score升序弹出最小的n个, PopBottom 按score降序弹出最大的n个, 与 ZPOPMIN 和 ZPOPMAX 相同.
+*/
+type Popper interface {
+	PopTop(key string, n int) (error, []Element)
+	PopBottom(key string, n int) (error, []Element)
+}
+
+func (z ZSetTopKProvider) PopTop(key string, n int) (err error, ans []Element) {
+	_, end := z.opts.begin(ProviderZSet, OpPopTop, "key", key, "n", n)
+	defer end(&err)
+	if n <= 0 {
+		return nil, make([]Element, 0)
+	}
+	ans, err = z.b.ZPopMin(key, int64(n))
+	if err != nil {
+		z.opts.logError("pop failed", err, key, "", key)
+		return util.Wrap(err), nil
+	}
+	return nil, ans
+}
+
+func (z ZSetTopKProvider) PopBottom(key string, n int) (err error, ans []Element) {
+	_, end := z.opts.begin(ProviderZSet, OpPopBottom, "key", key, "n", n)
+	defer end(&err)
+	if n <= 0 {
+		return nil, make([]Element, 0)
+	}
+	ans, err = z.b.ZPopMax(key, int64(n))
+	if err != nil {
+		z.opts.logError("pop failed", err, key, "", key)
+		return util.Wrap(err), nil
+	}
+	return nil, ans
+}
+
+func (z zSetLockTopKProvider) PopTop(key string, n int) (err error, ans []Element) {
+	span, end := z.opts.begin(ProviderLock, OpPopTop, "key", key, "n", n)
+	defer end(&err)
+	z = z.withTrace(span)
+	return z.pop(key, n, true)
+}
+
+func (z zSetLockTopKProvider) PopBottom(key string, n int) (err error, ans []Element) {
+	span, end := z.opts.begin(ProviderLock, OpPopBottom, "key", key, "n", n)
+	defer end(&err)
+	z = z.withTrace(span)
+	return z.pop(key, n, false)
+}
+
+func (z zSetLockTopKProvider) pop(key string, n int, top bool) (error, []Element) {
+	if n <= 0 {
+		return nil, make([]Element, 0)
+	}
+	lock, err := z.acquire(key)
+	if err != nil {
+		return err, nil
+	}
+	defer lock.UnLock()
+	metaKey, err := z.currentMeta(key)
+	if err != nil {
+		return err, nil
+	}
+	ans, err := z.popMembers(metaKey, n, top)
+	if err != nil {
+		return err, nil
+	}
+	return nil, ans
+}
+
+/*
+popMembers 从第一个(top)或最后一个shard开始读取要弹出的member, 所有修改在一个事务中执行:
+删除member和 m_to_z 中的记录, 清空的shard从meta中删除, 从后弹出时更新shard在meta中的最大score.
+在持有锁的情况下执行.
+*/
+func (z zSetLockTopKProvider) popMembers(metaKey string, n int, top bool) ([]Element, error) {
+	ans := make([]Element, 0)
+	all := RangeBy{Min: "-inf", Max: "+inf"}
+	var shards []string
+	var err error
+	if top {
+		shards, err = z.b.ZRangeByScore(metaKey, all)
+	} else {
+		shards, err = z.b.ZRevRangeByScore(metaKey, all)
+	}
+	if err != nil {
+		z.opts.logError("pop failed", err, metaKey, "", "")
+		return nil, util.Wrap(err)
+	}
+	tx := z.b.TxPipeline()
+	for _, shard := range shards {
+		need := n - len(ans)
+		if need <= 0 {
+			break
+		}
+		// 多读一个, 用于判断shard是否会被清空, 从后弹出时也是shard新的最大score
+		by := RangeBy{Min: "-inf", Max: "+inf", Count: int64(need + 1)}
+		var members []Element
+		if top {
+			members, err = z.b.ZRangeByScoreWithScores(shard, by)
+		} else {
+			members, err = z.b.ZRevRangeByScoreWithScores(shard, by)
+		}
+		if err != nil {
+			z.opts.logError("pop failed", err, metaKey, "", shard)
+			return nil, util.Wrap(err)
+		}
+		taken := members
+		if len(members) > need {
+			taken = members[:need]
+		}
+		if len(taken) > 0 {
+			if top {
+				tx.ZRemRangeByRank(shard, 0, int64(len(taken)-1))
+			} else {
+				tx.ZRemRangeByRank(shard, -int64(len(taken)), -1)
+			}
+		}
+		for _, e := range taken {
+			tx.HDel(z.getExistsKey(metaKey, e.Id), e.Id)
+		}
+		if len(members) == len(taken) {
+			tx.ZRem(metaKey, shard)
+		} else if !top {
+			tx.ZAdd(metaKey, Element{Id: shard, Score: members[need].Score})
+		}
+		ans = append(ans, taken...)
+	}
+	if len(shards) > 0 {
+		if err := tx.Exec(); err != nil {
+			z.opts.logError("pop failed", err, metaKey, "", "")
+			return nil, util.Wrap(err)
+		}
+	}
+	return ans, nil
+}
+
+func (z zSetShardTopKProvider) PopTop(key string, n int) (err error, ans []Element) {
+	_, end := z.opts.begin(ProviderLua, OpPopTop, "key", key, "n", n)
+	defer end(&err)
+	return z.pop(key, n, "poptop")
+}
+
+func (z zSetShardTopKProvider) PopBottom(key string, n int) (err error, ans []Element) {
+	_, end := z.opts.begin(ProviderLua, OpPopBottom, "key", key, "n", n)
+	defer end(&err)
+	return z.pop(key, n, "popbottom")
+}
+
+func (z zSetShardTopKProvider) pop(key string, n int, cmd string) (error, []Element) {
+	if n <= 0 {
+		return nil, make([]Element, 0)
+	}
+	res, err := z.b.Eval(script, []string{z.makeMetaKey(key)}, cmd, n)
+	if err != nil {
+		z.opts.logError("pop failed", err, key, "", "")
+		return util.Wrap(err), nil
+	}
+	ans, err := parseScoredReply(res)
+	if err != nil {
+		return util.Wrap(err), nil
+	}
+	return nil, ans
+}
+
+func (m *MemoryTopKProvider) PopTop(key string, n int) (err error, ans []Element) {
+	_, end := m.opts.begin(ProviderMemory, OpPopTop, "key", key, "n", n)
+	defer end(&err)
+	return nil, m.pop(key, n, true)
+}
+
+func (m *MemoryTopKProvider) PopBottom(key string, n int) (err error, ans []Element) {
+	_, end := m.opts.begin(ProviderMemory, OpPopBottom, "key", key, "n", n)
+	defer end(&err)
+	return nil, m.pop(key, n, false)
+}
+
+func (m *MemoryTopKProvider) pop(key string, n int, top bool) []Element {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.popLocked(key, n, top)
+}
+
+// popLocked 在持有锁的情况下执行
+func (m *MemoryTopKProvider) popLocked(key string, n int, top bool) []Element {
+	ans := make([]Element, 0)
+	zs, ok := m.keys[key]
+	if !ok {
+		return ans
+	}
+	for len(ans) < n {
+		x := zs.zsl.tail
+		if top {
+			x = zs.zsl.first()
+		}
+		if x == nil {
+			break
+		}
+		ans = append(ans, Element{Id: x.member, Score: x.score})
+		zs.zsl.delete(x.score, x.member)
+		delete(zs.dict, x.member)
+	}
+	if len(zs.dict) == 0 {
+		delete(m.keys, key)
+	}
+	return ans
+}
@@ -0,0 +1,208 @@
+package topk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets 与 prometheus client 的 DefBuckets 一致, 单位秒
+var DefaultLatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+/*
+PromMetrics 内置的 Metrics 实现, 以 prometheus 文本格式导出
+
+	m := topk.NewPromMetrics(nil)
+	tp := topk.NewLockTopKProvider(cli, topk.WithMetrics(m))
+	http.Handle("/metrics", m)
+*/
+type PromMetrics struct {
+	mu          sync.Mutex
+	buckets     []float64
+	ops         map[string]uint64
+	opLatency   map[string]*histogram
+	shardEvents map[string]uint64
+	lockWait    map[string]*histogram
+	lockFails   map[string]uint64
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	for i := range buckets {
+		if v <= buckets[i] {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// NewPromMetrics buckets 为空时使用 DefaultLatencyBuckets
+func NewPromMetrics(buckets []float64) *PromMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	b := make([]float64, len(buckets))
+	copy(b, buckets)
+	sort.Float64s(b)
+	return &PromMetrics{
+		buckets:     b,
+		ops:         make(map[string]uint64),
+		opLatency:   make(map[string]*histogram),
+		shardEvents: make(map[string]uint64),
+		lockWait:    make(map[string]*histogram),
+		lockFails:   make(map[string]uint64),
+	}
+}
+
+func (m *PromMetrics) ObserveOp(provider, op string, d time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ops[labels("provider", provider, "op", op, "result", result)]++
+	m.histogram(m.opLatency, labels("provider", provider, "op", op)).observe(m.buckets, d.Seconds())
+}
+
+func (m *PromMetrics) IncShardEvent(provider, event string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.shardEvents[labels("provider", provider, "event", event)]++
+}
+
+func (m *PromMetrics) ObserveLockWait(provider string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.histogram(m.lockWait, labels("provider", provider)).observe(m.buckets, d.Seconds())
+}
+
+func (m *PromMetrics) IncLockFailure(provider string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lockFails[labels("provider", provider)]++
+}
+
+func (m *PromMetrics) histogram(hs map[string]*histogram, lbs string) *histogram {
+	h, ok := hs[lbs]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		hs[lbs] = h
+	}
+	return h
+}
+
+// ServeHTTP 实现 http.Handler, 输出 prometheus 文本格式
+func (m *PromMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := m.WriteTo(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// WriteTo 以 prometheus 文本格式写出所有指标
+func (m *PromMetrics) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countWriter{w: bw}
+	m.mu.Lock()
+	writeCounters(cw, "topk_ops_total", "Total number of provider operations.", m.ops)
+	m.writeHistograms(cw, "topk_op_duration_seconds", "Latency of provider operations.", m.opLatency)
+	writeCounters(cw, "topk_shard_events_total", "Total number of shard splits and rebalances.", m.shardEvents)
+	m.writeHistograms(cw, "topk_lock_wait_seconds", "Time spent acquiring the leaderboard lock.", m.lockWait)
+	writeCounters(cw, "topk_lock_failures_total", "Total number of lock acquisitions that hit contention or failed.", m.lockFails)
+	m.mu.Unlock()
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, bw.Flush()
+}
+
+func writeCounters(w io.Writer, name, help string, counters map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, lbs := range sortedKeys(counters) {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, lbs, counters[lbs])
+	}
+}
+
+func (m *PromMetrics) writeHistograms(w io.Writer, name, help string, hs map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	keys := make([]string, 0, len(hs))
+	for k := range hs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, lbs := range keys {
+		h := hs[lbs]
+		for i, le := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, lbs, formatFloat(le), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, lbs, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, lbs, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, lbs, h.count)
+	}
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labels 把 name, value 对格式化为 a="x",b="y"
+func labels(kvs ...string) string {
+	b := strings.Builder{}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(kvs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(kvs[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
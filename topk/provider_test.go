@@ -0,0 +1,157 @@
+package topk_test
+
+import (
+	"context"
+	"pushan/RedTopK/topk"
+	"pushan/RedTopK/topktest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shardEvents 统计shard分裂和再平衡, 确认测试覆盖了这两种情况
+type shardEvents struct {
+	mu     sync.Mutex
+	events map[string]int
+}
+
+func newShardEvents() *shardEvents {
+	return &shardEvents{events: make(map[string]int)}
+}
+
+func (s *shardEvents) ObserveOp(string, string, time.Duration, error) {}
+func (s *shardEvents) ObserveLockWait(string, time.Duration)          {}
+func (s *shardEvents) IncLockFailure(string)                          {}
+
+func (s *shardEvents) IncShardEvent(provider, event string) {
+	s.mu.Lock()
+	s.events[event]++
+	s.mu.Unlock()
+}
+
+func (s *shardEvents) expect(t *testing.T, events ...string) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range events {
+		if s.events[e] == 0 {
+			t.Errorf("no %s happened, events: %v", e, s.events)
+		}
+	}
+}
+
+func TestProviders(t *testing.T) {
+	cfg := topktest.Config{Seed: 1, Ranges: true, Pops: true}
+	for _, p := range redisProviders {
+		p := p
+		t.Run(p.name, func(t *testing.T) {
+			cli := testRedis(t)
+			c := cfg
+			c.Key = testKey(t)
+			topktest.Test(t, p.new(cli), c)
+			testUnionStore(t, p.new(cli), c.Key+":union")
+		})
+	}
+}
+
+// TestLockProviderShards 较小的 ShardLimit 让 lock provider 频繁分裂和再平衡
+func TestLockProviderShards(t *testing.T) {
+	cli := testRedis(t)
+	m := newShardEvents()
+	tp := topk.NewLockTopKProvider(cli, topk.WithShardLimit(4), topk.WithMetrics(m))
+	topktest.Test(t, tp, topktest.Config{Key: testKey(t), Seed: 1, Runs: 10, Ops: 400, Ranges: true, Pops: true})
+	m.expect(t, topk.ShardSplit, topk.ShardRebalance)
+}
+
+/*
+TestLuaProviderShards lua provider 的 ShardLimit 固定为 topk.ShardLimit, 需要足够多的id才会分裂.
+只生成add, delete 和 topk, 稳定时约2/3的id存在, 16000次操作后超过 ShardLimit 个member.
+*/
+func TestLuaProviderShards(t *testing.T) {
+	if testing.Short() {
+		t.Skip("slow")
+	}
+	cli := testRedis(t)
+	m := newShardEvents()
+	tp := topk.NewTopKProvider(cli, topk.WithMetrics(m))
+	topktest.Test(t, tp, topktest.Config{
+		Key:    testKey(t),
+		Seed:   1,
+		Runs:   1,
+		Ops:    4 * topk.ShardLimit,
+		Ids:    9000,
+		Scores: 2000,
+		MaxK:   10,
+		// 每次收缩都要重新执行上万次操作
+		MaxShrinks: 20,
+	})
+	m.expect(t, topk.ShardSplit, topk.ShardRebalance)
+}
+
+// popAsync 在后台等待key上的一个元素, 等待者加入队列之后返回
+func popAsync(tp topk.TopKProvider, key string) <-chan []topk.Element {
+	ch := make(chan []topk.Element, 1)
+	go func() {
+		_, ans := tp.(topk.BlockingPopper).BlockingPopTop(context.Background(), key, 1, 3*time.Second)
+		ch <- ans
+	}()
+	time.Sleep(100 * time.Millisecond)
+	return ch
+}
+
+// expectWoken 等待者一次 BLPOP 最多等待1秒, 在这之前收到元素说明被写入唤醒, 而不是超时后重试弹出
+func expectWoken(t *testing.T, ch <-chan []topk.Element, id string) {
+	t.Helper()
+	select {
+	case ans := <-ch:
+		if len(ans) != 1 || ans[0].Id != id {
+			t.Fatalf("waiter popped %v, want %s", ans, id)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("waiter not woken")
+	}
+}
+
+// TestMoveWakesWaiter MoveTopUntil 移动了元素时唤醒dst上的等待者
+func TestMoveWakesWaiter(t *testing.T) {
+	for _, p := range redisProviders {
+		p := p
+		t.Run(p.name, func(t *testing.T) {
+			tp := p.new(testRedis(t))
+			src, dst := testKey(t)+":src", testKey(t)+":dst"
+			for i, id := range []string{"a", "b", "c"} {
+				if err := tp.AddElement(src, id, float64(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ch := popAsync(tp, dst)
+			err, moved := tp.(topk.Mover).MoveTopUntil(src, dst, "1", 10, 5)
+			if err != nil || len(moved) != 2 {
+				t.Fatalf("move: %v %v", err, moved)
+			}
+			expectWoken(t, ch, "a")
+			if err, left := tp.GetTopKS(dst, 10); err != nil || len(left) != 1 || left[0] != (topk.Element{Id: "b", Score: 5}) {
+				t.Fatalf("dst after pop: %v %v", err, left)
+			}
+			if err, left := tp.GetTopKS(src, 10); err != nil || len(left) != 1 || left[0].Id != "c" {
+				t.Fatalf("src after move: %v %v", err, left)
+			}
+		})
+	}
+}
+
+// TestCapacityWakesWaiter 设置了容量时, 没有被拒绝的 AddElement 唤醒等待者
+func TestCapacityWakesWaiter(t *testing.T) {
+	for _, p := range redisProviders {
+		p := p
+		t.Run(p.name, func(t *testing.T) {
+			tp := p.new(testRedis(t), topk.WithCapacity(1))
+			key := testKey(t)
+			ch := popAsync(tp, key)
+			if err := tp.AddElement(key, "a", 1); err != nil {
+				t.Fatal(err)
+			}
+			expectWoken(t, ch, "a")
+		})
+	}
+}
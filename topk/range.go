@@ -0,0 +1,270 @@
+package topk
+
+import "pushan/RedTopK/util"
+
+/*
+RangeQuerier 可以按score区间查询的provider.
+min 和 max 的写法与 ZRANGEBYSCORE 相同, 例如 "1000", "(2000", "-inf", "+inf".
+*/
+type RangeQuerier interface {
+	// RangeByScore 按score升序返回区间内跳过offset个之后的count个member, count小于0表示不限制
+	RangeByScore(key string, min, max string, offset, count int) (error, []Element)
+	// CountByScore 返回区间内的member数量
+	CountByScore(key string, min, max string) (error, int64)
+}
+
+// afterBound 返回紧接在上界max之后的下界, 用于找到区间之后的第一个shard
+func afterBound(max string) string {
+	if len(max) > 0 && max[0] == '(' {
+		return max[1:]
+	}
+	return "(" + max
+}
+
+// rangeShards 返回可能包含区间内member的shard: 最大score在区间内的shard, 以及之后的第一个shard
+func rangeShards(b Backend, metaKey string, min, max string) ([]string, error) {
+	shards, err := b.ZRangeByScore(metaKey, RangeBy{Min: min, Max: max})
+	if err != nil {
+		return nil, err
+	}
+	next, err := b.ZRangeByScore(metaKey, RangeBy{Min: afterBound(max), Max: "+inf", Count: 1})
+	if err != nil {
+		return nil, err
+	}
+	return append(shards, next...), nil
+}
+
+// shardCounts 返回每个shard中区间内的member数量
+func shardCounts(b Backend, shards []string, min, max string) ([]int64, error) {
+	pl := b.Pipeline()
+	replies := make([]*IntReply, len(shards))
+	for i := range shards {
+		replies[i] = pl.ZCount(shards[i], min, max)
+	}
+	if len(shards) > 0 {
+		if err := pl.Exec(); err != nil {
+			return nil, err
+		}
+	}
+	counts := make([]int64, len(shards))
+	for i := range replies {
+		counts[i] = replies[i].Val
+	}
+	return counts, nil
+}
+
+// layoutRange 只读取与区间重叠的shard, 用 ZCOUNT 跳过offset覆盖的整个shard, lua 和 lock provider 的布局相同
+func layoutRange(b Backend, metaKey string, min, max string, offset, count int) ([]Element, error) {
+	ans := make([]Element, 0)
+	shards, err := rangeShards(b, metaKey, min, max)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := shardCounts(b, shards, min, max)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(shards) && count != 0; i++ {
+		if int64(offset) >= counts[i] {
+			offset -= int(counts[i])
+			continue
+		}
+		members, err := b.ZRangeByScoreWithScores(shards[i], RangeBy{
+			Min:    min,
+			Max:    max,
+			Offset: int64(offset),
+			Count:  int64(count),
+		})
+		if err != nil {
+			return nil, err
+		}
+		offset = 0
+		if count > 0 {
+			count -= len(members)
+		}
+		ans = append(ans, members...)
+	}
+	return ans, nil
+}
+
+func layoutCount(b Backend, metaKey string, min, max string) (int64, error) {
+	shards, err := rangeShards(b, metaKey, min, max)
+	if err != nil {
+		return 0, err
+	}
+	counts, err := shardCounts(b, shards, min, max)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for i := range counts {
+		n += counts[i]
+	}
+	return n, nil
+}
+
+// RangeByScore 普通zset直接使用 ZRANGEBYSCORE
+func (z ZSetTopKProvider) RangeByScore(key string, min, max string, offset, count int) (err error, ans []Element) {
+	_, end := z.opts.begin(ProviderZSet, OpRange, "key", key, "min", min, "max", max)
+	defer end(&err)
+	if _, _, err := z.opts.validateRange(key, min, max); err != nil {
+		return err, nil
+	}
+	if offset < 0 || count == 0 {
+		return nil, make([]Element, 0)
+	}
+	ans, err = z.b.ZRangeByScoreWithScores(key, RangeBy{
+		Min:    min,
+		Max:    max,
+		Offset: int64(offset),
+		Count:  int64(count),
+	})
+	if err != nil {
+		z.opts.logError("range by score failed", err, key, "", key)
+		return util.Wrap(err), nil
+	}
+	return nil, ans
+}
+
+func (z ZSetTopKProvider) CountByScore(key string, min, max string) (err error, n int64) {
+	_, end := z.opts.begin(ProviderZSet, OpCount, "key", key, "min", min, "max", max)
+	defer end(&err)
+	if _, _, err := z.opts.validateRange(key, min, max); err != nil {
+		return err, 0
+	}
+	n, err = z.b.ZCount(key, min, max)
+	if err != nil {
+		z.opts.logError("count by score failed", err, key, "", key)
+		return util.Wrap(err), 0
+	}
+	return nil, n
+}
+
+func (z zSetLockTopKProvider) RangeByScore(key string, min, max string, offset, count int) (err error, ans []Element) {
+	span, end := z.opts.begin(ProviderLock, OpRange, "key", key, "min", min, "max", max)
+	defer end(&err)
+	z = z.withTrace(span)
+	if _, _, err := z.opts.validateRange(key, min, max); err != nil {
+		return err, nil
+	}
+	if offset < 0 || count == 0 {
+		return nil, make([]Element, 0)
+	}
+	lock, err := z.acquire(key)
+	if err != nil {
+		return err, nil
+	}
+	defer lock.UnLock()
+	metaKey, err := z.currentMeta(key)
+	if err != nil {
+		return err, nil
+	}
+	ans, err = layoutRange(z.b, metaKey, min, max, offset, count)
+	if err != nil {
+		z.opts.logError("range by score failed", err, metaKey, "", "")
+		return util.Wrap(err), nil
+	}
+	return nil, ans
+}
+
+func (z zSetLockTopKProvider) CountByScore(key string, min, max string) (err error, n int64) {
+	span, end := z.opts.begin(ProviderLock, OpCount, "key", key, "min", min, "max", max)
+	defer end(&err)
+	z = z.withTrace(span)
+	if _, _, err := z.opts.validateRange(key, min, max); err != nil {
+		return err, 0
+	}
+	lock, err := z.acquire(key)
+	if err != nil {
+		return err, 0
+	}
+	defer lock.UnLock()
+	metaKey, err := z.currentMeta(key)
+	if err != nil {
+		return err, 0
+	}
+	n, err = layoutCount(z.b, metaKey, min, max)
+	if err != nil {
+		z.opts.logError("count by score failed", err, metaKey, "", "")
+		return util.Wrap(err), 0
+	}
+	return nil, n
+}
+
+// RangeByScore 在脚本中执行, 与 layoutRange 的逻辑相同
+func (z zSetShardTopKProvider) RangeByScore(key string, min, max string, offset, count int) (err error, ans []Element) {
+	_, end := z.opts.begin(ProviderLua, OpRange, "key", key, "min", min, "max", max)
+	defer end(&err)
+	if _, _, err := z.opts.validateRange(key, min, max); err != nil {
+		return err, nil
+	}
+	if offset < 0 || count == 0 {
+		return nil, make([]Element, 0)
+	}
+	res, err := z.b.Eval(script, []string{z.makeMetaKey(key)}, "range", min, max, offset, count)
+	if err != nil {
+		z.opts.logError("range by score failed", err, key, "", "")
+		return util.Wrap(err), nil
+	}
+	ans, err = parseScoredReply(res)
+	if err != nil {
+		return util.Wrap(err), nil
+	}
+	return nil, ans
+}
+
+func (z zSetShardTopKProvider) CountByScore(key string, min, max string) (err error, n int64) {
+	_, end := z.opts.begin(ProviderLua, OpCount, "key", key, "min", min, "max", max)
+	defer end(&err)
+	if _, _, err := z.opts.validateRange(key, min, max); err != nil {
+		return err, 0
+	}
+	n, err = evalInt(z.b, []string{z.makeMetaKey(key)}, "count", min, max)
+	if err != nil {
+		z.opts.logError("count by score failed", err, key, "", "")
+		return util.Wrap(err), 0
+	}
+	return nil, n
+}
+
+func (m *MemoryTopKProvider) RangeByScore(key string, min, max string, offset, count int) (err error, ans []Element) {
+	_, end := m.opts.begin(ProviderMemory, OpRange, "key", key, "min", min, "max", max)
+	defer end(&err)
+	lo, hi, err := m.opts.validateRange(key, min, max)
+	if err != nil {
+		return err, nil
+	}
+	ans = make([]Element, 0)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	zs, ok := m.keys[key]
+	if !ok || offset < 0 || count == 0 {
+		return nil, ans
+	}
+	x := zs.zsl.byRank(zs.zsl.countWhile(lo.below) + offset + 1)
+	for ; x != nil && !hi.above(x.score) && (count < 0 || len(ans) < count); x = x.next() {
+		ans = append(ans, Element{Id: x.member, Score: x.score})
+	}
+	return nil, ans
+}
+
+func (m *MemoryTopKProvider) CountByScore(key string, min, max string) (err error, n int64) {
+	_, end := m.opts.begin(ProviderMemory, OpCount, "key", key, "min", min, "max", max)
+	defer end(&err)
+	lo, hi, err := m.opts.validateRange(key, min, max)
+	if err != nil {
+		return err, 0
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	zs, ok := m.keys[key]
+	if !ok {
+		return nil, 0
+	}
+	below := zs.zsl.countWhile(lo.below)
+	upto := zs.zsl.countWhile(func(score float64) bool { return !hi.above(score) })
+	if upto <= below {
+		return nil, 0
+	}
+	return nil, int64(upto - below)
+}
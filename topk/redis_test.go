@@ -0,0 +1,42 @@
+package topk_test
+
+import (
+	"fmt"
+	"os"
+	"pushan/RedTopK/topk"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// redisProviders 需要redis的provider, 无法连接 REDIS_ADDR 时跳过
+var redisProviders = []struct {
+	name string
+	new  func(cli *redis.Client, opts ...topk.Option) topk.TopKProvider
+}{
+	{"lua", topk.NewTopKProvider},
+	{"lock", topk.NewLockTopKProvider},
+	{"zset", topk.NewZSetProvider},
+}
+
+// testRedis 连接环境变量 REDIS_ADDR 指定的redis, 默认为 127.0.0.1:6379, 无法连接时跳过测试
+func testRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:6379"
+	}
+	cli := redis.NewClient(&redis.Options{Addr: addr, DialTimeout: 200 * time.Millisecond})
+	if err := cli.Ping().Err(); err != nil {
+		cli.Close()
+		t.Skipf("redis %s not reachable: %s", addr, err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	return cli
+}
+
+// testKey 每次测试使用不同的key, 避免和之前留下的数据冲突
+func testKey(t *testing.T) string {
+	return fmt.Sprintf("topk_test:%s:%d", t.Name(), time.Now().UnixNano())
+}
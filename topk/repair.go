@@ -0,0 +1,174 @@
+package topk
+
+import (
+	"fmt"
+	"pushan/RedTopK/util"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Repairer 可以修复分片布局的provider
+type Repairer interface {
+	// Repair 检查布局, 有问题时重建, 返回修复前的检查结果
+	Repair(key string) (error, *CheckReport)
+}
+
+func (z zSetLockTopKProvider) Repair(key string) (error, *CheckReport) {
+	lock, err := z.acquire(key)
+	if err != nil {
+		return err, nil
+	}
+	defer lock.UnLock()
+	metaKey, err := z.currentMeta(key)
+	if err != nil {
+		return err, nil
+	}
+	report, err := checkLayout(z.b, key, metaKey)
+	if err != nil {
+		z.opts.logError("check layout failed", err, metaKey, "", "")
+		return err, nil
+	}
+	if report.OK() {
+		return nil, report
+	}
+	if err := rebuildLayout(z.b, metaKey, z.opts.shardLimit, z.getExistsKey); err != nil {
+		z.opts.logError("rebuild layout failed", err, metaKey, "", "")
+		return err, nil
+	}
+	z.opts.logger.Log(util.LevelWarn, "layout rebuilt", "key", key, "problems", len(report.Problems))
+	return nil, report
+}
+
+/*
+rebuildLayout 从所有shard(包括不在meta中的shard)中收集member, 在一个事务中重建整个布局.
+同一个member出现在多个shard中时, 以 m_to_z 指向的shard为准.
+新的shard填充到 shardLimit 的一半, 相同的score不会跨shard. 重建后的key保留meta(或shard_cnt)原有的剩余过期时间.
+*/
+func rebuildLayout(b Backend, metaKey string, shardLimit int, bucketOf func(metaKey, id string) string) error {
+	metaZSets, err := b.ZRangeWithScores(metaKey, 0, -1)
+	if err != nil {
+		return util.Wrap(err)
+	}
+	shardCntStr, ok, err := b.Get(metaKey + ":shard_cnt")
+	if err != nil {
+		return util.Wrap(err)
+	}
+	var shardCnt int64
+	if ok {
+		if shardCnt, err = strconv.ParseInt(shardCntStr, 10, 64); err != nil {
+			return util.Wrap(err)
+		}
+	}
+	ttl, err := layoutTTL(b, metaKey)
+	if err != nil {
+		return util.Wrap(err)
+	}
+	shards := make([]string, 0, len(metaZSets))
+	seen := make(map[string]bool, len(metaZSets))
+	for i := range metaZSets {
+		shards = append(shards, metaZSets[i].Id)
+		seen[metaZSets[i].Id] = true
+	}
+	for i := int64(1); i <= shardCnt; i++ {
+		if shard := fmt.Sprintf("%s:data_shard:%d", metaKey, i); !seen[shard] {
+			shards = append(shards, shard)
+		}
+	}
+
+	pl := b.Pipeline()
+	shardReplies := make([]*ElementsReply, len(shards))
+	for i := range shards {
+		shardReplies[i] = pl.ZRangeWithScores(shards[i], 0, -1)
+	}
+	buckets := make([]string, HashShardCnt)
+	hashReplies := make([]*MapReply, HashShardCnt)
+	for i := range hashReplies {
+		buckets[i] = fmt.Sprintf("%s:m_to_z:%d", metaKey, i)
+		hashReplies[i] = pl.HGetAll(buckets[i])
+	}
+	if err := pl.Exec(); err != nil {
+		return util.Wrap(err)
+	}
+	indexed := make(map[string]string)
+	for i := range hashReplies {
+		for member, shard := range hashReplies[i].Val {
+			indexed[member] = shard
+		}
+	}
+	scores := make(map[string]float64)
+	for i := range shards {
+		for _, e := range shardReplies[i].Val {
+			if _, ok := scores[e.Id]; !ok || indexed[e.Id] == shards[i] {
+				scores[e.Id] = e.Score
+			}
+		}
+	}
+	elements := make([]Element, 0, len(scores))
+	for member, score := range scores {
+		elements = append(elements, Element{Id: member, Score: score})
+	}
+	sort.Slice(elements, func(i, j int) bool {
+		if elements[i].Score != elements[j].Score {
+			return elements[i].Score < elements[j].Score
+		}
+		return elements[i].Id < elements[j].Id
+	})
+
+	tx := b.TxPipeline()
+	tx.Del(append(append([]string{metaKey}, shards...), buckets...)...)
+	rebuilt := []string{metaKey, metaKey + ":shard_cnt"}
+	touched := make(map[string]bool)
+	n := 0
+	for st := 0; st < len(elements); {
+		end := st + 1
+		for end < len(elements) && (end-st < shardLimit/2 || elements[end].Score == elements[end-1].Score) {
+			end++
+		}
+		n++
+		shard := fmt.Sprintf("%s:data_shard:%d", metaKey, n)
+		tx.ZAdd(shard, elements[st:end]...)
+		tx.ZAdd(metaKey, Element{Id: shard, Score: elements[end-1].Score})
+		rebuilt = append(rebuilt, shard)
+		index := make(map[string]map[string]string)
+		for _, e := range elements[st:end] {
+			bucket := bucketOf(metaKey, e.Id)
+			if index[bucket] == nil {
+				index[bucket] = make(map[string]string)
+			}
+			index[bucket][e.Id] = shard
+		}
+		for bucket, fields := range index {
+			tx.HMSet(bucket, fields)
+			if !touched[bucket] {
+				touched[bucket] = true
+				rebuilt = append(rebuilt, bucket)
+			}
+		}
+		st = end
+	}
+	tx.Set(metaKey+":shard_cnt", strconv.Itoa(n))
+	if ttl > 0 {
+		for _, key := range rebuilt {
+			tx.PExpire(key, ttl)
+		}
+	}
+	if err := tx.Exec(); err != nil {
+		return util.Wrap(err)
+	}
+	return nil
+}
+
+// layoutTTL 返回布局的剩余过期时间, meta损坏时使用 shard_cnt 的过期时间, 都没有时返回0
+func layoutTTL(b Backend, metaKey string) (time.Duration, error) {
+	for _, key := range []string{metaKey, metaKey + ":shard_cnt"} {
+		ttl, err := b.PTTL(key)
+		if err != nil {
+			return 0, err
+		}
+		if ttl > 0 {
+			return ttl, nil
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,179 @@
+package topk_test
+
+import (
+	"fmt"
+	"math/rand"
+	"pushan/RedTopK/bench"
+	"pushan/RedTopK/chaos"
+	"pushan/RedTopK/topk"
+	"pushan/RedTopK/topktest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const repairLockTimeout = 200 * time.Millisecond
+
+func repairOpts() []topk.Option {
+	return []topk.Option{topk.WithShardLimit(8), topk.WithLockTimeout(repairLockTimeout)}
+}
+
+// repairAndCheck 布局有问题时修复, 修复后的布局必须一致, 并且能继续正常使用
+func repairAndCheck(t *testing.T, tp topk.TopKProvider, key string) {
+	t.Helper()
+	err, report := tp.(topk.Checker).Check(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		if err, _ := tp.(topk.Repairer).Repair(key); err != nil {
+			t.Fatal(err)
+		}
+		if err, report = tp.(topk.Checker).Check(key); err != nil {
+			t.Fatal(err)
+		}
+		if !report.OK() {
+			t.Fatalf("layout still inconsistent after repair: %v", report.Problems)
+		}
+	}
+	err, elements := tp.GetTopKS(key, int(report.Members))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := topktest.Generate(rand.New(rand.NewSource(1)), 300, topktest.Config{Ids: 64, Scores: 16})
+	if f := topktest.CheckFrom(tp, key, elements, seq); f != nil {
+		t.Fatal(f)
+	}
+}
+
+// repairProfiles 与 chaos 命令相同的故障
+var repairProfiles = []struct {
+	name  string
+	rules []chaos.Rule
+}{
+	{"error", []chaos.Rule{{Command: "*", Action: chaos.ActionError, Probability: 0.02, Partial: true}}},
+	{"drop", []chaos.Rule{{Command: "*", Action: chaos.ActionDrop, Probability: 0.02}}},
+	{"delay", []chaos.Rule{{Command: "z*", Action: chaos.ActionDelay, Delay: 2 * repairLockTimeout, Probability: 0.005}}},
+	{"script", []chaos.Rule{{Command: "eval*", Action: chaos.ActionError, Probability: 0.2}}},
+}
+
+// runChaos 在故障注入下并发执行随机操作, 然后关闭故障, 返回b上的正常provider
+func runChaos(t *testing.T, b topk.Backend, key string, rules []chaos.Rule) topk.TopKProvider {
+	t.Helper()
+	inj := chaos.New(1, rules...)
+	faulty := topk.NewLockTopKProviderWithBackend(inj.Wrap(b), repairOpts()...)
+	bench.Run(faulty, bench.Config{
+		Key:          key,
+		Clients:      4,
+		OpsPerClient: 200,
+		Workload: bench.Synthetic{
+			Mix:    bench.Mix{Add: 70, Delete: 20, TopK: 10},
+			K:      10,
+			Ids:    bench.ZipfIds(200, 1.01),
+			Scores: bench.DiscreteScores(16),
+		},
+		Seed: 1,
+	})
+	fired := inj.Fired()
+	inj.SetRules()
+	if fired[0] == 0 {
+		t.Fatal("no fault injected")
+	}
+	return topk.NewLockTopKProviderWithBackend(b, repairOpts()...)
+}
+
+// TestRepairAfterChaos 注入故障后布局可能不一致, Repair 之后必须恢复
+func TestRepairAfterChaos(t *testing.T) {
+	for _, p := range repairProfiles {
+		p := p
+		t.Run(p.name, func(t *testing.T) {
+			key := testKey(t)
+			tp := runChaos(t, topk.NewRedisBackend(testRedis(t)), key, p.rules)
+			repairAndCheck(t, tp, key)
+		})
+	}
+}
+
+// TestRepairLayout 直接破坏布局: 删除一个 m_to_z 并在另一个shard中留下过期的副本, 修复后数据和过期时间不变
+func TestRepairLayout(t *testing.T) {
+	cli := testRedis(t)
+	key := testKey(t)
+	tp := topk.NewLockTopKProvider(cli, repairOpts()...)
+	want := make(map[string]float64)
+	for i := 0; i < 40; i++ {
+		id, score := "m"+strconv.Itoa(i), float64(i%10)
+		if err := tp.AddElement(key, id, score); err != nil {
+			t.Fatal(err)
+		}
+		want[id] = score
+	}
+	if err := tp.(topk.Expirer).ExpireAt(key, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	metaKey := fmt.Sprintf(topk.MetaZSetTemplate, key, topk.Version)
+	shards, err := cli.ZRange(metaKey, 0, -1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shards) < 2 {
+		t.Fatalf("expect several shards, got %v", shards)
+	}
+	first, err := cli.ZRange(shards[0], 0, 0).Result()
+	if err != nil || len(first) == 0 {
+		t.Fatalf("read %s: %v %v", shards[0], first, err)
+	}
+	stale := redis.Z{Member: first[0], Score: 100}
+	if err := cli.ZAdd(shards[len(shards)-1], stale).Err(); err != nil {
+		t.Fatal(err)
+	}
+	buckets, err := cli.Keys(metaKey + ":m_to_z:*").Result()
+	if err != nil || len(buckets) == 0 {
+		t.Fatalf("list m_to_z: %v %v", buckets, err)
+	}
+	if err := cli.Del(buckets[0]).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	err, report := tp.(topk.Checker).Check(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() {
+		t.Fatal("corrupted layout passed check")
+	}
+	if err, _ := tp.(topk.Repairer).Repair(key); err != nil {
+		t.Fatal(err)
+	}
+	if err, report = tp.(topk.Checker).Check(key); err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("layout still inconsistent after repair: %v", report.Problems)
+	}
+
+	err, elements := tp.GetTopKS(key, len(want)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elements) != len(want) {
+		t.Fatalf("got %d elements after repair, want %d", len(elements), len(want))
+	}
+	for _, e := range elements {
+		if score, ok := want[e.Id]; !ok || score != e.Score {
+			t.Errorf("%s: got score %v, want %v (exists %v)", e.Id, e.Score, score, ok)
+		}
+	}
+
+	keys, err := cli.Keys(metaKey + "*").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if ttl := cli.PTTL(k).Val(); ttl <= 0 {
+			t.Errorf("%s lost its ttl after repair: %v", k, ttl)
+		}
+	}
+}
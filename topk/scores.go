@@ -0,0 +1,165 @@
+package topk
+
+import (
+	"pushan/RedTopK/util"
+)
+
+// ScoreQuerier 可以批量查询member的score的provider
+type ScoreQuerier interface {
+	// GetScores 返回ids中存在的member的score, 不存在的id不在结果中
+	GetScores(key string, ids []string) (error, map[string]float64)
+}
+
+// scoresOf 把 "id,score,..." 形式的脚本结果转换为map
+func scoresOf(res interface{}) (map[string]float64, error) {
+	members, err := parseScoredReply(res)
+	if err != nil {
+		return nil, err
+	}
+	ans := make(map[string]float64, len(members))
+	for _, e := range members {
+		ans[e.Id] = e.Score
+	}
+	return ans, nil
+}
+
+var zsetScoresScript = NewScript(`
+	local l = {}
+	for i = 1, #ARGV do
+		local score = redis.call("zscore", KEYS[1], ARGV[i])
+		if score then
+			l[#l + 1] = ARGV[i]
+			l[#l + 1] = score
+		end
+	end
+	if #l == 0 then
+		return ""
+	end
+	return table.concat(l, ",") .. ","
+`)
+
+func (z ZSetTopKProvider) GetScores(key string, ids []string) (err error, ans map[string]float64) {
+	_, end := z.opts.begin(ProviderZSet, OpScores, "key", key, "n", len(ids))
+	defer end(&err)
+	for _, id := range ids {
+		if err := z.opts.validateId(key, id); err != nil {
+			return err, nil
+		}
+	}
+	if len(ids) == 0 {
+		return nil, make(map[string]float64)
+	}
+	res, err := z.b.Eval(zsetScoresScript, []string{key}, strArgs(ids)...)
+	if err != nil {
+		z.opts.logError("get scores failed", err, key, "", key)
+		return util.Wrap(err), nil
+	}
+	ans, err = scoresOf(res)
+	if err != nil {
+		return util.Wrap(err), nil
+	}
+	return nil, ans
+}
+
+// lockScoresScript KEYS[i] 为 ARGV[i] 所在的 m_to_z
+var lockScoresScript = NewScript(`
+	local l = {}
+	for i = 1, #ARGV do
+		local shard = redis.call("hget", KEYS[i], ARGV[i])
+		if shard then
+			local score = redis.call("zscore", shard, ARGV[i])
+			if score then
+				l[#l + 1] = ARGV[i]
+				l[#l + 1] = score
+			end
+		end
+	end
+	if #l == 0 then
+		return ""
+	end
+	return table.concat(l, ",") .. ","
+`)
+
+func (z zSetLockTopKProvider) GetScores(key string, ids []string) (err error, ans map[string]float64) {
+	span, end := z.opts.begin(ProviderLock, OpScores, "key", key, "n", len(ids))
+	defer end(&err)
+	z = z.withTrace(span)
+	for _, id := range ids {
+		if err := z.opts.validateId(key, id); err != nil {
+			return err, nil
+		}
+	}
+	if len(ids) == 0 {
+		return nil, make(map[string]float64)
+	}
+	lock, err := z.acquire(key)
+	if err != nil {
+		return err, nil
+	}
+	defer lock.UnLock()
+	metaKey, err := z.currentMeta(key)
+	if err != nil {
+		return err, nil
+	}
+	hashKeys := make([]string, len(ids))
+	for i := range ids {
+		hashKeys[i] = z.getExistsKey(metaKey, ids[i])
+	}
+	res, err := z.b.Eval(lockScoresScript, hashKeys, strArgs(ids)...)
+	if err != nil {
+		z.opts.logError("get scores failed", err, metaKey, "", "")
+		return util.Wrap(err), nil
+	}
+	ans, err = scoresOf(res)
+	if err != nil {
+		return util.Wrap(err), nil
+	}
+	return nil, ans
+}
+
+func (z zSetShardTopKProvider) GetScores(key string, ids []string) (err error, ans map[string]float64) {
+	_, end := z.opts.begin(ProviderLua, OpScores, "key", key, "n", len(ids))
+	defer end(&err)
+	for _, id := range ids {
+		if err := z.opts.validateId(key, id); err != nil {
+			return err, nil
+		}
+	}
+	if len(ids) == 0 {
+		return nil, make(map[string]float64)
+	}
+	args := append([]interface{}{"scores"}, strArgs(ids)...)
+	res, err := z.b.Eval(script, []string{z.makeMetaKey(key)}, args...)
+	if err != nil {
+		z.opts.logError("get scores failed", err, key, "", "")
+		return util.Wrap(err), nil
+	}
+	ans, err = scoresOf(res)
+	if err != nil {
+		return util.Wrap(err), nil
+	}
+	return nil, ans
+}
+
+func (m *MemoryTopKProvider) GetScores(key string, ids []string) (err error, ans map[string]float64) {
+	_, end := m.opts.begin(ProviderMemory, OpScores, "key", key, "n", len(ids))
+	defer end(&err)
+	for _, id := range ids {
+		if err := m.opts.validateId(key, id); err != nil {
+			return err, nil
+		}
+	}
+	ans = make(map[string]float64)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	zs, ok := m.keys[key]
+	if !ok {
+		return nil, ans
+	}
+	for _, id := range ids {
+		if score, ok := zs.dict[id]; ok {
+			ans[id] = score
+		}
+	}
+	return nil, ans
+}
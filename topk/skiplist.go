@@ -0,0 +1,202 @@
+package topk
+
+import "math/rand"
+
+// 与redis zset的skiplist相同的参数
+const (
+	skipListMaxLevel = 32
+	skipListP        = 0.25
+)
+
+type skipLevel struct {
+	forward *skipNode
+	// span 到forward之间跨过的节点数, 用于计算排名
+	span int
+}
+
+type skipNode struct {
+	member   string
+	score    float64
+	backward *skipNode
+	level    []skipLevel
+}
+
+/*
+skipList 按 score 升序排列的跳表, score 相同时按 member 字典序, 与redis zset的顺序一致.
+不是并发安全的.
+*/
+type skipList struct {
+	head   *skipNode
+	tail   *skipNode
+	length int
+	level  int
+	r      *rand.Rand
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipNode{level: make([]skipLevel, skipListMaxLevel)},
+		level: 1,
+		r:     rand.New(rand.NewSource(1)),
+	}
+}
+
+func (sl *skipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && sl.r.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+// before 判断节点n是否排在(score, member)之前
+func (n *skipNode) before(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+func (sl *skipList) insert(score float64, member string) *skipNode {
+	var update [skipListMaxLevel]*skipNode
+	var rank [skipListMaxLevel]int
+	x := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		if i < sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	level := sl.randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = sl.head
+			update[i].level[i].span = sl.length
+		}
+		sl.level = level
+	}
+	x = &skipNode{member: member, score: score, level: make([]skipLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < sl.level; i++ {
+		update[i].level[i].span++
+	}
+	if update[0] != sl.head {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+	sl.length++
+	return x
+}
+
+// delete 删除(score, member), 不存在时返回false
+func (sl *skipList) delete(score float64, member string) bool {
+	var update [skipListMaxLevel]*skipNode
+	x := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+	for i := 0; i < sl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		sl.tail = x.backward
+	}
+	for sl.level > 1 && sl.head.level[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+	return true
+}
+
+// first 返回第一个节点, 为空时返回nil
+func (sl *skipList) first() *skipNode {
+	return sl.head.level[0].forward
+}
+
+// next 返回下一个节点
+func (n *skipNode) next() *skipNode {
+	return n.level[0].forward
+}
+
+// countWhile 从头开始统计score满足f的节点数, f需要对有序的节点先返回true再返回false
+func (sl *skipList) countWhile(f func(score float64) bool) int {
+	x := sl.head
+	rank := 0
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && f(x.level[i].forward.score) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+	}
+	return rank
+}
+
+// byRank 返回排名为rank的节点, rank从1开始, 超出范围时返回nil
+func (sl *skipList) byRank(rank int) *skipNode {
+	if rank < 1 || rank > sl.length {
+		return nil
+	}
+	x := sl.head
+	traversed := 0
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// rank 返回(score, member)的排名, 从1开始, 不存在时返回0
+func (sl *skipList) rank(score float64, member string) (int, *skipNode) {
+	x := sl.head
+	rank := 0
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !x.level[i].forward.after(score, member) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != sl.head && x.score == score && x.member == member {
+			return rank, x
+		}
+	}
+	return 0, nil
+}
+
+// after 判断节点n是否排在(score, member)之后
+func (n *skipNode) after(score float64, member string) bool {
+	return n.score > score || (n.score == score && n.member > member)
+}
+
+// prev 返回上一个节点
+func (n *skipNode) prev() *skipNode {
+	return n.backward
+}
@@ -0,0 +1,214 @@
+package topk
+
+import (
+	"fmt"
+	"pushan/RedTopK/util"
+)
+
+// FillFactorBuckets fill factor 直方图的桶数, 前10个桶每个覆盖10%, 最后一个桶为超过shard上限的shard
+const FillFactorBuckets = 11
+
+// Inspector 可以返回leaderboard布局统计信息的provider
+type Inspector interface {
+	Stats(key string) (error, *Stats)
+}
+
+// ShardStats 单个data shard的统计信息
+type ShardStats struct {
+	Key      string  `json:"key"`
+	Members  int64   `json:"members"`
+	MinScore float64 `json:"min_score"`
+	MaxScore float64 `json:"max_score"`
+	// MetaScore meta zset 中记录的最大score, 正常情况下等于 MaxScore
+	MetaScore   float64 `json:"meta_score"`
+	MemoryBytes int64   `json:"memory_bytes"`
+}
+
+// Stats leaderboard的布局统计信息, MemoryBytes 为-1表示redis不支持 MEMORY USAGE
+type Stats struct {
+	Key          string       `json:"key"`
+	MetaKey      string       `json:"meta_key"`
+	ShardCount   int          `json:"shard_count"`
+	TotalMembers int64        `json:"total_members"`
+	Shards       []ShardStats `json:"shards"`
+	// FillFactor shard数量按 Members/shard上限 分桶
+	FillFactor []int `json:"fill_factor"`
+	// HashBuckets m_to_z 每个hash桶中的member数量
+	HashBuckets []int64 `json:"hash_buckets"`
+	MemoryBytes int64   `json:"memory_bytes"`
+}
+
+func fillFactorBucket(members int64, limit int) int {
+	if members > int64(limit) {
+		return FillFactorBuckets - 1
+	}
+	b := int(members * 10 / int64(limit))
+	if b >= FillFactorBuckets-1 {
+		b = FillFactorBuckets - 2
+	}
+	return b
+}
+
+// layoutStats 读取分片布局的统计信息, lua 和 lock provider 的布局相同
+func layoutStats(b Backend, key, metaKey string, shardLimit int) (*Stats, error) {
+	metaZSets, err := b.ZRangeWithScores(metaKey, 0, -1)
+	if err != nil {
+		return nil, util.Wrap(err)
+	}
+	stats := &Stats{
+		Key:         key,
+		MetaKey:     metaKey,
+		ShardCount:  len(metaZSets),
+		Shards:      make([]ShardStats, len(metaZSets)),
+		FillFactor:  make([]int, FillFactorBuckets),
+		HashBuckets: make([]int64, HashShardCnt),
+	}
+	pl := b.Pipeline()
+	cardReplies := make([]*IntReply, len(metaZSets))
+	minReplies := make([]*ElementsReply, len(metaZSets))
+	maxReplies := make([]*ElementsReply, len(metaZSets))
+	for i := range metaZSets {
+		shard := metaZSets[i].Id
+		cardReplies[i] = pl.ZCard(shard)
+		minReplies[i] = pl.ZRangeWithScores(shard, 0, 0)
+		maxReplies[i] = pl.ZRevRangeWithScores(shard, 0, 0)
+	}
+	hashReplies := make([]*IntReply, HashShardCnt)
+	for i := range hashReplies {
+		hashReplies[i] = pl.HLen(fmt.Sprintf("%s:m_to_z:%d", metaKey, i))
+	}
+	if err := pl.Exec(); err != nil {
+		return nil, util.Wrap(err)
+	}
+	for i := range metaZSets {
+		s := &stats.Shards[i]
+		s.Key = metaZSets[i].Id
+		s.MetaScore = metaZSets[i].Score
+		s.Members = cardReplies[i].Val
+		if mins := minReplies[i].Val; len(mins) > 0 {
+			s.MinScore = mins[0].Score
+		}
+		if maxs := maxReplies[i].Val; len(maxs) > 0 {
+			s.MaxScore = maxs[0].Score
+		}
+		stats.TotalMembers += s.Members
+		stats.FillFactor[fillFactorBucket(s.Members, shardLimit)]++
+	}
+	for i := range hashReplies {
+		stats.HashBuckets[i] = hashReplies[i].Val
+	}
+	keys := []string{metaKey}
+	for i := range stats.Shards {
+		keys = append(keys, stats.Shards[i].Key)
+	}
+	for i := range stats.HashBuckets {
+		if stats.HashBuckets[i] > 0 {
+			keys = append(keys, fmt.Sprintf("%s:m_to_z:%d", metaKey, i))
+		}
+	}
+	mem, err := memoryUsage(b, keys)
+	if err != nil {
+		stats.MemoryBytes = -1
+		for i := range stats.Shards {
+			stats.Shards[i].MemoryBytes = -1
+		}
+		return stats, nil
+	}
+	for i := range mem {
+		stats.MemoryBytes += mem[i]
+	}
+	for i := range stats.Shards {
+		stats.Shards[i].MemoryBytes = mem[i+1]
+	}
+	return stats, nil
+}
+
+// memoryUsage 返回每个key的 MEMORY USAGE, key不存在时为0
+func memoryUsage(b Backend, keys []string) ([]int64, error) {
+	pl := b.Pipeline()
+	replies := make([]*IntReply, len(keys))
+	for i := range keys {
+		replies[i] = pl.MemoryUsage(keys[i])
+	}
+	_ = pl.Exec()
+	mem := make([]int64, len(keys))
+	for i := range replies {
+		if err := replies[i].Err; err != nil {
+			return nil, util.Wrap(err)
+		}
+		mem[i] = replies[i].Val
+	}
+	return mem, nil
+}
+
+func (z zSetShardTopKProvider) Stats(key string) (error, *Stats) {
+	metaKey, err := z.currentMeta(key)
+	if err != nil {
+		return err, nil
+	}
+	stats, err := layoutStats(z.b, key, metaKey, ShardLimit)
+	if err != nil {
+		z.opts.logError("get stats failed", err, key, "", "")
+		return err, nil
+	}
+	return nil, stats
+}
+
+func (z zSetLockTopKProvider) Stats(key string) (error, *Stats) {
+	lock, err := z.acquire(key)
+	if err != nil {
+		return err, nil
+	}
+	defer lock.UnLock()
+	metaKey, err := z.currentMeta(key)
+	if err != nil {
+		return err, nil
+	}
+	stats, err := layoutStats(z.b, key, metaKey, z.opts.shardLimit)
+	if err != nil {
+		z.opts.logError("get stats failed", err, metaKey, "", "")
+		return err, nil
+	}
+	return nil, stats
+}
+
+// Stats 普通zset只有一个shard, 即key本身
+func (z ZSetTopKProvider) Stats(key string) (error, *Stats) {
+	pl := z.b.Pipeline()
+	cardReply := pl.ZCard(key)
+	minReply := pl.ZRangeWithScores(key, 0, 0)
+	maxReply := pl.ZRevRangeWithScores(key, 0, 0)
+	if err := pl.Exec(); err != nil {
+		z.opts.logError("get stats failed", err, key, "", key)
+		return util.Wrap(err), nil
+	}
+	stats := &Stats{
+		Key:        key,
+		MetaKey:    key,
+		FillFactor: make([]int, FillFactorBuckets),
+	}
+	if cardReply.Val == 0 {
+		return nil, stats
+	}
+	shard := ShardStats{Key: key, Members: cardReply.Val}
+	if mins := minReply.Val; len(mins) > 0 {
+		shard.MinScore = mins[0].Score
+	}
+	if maxs := maxReply.Val; len(maxs) > 0 {
+		shard.MaxScore = maxs[0].Score
+		shard.MetaScore = maxs[0].Score
+	}
+	stats.ShardCount = 1
+	stats.TotalMembers = shard.Members
+	stats.FillFactor[fillFactorBucket(shard.Members, ShardLimit)]++
+	stats.Shards = []ShardStats{shard}
+	mem, err := memoryUsage(z.b, []string{key})
+	if err != nil {
+		stats.MemoryBytes = -1
+		stats.Shards[0].MemoryBytes = -1
+	} else {
+		stats.MemoryBytes = mem[0]
+		stats.Shards[0].MemoryBytes = mem[0]
+	}
+	return nil, stats
+}
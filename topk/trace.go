@@ -0,0 +1,54 @@
+package topk
+
+import "time"
+
+// Tracer 为每次provider调用创建一个根span
+type Tracer interface {
+	Start(name string, attrs ...interface{}) Span
+}
+
+// Span attrs 为交替出现的 key 和 value
+type Span interface {
+	StartChild(name string, attrs ...interface{}) Span
+	SetAttr(key string, value interface{})
+	End(err error)
+}
+
+type nopTracer struct{}
+
+func (nopTracer) Start(string, ...interface{}) Span { return nopSpan{} }
+
+type nopSpan struct{}
+
+func (nopSpan) StartChild(string, ...interface{}) Span { return nopSpan{} }
+func (nopSpan) SetAttr(string, interface{})            {}
+func (nopSpan) End(error)                              {}
+
+// begin 开始一次provider调用, 返回根span和用于 defer 的结束函数, 结束时记录指标并关闭span
+func (o options) begin(provider, op string, attrs ...interface{}) (Span, func(err *error)) {
+	st := time.Now()
+	span := o.tracer.Start("topk."+op, append([]interface{}{"provider", provider}, attrs...)...)
+	return span, func(err *error) {
+		o.metrics.ObserveOp(provider, op, time.Since(st), *err)
+		span.End(*err)
+	}
+}
+
+// opTrace 记录一次调用中当前所在的span, 通过 Backend.WithHook 把redis命令的span挂在当前span下
+type opTrace struct {
+	cur Span
+}
+
+// child 在当前span下开启子span, 返回的函数用于 defer, 结束子span并恢复当前span
+func (t *opTrace) child(name string, attrs ...interface{}) func(err *error) {
+	if t == nil {
+		return func(*error) {}
+	}
+	parent := t.cur
+	span := parent.StartChild(name, attrs...)
+	t.cur = span
+	return func(err *error) {
+		span.End(*err)
+		t.cur = parent
+	}
+}
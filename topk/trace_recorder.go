@@ -0,0 +1,107 @@
+package topk
+
+import (
+	"sync"
+	"time"
+)
+
+// RecordedSpan SpanRecorder 记录下来的span
+type RecordedSpan struct {
+	Name      string
+	Attrs     map[string]interface{}
+	StartTime time.Time
+	EndTime   time.Time
+	Err       error
+	Children  []*RecordedSpan
+
+	recorder *SpanRecorder
+}
+
+/*
+SpanRecorder 把span记录在内存中的 Tracer, 用于测试
+
+	rec := topk.NewSpanRecorder()
+	tp := topk.NewLockTopKProvider(cli, topk.WithTracer(rec))
+	tp.AddElement("key", "id", 1)
+	spans := rec.Spans()
+*/
+type SpanRecorder struct {
+	mu    sync.Mutex
+	spans []*RecordedSpan
+}
+
+func NewSpanRecorder() *SpanRecorder {
+	return &SpanRecorder{}
+}
+
+func (r *SpanRecorder) Start(name string, attrs ...interface{}) Span {
+	span := r.newSpan(name, attrs)
+	r.mu.Lock()
+	r.spans = append(r.spans, span)
+	r.mu.Unlock()
+	return span
+}
+
+// Spans 返回所有的根span
+func (r *SpanRecorder) Spans() []*RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	spans := make([]*RecordedSpan, len(r.spans))
+	copy(spans, r.spans)
+	return spans
+}
+
+func (r *SpanRecorder) Reset() {
+	r.mu.Lock()
+	r.spans = nil
+	r.mu.Unlock()
+}
+
+func (r *SpanRecorder) newSpan(name string, attrs []interface{}) *RecordedSpan {
+	span := &RecordedSpan{
+		Name:      name,
+		Attrs:     make(map[string]interface{}, len(attrs)/2),
+		StartTime: time.Now(),
+		recorder:  r,
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if k, ok := attrs[i].(string); ok {
+			span.Attrs[k] = attrs[i+1]
+		}
+	}
+	return span
+}
+
+func (s *RecordedSpan) StartChild(name string, attrs ...interface{}) Span {
+	child := s.recorder.newSpan(name, attrs)
+	s.recorder.mu.Lock()
+	s.Children = append(s.Children, child)
+	s.recorder.mu.Unlock()
+	return child
+}
+
+func (s *RecordedSpan) SetAttr(key string, value interface{}) {
+	s.recorder.mu.Lock()
+	s.Attrs[key] = value
+	s.recorder.mu.Unlock()
+}
+
+func (s *RecordedSpan) End(err error) {
+	s.recorder.mu.Lock()
+	s.EndTime = time.Now()
+	s.Err = err
+	s.recorder.mu.Unlock()
+}
+
+// Find 深度优先查找第一个名字为name的span, 包括自身
+func (s *RecordedSpan) Find(name string) *RecordedSpan {
+	if s.Name == name {
+		return s
+	}
+	for _, c := range s.Children {
+		if found := c.Find(name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
@@ -0,0 +1,538 @@
+package topk
+
+import (
+	"fmt"
+	"math"
+	"pushan/RedTopK/util"
+)
+
+/*
+UnionStorer 可以把多个key的并集保存为新排行榜的provider, 与 ZUNIONSTORE 相同, 返回dst中的member数.
+weights 为nil时所有权重为1, 否则个数需要与keys相同, 可以为负数. dst原有的内容被替换, 构建期间对dst的写入会丢失.
+
+分片provider在新版本的布局中逐批构建结果, 构建完成后原子地修改 "{meta}:current" 指向新版本, 之后在脚本之外删除旧版本,
+读取dst不会看到构建到一半的结果. 构建时按score游标分批读取每个源key, 不是源key的快照, 返回值为新版本中实际的member数.
+分片provider的新版本继承dst原有的剩余过期时间, 其他provider与 ZUNIONSTORE 相同清除dst的过期时间.
+*/
+type UnionStorer interface {
+	UnionStore(dst string, keys []string, weights []float64, agg Aggregate) (error, int64)
+}
+
+const (
+	// unionBatch 构建时每批读取和写入的member数
+	unionBatch = 500
+	// currentSuffix 指向当前版本meta的key的后缀, genSuffix 版本号计数器的后缀
+	currentSuffix = ":current"
+	genSuffix     = ":gen"
+)
+
+// resolveMeta 返回base当前版本的meta key, 没有执行过 UnionStore 时就是base
+func resolveMeta(b Backend, base string) (string, error) {
+	cur, ok, err := b.Get(base + currentSuffix)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return cur, nil
+	}
+	return base, nil
+}
+
+// checkUnionWeights 与 ZUNIONSTORE 相同, 权重可以为负数
+func checkUnionWeights(keys []string, weights []float64) ([]float64, error) {
+	if weights == nil {
+		return checkWeights(keys, nil)
+	}
+	if len(weights) != len(keys) {
+		return nil, fmt.Errorf("%w: %d weights for %d keys", ErrInvalidWeight, len(weights), len(keys))
+	}
+	for _, w := range weights {
+		if math.IsNaN(w) || math.IsInf(w, 0) {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidWeight, w)
+		}
+	}
+	return weights, nil
+}
+
+/*
+buildUnion 按批读取每个key, 每个member只在第一个包含它的key中处理: 查询它在所有key中的score,
+合并之后交给write. 不需要在内存中保存已经处理过的member.
+每批从上一批最后的score开始读取, 跳过该score上已经读过的member, 构建期间源key的写入不会使后面的member整体错位.
+score被修改的member仍然可能被处理两次, write需要按id覆盖.
+*/
+func buildUnion(rq RangeQuerier, sq ScoreQuerier, o options, keys []string, weights []float64, agg Aggregate,
+	write func([]Element) error) error {
+	walks := make([]*walk, len(keys))
+	for i := range keys {
+		walks[i] = &walk{key: keys[i], weight: weights[i]}
+	}
+	for i, w := range walks {
+		// min 游标的score, skip 该score上已经读过的member数
+		min, skip := "-inf", 0
+		for !w.done {
+			err, page := rq.RangeByScore(w.key, min, "+inf", skip, unionBatch)
+			if err != nil {
+				return err
+			}
+			w.done = len(page) < unionBatch
+			if len(page) > 0 {
+				last := formatScore(page[len(page)-1].Score)
+				tied := 0
+				for j := len(page) - 1; j >= 0 && page[j].Score == page[len(page)-1].Score; j-- {
+					tied++
+				}
+				if last == min {
+					skip += tied
+				} else {
+					min, skip = last, tied
+				}
+			}
+			ids := make([]string, len(page))
+			for j := range page {
+				ids[j] = page[j].Id
+			}
+			scores := make([]map[string]float64, len(walks))
+			for j := range walks {
+				var err error
+				if err, scores[j] = sq.GetScores(walks[j].key, ids); err != nil {
+					return err
+				}
+			}
+			members := make([]Element, 0, len(ids))
+			for _, id := range ids {
+				if handledBefore(id, i, scores) {
+					continue
+				}
+				score, ok := aggregate(id, walks, scores, agg, false)
+				if !ok {
+					continue
+				}
+				if err := o.validateScore(keys[i], id, score); err != nil {
+					return err
+				}
+				members = append(members, Element{Id: id, Score: score})
+			}
+			if len(members) == 0 {
+				continue
+			}
+			if err := write(members); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// handledBefore id在第i个key之前的key中存在时已经处理过
+func handledBefore(id string, i int, scores []map[string]float64) bool {
+	for j := 0; j < i; j++ {
+		if _, ok := scores[j][id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func aggregateName(agg Aggregate) string {
+	switch agg {
+	case AggregateMin:
+		return "MIN"
+	case AggregateMax:
+		return "MAX"
+	}
+	return "SUM"
+}
+
+// UnionStore 普通zset直接使用 ZUNIONSTORE, 集群模式下所有key需要在同一个slot
+func (z ZSetTopKProvider) UnionStore(dst string, keys []string, weights []float64, agg Aggregate) (err error, n int64) {
+	_, end := z.opts.begin(ProviderZSet, OpUnionStore, "key", dst, "keys", len(keys))
+	defer end(&err)
+	weights, err = checkUnionWeights(keys, weights)
+	if err != nil {
+		return util.Wrap(err), 0
+	}
+	if len(keys) == 0 {
+		// ZUNIONSTORE 至少需要一个key, 结果为空时dst被删除
+		pl := z.b.Pipeline()
+		pl.Del(dst)
+		if err := pl.Exec(); err != nil {
+			z.opts.logError("union store failed", err, dst, "", dst)
+			return util.Wrap(err), 0
+		}
+		return nil, 0
+	}
+	n, err = z.b.ZUnionStore(dst, keys, weights, aggregateName(agg))
+	if err != nil {
+		z.opts.logError("union store failed", err, dst, "", dst)
+		return util.Wrap(err), 0
+	}
+	if n > 0 {
+		// 在写入之后查询, 之前加入队列的等待者都能被唤醒
+		pl := z.b.Pipeline()
+		waiting := pl.Exists(waitQueueKey(dst))
+		if err := pl.Exec(); err != nil {
+			z.opts.logError("wake waiter failed", err, dst, "", dst)
+			return nil, n
+		}
+		wakeIfWaiting(z.b, z.opts, waitQueueKey(dst), waiting)
+	}
+	return nil, n
+}
+
+// replace 在一个事务中删除dst并写入members
+func (z ZSetTopKProvider) replace(dst string, members []Element) error {
+	if err := z.opts.validateAll(dst, members); err != nil {
+		return err
+	}
+	tx := z.b.TxPipeline()
+	tx.Del(dst)
+	if len(members) > 0 {
+		tx.ZAdd(dst, members...)
+	}
+	waiting := tx.Exists(waitQueueKey(dst))
+	if err := tx.Exec(); err != nil {
+		z.opts.logError("replace failed", err, dst, "", dst)
+		return util.Wrap(err)
+	}
+	if len(members) > 0 {
+		wakeIfWaiting(z.b, z.opts, waitQueueKey(dst), waiting)
+	}
+	return nil
+}
+
+// currentMeta 返回key当前版本的meta key, lock provider 在持有锁的情况下执行
+func (z zSetLockTopKProvider) currentMeta(key string) (string, error) {
+	base := z.makeMetaKey(key)
+	metaKey, err := resolveMeta(z.b, base)
+	if err != nil {
+		z.opts.logError("resolve meta failed", err, base, "", "")
+		return "", util.WrapSkip(err, 1)
+	}
+	return metaKey, nil
+}
+
+// writeMeta 与 currentMeta 相同, 同时在一个pipeline中查询key是否有等待者, 在持有锁的情况下执行
+func (z zSetLockTopKProvider) writeMeta(key string) (string, *IntReply, error) {
+	base := z.makeMetaKey(key)
+	pl := z.b.Pipeline()
+	cur := pl.Get(base + currentSuffix)
+	waiting := pl.Exists(waitQueueKey(base))
+	if err := pl.Exec(); err != nil {
+		z.opts.logError("resolve meta failed", err, base, "", "")
+		return "", nil, util.WrapSkip(err, 1)
+	}
+	if cur.Ok {
+		return cur.Val, waiting, nil
+	}
+	return base, waiting, nil
+}
+
+func (z zSetShardTopKProvider) currentMeta(key string) (string, error) {
+	base := z.makeMetaKey(key)
+	metaKey, err := resolveMeta(z.b, base)
+	if err != nil {
+		z.opts.logError("resolve meta failed", err, base, "", "")
+		return "", util.WrapSkip(err, 1)
+	}
+	return metaKey, nil
+}
+
+/*
+newGeneration 分配dst的新版本meta key, 与dst在同一个slot.
+计数器单独过期或被删除之后从1重新开始, 可能分配到当前版本, 这时再分配一次.
+*/
+func newGeneration(b Backend, base string) (string, error) {
+	cur, _, err := b.Get(base + currentSuffix)
+	if err != nil {
+		return "", err
+	}
+	for {
+		n, err := b.Incr(base + genSuffix)
+		if err != nil {
+			return "", err
+		}
+		if gen := fmt.Sprintf("%s:g%d", base, n); gen != cur {
+			return gen, nil
+		}
+	}
+}
+
+// dropGeneration 删除构建失败的新版本或者切换之后的旧版本, 用 UNLINK 在后台释放内存, 失败只记录日志
+func dropGeneration(b Backend, o options, metaKey string) {
+	shards, err := b.ZRangeByScore(metaKey, RangeBy{Min: "-inf", Max: "+inf"})
+	if err != nil {
+		o.logError("drop generation failed", err, metaKey, "", "")
+		return
+	}
+	pl := b.Pipeline()
+	pl.Unlink(layoutKeys(metaKey, shards)...)
+	if err := pl.Exec(); err != nil {
+		o.logError("drop generation failed", err, metaKey, "", "")
+	}
+}
+
+// generationSize 构建完成之后新版本中实际的member数
+func generationSize(b Backend, o options, gen string) (int64, error) {
+	n, err := layoutCount(b, gen, "-inf", "+inf")
+	if err != nil {
+		o.logError("count generation failed", err, gen, "", "")
+		return 0, util.WrapSkip(err, 1)
+	}
+	return n, nil
+}
+
+// UnionStore 不持有dst的锁构建新版本, 只在切换时持有锁
+func (z zSetLockTopKProvider) UnionStore(dst string, keys []string, weights []float64, agg Aggregate) (err error, n int64) {
+	span, end := z.opts.begin(ProviderLock, OpUnionStore, "key", dst, "keys", len(keys))
+	defer end(&err)
+	z = z.withTrace(span)
+	weights, err = checkUnionWeights(keys, weights)
+	if err != nil {
+		return util.Wrap(err), 0
+	}
+	base := z.makeMetaKey(dst)
+	gen, err := newGeneration(z.b, base)
+	if err != nil {
+		z.opts.logError("union store failed", err, base, "", "")
+		return util.Wrap(err), 0
+	}
+	err = buildUnion(z, z, z.opts, keys, weights, agg, func(members []Element) error {
+		for _, e := range members {
+			if err := z.addMember(gen, e.Id, e.Score); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		n, err = generationSize(z.b, z.opts, gen)
+	}
+	if err != nil {
+		dropGeneration(z.b, z.opts, gen)
+		return err, 0
+	}
+	if err := z.swap(dst, gen, n > 0); err != nil {
+		return err, 0
+	}
+	return nil, n
+}
+
+// replace 与 UnionStore 相同, 在新版本中写入members之后切换
+func (z zSetLockTopKProvider) replace(dst string, members []Element) error {
+	if err := z.opts.validateAll(dst, members); err != nil {
+		return err
+	}
+	base := z.makeMetaKey(dst)
+	gen, err := newGeneration(z.b, base)
+	if err != nil {
+		z.opts.logError("replace failed", err, base, "", "")
+		return util.Wrap(err)
+	}
+	for _, e := range members {
+		if err := z.addMember(gen, e.Id, e.Score); err != nil {
+			dropGeneration(z.b, z.opts, gen)
+			return err
+		}
+	}
+	return z.swap(dst, gen, len(members) > 0)
+}
+
+/*
+swap 持有dst的锁把 "{meta}:current" 指向gen并删除旧版本, 失败时删除gen. wake 为true时唤醒等待者.
+旧版本的剩余过期时间在同一个事务中设置到gen的布局和 "{meta}:current" 上, 与 "swap" 脚本相同.
+*/
+func (z zSetLockTopKProvider) swap(dst string, gen string, wake bool) error {
+	base := z.makeMetaKey(dst)
+	lock, err := z.acquire(dst)
+	if err != nil {
+		dropGeneration(z.b, z.opts, gen)
+		return err
+	}
+	defer lock.UnLock()
+	old, err := z.currentMeta(dst)
+	if err != nil {
+		dropGeneration(z.b, z.opts, gen)
+		return err
+	}
+	// 与 "swap" 脚本相同, 不能删除当前版本
+	if old == gen {
+		return nil
+	}
+	ttl, err := z.b.PTTL(old)
+	var shards []string
+	if err == nil && ttl > 0 {
+		shards, err = z.b.ZRangeByScore(gen, RangeBy{Min: "-inf", Max: "+inf"})
+	}
+	if err != nil {
+		z.opts.logError("swap generation failed", err, base, "", "")
+		dropGeneration(z.b, z.opts, gen)
+		return util.Wrap(err)
+	}
+	tx := z.b.TxPipeline()
+	tx.Set(base+currentSuffix, gen)
+	if ttl > 0 {
+		for _, key := range append(layoutKeys(gen, shards), base+currentSuffix) {
+			tx.PExpire(key, ttl)
+		}
+	}
+	waiting := tx.Exists(waitQueueKey(base))
+	if err := tx.Exec(); err != nil {
+		z.opts.logError("swap generation failed", err, base, "", "")
+		dropGeneration(z.b, z.opts, gen)
+		return util.Wrap(err)
+	}
+	dropGeneration(z.b, z.opts, old)
+	if wake {
+		wakeIfWaiting(z.b, z.opts, waitQueueKey(base), waiting)
+	}
+	return nil
+}
+
+// UnionStore 用 "addmany" 写入新版本, 用 "swap" 在脚本中切换并删除旧版本
+func (z zSetShardTopKProvider) UnionStore(dst string, keys []string, weights []float64, agg Aggregate) (err error, n int64) {
+	_, end := z.opts.begin(ProviderLua, OpUnionStore, "key", dst, "keys", len(keys))
+	defer end(&err)
+	weights, err = checkUnionWeights(keys, weights)
+	if err != nil {
+		return util.Wrap(err), 0
+	}
+	base := z.makeMetaKey(dst)
+	gen, err := newGeneration(z.b, base)
+	if err != nil {
+		z.opts.logError("union store failed", err, base, "", "")
+		return util.Wrap(err), 0
+	}
+	err = buildUnion(z, z, z.opts, keys, weights, agg, func(members []Element) error {
+		return z.addMany(gen, members)
+	})
+	if err == nil {
+		n, err = generationSize(z.b, z.opts, gen)
+	}
+	if err != nil {
+		dropGeneration(z.b, z.opts, gen)
+		return err, 0
+	}
+	if err := z.swap(base, gen); err != nil {
+		return err, 0
+	}
+	return nil, n
+}
+
+// replace 与 UnionStore 相同, 按批写入新版本之后切换
+func (z zSetShardTopKProvider) replace(dst string, members []Element) error {
+	if err := z.opts.validateAll(dst, members); err != nil {
+		return err
+	}
+	base := z.makeMetaKey(dst)
+	gen, err := newGeneration(z.b, base)
+	if err != nil {
+		z.opts.logError("replace failed", err, base, "", "")
+		return util.Wrap(err)
+	}
+	for st := 0; st < len(members); st += unionBatch {
+		end := st + unionBatch
+		if end > len(members) {
+			end = len(members)
+		}
+		if err := z.addMany(gen, members[st:end]); err != nil {
+			dropGeneration(z.b, z.opts, gen)
+			return err
+		}
+	}
+	return z.swap(base, gen)
+}
+
+// addMany 用 "addmany" 把members写入还没有切换的版本gen
+func (z zSetShardTopKProvider) addMany(gen string, members []Element) error {
+	args := make([]interface{}, 0, 1+2*len(members))
+	args = append(args, "addmany")
+	for _, e := range members {
+		args = append(args, formatScore(e.Score), e.Id)
+	}
+	if _, err := z.b.Eval(script, []string{gen}, args...); err != nil {
+		z.opts.logError("add members failed", err, gen, "", "")
+		return util.Wrap(err)
+	}
+	return nil
+}
+
+// swap 用 "swap" 在脚本中切换到gen, 脚本返回旧版本, 在脚本之外删除. 失败时删除gen
+func (z zSetShardTopKProvider) swap(base string, gen string) error {
+	res, err := z.b.Eval(script, []string{base}, "swap", gen)
+	if err != nil {
+		z.opts.logError("swap generation failed", err, base, "", "")
+		dropGeneration(z.b, z.opts, gen)
+		return util.Wrap(err)
+	}
+	if old, ok := res.(string); ok && old != gen {
+		dropGeneration(z.b, z.opts, old)
+	}
+	return nil
+}
+
+// UnionStore 在持有锁的情况下计算并替换dst
+func (m *MemoryTopKProvider) UnionStore(dst string, keys []string, weights []float64, agg Aggregate) (err error, n int64) {
+	_, end := m.opts.begin(ProviderMemory, OpUnionStore, "key", dst, "keys", len(keys))
+	defer end(&err)
+	weights, err = checkUnionWeights(keys, weights)
+	if err != nil {
+		return util.Wrap(err), 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	walks := make([]*walk, len(keys))
+	scores := make([]map[string]float64, len(keys))
+	for i := range keys {
+		walks[i] = &walk{key: keys[i], weight: weights[i]}
+		if zs, ok := m.keys[keys[i]]; ok {
+			scores[i] = zs.dict
+		}
+	}
+	union := &memZSet{dict: make(map[string]float64), zsl: newSkipList()}
+	for i := range keys {
+		for id := range scores[i] {
+			if handledBefore(id, i, scores) {
+				continue
+			}
+			score, _ := aggregate(id, walks, scores, agg, false)
+			if err := m.opts.validateScore(keys[i], id, score); err != nil {
+				return err, 0
+			}
+			union.zsl.insert(score, id)
+			union.dict[id] = score
+		}
+	}
+	m.replaceLocked(dst, union)
+	return nil, int64(len(union.dict))
+}
+
+func (m *MemoryTopKProvider) replace(dst string, members []Element) error {
+	if err := m.opts.validateAll(dst, members); err != nil {
+		return err
+	}
+	zs := &memZSet{dict: make(map[string]float64), zsl: newSkipList()}
+	for _, e := range members {
+		if old, ok := zs.dict[e.Id]; ok {
+			zs.zsl.delete(old, e.Id)
+		}
+		zs.zsl.insert(e.Score, e.Id)
+		zs.dict[e.Id] = e.Score
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replaceLocked(dst, zs)
+	return nil
+}
+
+// replaceLocked 用zs替换dst, 与 ZUNIONSTORE 相同, dst原有的过期时间被清除. 在持有锁的情况下执行
+func (m *MemoryTopKProvider) replaceLocked(dst string, zs *memZSet) {
+	if t, ok := m.expires[dst]; ok {
+		t.Stop()
+		delete(m.expires, dst)
+	}
+	delete(m.keys, dst)
+	if len(zs.dict) > 0 {
+		m.keys[dst] = zs
+		m.wakeOne(dst)
+	}
+}
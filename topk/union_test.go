@@ -0,0 +1,141 @@
+package topk_test
+
+import (
+	"fmt"
+	"pushan/RedTopK/topk"
+	"testing"
+	"time"
+)
+
+// testUnionStore 每种 Aggregate 的带权并集与读取全部member的结果相同, 每次都替换dst原有的内容
+func testUnionStore(t *testing.T, tp topk.TopKProvider, key string) {
+	t.Helper()
+	us := tp.(topk.UnionStorer)
+	keys := []string{key + ":a", key + ":b"}
+	data := []map[string]float64{
+		{"a": 1, "b": 2, "c": 3},
+		{"b": -1, "c": 4, "d": 5},
+	}
+	fill(t, tp, keys, data)
+	dst := key + ":dst"
+	if err := tp.AddElement(dst, "old", -100); err != nil {
+		t.Fatal(err)
+	}
+	for _, weights := range [][]float64{nil, {2, -1}} {
+		for _, a := range aggregates {
+			err, n := us.UnionStore(dst, keys, weights, a.agg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := bruteCombine(data, weights, a.agg, 100, false)
+			err, got := tp.GetTopKS(dst, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(len(want)) || fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("%s weights=%v: %d %v, want %v", a.name, weights, n, got, want)
+			}
+		}
+	}
+	// 没有源key时结果为空
+	if err, n := us.UnionStore(dst, nil, nil, topk.AggregateSum); err != nil || n != 0 {
+		t.Fatalf("union of no keys: %v %d", err, n)
+	}
+	if err, got := tp.GetTopKS(dst, 100); err != nil || len(got) != 0 {
+		t.Fatalf("dst after union of no keys: %v %v", err, got)
+	}
+}
+
+func TestMemoryUnionStore(t *testing.T) {
+	testUnionStore(t, topk.NewMemoryProvider(), "union")
+}
+
+// shardedProviders redisProviders 中使用版本切换实现 UnionStore 的provider
+var shardedProviders = redisProviders[:2]
+
+// TestUnionStoreKeepsTTL 新版本和 "{meta}:current" 继承旧版本的剩余过期时间, 之后整个key一起过期
+func TestUnionStoreKeepsTTL(t *testing.T) {
+	for _, p := range shardedProviders {
+		p := p
+		t.Run(p.name, func(t *testing.T) {
+			cli := testRedis(t)
+			tp := p.new(cli)
+			key := testKey(t)
+			fill(t, tp, []string{key + ":src"}, []map[string]float64{{"a": 1, "b": 2}})
+			us := tp.(topk.UnionStorer)
+			if err, _ := us.UnionStore(key, []string{key + ":src"}, nil, topk.AggregateSum); err != nil {
+				t.Fatal(err)
+			}
+			if err := tp.(topk.Expirer).ExpireAt(key, time.Now().Add(500*time.Millisecond)); err != nil {
+				t.Fatal(err)
+			}
+			if err, _ := us.UnionStore(key, []string{key + ":src"}, []float64{2}, topk.AggregateSum); err != nil {
+				t.Fatal(err)
+			}
+			if err, got := tp.GetTopKS(key, 10); err != nil || fmt.Sprint(got) != "[{a 2} {b 4}]" {
+				t.Fatalf("after union store: %v %v", err, got)
+			}
+			base := fmt.Sprintf(topk.MetaZSetTemplate, key, topk.Version)
+			if ttl := cli.PTTL(base + ":current").Val(); ttl <= 0 || ttl > 500*time.Millisecond {
+				t.Fatalf("current ttl %v", ttl)
+			}
+			time.Sleep(600 * time.Millisecond)
+			if err, got := tp.GetTopKS(key, 10); err != nil || len(got) != 0 {
+				t.Fatalf("after expiry: %v %v", err, got)
+			}
+			if left := cli.Keys(base + "*").Val(); len(left) != 0 {
+				t.Fatalf("keys left after expiry: %v", left)
+			}
+		})
+	}
+}
+
+// TestUnionStoreGenExpired 版本计数器单独过期后从1重新开始, 不能把当前版本当作新版本
+func TestUnionStoreGenExpired(t *testing.T) {
+	for _, p := range shardedProviders {
+		p := p
+		t.Run(p.name, func(t *testing.T) {
+			cli := testRedis(t)
+			tp := p.new(cli)
+			key := testKey(t)
+			keys := []string{key + ":x", key + ":y"}
+			fill(t, tp, keys, []map[string]float64{{"a": 1}, {"b": 2}})
+			us := tp.(topk.UnionStorer)
+			if err, _ := us.UnionStore(key, keys[:1], nil, topk.AggregateSum); err != nil {
+				t.Fatal(err)
+			}
+			base := fmt.Sprintf(topk.MetaZSetTemplate, key, topk.Version)
+			if err := cli.Del(base + ":gen").Err(); err != nil {
+				t.Fatal(err)
+			}
+			if err, n := us.UnionStore(key, keys[1:], nil, topk.AggregateSum); err != nil || n != 1 {
+				t.Fatalf("union store after gen expired: %v %d", err, n)
+			}
+			if err, got := tp.GetTopKS(key, 10); err != nil || fmt.Sprint(got) != "[{b 2}]" {
+				t.Fatalf("after union store: %v %v", err, got)
+			}
+			if left := cli.Keys(base + ":g1*").Val(); len(left) != 0 {
+				t.Fatalf("old generation left: %v", left)
+			}
+		})
+	}
+}
+
+// TestUnionStoreWakesWaiter 结果不为空时唤醒dst上的等待者
+func TestUnionStoreWakesWaiter(t *testing.T) {
+	for _, p := range redisProviders {
+		p := p
+		t.Run(p.name, func(t *testing.T) {
+			tp := p.new(testRedis(t))
+			key := testKey(t)
+			if err := tp.AddElement(key+":src", "a", 1); err != nil {
+				t.Fatal(err)
+			}
+			ch := popAsync(tp, key)
+			if err, n := tp.(topk.UnionStorer).UnionStore(key, []string{key + ":src"}, nil, topk.AggregateSum); err != nil || n != 1 {
+				t.Fatalf("union store: %v %d", err, n)
+			}
+			expectWoken(t, ch, "a")
+		})
+	}
+}
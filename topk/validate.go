@@ -0,0 +1,109 @@
+package topk
+
+import (
+	"fmt"
+	"math"
+	"pushan/RedTopK/util"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultMaxIdLen id的默认最大字节数
+	DefaultMaxIdLen = 1024
+	// idSeparator lua脚本使用逗号拼接返回结果, id中不能出现
+	idSeparator = ","
+)
+
+// InfPolicy ±Inf score的处理策略
+type InfPolicy int
+
+const (
+	// InfReject 拒绝±Inf, 返回 ErrInvalidScore, 默认策略
+	InfReject InfPolicy = iota
+	// InfAllow 允许±Inf, 与redis zset的行为一致
+	InfAllow
+)
+
+func (o options) validateId(key string, id string) error {
+	if id == "" {
+		return util.WrapSkip(fmt.Errorf("%w: empty id (key = %s)", ErrInvalidId, key), 1)
+	}
+	if len(id) > o.maxIdLen {
+		return util.WrapSkip(fmt.Errorf("%w: id too long, %d > %d (key = %s)", ErrInvalidId, len(id), o.maxIdLen, key), 1)
+	}
+	if !utf8.ValidString(id) || strings.Contains(id, idSeparator) {
+		return util.WrapSkip(fmt.Errorf("%w: id %q contains invalid characters (key = %s)", ErrInvalidId, id, key), 1)
+	}
+	return nil
+}
+
+func (o options) validateScore(key string, id string, score float64) error {
+	if math.IsNaN(score) {
+		return util.WrapSkip(fmt.Errorf("%w: NaN (key = %s, id = %s)", ErrInvalidScore, key, id), 1)
+	}
+	if math.IsInf(score, 0) && o.infPolicy != InfAllow {
+		return util.WrapSkip(fmt.Errorf("%w: %f is not allowed (key = %s, id = %s)", ErrInvalidScore, score, key, id), 1)
+	}
+	return nil
+}
+
+// validate AddElement 的参数校验, 所有provider保持一致
+func (o options) validate(key string, id string, score float64) error {
+	if err := o.validateId(key, id); err != nil {
+		return err
+	}
+	return o.validateScore(key, id, score)
+}
+
+// validateAll 写入多个member之前的校验
+func (o options) validateAll(key string, members []Element) error {
+	for _, e := range members {
+		if err := o.validate(key, e.Id, e.Score); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scoreBound score区间的一端, 与 ZRANGEBYSCORE 相同, "(" 开头表示不包含边界
+type scoreBound struct {
+	value     float64
+	exclusive bool
+}
+
+func parseBound(s string) (scoreBound, error) {
+	b := scoreBound{}
+	if strings.HasPrefix(s, "(") {
+		b.exclusive = true
+		s = s[1:]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) {
+		return b, fmt.Errorf("bad bound %q", s)
+	}
+	b.value = v
+	return b, nil
+}
+
+// below 判断score是否在下界之外
+func (b scoreBound) below(score float64) bool {
+	return score < b.value || (b.exclusive && score == b.value)
+}
+
+// above 判断score是否在上界之外
+func (b scoreBound) above(score float64) bool {
+	return score > b.value || (b.exclusive && score == b.value)
+}
+
+// validateRange 校验 RangeByScore 和 CountByScore 的区间, 所有provider保持一致
+func (o options) validateRange(key string, min, max string) (lo, hi scoreBound, err error) {
+	if lo, err = parseBound(min); err != nil {
+		return lo, hi, util.WrapSkip(fmt.Errorf("%w: min %s (key = %s)", ErrInvalidScore, err, key), 1)
+	}
+	if hi, err = parseBound(max); err != nil {
+		return lo, hi, util.WrapSkip(fmt.Errorf("%w: max %s (key = %s)", ErrInvalidScore, err, key), 1)
+	}
+	return lo, hi, nil
+}
@@ -0,0 +1,137 @@
+package topk_test
+
+import (
+	"errors"
+	"math"
+	"pushan/RedTopK/topk"
+	"strings"
+	"testing"
+)
+
+var invalidCases = []struct {
+	name  string
+	id    string
+	score float64
+	want  error
+}{
+	{"empty id", "", 1, topk.ErrInvalidId},
+	{"long id", strings.Repeat("a", topk.DefaultMaxIdLen+1), 1, topk.ErrInvalidId},
+	{"separator", "a,b", 1, topk.ErrInvalidId},
+	{"invalid utf8", string([]byte{0xff, 0xfe}), 1, topk.ErrInvalidId},
+	{"nan", "a", math.NaN(), topk.ErrInvalidScore},
+	{"+inf", "a", math.Inf(1), topk.ErrInvalidScore},
+	{"-inf", "a", math.Inf(-1), topk.ErrInvalidScore},
+}
+
+// checkValidation 所有provider对非法输入返回相同的错误, 且不写入任何数据
+func checkValidation(t *testing.T, newTP func(opts ...topk.Option) topk.TopKProvider) {
+	tp := newTP()
+	key := testKey(t)
+	for _, c := range invalidCases {
+		if err := tp.AddElement(key, c.id, c.score); !errors.Is(err, c.want) {
+			t.Errorf("%s: add expect %v, got %v", c.name, c.want, err)
+		}
+		if c.want != topk.ErrInvalidId {
+			continue
+		}
+		if err := tp.DeleteElement(key, c.id); !errors.Is(err, c.want) {
+			t.Errorf("%s: delete expect %v, got %v", c.name, c.want, err)
+		}
+	}
+	err, top := tp.GetTopKS(key, 10)
+	if err != nil || len(top) != 0 {
+		t.Fatalf("invalid input written: %v %v", err, top)
+	}
+
+	// WithMaxIdLen 和 InfAllow 放宽限制
+	tp = newTP(topk.WithMaxIdLen(2), topk.WithInfPolicy(topk.InfAllow))
+	if err := tp.AddElement(key, "abc", 1); !errors.Is(err, topk.ErrInvalidId) {
+		t.Errorf("max id len: expect %v, got %v", topk.ErrInvalidId, err)
+	}
+	if err := tp.AddElement(key, "a", math.Inf(1)); err != nil {
+		t.Errorf("+inf allowed: %v", err)
+	}
+	if err := tp.AddElement(key, "b", math.Inf(-1)); err != nil {
+		t.Errorf("-inf allowed: %v", err)
+	}
+	if err := tp.AddElement(key, "c", math.NaN()); !errors.Is(err, topk.ErrInvalidScore) {
+		t.Errorf("nan with InfAllow: expect %v, got %v", topk.ErrInvalidScore, err)
+	}
+	err, top = tp.GetTopKS(key, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []topk.Element{{Id: "b", Score: math.Inf(-1)}, {Id: "a", Score: math.Inf(1)}}
+	if len(top) != len(want) || top[0] != want[0] || top[1] != want[1] {
+		t.Fatalf("expect %v, got %v", want, top)
+	}
+	for _, e := range want {
+		_ = tp.DeleteElement(key, e.Id)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		checkValidation(t, func(opts ...topk.Option) topk.TopKProvider { return topk.NewMemoryProvider(opts...) })
+	})
+	for _, p := range redisProviders {
+		p := p
+		t.Run(p.name, func(t *testing.T) {
+			cli := testRedis(t)
+			checkValidation(t, func(opts ...topk.Option) topk.TopKProvider { return p.new(cli, opts...) })
+		})
+	}
+}
+
+// checkIncrValidation 增加之后的score溢出为±Inf或者为NaN时返回 ErrInvalidScore, 原来的score不变
+func checkIncrValidation(t *testing.T, newTP func(opts ...topk.Option) topk.TopKProvider) {
+	key := testKey(t)
+	tp := newTP()
+	inc := tp.(topk.Incrementer)
+	if err, _ := inc.IncrElement(key, "a", math.MaxFloat64); err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := inc.IncrElement(key, "a", math.MaxFloat64); !errors.Is(err, topk.ErrInvalidScore) {
+		t.Errorf("overflow: expect %v, got %v", topk.ErrInvalidScore, err)
+	}
+	err, top := tp.GetTopKS(key, 10)
+	if err != nil || len(top) != 1 || top[0].Score != math.MaxFloat64 {
+		t.Fatalf("score changed after overflow: %v %v", err, top)
+	}
+
+	_ = tp.DeleteElement(key, "a")
+
+	tp = newTP(topk.WithInfPolicy(topk.InfAllow))
+	inc = tp.(topk.Incrementer)
+	if err, _ := inc.IncrElement(key, "a", math.MaxFloat64); err != nil {
+		t.Fatal(err)
+	}
+	if err, score := inc.IncrElement(key, "a", math.MaxFloat64); err != nil || !math.IsInf(score, 1) {
+		t.Fatalf("overflow with InfAllow: %v %v", err, score)
+	}
+	if err, _ := inc.IncrElement(key, "a", math.Inf(-1)); !errors.Is(err, topk.ErrInvalidScore) {
+		t.Errorf("inf - inf: expect %v, got %v", topk.ErrInvalidScore, err)
+	}
+	err, top = tp.GetTopKS(key, 10)
+	if err != nil || len(top) != 1 || !math.IsInf(top[0].Score, 1) {
+		t.Fatalf("score changed after nan: %v %v", err, top)
+	}
+	_ = tp.DeleteElement(key, "a")
+}
+
+// TestIncrValidation zset provider 与 ZINCRBY 相同, 不检查增加之后的score
+func TestIncrValidation(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		checkIncrValidation(t, func(opts ...topk.Option) topk.TopKProvider { return topk.NewMemoryProvider(opts...) })
+	})
+	for _, p := range redisProviders {
+		p := p
+		if p.name == "zset" {
+			continue
+		}
+		t.Run(p.name, func(t *testing.T) {
+			cli := testRedis(t)
+			checkIncrValidation(t, func(opts ...topk.Option) topk.TopKProvider { return p.new(cli, opts...) })
+		})
+	}
+}
@@ -1,66 +1,112 @@
 package topk
 
-import "github.com/go-redis/redis"
+import (
+	"pushan/RedTopK/util"
+
+	"github.com/go-redis/redis"
+)
 
 type ZSetTopKProvider struct {
-	cli *redis.Client
+	b    Backend
+	opts options
 }
 
-func NewZSetProvider(cli *redis.Client) TopKProvider {
+func NewZSetProvider(cli *redis.Client, opts ...Option) TopKProvider {
 	if cli == nil {
 		panic("invalid param: cli")
 	}
+	return NewZSetProviderWithBackend(NewRedisBackend(cli), opts...)
+}
+
+// NewZSetProviderWithBackend 与 NewZSetProvider 相同, 使用指定的 Backend
+func NewZSetProviderWithBackend(b Backend, opts ...Option) TopKProvider {
+	if b == nil {
+		panic("invalid param: backend")
+	}
 	return ZSetTopKProvider{
-		cli: cli,
+		b:    b,
+		opts: newOptions(b, opts),
 	}
 }
 
-func (z ZSetTopKProvider) AddElement(key string, id string, score float64) error {
-	return z.cli.ZAdd(key, redis.Z{
-		Score:  score,
-		Member: id,
-	}).Err()
+func (z ZSetTopKProvider) AddElement(key string, id string, score float64) (err error) {
+	_, end := z.opts.begin(ProviderZSet, OpAdd, "key", key, "member", id)
+	defer end(&err)
+	if err := z.opts.validate(key, id, score); err != nil {
+		return err
+	}
+	evicted, err := z.add(key, id, score)
+	if err != nil {
+		return err
+	}
+	return rejectedErr(key, id, evicted)
 }
 
-func (z ZSetTopKProvider) DeleteElement(key string, id string) error {
-	return z.cli.ZRem(key, id).Err()
+// add 设置了容量时返回被淘汰的元素
+func (z ZSetTopKProvider) add(key string, id string, score float64) ([]Element, error) {
+	if limit := z.opts.capacityOf(key); limit > 0 {
+		return z.addCapped(key, id, score, limit)
+	}
+	pl := z.b.Pipeline()
+	pl.ZAdd(key, Element{Id: id, Score: score})
+	waiting := pl.Exists(waitQueueKey(key))
+	if err := pl.Exec(); err != nil {
+		z.opts.logError("add element failed", err, key, id, key)
+		return nil, util.Wrap(err)
+	}
+	wakeIfWaiting(z.b, z.opts, waitQueueKey(key), waiting)
+	return nil, nil
 }
-func (z ZSetTopKProvider) GetTopK(key string, k int) (error, []Element) {
+
+func (z ZSetTopKProvider) DeleteElement(key string, id string) (err error) {
+	_, end := z.opts.begin(ProviderZSet, OpDelete, "key", key, "member", id)
+	defer end(&err)
+	if err := z.opts.validateId(key, id); err != nil {
+		return err
+	}
+	if _, err := z.b.ZRem(key, id); err != nil {
+		z.opts.logError("delete element failed", err, key, id, key)
+		return util.Wrap(err)
+	}
+	return nil
+}
+func (z ZSetTopKProvider) GetTopK(key string, k int) (err error, ans []Element) {
+	_, end := z.opts.begin(ProviderZSet, OpTopK, "key", key, "k", k)
+	defer end(&err)
 	if k <= 0 {
 		return nil, make([]Element, 0)
 	}
-	res, err := z.cli.ZRangeByScore(key, redis.ZRangeBy{
+	res, err := z.b.ZRangeByScore(key, RangeBy{
 		Min:    "-inf",
 		Max:    "inf",
 		Offset: 0,
 		Count:  int64(k),
-	}).Result()
+	})
 	if err != nil {
-		return err, nil
+		z.opts.logError("get topk failed", err, key, "", key)
+		return util.Wrap(err), nil
 	}
-	ans := make([]Element, len(res))
+	ans = make([]Element, len(res))
 	for i := range res {
 		ans[i].Id = res[i]
 	}
 	return nil, ans
 }
-func (z ZSetTopKProvider) GetTopKS(key string, k int) (error, []Element) {
+func (z ZSetTopKProvider) GetTopKS(key string, k int) (err error, ans []Element) {
+	_, end := z.opts.begin(ProviderZSet, OpTopKS, "key", key, "k", k)
+	defer end(&err)
 	if k <= 0 {
 		return nil, make([]Element, 0)
 	}
-	res, err := z.cli.ZRangeByScoreWithScores(key, redis.ZRangeBy{
+	ans, err = z.b.ZRangeByScoreWithScores(key, RangeBy{
 		Min:    "-inf",
 		Max:    "inf",
 		Offset: 0,
 		Count:  int64(k),
-	}).Result()
+	})
 	if err != nil {
-		return err, nil
-	}
-	ans := make([]Element, len(res))
-	for i := range res {
-		ans[i].Id = res[i].Member.(string)
-		ans[i].Score = res[i].Score
+		z.opts.logError("get topk failed", err, key, "", key)
+		return util.Wrap(err), nil
 	}
 	return nil, ans
 }
@@ -3,9 +3,11 @@ package topk
 import (
 	"fmt"
 	"hash/adler32"
-	"log"
 	"math"
+	"math/rand"
 	"pushan/RedTopK/util"
+	"strconv"
+	"time"
 
 	"github.com/go-basic/uuid"
 	"github.com/go-redis/redis"
@@ -17,24 +19,47 @@ const (
 	HashShardCnt         = 499
 	VersionLock          = "v1.0"
 	MetaZSetLockTemplate = "topk_lock_meta::%s:%s"
+	// lockBackoffMin 和 lockBackoffMax 抢锁失败后重试间隔的范围, 每次失败翻倍
+	lockBackoffMin = time.Millisecond
+	lockBackoffMax = 50 * time.Millisecond
 )
 
-func NewLockTopKProvider(cli *redis.Client) TopKProvider {
+func NewLockTopKProvider(cli *redis.Client, opts ...Option) TopKProvider {
 	if cli == nil {
 		panic("invalid param: cli")
 	}
 
-	return zSetLockTopKProvider{cli: cli}
+	return NewLockTopKProviderWithBackend(NewRedisBackend(cli), opts...)
+}
+
+// NewLockTopKProviderWithBackend 与 NewLockTopKProvider 相同, 使用指定的 Backend
+func NewLockTopKProviderWithBackend(b Backend, opts ...Option) TopKProvider {
+	if b == nil {
+		panic("invalid param: backend")
+	}
+	return zSetLockTopKProvider{b: b, opts: newOptions(b, opts)}
 }
 
 type zSetLockTopKProvider struct {
-	cli *redis.Client
+	b     Backend
+	opts  options
+	trace *opTrace
 }
 
 func (z zSetLockTopKProvider) init() error {
 	return nil
 }
 
+// withTrace 返回记录trace的副本, 副本的redis命令都会记录为span的子span
+func (z zSetLockTopKProvider) withTrace(span Span) zSetLockTopKProvider {
+	if _, ok := span.(nopSpan); ok {
+		return z
+	}
+	z.trace = &opTrace{cur: span}
+	z.b = z.b.WithHook(z.trace.child)
+	return z
+}
+
 func (z zSetLockTopKProvider) makeMetaKey(key string) string {
 	return fmt.Sprintf(MetaZSetTemplate, key, Version)
 }
@@ -43,388 +68,486 @@ func (z zSetLockTopKProvider) makeLockKey(key string) string {
 	return z.makeMetaKey(key) + "::lock"
 }
 
-func (z zSetLockTopKProvider) allocShard(metaKey string) string {
-	// 在持有锁的情况下执行, 如果出错，则直接panic
+func (z zSetLockTopKProvider) newLock(key string) (util.Locker, error) {
+	lock := z.opts.newLocker(z.makeLockKey(key), uuid.New(), z.opts.lockTimeMs)
+	if lock == nil {
+		return nil, util.WrapSkip(fmt.Errorf("%w: create lock for (%s) failed", ErrLockNotAcquired, key), 1)
+	}
+	if ls, ok := lock.(util.LoggerSetter); ok {
+		ls.SetLogger(z.opts.logger)
+	}
+	return lock, nil
+}
+
+/*
+acquire 获取key的锁, 失败时按指数退避加随机抖动重试, 等待超过锁的超时时间后返回 ErrLockNotAcquired.
+持有者最多持有锁 LockTimeMs(或 WithLockTimeout 指定的时间), 因此等待同样长的时间足够.
+*/
+func (z zSetLockTopKProvider) acquire(key string) (lock util.Locker, err error) {
+	end := z.trace.child("lock.acquire", "key", key)
+	defer end(&err)
+	lock, err = z.newLock(key)
+	if err != nil {
+		return nil, err
+	}
+	st := time.Now()
+	deadline := st.Add(time.Duration(z.opts.lockTimeMs) * time.Millisecond)
+	backoff := lockBackoffMin
+	for i := 0; !lock.Lock(); i++ {
+		// 每次获取只在第一次失败时计数, 与重试次数无关
+		if i == 0 {
+			z.opts.metrics.IncLockFailure(ProviderLock)
+		}
+		now := time.Now()
+		if !now.Before(deadline) {
+			z.opts.metrics.ObserveLockWait(ProviderLock, now.Sub(st))
+			return nil, util.WrapSkip(fmt.Errorf("%w: acquire lock for (%s) failed after %v", ErrLockNotAcquired, key, now.Sub(st)), 1)
+		}
+		// 在 [backoff/2, backoff] 之间随机等待, 避免多个等待者同时重试
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if left := deadline.Sub(now); sleep > left {
+			sleep = left
+		}
+		time.Sleep(sleep)
+		if backoff < lockBackoffMax {
+			backoff *= 2
+		}
+	}
+	z.opts.metrics.ObserveLockWait(ProviderLock, time.Since(st))
+	return lock, nil
+}
+
+func (z zSetLockTopKProvider) allocShard(metaKey string) (string, error) {
+	// 在持有锁的情况下执行
 	shardCntKey := metaKey + ":shard_cnt"
-	shardCnt, err := z.cli.Incr(shardCntKey).Result()
+	shardCnt, err := z.b.Incr(shardCntKey)
 	if err != nil {
-		log.Printf("%s\n", err)
-		panic(err)
+		z.opts.logError("alloc shard failed", err, metaKey, "", shardCntKey)
+		return "", util.Wrap(err)
 	}
-	return fmt.Sprintf("%s:data_shard:%d", metaKey, shardCnt)
+	return fmt.Sprintf("%s:data_shard:%d", metaKey, shardCnt), nil
 }
 
-func (z zSetLockTopKProvider) getTargetShard(metaKey string, score float64) (targetShard string) {
-	// 在持有锁的情况下执行, 如果出错，则直接panic
+func (z zSetLockTopKProvider) getTargetShard(metaKey string, score float64) (_ string, err error) {
+	// 在持有锁的情况下执行
+	end := z.trace.child("shard.lookup", "score", score)
+	defer end(&err)
 	// 获取最大值大于等于score的第一个zset
-	rangeRes, err := z.cli.ZRangeByScore(metaKey, redis.ZRangeBy{
-		Min:    fmt.Sprintf("%f", score),
+	rangeRes, err := z.b.ZRangeByScore(metaKey, RangeBy{
+		Min:    formatScore(score),
 		Max:    "inf",
 		Offset: 0,
 		Count:  1,
-	}).Result()
+	})
 	if err != nil {
-		log.Printf("%s\n", err)
-		panic(err)
+		z.opts.logError("get target shard failed", err, metaKey, "", "")
+		return "", util.Wrap(err)
 	}
 	if len(rangeRes) == 0 {
 		// 不存在则放到最后一个shard
-		rangeRes, err = z.cli.ZRevRangeByScore(metaKey, redis.ZRangeBy{
+		rangeRes, err = z.b.ZRevRangeByScore(metaKey, RangeBy{
 			Min:    "-inf",
 			Max:    "inf",
 			Offset: 0,
 			Count:  1,
-		}).Result()
-	}
-	if err != nil {
-		log.Printf("%s\n", err)
-		panic(err)
+		})
+		if err != nil {
+			z.opts.logError("get last shard failed", err, metaKey, "", "")
+			return "", util.Wrap(err)
+		}
 	}
 	if len(rangeRes) == 0 {
 		return z.allocShard(metaKey)
 	}
-	return rangeRes[0]
+	return rangeRes[0], nil
 }
 
-func (z zSetLockTopKProvider) getMaximiumScoreOfShard(shard string) float64 {
-	scores, err := z.cli.ZRevRangeByScoreWithScores(shard, redis.ZRangeBy{
+func (z zSetLockTopKProvider) getMaximiumScoreOfShard(shard string) (float64, error) {
+	scores, err := z.b.ZRevRangeByScoreWithScores(shard, RangeBy{
 		Min:    "-inf",
 		Max:    "inf",
 		Offset: 0,
 		Count:  1,
-	}).Result()
+	})
 	if err != nil {
-		log.Printf("%s\n", err)
-		panic(err)
+		z.opts.logError("get max score of shard failed", err, "", "", shard)
+		return 0, util.Wrap(err)
 	}
 	if len(scores) <= 0 {
-		panic(fmt.Errorf("no member in shard:%s", shard))
+		return 0, util.Wrap(fmt.Errorf("%w: no member in shard:%s", ErrCorruptLayout, shard))
 	}
-	return scores[0].Score
+	return scores[0].Score, nil
 }
 
 func (z zSetLockTopKProvider) splitTrans(metaKey, srcShard, targetShard string, srcMax, tgtMax float64,
-	transMembers []redis.Z, removeScoreMin, removeScoreMax string) {
-	pl := z.cli.TxPipeline()
+	transMembers []Element, removeScoreMin, removeScoreMax string) error {
+	pl := z.b.TxPipeline()
 	pl.ZAdd(targetShard, transMembers...)
 	pl.ZRemRangeByScore(srcShard, removeScoreMin, removeScoreMax)
-	pl.ZAdd(metaKey, redis.Z{
-		Score:  srcMax,
-		Member: srcShard,
+	pl.ZAdd(metaKey, Element{
+		Id:    srcShard,
+		Score: srcMax,
 	},
-		redis.Z{
-			Score:  tgtMax,
-			Member: targetShard,
+		Element{
+			Id:    targetShard,
+			Score: tgtMax,
 		})
 	for i := range transMembers {
-		member := transMembers[i].Member.(string)
+		member := transMembers[i].Id
 		pl.HSet(z.getExistsKey(metaKey, member), member, targetShard)
 	}
-	_, err := pl.Exec()
+	err := pl.Exec()
 	if err != nil {
-		log.Printf("%s\n", err)
-		panic(err)
+		z.opts.logError("split shard failed", err, metaKey, "", srcShard)
+		return util.Wrap(err)
 	}
+	if err := inheritTTL(z.b, metaKey, targetShard); err != nil {
+		z.opts.logError("inherit ttl failed", err, metaKey, "", targetShard)
+		return util.Wrap(err)
+	}
+	return nil
 }
 
-func (z zSetLockTopKProvider) splitShard(targetShard, metakey string) {
-	maxScoreOfTargetShard := z.getMaximiumScoreOfShard(targetShard)
+func (z zSetLockTopKProvider) splitShard(targetShard, metakey string) (err error) {
+	end := z.trace.child("shard.split", "shard", targetShard)
+	defer end(&err)
+	maxScoreOfTargetShard, err := z.getMaximiumScoreOfShard(targetShard)
+	if err != nil {
+		return err
+	}
 	var splitShard string
 	var splitMax float64 = -math.MaxFloat64
-	maxScoreStr := fmt.Sprintf("%f", maxScoreOfTargetShard)
-	maxAfterRemove, err := z.cli.ZRevRangeByScoreWithScores(targetShard, redis.ZRangeBy{
+	maxScoreStr := formatScore(maxScoreOfTargetShard)
+	maxAfterRemove, err := z.b.ZRevRangeByScoreWithScores(targetShard, RangeBy{
 		Min:    "-inf",
-		Max:    fmt.Sprintf("(%s", maxScoreStr),
+		Max:    "(" + maxScoreStr,
 		Offset: 0,
 		Count:  1,
-	}).Result()
+	})
 	if err != nil {
-		log.Printf("%s\n", err)
-		panic(err)
+		z.opts.logError("split shard failed", err, metakey, "", targetShard)
+		return util.Wrap(err)
 	}
 	if len(maxAfterRemove) <= 0 {
 		// empty after remove
-		return
+		return nil
 	}
-	maxMemberScores, err := z.cli.ZRangeByScoreWithScores(targetShard, redis.ZRangeBy{
+	maxMemberScores, err := z.b.ZRangeByScoreWithScores(targetShard, RangeBy{
 		Min: maxScoreStr,
 		Max: maxScoreStr,
-	}).Result()
+	})
 	if err != nil {
-		log.Printf("%s\n", err)
-		panic(err)
+		z.opts.logError("split shard failed", err, metakey, "", targetShard)
+		return util.Wrap(err)
 	}
-	nextZset, err := z.cli.ZRangeByScoreWithScores(metakey, redis.ZRangeBy{
-		Min:    fmt.Sprintf("(%f", maxScoreOfTargetShard),
+	nextZset, err := z.b.ZRangeByScoreWithScores(metakey, RangeBy{
+		Min:    "(" + maxScoreStr,
 		Max:    "inf",
 		Offset: 0,
 		Count:  1,
-	}).Result()
+	})
 	if err != nil {
-		log.Printf("%s\n", err)
-		panic(err)
+		z.opts.logError("split shard failed", err, metakey, "", targetShard)
+		return util.Wrap(err)
 	}
+	event := ShardSplit
 	if len(nextZset) > 0 {
-		splitShard = nextZset[0].Member.(string)
-		nextMemberCnt, err := z.cli.ZCard(splitShard).Result()
+		splitShard = nextZset[0].Id
+		nextMemberCnt, err := z.b.ZCard(splitShard)
 		if err != nil {
-			log.Printf("%s\n", err)
-			panic(err)
+			z.opts.logError("split shard failed", err, metakey, "", splitShard)
+			return util.Wrap(err)
 		}
-		if nextMemberCnt+int64(len(maxMemberScores)) > ShardLimit {
-			splitShard = z.allocShard(metakey)
+		if nextMemberCnt+int64(len(maxMemberScores)) > int64(z.opts.shardLimit) {
+			splitShard, err = z.allocShard(metakey)
+			if err != nil {
+				return err
+			}
 		} else {
 			splitMax = nextZset[0].Score
+			event = ShardRebalance
 		}
 	} else {
-		splitShard = z.allocShard(metakey)
+		splitShard, err = z.allocShard(metakey)
+		if err != nil {
+			return err
+		}
 	}
 	splitMax = math.Max(splitMax, maxScoreOfTargetShard)
-	z.splitTrans(metakey, targetShard, splitShard, maxAfterRemove[0].Score,
+	err = z.splitTrans(metakey, targetShard, splitShard, maxAfterRemove[0].Score,
 		splitMax, maxMemberScores, maxScoreStr, maxScoreStr)
+	if err != nil {
+		return err
+	}
+	z.opts.metrics.IncShardEvent(ProviderLock, event)
+	return nil
 }
 
-func (z zSetLockTopKProvider) addElementToTargetShard(targetShard, metaKey, id string, score float64) {
-	// 在持有锁的情况下执行, 如果出错，则直接panic
+func (z zSetLockTopKProvider) addElementToTargetShard(targetShard, metaKey, id string, score float64) error {
+	// 在持有锁的情况下执行
 	var targetShardMaxScore float64 = score
-	scores, err := z.cli.ZRevRangeByScoreWithScores(targetShard, redis.ZRangeBy{
+	scores, err := z.b.ZRevRangeByScoreWithScores(targetShard, RangeBy{
 		Min:    "-inf",
 		Max:    "inf",
 		Offset: 0,
 		Count:  1,
-	}).Result()
+	})
 	if err != nil {
-		log.Printf("%s\n", err)
-		panic(err)
+		z.opts.logError("add element failed", err, metaKey, id, targetShard)
+		return util.Wrap(err)
 	}
 	if len(scores) > 0 && targetShardMaxScore < scores[0].Score {
 		targetShardMaxScore = scores[0].Score
 	}
-	pl := z.cli.Pipeline()
-	_ = pl.ZAdd(targetShard, redis.Z{
-		Score:  score,
-		Member: id,
+	pl := z.b.Pipeline()
+	_ = pl.ZAdd(targetShard, Element{
+		Id:    id,
+		Score: score,
 	})
-	pl.ZAdd(metaKey, redis.Z{
-		Score:  targetShardMaxScore,
-		Member: targetShard,
-	}).Err()
-	pl.HSet(z.getExistsKey(metaKey, id), id, targetShard)
-
-	shardMemberCmd := pl.ZCard(targetShard)
-	_, err = pl.Exec()
-	if err != nil {
-		log.Printf("%s\n", err)
-		panic(err)
-	}
-	shardMemberCnt, err := shardMemberCmd.Result()
+	pl.ZAdd(metaKey, Element{
+		Id:    targetShard,
+		Score: targetShardMaxScore,
+	})
+	hashKey := z.getExistsKey(metaKey, id)
+	pl.HSet(hashKey, id, targetShard)
+	hashLenReply := pl.HLen(hashKey)
+
+	shardMemberReply := pl.ZCard(targetShard)
+	err = pl.Exec()
 	if err != nil {
-		log.Printf("%s\n", err)
-		panic(err)
+		z.opts.logError("add element failed", err, metaKey, id, targetShard)
+		return util.Wrap(err)
+	}
+	// 新建的 m_to_z 继承meta的过期时间
+	if hashLenReply.Val == 1 {
+		if err := inheritTTL(z.b, metaKey, hashKey); err != nil {
+			z.opts.logError("inherit ttl failed", err, metaKey, id, hashKey)
+			return util.Wrap(err)
+		}
 	}
+	shardMemberCnt := shardMemberReply.Val
 	// 判断是否需要分裂
-	if shardMemberCnt > ShardLimit {
+	if shardMemberCnt > int64(z.opts.shardLimit) {
 		// 分裂
-		z.splitShard(targetShard, metaKey)
+		return z.splitShard(targetShard, metaKey)
 	}
+	return nil
 }
 
-func (z zSetLockTopKProvider) AddElement(key string, id string, score float64) (ansErr error) {
-	ansErr = nil
-	defer func() {
-		if err := recover(); err != nil {
-			ansErr = err.(error)
-		}
-	}()
-	lockKey := z.makeLockKey(key)
-	lock := util.NewRedisLock(z.cli, lockKey, uuid.New(), LockTimeMs)
-	if lock == nil {
-		return fmt.Errorf("create lock for (%s, %s, %f) failed", key, id, score)
-	}
-	// 为了测试，循环抢锁
-	for !lock.Lock() {
+func (z zSetLockTopKProvider) AddElement(key string, id string, score float64) (err error) {
+	span, end := z.opts.begin(ProviderLock, OpAdd, "key", key, "member", id)
+	defer end(&err)
+	z = z.withTrace(span)
+	if err := z.opts.validate(key, id, score); err != nil {
+		return err
+	}
+	lock, err := z.acquire(key)
+	if err != nil {
+		return err
 	}
-	/*
-		if !lock.Lock() {
-			return fmt.Errorf("acquire lock for (%s, %s, %f) failed", key, id, score)
-		}
-	*/
 	defer lock.UnLock()
+	metaKey, waiting, err := z.writeMeta(key)
+	if err != nil {
+		return err
+	}
+	evicted, err := z.add(metaKey, key, id, score, waiting)
+	if err != nil {
+		return err
+	}
+	return rejectedErr(key, id, evicted)
+}
+
+// add 设置了容量时返回被淘汰的元素, 在持有锁的情况下执行, waiting 来自 writeMeta
+func (z zSetLockTopKProvider) add(metaKey string, key string, id string, score float64, waiting *IntReply) ([]Element, error) {
+	var evicted []Element
+	var err error
+	if limit := z.opts.capacityOf(key); limit > 0 {
+		evicted, err = z.addCapped(metaKey, id, score, limit)
+	} else {
+		err = z.addMember(metaKey, id, score)
+	}
+	if err != nil {
+		return nil, err
+	}
+	wakeIfWaiting(z.b, z.opts, waitQueueKey(z.makeMetaKey(key)), waiting)
+	return evicted, nil
+}
 
-	metaKey := z.makeMetaKey(key)
-	z.deleteMember(metaKey, id)
-	targetShard := z.getTargetShard(metaKey, score)
+// addMember 添加或更新id的score, 在持有锁的情况下执行
+func (z zSetLockTopKProvider) addMember(metaKey string, id string, score float64) error {
+	if _, err := z.deleteMember(metaKey, id); err != nil {
+		return err
+	}
+	targetShard, err := z.getTargetShard(metaKey, score)
+	if err != nil {
+		return err
+	}
 	// 添加到targetshard
-	z.addElementToTargetShard(targetShard, metaKey, id, score)
-	return
+	return z.addElementToTargetShard(targetShard, metaKey, id, score)
+}
+
+// formatScore 以能精确还原的形式格式化score, 用作 ZRANGEBYSCORE 的边界
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'g', -1, 64)
 }
 
 func (z zSetLockTopKProvider) getExistsKey(metaKey string, id string) string {
 	return fmt.Sprintf("%s:m_to_z:%d", metaKey, adler32.Checksum([]byte(id))%HashShardCnt)
 }
 
-func (z zSetLockTopKProvider) deleteMember(metaKey string, id string) {
-	// 在持有锁的情况下执行, 如果出错，则直接panic
-	hashKey := z.getExistsKey(metaKey, id)
-	exists, err := z.cli.HExists(hashKey, id).Result()
-	if err != nil {
-		log.Printf("%s\n", err)
-		panic(err)
-	}
-	if exists {
-		targetZSet, err := z.cli.HGet(hashKey, id).Result()
-		if err != nil {
-			log.Printf("%s\n", err)
-			panic(err)
-		}
-		top2, err := z.cli.ZRevRangeByScoreWithScores(targetZSet, redis.ZRangeBy{
-			Min:    "-inf",
-			Max:    "inf",
-			Offset: 0,
-			Count:  2,
-		}).Result()
-		if err != nil {
-			log.Printf("%s\n", err)
-			panic(err)
-		}
-		pl := z.cli.TxPipeline()
-		// 所有的修改放到一个pipeline，防止部分失败
-		pl.ZRem(targetZSet, id)
-		pl.HDel(hashKey, id)
-		if len(top2) <= 1 {
-			// 只有唯一一个元素, 删除该zset
-			pl.ZRem(metaKey, targetZSet)
-		} else {
-			// 多余1个元素
-			if top2[0].Member == id {
-				// 最大值为删除的元素
-				pl.ZAdd(metaKey, redis.Z{
-					Score:  top2[1].Score,
-					Member: targetZSet,
-				})
-			} /* else {
-				// 最大值删除后不会改变, Do nothing
-			} */
-		}
-		_, err = pl.Exec()
-		if err != nil {
-			log.Printf("%s\n", err)
-			panic(err)
-		}
-	}
+// lookupMember 从 m_to_z 中查找id所在的shard, id不存在时返回空字符串
+func (z zSetLockTopKProvider) lookupMember(hashKey string, id string) (shard string, err error) {
+	end := z.trace.child("shard.lookup", "member", id)
+	defer end(&err)
+	shard, _, err = z.b.HGet(hashKey, id)
+	return shard, err
 }
 
-func (z zSetLockTopKProvider) GetTopK(key string, k int) (ansErr error, ans []Element) {
-	ansErr = nil
-	defer func() {
-		if err := recover(); err != nil {
-			ansErr = err.(error)
-		}
-	}()
-	lockKey := z.makeLockKey(key)
-	lock := util.NewRedisLock(z.cli, lockKey, uuid.New(), LockTimeMs)
-	if lock == nil {
-		panic(fmt.Errorf("create lock for (%s) failed", key))
+// deleteMember 删除id, 返回id是否存在
+func (z zSetLockTopKProvider) deleteMember(metaKey string, id string) (bool, error) {
+	// 在持有锁的情况下执行
+	hashKey := z.getExistsKey(metaKey, id)
+	targetZSet, err := z.lookupMember(hashKey, id)
+	if err != nil {
+		z.opts.logError("delete element failed", err, metaKey, id, "")
+		return false, util.Wrap(err)
 	}
-	if !lock.Lock() {
-		panic(fmt.Errorf("acquire lock for (%s) failed", key))
+	if targetZSet == "" {
+		return false, nil
 	}
-	defer lock.UnLock()
-	metaKey := z.makeMetaKey(key)
-	metaZSets, err := z.cli.ZRangeByScore(metaKey, redis.ZRangeBy{
+	top2, err := z.b.ZRevRangeByScoreWithScores(targetZSet, RangeBy{
 		Min:    "-inf",
 		Max:    "inf",
 		Offset: 0,
-		Count:  0,
-	}).Result()
+		Count:  2,
+	})
 	if err != nil {
-		log.Printf("%s\n", err)
-		panic(err)
+		z.opts.logError("delete element failed", err, metaKey, id, targetZSet)
+		return false, util.Wrap(err)
+	}
+	if len(top2) == 0 {
+		// m_to_z 指向了一个空的shard
+		return false, util.Wrap(fmt.Errorf("%w: member %s points to empty shard %s", ErrCorruptLayout, id, targetZSet))
+	}
+	pl := z.b.TxPipeline()
+	// 所有的修改放到一个pipeline，防止部分失败
+	pl.ZRem(targetZSet, id)
+	pl.HDel(hashKey, id)
+	if len(top2) <= 1 {
+		// 只有唯一一个元素, 删除该zset
+		pl.ZRem(metaKey, targetZSet)
+	} else {
+		// 多余1个元素
+		if top2[0].Id == id {
+			// 最大值为删除的元素
+			pl.ZAdd(metaKey, Element{
+				Id:    targetZSet,
+				Score: top2[1].Score,
+			})
+		} /* else {
+			// 最大值删除后不会改变, Do nothing
+		} */
+	}
+	err = pl.Exec()
+	if err != nil {
+		z.opts.logError("delete element failed", err, metaKey, id, targetZSet)
+		return false, util.Wrap(err)
 	}
-	ans = make([]Element, 0, k)
-	for i := 0; i < len(metaZSets) && k > 0; i++ {
-		members, err := z.cli.ZRangeByScore(metaZSets[i], redis.ZRangeBy{
-			Min:    "-inf",
-			Max:    "inf",
-			Offset: 0,
-			Count:  int64(k),
-		}).Result()
-		if err != nil {
-			log.Printf("%s\n", err)
-			panic(err)
-		}
-		k -= len(members)
-		for j := range members {
-			ele := Element{Id: members[j]}
-			ans = append(ans, ele)
-		}
+	return true, nil
+}
+
+func (z zSetLockTopKProvider) GetTopK(key string, k int) (err error, ans []Element) {
+	span, end := z.opts.begin(ProviderLock, OpTopK, "key", key, "k", k)
+	defer end(&err)
+	z = z.withTrace(span)
+	err, ans = z.getTopKS(key, k)
+	if err != nil {
+		return err, nil
 	}
-	return
+	for i := range ans {
+		ans[i].Score = 0
+	}
+	return nil, ans
 }
-func (z zSetLockTopKProvider) GetTopKS(key string, k int) (ansErr error, ans []Element) {
-	ansErr = nil
-	defer func() {
-		if err := recover(); err != nil {
-			ansErr = err.(error)
-		}
-	}()
-	lockKey := z.makeLockKey(key)
-	lock := util.NewRedisLock(z.cli, lockKey, uuid.New(), LockTimeMs)
-	if lock == nil {
-		panic(fmt.Errorf("create lock for (%s) failed", key))
+
+func (z zSetLockTopKProvider) GetTopKS(key string, k int) (err error, ans []Element) {
+	span, end := z.opts.begin(ProviderLock, OpTopKS, "key", key, "k", k)
+	defer end(&err)
+	z = z.withTrace(span)
+	return z.getTopKS(key, k)
+}
+
+func (z zSetLockTopKProvider) getTopKS(key string, k int) (error, []Element) {
+	if k <= 0 {
+		return nil, make([]Element, 0)
 	}
-	if !lock.Lock() {
-		panic(fmt.Errorf("acquire lock for (%s) failed", key))
+	lock, err := z.acquire(key)
+	if err != nil {
+		return err, nil
 	}
 	defer lock.UnLock()
-	metaKey := z.makeMetaKey(key)
-	metaZSets, err := z.cli.ZRangeByScore(metaKey, redis.ZRangeBy{
-		Min:    "-inf",
-		Max:    "inf",
-		Offset: 0,
-		Count:  0,
-	}).Result()
+	metaKey, err := z.currentMeta(key)
 	if err != nil {
-		log.Printf("%s\n", err)
-		panic(err)
+		return err, nil
 	}
-	ans = make([]Element, 0, k)
+	metaZSets, err := z.walkMeta(metaKey)
+	if err != nil {
+		z.opts.logError("get topk failed", err, metaKey, "", "")
+		return util.Wrap(err), nil
+	}
+	ans := make([]Element, 0, k)
 	for i := 0; i < len(metaZSets) && k > 0; i++ {
-		members, err := z.cli.ZRangeByScoreWithScores(metaZSets[i], redis.ZRangeBy{
-			Min:    "-inf",
-			Max:    "inf",
-			Offset: 0,
-			Count:  int64(k),
-		}).Result()
+		members, err := z.readShard(metaZSets[i], k)
 		if err != nil {
-			log.Printf("%s\n", err)
-			panic(err)
+			z.opts.logError("get topk failed", err, metaKey, "", metaZSets[i])
+			return util.Wrap(err), nil
 		}
 		k -= len(members)
-		for j := range members {
-			ele := Element{Id: members[j].Member.(string), Score: members[j].Score}
-			ans = append(ans, ele)
-		}
+		ans = append(ans, members...)
 	}
-	return
+	return nil, ans
 }
 
-func (z zSetLockTopKProvider) DeleteElement(key string, id string) (ansErr error) {
-	ansErr = nil
-	defer func() {
-		if err := recover(); err != nil {
-			ansErr = err.(error)
-		}
-	}()
-	lockKey := z.makeLockKey(key)
-	lock := util.NewRedisLock(z.cli, lockKey, uuid.New(), LockTimeMs)
-	if lock == nil {
-		return fmt.Errorf("create lock for (%s, %s) failed", key, id)
-	}
-	if !lock.Lock() {
-		return fmt.Errorf("acquire lock for (%s, %s) failed", key, id)
+// walkMeta 按最大score从小到大返回所有shard
+func (z zSetLockTopKProvider) walkMeta(metaKey string) (shards []string, err error) {
+	end := z.trace.child("meta.walk", "key", metaKey)
+	defer end(&err)
+	return z.b.ZRangeByScore(metaKey, RangeBy{
+		Min:    "-inf",
+		Max:    "inf",
+		Offset: 0,
+		Count:  0,
+	})
+}
+
+// readShard 返回shard中score最小的k个member
+func (z zSetLockTopKProvider) readShard(shard string, k int) (members []Element, err error) {
+	end := z.trace.child("shard.read", "shard", shard, "k", k)
+	defer end(&err)
+	return z.b.ZRangeByScoreWithScores(shard, RangeBy{
+		Min:    "-inf",
+		Max:    "inf",
+		Offset: 0,
+		Count:  int64(k),
+	})
+}
+
+func (z zSetLockTopKProvider) DeleteElement(key string, id string) (err error) {
+	span, end := z.opts.begin(ProviderLock, OpDelete, "key", key, "member", id)
+	defer end(&err)
+	z = z.withTrace(span)
+	if err := z.opts.validateId(key, id); err != nil {
+		return err
+	}
+	lock, err := z.acquire(key)
+	if err != nil {
+		return err
 	}
 	defer lock.UnLock()
-	z.deleteMember(z.makeMetaKey(key), id)
-	return
+	metaKey, err := z.currentMeta(key)
+	if err != nil {
+		return err
+	}
+	_, err = z.deleteMember(metaKey, id)
+	return err
 }
@@ -2,6 +2,7 @@ package topk
 
 import (
 	"fmt"
+	"pushan/RedTopK/util"
 	"strconv"
 	"strings"
 
@@ -17,6 +18,7 @@ type TopKProvider interface {
 	AddElement(key string, id string, score float64) error
 	GetTopK(key string, k int) (error, []Element)
 	GetTopKS(key string, k int) (error, []Element)
+	// DeleteElement 与 ZREM 相同, id不存在时不返回错误, 可以重复删除
 	DeleteElement(key string, id string) error
 }
 
@@ -25,16 +27,25 @@ const (
 	MetaZSetTemplate = "{topk_meta::%s}:%s"
 )
 
-func NewTopKProvider(cli *redis.Client) TopKProvider {
+func NewTopKProvider(cli *redis.Client, opts ...Option) TopKProvider {
 	if cli == nil {
 		panic("invalid param: cli")
 	}
 
-	return zSetShardTopKProvider{cli: cli}
+	return NewTopKProviderWithBackend(NewRedisBackend(cli), opts...)
+}
+
+// NewTopKProviderWithBackend 与 NewTopKProvider 相同, 使用指定的 Backend, Backend 需要支持 Eval
+func NewTopKProviderWithBackend(b Backend, opts ...Option) TopKProvider {
+	if b == nil {
+		panic("invalid param: backend")
+	}
+	return zSetShardTopKProvider{b: b, opts: newOptions(b, opts)}
 }
 
 type zSetShardTopKProvider struct {
-	cli *redis.Client
+	b    Backend
+	opts options
 }
 
 func (z zSetShardTopKProvider) init() error {
@@ -45,49 +56,127 @@ func (z zSetShardTopKProvider) makeMetaKey(key string) string {
 	return fmt.Sprintf(MetaZSetTemplate, key, Version)
 }
 
-func (z zSetShardTopKProvider) AddElement(key string, id string, score float64) error {
-	cmd := script.Run(z.cli, []string{z.makeMetaKey(key)}, "add", score, id)
-	_, err := cmd.Result()
-	return err
+// AddMember 脚本的返回值
+const (
+	luaAdded           = 1
+	luaAddedSplit      = 2
+	luaAddedRebalanced = 3
+)
+
+func (z zSetShardTopKProvider) AddElement(key string, id string, score float64) (err error) {
+	_, end := z.opts.begin(ProviderLua, OpAdd, "key", key, "member", id)
+	defer end(&err)
+	if err := z.opts.validate(key, id, score); err != nil {
+		return err
+	}
+	evicted, err := z.add(key, id, score)
+	if err != nil {
+		return err
+	}
+	return rejectedErr(key, id, evicted)
+}
+
+// add 设置了容量时返回被淘汰的元素
+func (z zSetShardTopKProvider) add(key string, id string, score float64) ([]Element, error) {
+	if limit := z.opts.capacityOf(key); limit > 0 {
+		return z.addCapped(key, id, score, limit)
+	}
+	res, err := evalInt(z.b, []string{z.makeMetaKey(key)}, "add", score, id)
+	if err != nil {
+		z.opts.logError("add element failed", err, key, id, "")
+		return nil, util.Wrap(err)
+	}
+	z.shardEvent(res)
+	return nil, nil
+}
+
+func (z zSetShardTopKProvider) shardEvent(res int64) {
+	switch res {
+	case luaAddedSplit:
+		z.opts.metrics.IncShardEvent(ProviderLua, ShardSplit)
+	case luaAddedRebalanced:
+		z.opts.metrics.IncShardEvent(ProviderLua, ShardRebalance)
+	}
 }
 
-func (z zSetShardTopKProvider) GetTopK(key string, k int) (error, []Element) {
-	cmd := script.Run(z.cli, []string{z.makeMetaKey(key)}, "topk", k)
-	res, err := cmd.Result()
+func (z zSetShardTopKProvider) GetTopK(key string, k int) (err error, ans []Element) {
+	_, end := z.opts.begin(ProviderLua, OpTopK, "key", key, "k", k)
+	defer end(&err)
+	res, err := z.b.Eval(script, []string{z.makeMetaKey(key)}, "topk", k)
 	if err != nil {
-		return err, nil
+		z.opts.logError("get topk failed", err, key, "", "")
+		return util.Wrap(err), nil
+	}
+	resStr, ok := res.(string)
+	if !ok {
+		return util.Wrap(fmt.Errorf("%w: unexpected script reply %v", ErrCorruptLayout, res)), nil
 	}
-	resStr := res.(string)
 	resArr := strings.Split(resStr, ",")
 	k = len(resArr) - 1
-	ans := make([]Element, k)
+	ans = make([]Element, k)
 	for i := 0; i < k; i++ {
 		ans[i].Id = resArr[i]
 	}
 	return nil, ans
 }
 
-func (z zSetShardTopKProvider) GetTopKS(key string, k int) (error, []Element) {
-	cmd := script.Run(z.cli, []string{z.makeMetaKey(key)}, "topks", k)
-	res, err := cmd.Result()
+func (z zSetShardTopKProvider) GetTopKS(key string, k int) (err error, ans []Element) {
+	_, end := z.opts.begin(ProviderLua, OpTopKS, "key", key, "k", k)
+	defer end(&err)
+	res, err := z.b.Eval(script, []string{z.makeMetaKey(key)}, "topks", k)
+	if err != nil {
+		z.opts.logError("get topk failed", err, key, "", "")
+		return util.Wrap(err), nil
+	}
+	ans, err = parseScoredReply(res)
 	if err != nil {
-		return err, nil
+		return util.Wrap(err), nil
+	}
+	return nil, ans
+}
+
+// parseScoredReply 解析脚本返回的 "id,score,id,score," 格式的结果
+func parseScoredReply(res interface{}) ([]Element, error) {
+	resStr, ok := res.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: unexpected script reply %v", ErrCorruptLayout, res)
 	}
-	resStr := res.(string)
 	resArr := strings.Split(resStr, ",")
-	k = (len(resArr) - 1) >> 1
+	k := (len(resArr) - 1) >> 1
 	ans := make([]Element, k)
 	for i := 0; i < k; i++ {
+		var err error
 		ans[i].Id = resArr[i<<1]
-		ans[i].Score, _ = strconv.ParseFloat(resArr[(i<<1)+1], 64)
+		ans[i].Score, err = strconv.ParseFloat(resArr[(i<<1)+1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad score of %s: %s", ErrCorruptLayout, ans[i].Id, err)
+		}
 	}
-	return nil, ans
+	return ans, nil
+}
+
+func (z zSetShardTopKProvider) DeleteElement(key string, id string) (err error) {
+	_, end := z.opts.begin(ProviderLua, OpDelete, "key", key, "member", id)
+	defer end(&err)
+	if err := z.opts.validateId(key, id); err != nil {
+		return err
+	}
+	if _, err := evalInt(z.b, []string{z.makeMetaKey(key)}, "del", id); err != nil {
+		z.opts.logError("delete element failed", err, key, id, "")
+		return util.Wrap(err)
+	}
+	return nil
 }
 
-func (z zSetShardTopKProvider) DeleteElement(key string, id string) error {
-	cmd := script.Run(z.cli, []string{z.makeMetaKey(key)}, "del", id)
-	if cmd.Err() != nil && strings.Contains(cmd.Err().Error(), "redis: nil") {
-		return nil
+// evalInt 执行脚本并要求返回整数
+func evalInt(b Backend, keys []string, args ...interface{}) (int64, error) {
+	res, err := b.Eval(script, keys, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("%w: unexpected script reply %v", ErrCorruptLayout, res)
 	}
-	return cmd.Err()
+	return n, nil
 }
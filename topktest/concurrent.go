@@ -0,0 +1,83 @@
+package topktest
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"pushan/RedTopK/topk"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultConcurrentOps CheckConcurrent 中每个client默认的操作数, 历史过长时线性化检查的代价很高
+const DefaultConcurrentOps = 25
+
+/*
+CheckConcurrent 用 cfg.Clients 个goroutine并发执行随机操作, 记录历史并检查是否可线性化.
+每个client的操作序列由 cfg.Seed + client 生成, cfg.Ops 为0时使用 DefaultConcurrentOps.
+*/
+func CheckConcurrent(tp topk.TopKProvider, cfg Config) (History, *Linearization) {
+	if cfg.Ops <= 0 {
+		cfg.Ops = DefaultConcurrentOps
+	}
+	// 线性化检查不支持只读的区间查询
+	cfg.Ranges = false
+	cfg = cfg.withDefaults()
+	key := fmt.Sprintf("%s:%d", cfg.Key, atomic.AddInt64(&keySeq, 1))
+	rec := NewHistoryRecorder()
+	wg := sync.WaitGroup{}
+	start := make(chan struct{})
+	ids := make(map[string]bool)
+	for c := 0; c < cfg.Clients; c++ {
+		ops := Generate(rand.New(rand.NewSource(cfg.Seed+int64(c))), cfg.Ops, cfg)
+		for _, op := range ops {
+			if op.Kind == OpAdd {
+				ids[op.Id] = true
+			}
+		}
+		wg.Add(1)
+		go func(client topk.TopKProvider, ops []Op) {
+			defer wg.Done()
+			<-start
+			for _, op := range ops {
+				apply(client, key, op)
+			}
+		}(rec.Wrap(tp, c), ops)
+	}
+	close(start)
+	wg.Wait()
+	for id := range ids {
+		_ = tp.DeleteElement(key, id)
+	}
+	h := rec.History()
+	return h, CheckLinearizable(h, cfg.MaxSteps)
+}
+
+// TestConcurrent 运行 CheckConcurrent, 历史不可线性化时输出时间轴
+func TestConcurrent(t T, tp topk.TopKProvider, cfg Config) {
+	t.Helper()
+	h, lin := CheckConcurrent(tp, cfg)
+	if lin.Ok {
+		return
+	}
+	buf := bytes.Buffer{}
+	_ = WriteTimeline(&buf, h, lin)
+	t.Fatalf("%s", buf.String())
+}
+
+func apply(tp topk.TopKProvider, key string, op Op) {
+	switch op.Kind {
+	case OpAdd:
+		_ = tp.AddElement(key, op.Id, op.Score)
+	case OpDelete:
+		_ = tp.DeleteElement(key, op.Id)
+	case OpTopK:
+		_, _ = tp.GetTopK(key, op.K)
+	case OpTopKS:
+		_, _ = tp.GetTopKS(key, op.K)
+	case OpPopTop:
+		_, _ = tp.(topk.Popper).PopTop(key, op.K)
+	case OpPopBottom:
+		_, _ = tp.(topk.Popper).PopBottom(key, op.K)
+	}
+}
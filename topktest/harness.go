@@ -0,0 +1,393 @@
+/*
+Package topktest 对任意 TopKProvider 做差分测试: 用固定的seed生成随机操作序列,
+同时在被测provider和参考实现上执行并比较结果, 失败时把序列收缩为最小的复现用例.
+
+在 go test 中使用:
+
+	func TestLockProvider(t *testing.T) {
+		cli := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+		topktest.Test(t, topk.NewLockTopKProvider(cli), topktest.Config{Key: "topktest"})
+	}
+*/
+package topktest
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"pushan/RedTopK/topk"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Config struct {
+	// Key 每次执行使用新的 Key:<序号>, 参考实现使用 Key:<序号>:ref
+	Key  string
+	Seed int64
+	// Runs 随机序列的个数, Ops 每个序列的操作数
+	Runs int
+	Ops  int
+	// Ids 和 Scores id和score的取值个数, MaxK topk操作的最大k
+	Ids    int
+	Scores int
+	MaxK   int
+	// Ranges 生成 OpRange, OpCount 和 OpAround, 被测provider和参考实现都需要实现 topk.RangeQuerier 和 topk.AroundQuerier
+	Ranges bool
+	// Pops 生成 OpPopTop 和 OpPopBottom, 被测provider和参考实现都需要实现 topk.Popper
+	Pops bool
+	// Capacity 大于0时参考实现为 NewCappedModel, 被测provider需要使用相同的 topk.WithCapacity, 不用于 CheckConcurrent
+	Capacity int
+	// MaxShrinks 收缩时最多执行的次数
+	MaxShrinks int
+	// Clients 和 MaxSteps 用于 CheckConcurrent: 并发的client个数和线性化检查的最大搜索步数
+	Clients  int
+	MaxSteps int
+	// NewReference 为空时使用 NewModel
+	NewReference func() topk.TopKProvider
+	// Reset 不为空时在每次执行前调用, 用于清理上一次执行留下的数据
+	Reset func() error
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.Key == "" {
+		cfg.Key = "topktest"
+	}
+	if cfg.Runs <= 0 {
+		cfg.Runs = 20
+	}
+	if cfg.Ops <= 0 {
+		cfg.Ops = 200
+	}
+	if cfg.Ids <= 0 {
+		cfg.Ids = 32
+	}
+	if cfg.Scores <= 0 {
+		cfg.Scores = 8
+	}
+	if cfg.MaxK <= 0 {
+		cfg.MaxK = cfg.Ids
+	}
+	if cfg.MaxShrinks <= 0 {
+		cfg.MaxShrinks = 1000
+	}
+	if cfg.Clients <= 0 {
+		cfg.Clients = 4
+	}
+	if cfg.MaxSteps <= 0 {
+		cfg.MaxSteps = 1000000
+	}
+	if cfg.NewReference == nil {
+		cfg.NewReference = func() topk.TopKProvider { return NewCappedModel(cfg.Capacity) }
+	}
+	return cfg
+}
+
+// Failure 收缩后的失败用例
+type Failure struct {
+	Seed int64
+	// Ops 收缩后的操作序列, Original 收缩前的操作数
+	Ops      []Op
+	Original int
+	// Step 出错的操作下标, 等于 len(Ops) 表示执行完所有操作后的最终比较
+	Step   int
+	Detail string
+}
+
+func (f *Failure) Error() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "seed %d: shrunk from %d to %d ops, ", f.Seed, f.Original, len(f.Ops))
+	if f.Step < len(f.Ops) {
+		fmt.Fprintf(&b, "step %d %s: %s", f.Step, f.Ops[f.Step], f.Detail)
+	} else {
+		fmt.Fprintf(&b, "final check: %s", f.Detail)
+	}
+	b.WriteString("\nreproducer:\n\t[]topktest.Op{\n")
+	for _, op := range f.Ops {
+		fmt.Fprintf(&b, "\t\t%#v,\n", op)
+	}
+	b.WriteString("\t}")
+	return b.String()
+}
+
+// T 是 *testing.T 的子集, 便于在 go test 和命令行中复用
+type T interface {
+	Helper()
+	Fatalf(format string, args ...interface{})
+}
+
+// Test 运行 Check, 失败时打印最小复现用例
+func Test(t T, tp topk.TopKProvider, cfg Config) {
+	t.Helper()
+	if f := Check(tp, cfg); f != nil {
+		t.Fatalf("%s", f)
+	}
+}
+
+// keySeq 以启动时间开始, 避免和之前进程留下的数据冲突
+var keySeq = time.Now().UnixNano()
+
+// Check 依次运行 cfg.Runs 个随机序列, 返回第一个失败收缩后的结果, 全部通过时返回nil
+func Check(tp topk.TopKProvider, cfg Config) *Failure {
+	cfg = cfg.withDefaults()
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	for i := 0; i < cfg.Runs; i++ {
+		seed := cfg.Seed + int64(i)
+		ops := Generate(rand.New(rand.NewSource(seed)), cfg.Ops, cfg)
+		f := execute(tp, cfg, ops)
+		if f == nil {
+			continue
+		}
+		f.Seed = seed
+		return shrink(tp, cfg, f)
+	}
+	return nil
+}
+
+// Replay 执行给定的操作序列, 用于回放 Failure 中的复现用例
+func Replay(tp topk.TopKProvider, cfg Config, ops []Op) *Failure {
+	return execute(tp, cfg.withDefaults(), ops)
+}
+
+// shrink 不断删除操作块, 保留仍然失败的最短序列
+func shrink(tp topk.TopKProvider, cfg Config, f *Failure) *Failure {
+	best := f
+	best.Original = len(f.Ops)
+	runs := 0
+	for chunk := len(best.Ops) / 2; chunk >= 1 && runs < cfg.MaxShrinks; chunk /= 2 {
+		for i := 0; i < len(best.Ops) && runs < cfg.MaxShrinks; {
+			end := i + chunk
+			if end > len(best.Ops) {
+				end = len(best.Ops)
+			}
+			cand := make([]Op, 0, len(best.Ops)-(end-i))
+			cand = append(append(cand, best.Ops[:i]...), best.Ops[end:]...)
+			runs++
+			if nf := execute(tp, cfg, cand); nf != nil {
+				nf.Seed, nf.Original = best.Seed, best.Original
+				best = nf
+				continue
+			}
+			i = end
+		}
+	}
+	return best
+}
+
+// execute 在新的key上执行ops, 返回第一个不一致
+func execute(tp topk.TopKProvider, cfg Config, ops []Op) *Failure {
+	if cfg.Reset != nil {
+		if err := cfg.Reset(); err != nil {
+			return &Failure{Ops: ops, Detail: fmt.Sprintf("reset failed: %s", err)}
+		}
+	}
+	key := fmt.Sprintf("%s:%d", cfg.Key, atomic.AddInt64(&keySeq, 1))
+	return run(tp, cfg.NewReference(), key, key+":ref", nil, ops)
+}
+
+/*
+CheckFrom 在key已有的数据上继续执行ops, initial 为key中现有的元素, 用于初始化参考实现.
+可以用来检查修复后的布局是否还能正常使用. 与 Check 不同, 结束后不会清理数据.
+*/
+func CheckFrom(tp topk.TopKProvider, key string, initial []topk.Element, ops []Op) *Failure {
+	ref := NewModel()
+	for _, e := range initial {
+		_ = ref.AddElement(key, e.Id, e.Score)
+	}
+	return run(tp, ref, key, key, initial, ops)
+}
+
+// run 依次在tp和ref上执行ops, initial 为执行前已有的元素
+func run(tp, ref topk.TopKProvider, key, refKey string, initial []topk.Element, ops []Op) *Failure {
+	fail := func(step int, format string, args ...interface{}) *Failure {
+		return &Failure{Ops: ops, Step: step, Detail: fmt.Sprintf(format, args...)}
+	}
+	ids := make(map[string]bool)
+	for _, e := range initial {
+		ids[e.Id] = true
+	}
+	if initial == nil {
+		defer func() {
+			// 清理本次执行的数据
+			for id := range ids {
+				_ = tp.DeleteElement(key, id)
+				_ = ref.DeleteElement(refKey, id)
+			}
+		}()
+	}
+	for i, op := range ops {
+		switch op.Kind {
+		case OpAdd:
+			ids[op.Id] = true
+			refErr := ref.AddElement(refKey, op.Id, op.Score)
+			if refErr != nil && !errors.Is(refErr, topk.ErrRejected) {
+				return fail(i, "reference failed: %s", refErr)
+			}
+			err := tp.AddElement(key, op.Id, op.Score)
+			if err != nil && !errors.Is(err, topk.ErrRejected) {
+				return fail(i, "unexpected error: %s", err)
+			}
+			if (err == nil) != (refErr == nil) {
+				return fail(i, "expect error %v, got %v", refErr, err)
+			}
+		case OpDelete:
+			// 删除不存在的元素也不返回错误
+			if err := ref.DeleteElement(refKey, op.Id); err != nil {
+				return fail(i, "reference failed: %s", err)
+			}
+			if err := tp.DeleteElement(key, op.Id); err != nil {
+				return fail(i, "unexpected error: %s", err)
+			}
+		case OpTopK, OpTopKS:
+			if detail := compareTopK(tp, ref, key, refKey, op.Kind, op.K); detail != "" {
+				return fail(i, "%s", detail)
+			}
+		case OpRange, OpCount:
+			if detail := compareRange(tp, ref, key, refKey, op); detail != "" {
+				return fail(i, "%s", detail)
+			}
+		case OpAround:
+			if detail := compareAround(tp, ref, key, refKey, op); detail != "" {
+				return fail(i, "%s", detail)
+			}
+		case OpPopTop, OpPopBottom:
+			if detail := comparePop(tp, ref, key, refKey, op); detail != "" {
+				return fail(i, "%s", detail)
+			}
+		default:
+			return fail(i, "unknown op kind %q", op.Kind)
+		}
+	}
+	// 最终比较所有元素
+	if detail := compareTopK(tp, ref, key, refKey, OpTopKS, len(ids)+1); detail != "" {
+		return fail(len(ops), "%s", detail)
+	}
+	return nil
+}
+
+func compareTopK(tp, ref topk.TopKProvider, key, refKey string, kind string, k int) string {
+	get := func(p topk.TopKProvider, key string) (error, []topk.Element) {
+		if kind == OpTopK {
+			return p.GetTopK(key, k)
+		}
+		return p.GetTopKS(key, k)
+	}
+	refErr, expect := get(ref, refKey)
+	if refErr != nil {
+		return fmt.Sprintf("reference failed: %s", refErr)
+	}
+	err, got := get(tp, key)
+	if err != nil {
+		return fmt.Sprintf("unexpected error: %s", err)
+	}
+	return compareElements(expect, got)
+}
+
+func compareRange(tp, ref topk.TopKProvider, key, refKey string, op Op) string {
+	rq, ok := tp.(topk.RangeQuerier)
+	if !ok {
+		return "provider does not implement topk.RangeQuerier"
+	}
+	refRq, ok := ref.(topk.RangeQuerier)
+	if !ok {
+		return "reference does not implement topk.RangeQuerier"
+	}
+	if op.Kind == OpCount {
+		refErr, expect := refRq.CountByScore(refKey, op.Min, op.Max)
+		if refErr != nil {
+			return fmt.Sprintf("reference failed: %s", refErr)
+		}
+		err, got := rq.CountByScore(key, op.Min, op.Max)
+		if err != nil {
+			return fmt.Sprintf("unexpected error: %s", err)
+		}
+		if got != expect {
+			return fmt.Sprintf("expect count %d, got %d", expect, got)
+		}
+		return ""
+	}
+	refErr, expect := refRq.RangeByScore(refKey, op.Min, op.Max, op.Offset, op.K)
+	if refErr != nil {
+		return fmt.Sprintf("reference failed: %s", refErr)
+	}
+	err, got := rq.RangeByScore(key, op.Min, op.Max, op.Offset, op.K)
+	if err != nil {
+		return fmt.Sprintf("unexpected error: %s", err)
+	}
+	return compareElements(expect, got)
+}
+
+func comparePop(tp, ref topk.TopKProvider, key, refKey string, op Op) string {
+	p, ok := tp.(topk.Popper)
+	if !ok {
+		return "provider does not implement topk.Popper"
+	}
+	refP, ok := ref.(topk.Popper)
+	if !ok {
+		return "reference does not implement topk.Popper"
+	}
+	pop := func(p topk.Popper, key string) (error, []topk.Element) {
+		if op.Kind == OpPopTop {
+			return p.PopTop(key, op.K)
+		}
+		return p.PopBottom(key, op.K)
+	}
+	refErr, expect := pop(refP, refKey)
+	if refErr != nil {
+		return fmt.Sprintf("reference failed: %s", refErr)
+	}
+	err, got := pop(p, key)
+	if err != nil {
+		return fmt.Sprintf("unexpected error: %s", err)
+	}
+	return compareElements(expect, got)
+}
+
+func compareAround(tp, ref topk.TopKProvider, key, refKey string, op Op) string {
+	aq, ok := tp.(topk.AroundQuerier)
+	if !ok {
+		return "provider does not implement topk.AroundQuerier"
+	}
+	refAq, ok := ref.(topk.AroundQuerier)
+	if !ok {
+		return "reference does not implement topk.AroundQuerier"
+	}
+	refErr, expect := refAq.GetAround(refKey, op.Id, op.Before, op.After)
+	if refErr != nil && !errors.Is(refErr, topk.ErrNotFound) {
+		return fmt.Sprintf("reference failed: %s", refErr)
+	}
+	err, got := aq.GetAround(key, op.Id, op.Before, op.After)
+	if err != nil && !errors.Is(err, topk.ErrNotFound) {
+		return fmt.Sprintf("unexpected error: %s", err)
+	}
+	if (err == nil) != (refErr == nil) {
+		return fmt.Sprintf("expect error %v, got %v", refErr, err)
+	}
+	for i := 0; i < len(expect) || i < len(got); i++ {
+		switch {
+		case i >= len(got):
+			return fmt.Sprintf("missing element %d %v, got %d elements", i, expect[i], len(got))
+		case i >= len(expect):
+			return fmt.Sprintf("unexpected element %d %v, expect %d elements", i, got[i], len(expect))
+		case got[i] != expect[i]:
+			return fmt.Sprintf("element %d: expect %v, got %v", i, expect[i], got[i])
+		}
+	}
+	return ""
+}
+
+func compareElements(expect, got []topk.Element) string {
+	for i := 0; i < len(expect) || i < len(got); i++ {
+		switch {
+		case i >= len(got):
+			return fmt.Sprintf("missing element %d %v, got %d elements", i, expect[i], len(got))
+		case i >= len(expect):
+			return fmt.Sprintf("unexpected element %d %v, expect %d elements", i, got[i], len(expect))
+		case got[i] != expect[i]:
+			return fmt.Sprintf("element %d: expect %v, got %v", i, expect[i], got[i])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,141 @@
+package topktest
+
+import (
+	"errors"
+	"pushan/RedTopK/topk"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Outcome 操作的结果类型
+type Outcome string
+
+const (
+	// OutcomeOk 操作成功
+	OutcomeOk Outcome = "ok"
+	// OutcomeNotFound 删除的元素不存在
+	OutcomeNotFound Outcome = "not_found"
+	// OutcomeRejected 操作被拒绝且没有产生效果, 例如没有抢到锁, 检查时忽略
+	OutcomeRejected Outcome = "rejected"
+	// OutcomeUnknown 操作出错且不确定是否已经生效, 可以在调用之后的任意时刻生效或者从不生效
+	OutcomeUnknown Outcome = "unknown"
+)
+
+// Operation 历史中的一次调用, Call 和 Return 为相对于记录开始的纳秒数
+type Operation struct {
+	Client   int            `json:"client"`
+	Input    Op             `json:"input"`
+	Outcome  Outcome        `json:"outcome"`
+	Elements []topk.Element `json:"elements,omitempty"`
+	Err      string         `json:"err,omitempty"`
+	Call     int64          `json:"call"`
+	Return   int64          `json:"return"`
+}
+
+// History 按调用时间排序的并发操作历史
+type History []Operation
+
+// HistoryRecorder 记录多个client并发调用的历史
+type HistoryRecorder struct {
+	mu    sync.Mutex
+	start time.Time
+	ops   History
+}
+
+func NewHistoryRecorder() *HistoryRecorder {
+	return &HistoryRecorder{start: time.Now()}
+}
+
+// Wrap 返回记录 client 所有调用的 TopKProvider, 同一个client的调用不能并发
+func (h *HistoryRecorder) Wrap(tp topk.TopKProvider, client int) topk.TopKProvider {
+	return recordingProvider{tp: tp, h: h, client: client}
+}
+
+// History 返回目前记录的历史
+func (h *HistoryRecorder) History() History {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ops := make(History, len(h.ops))
+	copy(ops, h.ops)
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].Call < ops[j].Call })
+	return ops
+}
+
+func (h *HistoryRecorder) record(client int, input Op, call func() (error, []topk.Element)) (error, []topk.Element) {
+	st := time.Since(h.start).Nanoseconds()
+	err, elements := call()
+	op := Operation{
+		Client:   client,
+		Input:    input,
+		Outcome:  outcomeOf(err),
+		Elements: elements,
+		Call:     st,
+		Return:   time.Since(h.start).Nanoseconds(),
+	}
+	if err != nil {
+		op.Err = err.Error()
+	}
+	h.mu.Lock()
+	h.ops = append(h.ops, op)
+	h.mu.Unlock()
+	return err, elements
+}
+
+func outcomeOf(err error) Outcome {
+	switch {
+	case err == nil:
+		return OutcomeOk
+	case errors.Is(err, topk.ErrNotFound):
+		return OutcomeNotFound
+	case errors.Is(err, topk.ErrLockNotAcquired),
+		errors.Is(err, topk.ErrInvalidId), errors.Is(err, topk.ErrInvalidScore):
+		return OutcomeRejected
+	}
+	return OutcomeUnknown
+}
+
+type recordingProvider struct {
+	tp     topk.TopKProvider
+	h      *HistoryRecorder
+	client int
+}
+
+func (r recordingProvider) AddElement(key string, id string, score float64) error {
+	err, _ := r.h.record(r.client, Op{Kind: OpAdd, Id: id, Score: score}, func() (error, []topk.Element) {
+		return r.tp.AddElement(key, id, score), nil
+	})
+	return err
+}
+
+func (r recordingProvider) DeleteElement(key string, id string) error {
+	err, _ := r.h.record(r.client, Op{Kind: OpDelete, Id: id}, func() (error, []topk.Element) {
+		return r.tp.DeleteElement(key, id), nil
+	})
+	return err
+}
+
+func (r recordingProvider) GetTopK(key string, k int) (error, []topk.Element) {
+	return r.h.record(r.client, Op{Kind: OpTopK, K: k}, func() (error, []topk.Element) {
+		return r.tp.GetTopK(key, k)
+	})
+}
+
+func (r recordingProvider) GetTopKS(key string, k int) (error, []topk.Element) {
+	return r.h.record(r.client, Op{Kind: OpTopKS, K: k}, func() (error, []topk.Element) {
+		return r.tp.GetTopKS(key, k)
+	})
+}
+
+// PopTop 被包装的provider需要实现 topk.Popper
+func (r recordingProvider) PopTop(key string, n int) (error, []topk.Element) {
+	return r.h.record(r.client, Op{Kind: OpPopTop, K: n}, func() (error, []topk.Element) {
+		return r.tp.(topk.Popper).PopTop(key, n)
+	})
+}
+
+func (r recordingProvider) PopBottom(key string, n int) (error, []topk.Element) {
+	return r.h.record(r.client, Op{Kind: OpPopBottom, K: n}, func() (error, []topk.Element) {
+		return r.tp.(topk.Popper).PopBottom(key, n)
+	})
+}
@@ -0,0 +1,314 @@
+package topktest
+
+import (
+	"encoding/binary"
+	"math"
+	"pushan/RedTopK/topk"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lstate 顺序模型的状态, 按 score, id 升序排列, 只读
+type lstate []topk.Element
+
+func (s lstate) find(id string) int {
+	for i := range s {
+		if s[i].Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s lstate) without(i int) lstate {
+	ns := make(lstate, 0, len(s))
+	return append(append(ns, s[:i]...), s[i+1:]...)
+}
+
+func (s lstate) with(id string, score float64) lstate {
+	if i := s.find(id); i >= 0 {
+		s = s.without(i)
+	}
+	i := sort.Search(len(s), func(i int) bool {
+		return s[i].Score > score || (s[i].Score == score && s[i].Id > id)
+	})
+	ns := make(lstate, 0, len(s)+1)
+	ns = append(append(ns, s[:i]...), topk.Element{Id: id, Score: score})
+	return append(ns, s[i:]...)
+}
+
+func (s lstate) key() string {
+	b := strings.Builder{}
+	for _, e := range s {
+		b.WriteString(e.Id)
+		b.WriteByte(0)
+		b.WriteString(strconv.FormatFloat(e.Score, 'g', -1, 64))
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// step 在状态s上执行op, 返回新的状态和op的结果是否符合模型
+func (s lstate) step(op *Operation) (lstate, bool) {
+	in := op.Input
+	switch in.Kind {
+	case OpAdd:
+		return s.with(in.Id, in.Score), true
+	case OpDelete:
+		i := s.find(in.Id)
+		switch op.Outcome {
+		case OutcomeOk:
+			// 删除不存在的元素也成功
+			if i < 0 {
+				return s, true
+			}
+			return s.without(i), true
+		case OutcomeNotFound:
+			return s, i < 0
+		}
+		// 结果未知时不存在也可以
+		if i < 0 {
+			return s, true
+		}
+		return s.without(i), true
+	case OpTopK, OpTopKS:
+		k := in.K
+		if k > len(s) {
+			k = len(s)
+		}
+		if k < 0 {
+			k = 0
+		}
+		if len(op.Elements) != k {
+			return s, false
+		}
+		for i := 0; i < k; i++ {
+			expect := s[i]
+			if in.Kind == OpTopK {
+				expect.Score = 0
+			}
+			if op.Elements[i] != expect {
+				return s, false
+			}
+		}
+		return s, true
+	case OpPopTop, OpPopBottom:
+		k := in.K
+		if k > len(s) {
+			k = len(s)
+		}
+		if k < 0 {
+			k = 0
+		}
+		popped := make([]topk.Element, k)
+		ns := make(lstate, 0, len(s)-k)
+		if in.Kind == OpPopTop {
+			copy(popped, s[:k])
+			ns = append(ns, s[k:]...)
+		} else {
+			for i := range popped {
+				popped[i] = s[len(s)-1-i]
+			}
+			ns = append(ns, s[:len(s)-k]...)
+		}
+		// 结果未知时按已经弹出处理
+		if op.Outcome != OutcomeOk {
+			return ns, true
+		}
+		if len(op.Elements) != k {
+			return s, false
+		}
+		for i := range popped {
+			if op.Elements[i] != popped[i] {
+				return s, false
+			}
+		}
+		return ns, true
+	}
+	return s, false
+}
+
+// Linearization 线性化检查的结果
+type Linearization struct {
+	Ok bool
+	// Exhausted 超出搜索步数, 此时 Ok 没有意义
+	Exhausted bool
+	// Order 成功时为线性化顺序, 失败时为最长的可线性化前缀, 元素为 History 的下标
+	Order []int
+	// Blocking 失败时在最长前缀之后必须完成, 但无法线性化的操作
+	Blocking int
+	// Pending 失败时最长前缀之后可以选择的操作, 它们都不符合模型
+	Pending []int
+}
+
+type lentry struct {
+	op   int
+	call bool
+	ts   int64
+}
+
+type lframe struct {
+	entry int
+	state lstate
+}
+
+// ignored 检查时忽略的操作: 没有效果的操作和结果未知的读操作
+func ignored(op *Operation) bool {
+	switch op.Outcome {
+	case OutcomeRejected:
+		return true
+	case OutcomeUnknown:
+		return op.Input.Kind == OpTopK || op.Input.Kind == OpTopKS
+	}
+	return false
+}
+
+/*
+CheckLinearizable 检查历史是否可以线性化为一个合法的顺序执行.
+使用 Wing & Gong 的回溯搜索, 加上 Lowe 的状态缓存, 与 Porcupine 相同.
+maxSteps 为0时不限制搜索步数.
+*/
+func CheckLinearizable(h History, maxSteps int) *Linearization {
+	ents := make([]lentry, 0, 2*len(h))
+	unknown := make([]bool, len(h))
+	required := 0
+	for i := range h {
+		op := &h[i]
+		if ignored(op) {
+			continue
+		}
+		ret := op.Return
+		if op.Outcome == OutcomeUnknown {
+			// 结果未知的写操作可以在调用之后的任意时刻生效, 或者从不生效
+			unknown[i] = true
+			ret = math.MaxInt64
+		} else {
+			required++
+		}
+		ents = append(ents, lentry{op: i, call: true, ts: op.Call}, lentry{op: i, ts: ret})
+	}
+	// 时间相同时调用在前, 视为并发
+	sort.SliceStable(ents, func(i, j int) bool {
+		if ents[i].ts != ents[j].ts {
+			return ents[i].ts < ents[j].ts
+		}
+		return ents[i].call && !ents[j].call
+	})
+
+	// 双向链表, head 为哨兵, -1 表示链表结尾
+	head := len(ents)
+	next := make([]int, len(ents)+1)
+	prev := make([]int, len(ents)+1)
+	match := make([]int, len(ents))
+	callOf := make(map[int]int, len(h))
+	for i := range ents {
+		next[i], prev[i] = i+1, i-1
+		if ents[i].call {
+			callOf[ents[i].op] = i
+		} else {
+			match[callOf[ents[i].op]] = i
+		}
+	}
+	if len(ents) > 0 {
+		prev[0] = head
+		next[len(ents)-1] = -1
+		next[head] = 0
+	} else {
+		next[head] = -1
+	}
+	unlink := func(e int) {
+		next[prev[e]] = next[e]
+		if next[e] >= 0 {
+			prev[next[e]] = prev[e]
+		}
+	}
+	relink := func(e int) {
+		next[prev[e]] = e
+		if next[e] >= 0 {
+			prev[next[e]] = e
+		}
+	}
+
+	res := &Linearization{Blocking: -1}
+	linearized := make([]uint64, (len(h)+63)/64)
+	cache := make(map[string]bool)
+	cacheKey := func(s lstate) string {
+		b := make([]byte, 8*len(linearized))
+		for i, w := range linearized {
+			binary.LittleEndian.PutUint64(b[i*8:], w)
+		}
+		return string(b) + s.key()
+	}
+	stack := make([]lframe, 0, len(h))
+	state := lstate{}
+	best := -1
+	e := next[head]
+	for steps := 0; required > 0; steps++ {
+		if maxSteps > 0 && steps >= maxSteps {
+			res.Exhausted = true
+			return res
+		}
+		if e >= 0 && ents[e].call {
+			op := ents[e].op
+			if ns, ok := state.step(&h[op]); ok {
+				linearized[op/64] |= 1 << (op % 64)
+				if k := cacheKey(ns); !cache[k] {
+					cache[k] = true
+					stack = append(stack, lframe{entry: e, state: state})
+					state = ns
+					unlink(e)
+					unlink(match[e])
+					if !unknown[op] {
+						required--
+					}
+					e = next[head]
+					continue
+				}
+				linearized[op/64] &^= 1 << (op % 64)
+			}
+			e = next[e]
+			continue
+		}
+		// 遇到返回事件, 当前前缀无法继续, 记录最长的前缀
+		if len(stack) > best {
+			best = len(stack)
+			res.Order = res.Order[:0]
+			for _, f := range stack {
+				res.Order = append(res.Order, ents[f.entry].op)
+			}
+			res.Pending = res.Pending[:0]
+			for p := next[head]; p >= 0 && p != e; p = next[p] {
+				if ents[p].call {
+					res.Pending = append(res.Pending, ents[p].op)
+				}
+			}
+			res.Blocking = -1
+			if e >= 0 {
+				res.Blocking = ents[e].op
+			}
+		}
+		if len(stack) == 0 {
+			return res
+		}
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		op := ents[f.entry].op
+		state = f.state
+		linearized[op/64] &^= 1 << (op % 64)
+		relink(match[f.entry])
+		relink(f.entry)
+		if !unknown[op] {
+			required++
+		}
+		e = next[f.entry]
+	}
+	res.Ok = true
+	res.Blocking = -1
+	res.Pending = nil
+	res.Order = res.Order[:0]
+	for _, f := range stack {
+		res.Order = append(res.Order, ents[f.entry].op)
+	}
+	return res
+}
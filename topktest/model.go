@@ -0,0 +1,221 @@
+package topktest
+
+import (
+	"fmt"
+	"math"
+	"pushan/RedTopK/topk"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Model 内存中的参考实现, 排序规则与redis zset一致: score升序, score相同按member字典序
+type Model struct {
+	mu       sync.Mutex
+	keys     map[string]map[string]float64
+	capacity int
+}
+
+func NewModel() *Model {
+	return &Model{keys: make(map[string]map[string]float64)}
+}
+
+// NewCappedModel 每个key最多保留capacity个元素, 与 topk.WithCapacity 相同
+func NewCappedModel(capacity int) *Model {
+	m := NewModel()
+	m.capacity = capacity
+	return m
+}
+
+// worst 返回排在最后的member, 与redis相同, score相同时按member的字典序
+func worst(members map[string]float64) string {
+	ans := ""
+	for id, score := range members {
+		if ans == "" || score > members[ans] || score == members[ans] && id > ans {
+			ans = id
+		}
+	}
+	return ans
+}
+
+func (m *Model) AddElement(key string, id string, score float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members, ok := m.keys[key]
+	if !ok {
+		members = make(map[string]float64)
+		m.keys[key] = members
+	}
+	if _, ok := members[id]; !ok && m.capacity > 0 && len(members) >= m.capacity {
+		w := worst(members)
+		if score > members[w] || score == members[w] && id > w {
+			return fmt.Errorf("%w: key = %s, id = %s", topk.ErrRejected, key, id)
+		}
+	}
+	members[id] = score
+	for m.capacity > 0 && len(members) > m.capacity {
+		delete(members, worst(members))
+	}
+	return nil
+}
+
+func (m *Model) DeleteElement(key string, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys[key], id)
+	return nil
+}
+
+func (m *Model) GetTopK(key string, k int) (error, []topk.Element) {
+	_, ans := m.GetTopKS(key, k)
+	for i := range ans {
+		ans[i].Score = 0
+	}
+	return nil, ans
+}
+
+func (m *Model) GetTopKS(key string, k int) (error, []topk.Element) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := m.keys[key]
+	ans := make([]topk.Element, 0, len(members))
+	for id, score := range members {
+		ans = append(ans, topk.Element{Id: id, Score: score})
+	}
+	sort.Slice(ans, func(i, j int) bool {
+		if ans[i].Score != ans[j].Score {
+			return ans[i].Score < ans[j].Score
+		}
+		return ans[i].Id < ans[j].Id
+	})
+	if k < 0 {
+		k = 0
+	}
+	if k < len(ans) {
+		ans = ans[:k]
+	}
+	return nil, ans
+}
+
+// inRange 判断score是否在 ZRANGEBYSCORE 写法的区间内, 区间不合法时返回错误
+func inRange(min, max string) (func(score float64) bool, error) {
+	parse := func(s string) (float64, bool, error) {
+		exclusive := strings.HasPrefix(s, "(")
+		v, err := strconv.ParseFloat(strings.TrimPrefix(s, "("), 64)
+		if err != nil || math.IsNaN(v) {
+			return 0, false, fmt.Errorf("%w: bad bound %q", topk.ErrInvalidScore, s)
+		}
+		return v, exclusive, nil
+	}
+	lo, loEx, err := parse(min)
+	if err != nil {
+		return nil, err
+	}
+	hi, hiEx, err := parse(max)
+	if err != nil {
+		return nil, err
+	}
+	return func(score float64) bool {
+		return (score > lo || !loEx && score == lo) && (score < hi || !hiEx && score == hi)
+	}, nil
+}
+
+func (m *Model) RangeByScore(key string, min, max string, offset, count int) (error, []topk.Element) {
+	in, err := inRange(min, max)
+	if err != nil {
+		return err, nil
+	}
+	_, all := m.GetTopKS(key, math.MaxInt32)
+	ans := make([]topk.Element, 0)
+	if offset < 0 {
+		return nil, ans
+	}
+	for _, e := range all {
+		if !in(e.Score) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if count >= 0 && len(ans) >= count {
+			break
+		}
+		ans = append(ans, e)
+	}
+	return nil, ans
+}
+
+func (m *Model) CountByScore(key string, min, max string) (error, int64) {
+	in, err := inRange(min, max)
+	if err != nil {
+		return err, 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, score := range m.keys[key] {
+		if in(score) {
+			n++
+		}
+	}
+	return nil, n
+}
+
+func (m *Model) GetAround(key string, id string, before, after int) (error, []topk.RankedElement) {
+	_, all := m.GetTopKS(key, math.MaxInt32)
+	for i := range all {
+		if all[i].Id != id {
+			continue
+		}
+		if before < 0 {
+			before = 0
+		}
+		if after < 0 {
+			after = 0
+		}
+		st, end := i-before, i+after+1
+		if st < 0 {
+			st = 0
+		}
+		if end > len(all) {
+			end = len(all)
+		}
+		ans := make([]topk.RankedElement, 0, end-st)
+		for j := st; j < end; j++ {
+			ans = append(ans, topk.RankedElement{Id: all[j].Id, Score: all[j].Score, Rank: int64(j)})
+		}
+		return nil, ans
+	}
+	return fmt.Errorf("%w: key = %s, id = %s", topk.ErrNotFound, key, id), nil
+}
+
+func (m *Model) PopTop(key string, n int) (error, []topk.Element) {
+	return nil, m.pop(key, n, true)
+}
+
+func (m *Model) PopBottom(key string, n int) (error, []topk.Element) {
+	return nil, m.pop(key, n, false)
+}
+
+func (m *Model) pop(key string, n int, top bool) []topk.Element {
+	_, all := m.GetTopKS(key, math.MaxInt32)
+	if !top {
+		for i, j := 0, len(all)-1; i < j; i, j = i+1, j-1 {
+			all[i], all[j] = all[j], all[i]
+		}
+	}
+	if n < 0 {
+		n = 0
+	}
+	if n < len(all) {
+		all = all[:n]
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range all {
+		delete(m.keys[key], e.Id)
+	}
+	return all
+}
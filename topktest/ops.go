@@ -0,0 +1,145 @@
+package topktest
+
+import (
+	"fmt"
+	"math/rand"
+	"pushan/RedTopK/topk"
+	"strconv"
+)
+
+// 操作类型, 与 topk 的 op 标签一致
+const (
+	OpAdd    = topk.OpAdd
+	OpDelete = topk.OpDelete
+	OpTopK   = topk.OpTopK
+	OpTopKS  = topk.OpTopKS
+	OpRange  = topk.OpRange
+	OpCount  = topk.OpCount
+	OpAround = topk.OpAround
+	// OpPopTop 和 OpPopBottom 使用 K 作为弹出的个数
+	OpPopTop    = topk.OpPopTop
+	OpPopBottom = topk.OpPopBottom
+)
+
+/*
+Op 一次操作, Kind 为 OpAdd 时使用 Id 和 Score, OpDelete 时使用 Id, OpTopK/OpTopKS 时使用 K.
+OpRange 使用 Min, Max, Offset 和 K(作为count), OpCount 使用 Min 和 Max, OpAround 使用 Id, Before 和 After.
+*/
+type Op struct {
+	Kind          string
+	Id            string
+	Score         float64
+	K             int
+	Min, Max      string
+	Offset        int
+	Before, After int
+}
+
+func (op Op) String() string {
+	switch op.Kind {
+	case OpAdd:
+		return fmt.Sprintf("add(%q, %s)", op.Id, strconv.FormatFloat(op.Score, 'g', -1, 64))
+	case OpDelete:
+		return fmt.Sprintf("delete(%q)", op.Id)
+	case OpRange:
+		return fmt.Sprintf("range(%s, %s, %d, %d)", op.Min, op.Max, op.Offset, op.K)
+	case OpCount:
+		return fmt.Sprintf("count(%s, %s)", op.Min, op.Max)
+	case OpAround:
+		return fmt.Sprintf("around(%q, %d, %d)", op.Id, op.Before, op.After)
+	}
+	return fmt.Sprintf("%s(%d)", op.Kind, op.K)
+}
+
+// GoString 输出可以直接粘贴到测试代码中的字面量
+func (op Op) GoString() string {
+	switch op.Kind {
+	case OpAdd:
+		return fmt.Sprintf("{Kind: topktest.OpAdd, Id: %q, Score: %s}", op.Id, strconv.FormatFloat(op.Score, 'g', -1, 64))
+	case OpDelete:
+		return fmt.Sprintf("{Kind: topktest.OpDelete, Id: %q}", op.Id)
+	case OpTopK:
+		return fmt.Sprintf("{Kind: topktest.OpTopK, K: %d}", op.K)
+	case OpRange:
+		return fmt.Sprintf("{Kind: topktest.OpRange, Min: %q, Max: %q, Offset: %d, K: %d}", op.Min, op.Max, op.Offset, op.K)
+	case OpCount:
+		return fmt.Sprintf("{Kind: topktest.OpCount, Min: %q, Max: %q}", op.Min, op.Max)
+	case OpAround:
+		return fmt.Sprintf("{Kind: topktest.OpAround, Id: %q, Before: %d, After: %d}", op.Id, op.Before, op.After)
+	case OpPopTop:
+		return fmt.Sprintf("{Kind: topktest.OpPopTop, K: %d}", op.K)
+	case OpPopBottom:
+		return fmt.Sprintf("{Kind: topktest.OpPopBottom, K: %d}", op.K)
+	}
+	return fmt.Sprintf("{Kind: topktest.OpTopKS, K: %d}", op.K)
+}
+
+/*
+Generate 生成n个随机操作. id和score的取值范围都很小, 以产生重复的add, 不存在的delete和相同的score.
+cfg.Ranges 为true时还会生成 OpRange, OpCount 和 OpAround, cfg.Pops 为true时还会生成 OpPopTop 和 OpPopBottom.
+*/
+func Generate(r *rand.Rand, n int, cfg Config) []Op {
+	cfg = cfg.withDefaults()
+	var extra []string
+	if cfg.Ranges {
+		extra = append(extra, OpRange, OpCount, OpAround)
+	}
+	if cfg.Pops {
+		extra = append(extra, OpPopTop, OpPopBottom)
+	}
+	ops := make([]Op, n)
+	for i := range ops {
+		id := "m" + strconv.Itoa(r.Intn(cfg.Ids))
+		switch n := r.Intn(8 + len(extra)); {
+		case n < 4:
+			score := float64(r.Intn(cfg.Scores))
+			if r.Intn(4) == 0 {
+				score += 0.5
+			}
+			ops[i] = Op{Kind: OpAdd, Id: id, Score: score}
+		case n < 6:
+			ops[i] = Op{Kind: OpDelete, Id: id}
+		case n < 7:
+			ops[i] = Op{Kind: OpTopKS, K: r.Intn(cfg.MaxK + 1)}
+		case n < 8:
+			ops[i] = Op{Kind: OpTopK, K: r.Intn(cfg.MaxK + 1)}
+		default:
+			ops[i] = generateExtra(r, extra[n-8], id, cfg)
+		}
+	}
+	return ops
+}
+
+func generateExtra(r *rand.Rand, kind string, id string, cfg Config) Op {
+	switch kind {
+	case OpRange:
+		min, max := randomBounds(r, cfg.Scores)
+		return Op{Kind: OpRange, Min: min, Max: max, Offset: r.Intn(4), K: r.Intn(cfg.MaxK+2) - 1}
+	case OpCount:
+		min, max := randomBounds(r, cfg.Scores)
+		return Op{Kind: OpCount, Min: min, Max: max}
+	case OpAround:
+		return Op{Kind: OpAround, Id: id, Before: r.Intn(cfg.MaxK/2 + 1), After: r.Intn(cfg.MaxK/2 + 1)}
+	}
+	// 弹出的个数较小, 避免很快清空
+	return Op{Kind: kind, K: r.Intn(4)}
+}
+
+// randomBounds 生成 ZRANGEBYSCORE 写法的区间, 包括开区间, ±inf 和 min > max 的空区间
+func randomBounds(r *rand.Rand, scores int) (string, string) {
+	bound := func(inf string) string {
+		if r.Intn(8) == 0 {
+			return inf
+		}
+		v := float64(r.Intn(scores+2) - 1)
+		if r.Intn(4) == 0 {
+			v += 0.5
+		}
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if r.Intn(3) == 0 {
+			s = "(" + s
+		}
+		return s
+	}
+	return bound("-inf"), bound("+inf")
+}
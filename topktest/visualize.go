@@ -0,0 +1,121 @@
+package topktest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// timelineWidth 时间轴的字符宽度
+const timelineWidth = 60
+
+func (op Operation) result() string {
+	switch {
+	case op.Outcome != OutcomeOk:
+		return string(op.Outcome)
+	case op.Input.Kind == OpTopK || op.Input.Kind == OpTopKS:
+		parts := make([]string, len(op.Elements))
+		for i, e := range op.Elements {
+			if op.Input.Kind == OpTopK {
+				parts[i] = e.Id
+			} else {
+				parts[i] = e.Id + ":" + strconv.FormatFloat(e.Score, 'g', -1, 64)
+			}
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	}
+	return string(op.Outcome)
+}
+
+/*
+WriteTimeline 把历史输出为文本时间轴, 每行一个操作:
+
+	#  CLIENT  |====      | ORDER  OPERATION -> RESULT
+
+ORDER 为操作在线性化中的位置, 失败时 !! 标记无法线性化的操作, ? 标记在最长前缀之后可以选择的操作.
+结果未知的操作用 > 延伸到时间轴结尾.
+*/
+func WriteTimeline(w io.Writer, h History, lin *Linearization) error {
+	bw := bufio.NewWriter(w)
+	failed := lin != nil && !lin.Ok && !lin.Exhausted && lin.Blocking >= 0
+	// 失败时只输出阻塞操作返回之前开始的操作
+	shown := h
+	if failed {
+		shown = make(History, 0, len(h))
+		for _, op := range h {
+			if op.Call <= h[lin.Blocking].Return {
+				shown = append(shown, op)
+			}
+		}
+	}
+	var end int64
+	for _, op := range shown {
+		if op.Return > end {
+			end = op.Return
+		}
+	}
+	if end == 0 {
+		end = 1
+	}
+	pos := func(ts int64) int {
+		return int(float64(ts) / float64(end) * float64(timelineWidth-1))
+	}
+	order := make(map[int]int)
+	marks := make(map[int]string)
+	if lin != nil {
+		for i, op := range lin.Order {
+			order[op] = i + 1
+		}
+		for _, op := range lin.Pending {
+			marks[op] = "?"
+		}
+		if lin.Blocking >= 0 && !lin.Ok {
+			marks[lin.Blocking] = "!!"
+		}
+		switch {
+		case lin.Exhausted:
+			fmt.Fprintln(bw, "search exhausted, result unknown")
+		case lin.Ok:
+			fmt.Fprintln(bw, "history is linearizable")
+		default:
+			fmt.Fprintf(bw, "history is not linearizable: longest linearizable prefix has %d of %d ops\n", len(lin.Order), len(h))
+		}
+	}
+	for i, op := range h {
+		if op.Call > end {
+			continue
+		}
+		bar := []byte(strings.Repeat(" ", timelineWidth))
+		from, to := pos(op.Call), pos(op.Return)
+		fill := byte('=')
+		switch {
+		case ignored(&op):
+			fill = '.'
+		case op.Outcome == OutcomeUnknown:
+			fill = '>'
+			to = timelineWidth - 1
+		}
+		if to >= timelineWidth {
+			to = timelineWidth - 1
+		}
+		for j := from; j <= to; j++ {
+			bar[j] = fill
+		}
+		tag := marks[i]
+		if n, ok := order[i]; ok {
+			tag = strconv.Itoa(n)
+		}
+		fmt.Fprintf(bw, "%4d  c%-3d |%s| %-4s %s -> %s\n", i, op.Client, bar, tag, op.Input, op.result())
+	}
+	if omitted := len(h) - len(shown); omitted > 0 {
+		fmt.Fprintf(bw, "... %d later operations omitted\n", omitted)
+	}
+	if failed {
+		op := h[lin.Blocking]
+		fmt.Fprintf(bw, "op %d %s -> %s returned, but no pending operation can be linearized after the prefix\n",
+			lin.Blocking, op.Input, op.result())
+	}
+	return bw.Flush()
+}
@@ -1,13 +1,55 @@
 package util
 
 import (
-	"log"
+	"fmt"
 	"time"
 
 	"github.com/go-redis/redis"
 )
 
-var unlockScript = redis.NewScript(`
+// Locker 分布式锁, RedisLock 和 MultiLock 均实现该接口
+type Locker interface {
+	Lock() bool
+	UnLock() bool
+}
+
+// LoggerSetter 可以设置 Logger 的锁, provider 会把自己的 Logger 传给锁
+type LoggerSetter interface {
+	SetLogger(l Logger)
+}
+
+// LockerFactory 根据 key, lockID 和超时时间创建锁, 无法创建时返回nil
+type LockerFactory func(key string, lockID string, lockTimeMs uint) Locker
+
+// LockClient RedisLock 使用的redis命令, 可以适配 *redis.Client 之外的客户端
+type LockClient interface {
+	// SetNX ttl为0表示不过期
+	SetNX(key, value string, ttl time.Duration) (bool, error)
+	// DelIfEqual key的值等于value时删除key, 返回是否删除, 需要与 UnlockScript 一样是原子的
+	DelIfEqual(key, value string) (bool, error)
+}
+
+// RedisLockFactory 返回基于单个redis实例的 LockerFactory
+func RedisLockFactory(cli *redis.Client) LockerFactory {
+	if cli == nil {
+		return LockFactory(nil)
+	}
+	return LockFactory(RedisLockClient(cli))
+}
+
+// LockFactory 返回基于 LockClient 的 LockerFactory
+func LockFactory(cli LockClient) LockerFactory {
+	return func(key string, lockID string, lockTimeMs uint) Locker {
+		lock := NewRedisLock(cli, key, lockID, lockTimeMs)
+		if lock == nil {
+			return nil
+		}
+		return lock
+	}
+}
+
+// UnlockScript KEYS[1]的值等于ARGV[1]时删除KEYS[1], 删除时返回1
+const UnlockScript = `
 	local key = KEYS[1]
 	local lockID = ARGV[1]
 	if redis.call("exists", key) and redis.call("get", key) == lockID then
@@ -16,9 +58,39 @@ var unlockScript = redis.NewScript(`
 	else
 		return 0
 	end
-`)
+`
+
+var unlockScript = redis.NewScript(UnlockScript)
 
-func NewRedisLock(cli *redis.Client, key string, lockID string, lockTimeMs uint) *RedisLock {
+// RedisLockClient 把 *redis.Client 适配为 LockClient
+func RedisLockClient(cli *redis.Client) LockClient {
+	if cli == nil {
+		return nil
+	}
+	return redisLockClient{cli}
+}
+
+type redisLockClient struct {
+	cli *redis.Client
+}
+
+func (c redisLockClient) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	return c.cli.SetNX(key, value, ttl).Result()
+}
+
+func (c redisLockClient) DelIfEqual(key, value string) (bool, error) {
+	res, err := unlockScript.Run(c.cli, []string{key}, value).Result()
+	if err != nil {
+		return false, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected unlock reply %T(%v)", res, res)
+	}
+	return n == 1, nil
+}
+
+func NewRedisLock(cli LockClient, key string, lockID string, lockTimeMs uint) *RedisLock {
 	if cli == nil {
 		return nil
 	}
@@ -27,38 +99,46 @@ func NewRedisLock(cli *redis.Client, key string, lockID string, lockTimeMs uint)
 		key,
 		lockID,
 		lockTimeMs,
+		NopLogger,
 	}
 }
 
 type RedisLock struct {
-	cli        *redis.Client
+	cli        LockClient
 	key        string
 	lockID     string
 	lockTimeMs uint
+	logger     Logger
+}
+
+func (rl *RedisLock) SetLogger(l Logger) {
+	if l != nil {
+		rl.logger = l
+	}
 }
 
 func (rl *RedisLock) Lock() bool {
-	res, err := rl.cli.SetNX(rl.key, rl.lockID, time.Millisecond*time.Duration(rl.lockTimeMs)).Result()
+	res, err := rl.cli.SetNX(rl.key, rl.lockID, time.Millisecond*time.Duration(rl.lockTimeMs))
 	if err != nil {
-		log.Printf("acquire lock failed. (key = %s, lockID = %s), err=%s", rl.key, rl.lockID, err)
+		rl.logger.Log(LevelError, "acquire lock failed", "key", rl.key, "lockID", rl.lockID, "err", err)
 		return false
 	}
 	if !res {
-		log.Printf("acquire lock failed. (key = %s, lockID = %s)", rl.key, rl.lockID)
+		rl.logger.Log(LevelDebug, "lock contention", "key", rl.key, "lockID", rl.lockID)
 	}
-	// log.Printf("acquire lock success. (key = %s, lockID = %s)", rl.key, rl.lockID)
-	return true
+	return res
 
 }
 
 func (rl *RedisLock) UnLock() bool {
-	res, err := unlockScript.Run(rl.cli, []string{rl.key}, rl.lockID).Result()
+	ok, err := rl.cli.DelIfEqual(rl.key, rl.lockID)
 	if err != nil {
-		log.Printf("release lock failed. (key = %s, lockID = %s), err=%s", rl.key, rl.lockID, err)
+		rl.logger.Log(LevelError, "release lock failed", "key", rl.key, "lockID", rl.lockID, "err", err)
 		return false
 	}
-	if res.(int64) != 1 {
-		log.Printf("release lock failed. (key = %s, lockID = %s)", rl.key, rl.lockID)
+	if !ok {
+		// 锁已经过期或者被其他人持有
+		rl.logger.Log(LevelWarn, "release lock failed, lock not held", "key", rl.key, "lockID", rl.lockID)
 		return false
 	}
 	return true
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Level 日志级别
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+/*
+Logger 结构化日志接口, keyvals 为交替出现的 key 和 value
+
+	logger.Log(util.LevelError, "split shard failed", "key", key, "shard", shard, "err", err)
+*/
+type Logger interface {
+	Log(level Level, msg string, keyvals ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(Level, string, ...interface{}) {}
+
+// NopLogger 丢弃所有日志, 是默认的 Logger
+var NopLogger Logger = nopLogger{}
+
+// NewStdLogger 使用标准库 log.Logger 输出不低于 minLevel 的日志
+func NewStdLogger(l *log.Logger, minLevel Level) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return stdLogger{l: l, minLevel: minLevel}
+}
+
+type stdLogger struct {
+	l        *log.Logger
+	minLevel Level
+}
+
+func (s stdLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	if level < s.minLevel {
+		return
+	}
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "[%s] %s", level, msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 < len(keyvals) {
+			fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v=?", keyvals[i])
+		}
+	}
+	s.l.Output(2, b.String())
+}
@@ -0,0 +1,154 @@
+package util
+
+import (
+	"time"
+)
+
+const (
+	// ClockDriftFactor 时钟漂移系数, 与 Redlock 算法描述保持一致
+	ClockDriftFactor = 0.01
+	// MinClockDriftMs 最小时钟漂移补偿
+	MinClockDriftMs = 2
+	// NodeTimeoutFactor 单个实例加锁和解锁的默认超时时间占锁超时时间的比例, 一个慢实例不会耗尽锁的有效时间
+	NodeTimeoutFactor = 0.01
+	// MinNodeTimeoutMs 单个实例的最小超时时间
+	MinNodeTimeoutMs = 5
+)
+
+// MultiLockFactory 返回基于多个独立redis master的 LockerFactory, *redis.Client 可以用 RedisLockClient 适配
+func MultiLockFactory(clis ...LockClient) LockerFactory {
+	return func(key string, lockID string, lockTimeMs uint) Locker {
+		lock := NewMultiLock(clis, key, lockID, lockTimeMs)
+		if lock == nil {
+			return nil
+		}
+		return lock
+	}
+}
+
+/*
+MultiLock Redlock算法实现
+同时在N个独立的redis实例上加锁, 超过半数实例加锁成功, 且扣除加锁耗时和时钟漂移后锁仍有效, 才认为加锁成功。
+每个实例最多等待 nodeTimeout, 超时的实例按失败计算。加锁失败时会释放所有实例上的锁。
+*/
+type MultiLock struct {
+	clis        []LockClient
+	key         string
+	lockID      string
+	lockTimeMs  uint
+	quorum      int
+	nodeTimeout time.Duration
+	validUntil  time.Time
+	logger      Logger
+}
+
+func NewMultiLock(clis []LockClient, key string, lockID string, lockTimeMs uint) *MultiLock {
+	if len(clis) == 0 {
+		return nil
+	}
+	for i := range clis {
+		if clis[i] == nil {
+			return nil
+		}
+	}
+	ttl := time.Millisecond * time.Duration(lockTimeMs)
+	nodeTimeout := time.Duration(float64(ttl) * NodeTimeoutFactor)
+	if nodeTimeout < MinNodeTimeoutMs*time.Millisecond {
+		nodeTimeout = MinNodeTimeoutMs * time.Millisecond
+	}
+	return &MultiLock{
+		clis:        clis,
+		key:         key,
+		lockID:      lockID,
+		lockTimeMs:  lockTimeMs,
+		quorum:      len(clis)/2 + 1,
+		nodeTimeout: nodeTimeout,
+		logger:      NopLogger,
+	}
+}
+
+// SetNodeTimeout 修改单个实例加锁和解锁的超时时间, 应该远小于锁的超时时间
+func (ml *MultiLock) SetNodeTimeout(d time.Duration) {
+	if d > 0 {
+		ml.nodeTimeout = d
+	}
+}
+
+func (ml *MultiLock) SetLogger(l Logger) {
+	if l != nil {
+		ml.logger = l
+	}
+}
+
+func (ml *MultiLock) Lock() bool {
+	ttl := time.Millisecond * time.Duration(ml.lockTimeMs)
+	st := time.Now()
+	acquired := ml.each("acquire lock failed", func(cli LockClient) (bool, error) {
+		return cli.SetNX(ml.key, ml.lockID, ttl)
+	})
+	drift := time.Duration(float64(ttl)*ClockDriftFactor) + MinClockDriftMs*time.Millisecond
+	validity := ttl - time.Since(st) - drift
+	if acquired >= ml.quorum && validity > 0 {
+		ml.validUntil = st.Add(ttl - drift)
+		return true
+	}
+	ml.logger.Log(LevelDebug, "lock contention", "key", ml.key, "lockID", ml.lockID, "acquired", acquired, "quorum", ml.quorum)
+	// 释放部分实例上已经拿到的锁
+	ml.unlockAll()
+	return false
+}
+
+func (ml *MultiLock) UnLock() bool {
+	ml.validUntil = time.Time{}
+	return ml.unlockAll() >= ml.quorum
+}
+
+// Validity 返回锁剩余的有效时间, 未持有锁时返回0
+func (ml *MultiLock) Validity() time.Duration {
+	validity := time.Until(ml.validUntil)
+	if validity < 0 {
+		return 0
+	}
+	return validity
+}
+
+// unlockAll 释放所有实例上的锁, 返回释放成功的实例数. 超时的实例上的锁由过期时间释放
+func (ml *MultiLock) unlockAll() int {
+	return ml.each("release lock failed", func(cli LockClient) (bool, error) {
+		return cli.DelIfEqual(ml.key, ml.lockID)
+	})
+}
+
+// each 在所有实例上并发执行fn, 最多等待 nodeTimeout, 返回fn返回true的实例数
+func (ml *MultiLock) each(msg string, fn func(cli LockClient) (bool, error)) int {
+	type result struct {
+		node int
+		ok   bool
+		err  error
+	}
+	// 带缓冲, 超时之后返回的结果不会阻塞
+	results := make(chan result, len(ml.clis))
+	for i := range ml.clis {
+		go func(i int) {
+			ok, err := fn(ml.clis[i])
+			results <- result{node: i, ok: ok, err: err}
+		}(i)
+	}
+	timer := time.NewTimer(ml.nodeTimeout)
+	defer timer.Stop()
+	n := 0
+	for pending := len(ml.clis); pending > 0; pending-- {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				ml.logger.Log(LevelError, msg, "key", ml.key, "lockID", ml.lockID, "node", r.node, "err", r.err)
+			} else if r.ok {
+				n++
+			}
+		case <-timer.C:
+			ml.logger.Log(LevelWarn, msg, "key", ml.key, "lockID", ml.lockID, "timeout", ml.nodeTimeout, "pending", pending)
+			return n
+		}
+	}
+	return n
+}
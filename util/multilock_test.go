@@ -0,0 +1,161 @@
+package util_test
+
+import (
+	"fmt"
+	"pushan/RedTopK/chaos"
+	"pushan/RedTopK/topk"
+	"pushan/RedTopK/util"
+	"testing"
+	"time"
+)
+
+// testNodes 用n个 topk.MemoryBackend 模拟n个独立的实例
+func testNodes(n int) []topk.Backend {
+	nodes := make([]topk.Backend, n)
+	for i := range nodes {
+		nodes[i] = topk.NewMemoryBackend()
+	}
+	return nodes
+}
+
+func lockClients(nodes ...topk.Backend) []util.LockClient {
+	clis := make([]util.LockClient, len(nodes))
+	for i := range nodes {
+		clis[i] = topk.BackendLockClient(nodes[i])
+	}
+	return clis
+}
+
+func testLockKey(t *testing.T) string {
+	return fmt.Sprintf("multilock_test:%s:%d", t.Name(), time.Now().UnixNano())
+}
+
+// hold 其他人在节点上持有锁
+func hold(t *testing.T, nodes []topk.Backend, key string) {
+	t.Helper()
+	for _, b := range nodes {
+		pl := b.Pipeline()
+		pl.Set(key, "other")
+		if err := pl.Exec(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// holders 返回每个实例上key的值, 不存在时为空
+func holders(t *testing.T, nodes []topk.Backend, key string) []string {
+	t.Helper()
+	ans := make([]string, len(nodes))
+	for i, b := range nodes {
+		v, _, err := b.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ans[i] = v
+	}
+	return ans
+}
+
+// TestMultiLockQuorum 超过半数实例加锁成功才算成功, 失败时释放已经拿到的锁, 不影响其他持有者
+func TestMultiLockQuorum(t *testing.T) {
+	nodes := testNodes(5)
+	key := testLockKey(t)
+	hold(t, nodes[:2], key)
+	lock := util.NewMultiLock(lockClients(nodes...), key, "a", 1000)
+	if !lock.Lock() {
+		t.Fatal("lock with 3 of 5 nodes failed")
+	}
+	if v := lock.Validity(); v <= 0 || v > time.Second {
+		t.Fatalf("validity %v out of (0, 1s]", v)
+	}
+	if !lock.UnLock() {
+		t.Fatal("unlock failed")
+	}
+	if got := holders(t, nodes, key); fmt.Sprint(got) != fmt.Sprint([]string{"other", "other", "", "", ""}) {
+		t.Fatalf("holders after unlock: %q", got)
+	}
+
+	hold(t, nodes[2:3], key)
+	if lock.Lock() {
+		t.Fatal("lock with 2 of 5 nodes succeeded")
+	}
+	if lock.Validity() != 0 {
+		t.Fatal("validity of a failed lock is not 0")
+	}
+	if got := holders(t, nodes, key); fmt.Sprint(got) != fmt.Sprint([]string{"other", "other", "other", "", ""}) {
+		t.Fatalf("failed lock left keys behind: %q", got)
+	}
+}
+
+// TestMultiLockDrift 加锁耗时和时钟漂移用完锁的有效时间时加锁失败, 并释放所有实例
+func TestMultiLockDrift(t *testing.T) {
+	nodes := testNodes(3)
+	key := testLockKey(t)
+	// 2ms的锁扣除 MinClockDriftMs 之后没有剩余时间
+	lock := util.NewMultiLock(lockClients(nodes...), key, "a", util.MinClockDriftMs)
+	if lock.Lock() {
+		t.Fatal("lock without validity left succeeded")
+	}
+	if got := holders(t, nodes, key); fmt.Sprint(got) != fmt.Sprint([]string{"", "", ""}) {
+		t.Fatalf("failed lock left keys behind: %q", got)
+	}
+}
+
+// TestMultiLockUnlock 只释放自己的锁, 超过半数实例释放成功时 UnLock 返回true
+func TestMultiLockUnlock(t *testing.T) {
+	nodes := testNodes(5)
+	key := testLockKey(t)
+	lock := util.NewMultiLock(lockClients(nodes...), key, "a", 1000)
+	if !lock.Lock() {
+		t.Fatal("lock failed")
+	}
+	// 两个实例上的锁过期后被其他人拿到
+	hold(t, nodes[:2], key)
+	if !lock.UnLock() {
+		t.Fatal("unlock on 3 of 5 nodes failed")
+	}
+	if got := holders(t, nodes, key); fmt.Sprint(got) != fmt.Sprint([]string{"other", "other", "", "", ""}) {
+		t.Fatalf("holders after unlock: %q", got)
+	}
+
+	if !lock.Lock() {
+		// 只剩3个实例可用, 仍然满足半数
+		t.Fatal("relock failed")
+	}
+	hold(t, nodes[2:4], key)
+	if lock.UnLock() {
+		t.Fatal("unlock on 1 of 5 nodes succeeded")
+	}
+	if got := holders(t, nodes, key); got[4] != "" {
+		t.Fatalf("unlock kept the lock on node 4: %q", got)
+	}
+}
+
+// TestMultiLockNodeTimeout 慢实例按失败计算, 加锁不会等待它
+func TestMultiLockNodeTimeout(t *testing.T) {
+	nodes := testNodes(3)
+	key := testLockKey(t)
+	delay := 300 * time.Millisecond
+	slow := chaos.New(1, chaos.Rule{Command: "*", Action: chaos.ActionDelay, Delay: delay})
+
+	lock := util.NewMultiLock(lockClients(nodes[0], nodes[1], slow.Wrap(nodes[2])), key, "a", 1000)
+	lock.SetNodeTimeout(50 * time.Millisecond)
+	st := time.Now()
+	if !lock.Lock() {
+		t.Fatal("lock with 2 fast nodes of 3 failed")
+	}
+	if d := time.Since(st); d >= delay {
+		t.Fatalf("lock waited %v for the slow node", d)
+	}
+	lock.UnLock()
+
+	lock = util.NewMultiLock(lockClients(nodes[0], slow.Wrap(nodes[1]), slow.Wrap(nodes[2])), testLockKey(t), "a", 1000)
+	lock.SetNodeTimeout(50 * time.Millisecond)
+	st = time.Now()
+	if lock.Lock() {
+		t.Fatal("lock with 1 fast node of 3 succeeded")
+	}
+	if d := time.Since(st); d >= delay {
+		t.Fatalf("lock waited %v for the slow nodes", d)
+	}
+}
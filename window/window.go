@@ -0,0 +1,273 @@
+/*
+Package window 滑动窗口排行榜, 统计最近 Size 个时间片(默认为最近60分钟)内的累计score.
+每个时间片是一个独立的分片排行榜, key为 "{key}:win:{时间片编号}", 保存该时间片内每个member的增量.
+读取时用 topk.Combiner 合并窗口内所有时间片的前k个member, 合并结果缓存 CacheTTL 的时间. 时间片离开窗口时通过 topk.Expirer 过期.
+
+与其他provider相同, score越小排名越靠前, 按次数统计热度时每次增加-1.
+
+	w := window.New(topk.NewTopKProvider(cli), window.WithSize(30))
+	_ = w.AddElement("trending", "item-1", -1)
+	_, top := w.GetTopKS("trending", 10)
+*/
+package window
+
+import (
+	"fmt"
+	"pushan/RedTopK/topk"
+	"pushan/RedTopK/util"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSize       = 60
+	DefaultResolution = time.Minute
+	DefaultCacheTTL   = time.Second
+)
+
+// Option window的可选配置
+type Option func(*options)
+
+type options struct {
+	size       int
+	resolution time.Duration
+	cacheTTL   time.Duration
+	logger     util.Logger
+	now        func() time.Time
+}
+
+// WithSize 窗口包含的时间片个数, 默认为 DefaultSize
+func WithSize(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.size = n
+		}
+	}
+}
+
+// WithResolution 时间片的长度, 默认为 DefaultResolution
+func WithResolution(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.resolution = d
+		}
+	}
+}
+
+// WithCacheTTL 合并结果的缓存时间, 0表示不缓存, 默认为 DefaultCacheTTL
+func WithCacheTTL(d time.Duration) Option {
+	return func(o *options) {
+		if d >= 0 {
+			o.cacheTTL = d
+		}
+	}
+}
+
+// WithLogger 设置过期时间失败时使用的 Logger, 默认不输出日志
+func WithLogger(l util.Logger) Option {
+	return func(o *options) {
+		if l != nil {
+			o.logger = l
+		}
+	}
+}
+
+// WithClock 指定获取当前时间的函数, 用于计算当前时间片和缓存是否过期, 默认为 time.Now
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		if now != nil {
+			o.now = now
+		}
+	}
+}
+
+// Provider 滑动窗口的 topk.TopKProvider, AddElement 的score为增量
+type Provider struct {
+	tp   topk.TopKProvider
+	inc  topk.Incrementer
+	comb *topk.Combiner
+	ex   topk.Expirer
+	opts options
+
+	mu    sync.Mutex
+	cache map[string]merged
+	// expired 每个key最后一次设置过期时间的时间片
+	expired map[string]int64
+}
+
+// merged 时间片slot的前k个合并结果, 按score升序
+type merged struct {
+	slot    int64
+	at      time.Time
+	k       int
+	members []topk.Element
+}
+
+/*
+New 返回基于tp的滑动窗口provider, tp需要实现 topk.Incrementer, topk.Expirer, 以及 topk.NewCombiner 需要的接口.
+*/
+func New(tp topk.TopKProvider, opts ...Option) *Provider {
+	if tp == nil {
+		panic("invalid param: tp")
+	}
+	inc, ok := tp.(topk.Incrementer)
+	if !ok {
+		panic("invalid param: tp does not implement topk.Incrementer")
+	}
+	ex, ok := tp.(topk.Expirer)
+	if !ok {
+		panic("invalid param: tp does not implement topk.Expirer")
+	}
+	o := options{
+		size:       DefaultSize,
+		resolution: DefaultResolution,
+		cacheTTL:   DefaultCacheTTL,
+		logger:     util.NopLogger,
+		now:        time.Now,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Provider{
+		tp:      tp,
+		inc:     inc,
+		comb:    topk.NewCombiner(tp),
+		ex:      ex,
+		opts:    o,
+		cache:   make(map[string]merged),
+		expired: make(map[string]int64),
+	}
+}
+
+func (p *Provider) slotOf(t time.Time) int64 {
+	return t.UnixNano() / int64(p.opts.resolution)
+}
+
+// Key 返回时间片slot的key
+func (p *Provider) Key(key string, slot int64) string {
+	return fmt.Sprintf("%s:win:%d", key, slot)
+}
+
+// slots 返回当前窗口内时间片的key, 从旧到新
+func (p *Provider) slots(key string, cur int64) []string {
+	keys := make([]string, p.opts.size)
+	for i := range keys {
+		keys[i] = p.Key(key, cur-int64(p.opts.size-1-i))
+	}
+	return keys
+}
+
+/*
+AddElement 把delta加到当前时间片中id的score上, 时间片第一次写入时设置过期时间.
+本地的合并缓存不会失效, 写入在 CacheTTL 之内可见.
+*/
+func (p *Provider) AddElement(key string, id string, delta float64) error {
+	slot := p.slotOf(p.opts.now())
+	bucket := p.Key(key, slot)
+	if err, _ := p.inc.IncrElement(bucket, id, delta); err != nil {
+		return err
+	}
+	p.expire(key, bucket, slot)
+	return nil
+}
+
+/*
+expire 每个时间片设置一次过期时间, 时间片离开窗口时过期. 之后新建的shard继承meta的过期时间.
+失败时只记录日志, 下一次写入时重试.
+*/
+func (p *Provider) expire(key string, bucket string, slot int64) {
+	p.mu.Lock()
+	last, ok := p.expired[key]
+	if ok && last >= slot {
+		p.mu.Unlock()
+		return
+	}
+	p.expired[key] = slot
+	p.mu.Unlock()
+
+	at := time.Unix(0, (slot+int64(p.opts.size))*int64(p.opts.resolution))
+	if err := p.ex.ExpireAt(bucket, at); err != nil {
+		p.opts.logger.Log(util.LevelError, "expire bucket failed", "key", bucket, "err", err)
+		p.forget(key, slot)
+	}
+}
+
+// forget 时间片需要重新设置过期时间
+func (p *Provider) forget(key string, slot int64) {
+	p.mu.Lock()
+	if p.expired[key] == slot {
+		delete(p.expired, key)
+	}
+	p.mu.Unlock()
+}
+
+// DeleteElement 从窗口内所有时间片中删除id, 与 topk.TopKProvider 相同, id不存在时不是错误
+func (p *Provider) DeleteElement(key string, id string) error {
+	cur := p.slotOf(p.opts.now())
+	for _, bucket := range p.slots(key, cur) {
+		if err := p.tp.DeleteElement(bucket, id); err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	delete(p.cache, key)
+	// 删除最后一个member后时间片被删除, 重新写入时需要再次设置过期时间
+	delete(p.expired, key)
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Provider) GetTopK(key string, k int) (error, []topk.Element) {
+	err, members := p.GetTopKS(key, k)
+	if err != nil {
+		return err, nil
+	}
+	ans := make([]topk.Element, len(members))
+	for i := range members {
+		ans[i].Id = members[i].Id
+	}
+	return nil, ans
+}
+
+// GetTopKS 返回窗口内累计score最小的k个member
+func (p *Provider) GetTopKS(key string, k int) (error, []topk.Element) {
+	if k <= 0 {
+		return nil, make([]topk.Element, 0)
+	}
+	members, err := p.merge(key, k)
+	if err != nil {
+		return err, nil
+	}
+	if k > len(members) {
+		k = len(members)
+	}
+	ans := make([]topk.Element, k)
+	copy(ans, members)
+	return nil, ans
+}
+
+/*
+merge 合并窗口内所有时间片中累计score最小的至少k个member, 不读取时间片的全部member.
+结果在同一个时间片内缓存 CacheTTL 的时间, 缓存的k不小于请求的k时直接使用.
+*/
+func (p *Provider) merge(key string, k int) ([]topk.Element, error) {
+	now := p.opts.now()
+	cur := p.slotOf(now)
+	p.mu.Lock()
+	c, ok := p.cache[key]
+	p.mu.Unlock()
+	if ok && c.slot == cur && c.k >= k && now.Sub(c.at) < p.opts.cacheTTL {
+		return c.members, nil
+	}
+
+	err, members := p.comb.TopKUnion(p.slots(key, cur), nil, topk.AggregateSum, k)
+	if err != nil {
+		return nil, err
+	}
+	if p.opts.cacheTTL > 0 {
+		p.mu.Lock()
+		p.cache[key] = merged{slot: cur, at: now, k: k, members: members}
+		p.mu.Unlock()
+	}
+	return members, nil
+}
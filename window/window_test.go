@@ -0,0 +1,162 @@
+package window_test
+
+import (
+	"fmt"
+	"pushan/RedTopK/topk"
+	"pushan/RedTopK/window"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clock 测试中手动推进的时间
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// expireRecorder 记录 ExpireAt 的调用, 不真正删除时间片
+type expireRecorder struct {
+	*topk.MemoryTopKProvider
+	mu      sync.Mutex
+	expires map[string][]time.Time
+}
+
+func (r *expireRecorder) ExpireAt(key string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expires[key] = append(r.expires[key], at)
+	return nil
+}
+
+func (r *expireRecorder) calls(key string) []time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.expires[key]
+}
+
+// start 是时间片的起点
+var start = time.Unix(1700000040, 0)
+
+func newWindow(opts ...window.Option) (*window.Provider, *expireRecorder, *clock) {
+	c := &clock{now: start}
+	tp := &expireRecorder{MemoryTopKProvider: topk.NewMemoryProvider(), expires: make(map[string][]time.Time)}
+	opts = append([]window.Option{window.WithClock(c.Now), window.WithSize(3), window.WithResolution(time.Minute)}, opts...)
+	return window.New(tp, opts...), tp, c
+}
+
+func add(t *testing.T, w *window.Provider, id string, delta float64) {
+	t.Helper()
+	if err := w.AddElement("trending", id, delta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func top(t *testing.T, w *window.Provider, k int) string {
+	t.Helper()
+	err, ans := w.GetTopKS("trending", k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(ans)
+}
+
+// TestSlotRotation 窗口内的时间片累加, 时间片离开窗口后不再计入
+func TestSlotRotation(t *testing.T) {
+	w, tp, c := newWindow(window.WithCacheTTL(0))
+	add(t, w, "a", -1)
+	add(t, w, "a", -1)
+	add(t, w, "b", -1)
+	c.advance(time.Minute)
+	add(t, w, "b", -2)
+	c.advance(time.Minute)
+	add(t, w, "c", -1)
+	if got := top(t, w, 10); got != "[{b -3} {a -2} {c -1}]" {
+		t.Fatalf("window of 3 slots: %s", got)
+	}
+	// 第一个时间片离开窗口
+	c.advance(time.Minute)
+	if got := top(t, w, 10); got != "[{b -2} {c -1}]" {
+		t.Fatalf("after the first slot left: %s", got)
+	}
+	c.advance(2 * time.Minute)
+	if got := top(t, w, 10); got != "[]" {
+		t.Fatalf("after all slots left: %s", got)
+	}
+
+	// 每个时间片只设置一次过期时间, 在离开窗口时过期
+	slot := start.Unix() / 60
+	for i := int64(0); i < 3; i++ {
+		key := w.Key("trending", slot+i)
+		want := fmt.Sprint([]time.Time{start.Add(time.Duration(i+3) * time.Minute)})
+		if got := fmt.Sprint(tp.calls(key)); got != want {
+			t.Errorf("expire %s: %s, want %s", key, got, want)
+		}
+	}
+}
+
+// TestMergedCache 合并结果在同一个时间片内缓存 CacheTTL, 更大的k或新的时间片重新合并
+func TestMergedCache(t *testing.T) {
+	w, _, c := newWindow(window.WithCacheTTL(time.Second))
+	add(t, w, "a", -2)
+	add(t, w, "b", -1)
+	if got := top(t, w, 1); got != "[{a -2}]" {
+		t.Fatalf("top 1: %s", got)
+	}
+	add(t, w, "b", -5)
+	// 缓存的k不小于请求的k, 写入不可见
+	if got := top(t, w, 1); got != "[{a -2}]" {
+		t.Fatalf("cached top 1: %s", got)
+	}
+	// 请求更大的k时重新合并
+	if got := top(t, w, 2); got != "[{b -6} {a -2}]" {
+		t.Fatalf("top 2: %s", got)
+	}
+	add(t, w, "a", -10)
+	if got := top(t, w, 1); got != "[{b -6}]" {
+		t.Fatalf("cached top 1 from top 2: %s", got)
+	}
+	c.advance(time.Second)
+	if got := top(t, w, 1); got != "[{a -12}]" {
+		t.Fatalf("top 1 after cache ttl: %s", got)
+	}
+
+	// 缓存没有过期, 但是时间片变化
+	add(t, w, "c", -20)
+	c.advance(time.Minute - time.Second)
+	if got := top(t, w, 1); got != "[{c -20}]" {
+		t.Fatalf("top 1 in the next slot: %s", got)
+	}
+}
+
+// TestDeleteElement 从所有时间片中删除并清除缓存, 不存在时不是错误
+func TestDeleteElement(t *testing.T) {
+	w, _, c := newWindow(window.WithCacheTTL(time.Minute))
+	add(t, w, "a", -1)
+	c.advance(time.Minute)
+	add(t, w, "a", -1)
+	add(t, w, "b", -1)
+	if got := top(t, w, 10); got != "[{a -2} {b -1}]" {
+		t.Fatalf("before delete: %s", got)
+	}
+	for i := 0; i < 2; i++ {
+		if err := w.DeleteElement("trending", "a"); err != nil {
+			t.Fatalf("delete #%d: %v", i, err)
+		}
+	}
+	if got := top(t, w, 10); got != "[{b -1}]" {
+		t.Fatalf("after delete: %s", got)
+	}
+}